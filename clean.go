@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// runClean implements the clean command.
+func runClean(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	runtime := fs.String("runtime", "", "container runtime: docker, podman or nerdctl (default: first found in PATH)")
+	keep := fs.Int("keep", -1, "keep this many of the most recent images, and the caches, removing only older images")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts := protogen.Options{Runtime: *runtime, Logf: log.Printf}
+	var removed []string
+	var err error
+	if *keep >= 0 {
+		removed, err = protogen.PruneImages(ctx, opts, *keep)
+	} else {
+		removed, err = protogen.Clean(ctx, opts)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("removed %d images", len(removed))
+	return nil
+}
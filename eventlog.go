@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// events, if non-nil, is the log of the -log=json flag, to which all
+// diagnostics are written as JSON events instead of text.
+var events *eventLog
+
+// An eventLog writes events, one JSON object per line, to stderr.
+type eventLog struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	results int // number of result events written
+}
+
+// startEventLog directs the log, and the progress, diagnostics and
+// output of the toolchain, to a new event log.
+func startEventLog(opts *protogen.Options) {
+	events = &eventLog{enc: json.NewEncoder(os.Stderr)}
+	log.SetPrefix("")
+	log.SetOutput(&eventWriter{typ: "log"})
+	opts.Logf = nil // reported by events
+	opts.Events = events.emit
+	opts.Stderr = &eventWriter{typ: "output"}
+}
+
+// emit writes the event.
+func (l *eventLog) emit(ev protogen.Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Type == "result" {
+		l.results++
+	}
+	l.enc.Encode(ev)
+}
+
+// fail writes the result event of a command that failed without one,
+// such as for an invalid config.
+func (l *eventLog) fail(err error) {
+	l.mu.Lock()
+	done := l.results > 0
+	l.mu.Unlock()
+	if !done {
+		l.emit(protogen.Event{Type: "result", Error: err.Error()})
+	}
+}
+
+// An eventWriter is an io.Writer that writes each line of text to the
+// event log as the message of an event of the specified type.
+type eventWriter struct {
+	mu  sync.Mutex
+	typ string
+	buf []byte // incomplete last line
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(w.buf[:i], "\r"))
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			events.emit(protogen.Event{Type: w.typ, Message: line})
+		}
+	}
+	return len(p), nil
+}
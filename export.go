@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// runExportImage implements the export-image command.
+func runExportImage(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	fs.StringVar(&tf.config, "config", "", "project config file (default: nearest "+protogen.ConfigFile+")")
+	fs.StringVar(&tf.runtime, "runtime", "", "container runtime: docker, podman or nerdctl (default: first found in PATH)")
+	fs.IntVar(&tf.retries, "retries", 2, "times to retry image builds, pulls and downloads that fail with network errors, with exponential backoff")
+	fs.StringVar(&tf.plugins, "plugins", "", "comma-separated list of additional plugins (e.g. gateway,openapiv2,validate)")
+	fs.StringVar(&tf.platform, "platform", "", "container platform of the machine that will load the image: linux/amd64 or linux/arm64 (default: host's)")
+	fs.StringVar(&tf.image, "image", "", "prebuilt toolchain image to pull and export instead of building one")
+	fs.StringVar(&tf.proxy, "proxy", "", "HTTP(S) proxy URL for the image build (default: $HTTPS_PROXY etc.)")
+	fs.StringVar(&tf.noProxy, "no-proxy", "", "comma-separated hosts to reach without the proxy (default: $NO_PROXY)")
+	fs.StringVar(&tf.caCerts, "ca-cert", "", "comma-separated PEM files of additional CA certificates for the image to trust")
+	fs.StringVar(&tf.dockerfile, "dockerfile", "", "Dockerfile that replaces the generated one (if it has a FROM instruction) or extends it")
+	fs.BoolVar(&tf.dryRun, "dry-run", false, "print the container commands that would be run, without running them")
+	fs.BoolVar(&tf.verbose, "v", false, "verbose: log each command, and show the full output of image builds")
+	output := fs.String("o", "proto-gen-go-image.tar", "tarball to write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts, err := tf.options(nil)
+	if err != nil {
+		return err
+	}
+	image, err := protogen.ExportImage(ctx, opts, *output)
+	if err != nil {
+		return err
+	}
+	report(opts, "exported %s to %s; on the offline machine, run with -image-tar=%s", image, *output, *output)
+	return nil
+}
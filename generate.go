@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// runGenerate implements the generate command, which is also the default.
+func runGenerate(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	tf.register(fs)
+	check := fs.Bool("check", false, "check that generated files are up to date, without changing them (like the check command)")
+	watch := fs.Bool("watch", false, "regenerate whenever a .proto file changes, until interrupted")
+	printDockerfile := fs.Bool("print-dockerfile", false, "print the toolchain Dockerfile and exit")
+	version := fs.Bool("version", false, "print the tool and toolchain versions and exit (like the version command)")
+	manifest := fs.String("manifest", "", "after generation, write the created or modified files and their SHA256 hashes as JSON to this file, or to stdout if \"json\"")
+	protocArgs, err := parseToolArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	opts, err := tf.options(protocArgs)
+	if err != nil {
+		return err
+	}
+
+	if *printDockerfile {
+		return printEffectiveDockerfile(opts)
+	}
+
+	if *version {
+		printVersions(&opts.Config)
+		return nil
+	}
+
+	if *check {
+		return checkGenerated(ctx, &tf, opts)
+	}
+
+	if *watch {
+		if all, _, err := tf.runs(opts); err != nil {
+			return err
+		} else if len(all) > 1 {
+			return fmt.Errorf("-watch does not support several workspace roots or config files; run it in a root's directory, with its arguments")
+		}
+		err := protogen.Watch(ctx, opts, func(res *protogen.Result, err error) {
+			if err != nil {
+				log.Print(err)
+			} else {
+				report(opts, "done (%d files changed); watching for changes...", len(res.Files))
+			}
+		})
+		if err != nil && err != context.Canceled {
+			return err
+		}
+		return nil
+	}
+
+	notifyUpdate := startUpdateCheck(ctx, opts)
+	res, err := tf.run(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if *manifest != "" {
+		if err := writeManifest(res, *manifest); err != nil {
+			return err
+		}
+	}
+	notifyUpdate()
+	return nil
+}
+
+// runs returns the options of the runs of the generate and check
+// commands, and their names: one for each root of the config's
+// workspace, if no protoc arguments select the .proto files, or else
+// one for each config file nearest to the .proto files, unless -config
+// or -buf-gen selects the config.
+func (f *toolFlags) runs(opts protogen.Options) ([]protogen.Options, []string, error) {
+	if len(opts.Roots) > 0 && len(opts.ProtocArgs) == 0 && opts.Recursive == "" {
+		var names []string
+		for _, r := range opts.Roots {
+			names = append(names, relName(opts.Dir, r.Dir))
+		}
+		return protogen.RootOptions(opts), names, nil
+	}
+	if f.config != "" || f.bufGen != "" {
+		return []protogen.Options{opts}, []string{"."}, nil
+	}
+	all, files, err := protogen.SplitByConfig(opts, func(filename string) (*protogen.Config, error) {
+		return f.loadConfigFile(filename, opts.Dir)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, relName(opts.Dir, filepath.Dir(file)))
+	}
+	return all, names, nil
+}
+
+// run runs the generate (or, with opts.Check, check) command: each of
+// its runs (see runs), up to -parallel at a time, reporting the outcome
+// of each, and returns their combined result, whose files are named
+// relative to opts.Dir.
+func (f *toolFlags) run(ctx context.Context, opts protogen.Options) (*protogen.Result, error) {
+	all, names, err := f.runs(opts)
+	if err != nil {
+		return nil, err
+	}
+	done := func(name string, res *protogen.Result) {
+		prefix := ""
+		if len(all) > 1 {
+			prefix = name + ": "
+		}
+		if opts.Check {
+			report(opts, "%sgenerated files are up to date", prefix)
+		} else {
+			report(opts, "%sdone: %s", prefix, summary(res))
+		}
+	}
+	if len(all) == 1 {
+		res, err := protogen.Run(ctx, all[0])
+		if err == nil {
+			done(names[0], res)
+		}
+		return res, err
+	}
+	results, err := protogen.RunEach(ctx, all, names, f.parallel)
+	combined := &protogen.Result{Hashes: make(map[string]string)}
+	for i, res := range results {
+		if res == nil {
+			continue
+		}
+		done(names[i], res)
+		for _, file := range res.Files {
+			name, _ := filepath.Rel(opts.Dir, filepath.Join(all[i].Dir, file))
+			combined.Files = append(combined.Files, name)
+			combined.Hashes[name] = res.Hashes[file]
+		}
+	}
+	return combined, err
+}
+
+// relName returns the name of the directory dir relative to pwd, if
+// within it, for messages.
+func relName(pwd, dir string) string {
+	if rel, err := filepath.Rel(pwd, dir); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return dir
+}
+
+// summary describes the work and timings of a run, for tracking its
+// performance.
+func summary(res *protogen.Result) string {
+	t := res.Timings
+	ms := func(d time.Duration) time.Duration { return d.Round(time.Millisecond) }
+	image := fmt.Sprintf("image %v", ms(t.Image))
+	switch {
+	case res.Image == "":
+		image = fmt.Sprintf("toolchain install %v", ms(t.Image))
+	case t.ImageCached:
+		image += " (cached)"
+	}
+	return fmt.Sprintf("%d .proto files compiled, %d files generated or changed; %s, protoc %v, post-processing %v, total %v",
+		res.Protos, len(res.Files), image, ms(t.Protoc), ms(t.Postprocess), ms(t.Total))
+}
+
+// runPrintDockerfile implements the print-dockerfile command.
+func runPrintDockerfile(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	fs.StringVar(&tf.config, "config", "", "project config file (default: nearest "+protogen.ConfigFile+")")
+	fs.StringVar(&tf.plugins, "plugins", "", "comma-separated list of additional plugins (e.g. gateway,openapiv2,validate)")
+	fs.StringVar(&tf.langs, "langs", "", "comma-separated list of language profiles whose plugins to add: go, python, java, kotlin, ts or swift")
+	fs.StringVar(&tf.platform, "platform", "", "container platform: linux/amd64 or linux/arm64 (default: host's)")
+	fs.StringVar(&tf.caCerts, "ca-cert", "", "comma-separated PEM files of additional CA certificates for the image to trust")
+	fs.StringVar(&tf.dockerfile, "dockerfile", "", "Dockerfile that replaces the generated one (if it has a FROM instruction) or extends it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	opts, err := tf.options(nil)
+	if err != nil {
+		return err
+	}
+	return printEffectiveDockerfile(opts)
+}
+
+// printEffectiveDockerfile prints the Dockerfile of the toolchain image.
+func printEffectiveDockerfile(opts protogen.Options) error {
+	dockerfile, err := opts.Config.Dockerfile(opts.Platform)
+	if err != nil {
+		return err
+	}
+	fmt.Print(dockerfile)
+	return nil
+}
+
+// writeManifest writes the JSON manifest of the files created or
+// modified by a run (see Result.ManifestJSON) to the named file, or to
+// stdout if it is "json".
+func writeManifest(res *protogen.Result, dest string) error {
+	data, err := res.ManifestJSON()
+	if err != nil {
+		return err
+	}
+	if dest == "json" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(dest, data, 0666)
+}
+
+// runCheck implements the check command.
+func runCheck(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	tf.register(fs)
+	protocArgs, err := parseToolArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	opts, err := tf.options(protocArgs)
+	if err != nil {
+		return err
+	}
+	return checkGenerated(ctx, &tf, opts)
+}
+
+// checkGenerated checks that the files generated with the options (and
+// the runs of the flags, see runs) are up to date.
+func checkGenerated(ctx context.Context, tf *toolFlags, opts protogen.Options) error {
+	opts.Check = true
+	_, err := tf.run(ctx, opts)
+	return err
+}
+
+// runLint implements the lint command.
+func runLint(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	tf.register(fs)
+	protocArgs, err := parseToolArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	opts, err := tf.options(protocArgs)
+	if err != nil {
+		return err
+	}
+	return protogen.Lint(ctx, opts)
+}
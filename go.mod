@@ -1,3 +1,9 @@
 module github.com/github/proto-gen-go
 
 go 1.19
+
+require (
+	github.com/fsnotify/fsnotify v1.6.0
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// sampleConfig is the content of the config file created by the init command.
+const sampleConfig = `# Configuration of proto-gen-go (https://github.com/github/proto-gen-go).
+
+# protoc release.
+protoc: %s
+
+# In a subtree's config file, extend that of the nearest ancestor
+# directory: unset settings are inherited, and plugins merged by name
+# (disable: true removes an inherited one).
+# inherit: true
+
+# Plugins to install: go, twirp, twirp_ruby, grpc, connect, gateway,
+# openapiv2, validate, doc, ts_proto, twirp_ts, mypy, swift, or any other,
+# given its Go package path (module), npm package (npm), pip package (pip)
+# or Swift package repository (swift) and version.
+plugins:
+  - name: go
+  - name: twirp
+  - name: grpc
+
+# Dockerfile that replaces (if it has a FROM) or extends the generated one;
+# see 'proto-gen-go print-dockerfile'.
+# dockerfile: build/protoc.Dockerfile
+
+# Language profiles whose plugins are added: go, python, java, kotlin, ts, swift.
+# langs: [go, ts]
+
+# Patterns of paths not matched by .proto file patterns (**/*.proto) or -r.
+# exclude:
+#   - api/legacy/**
+
+# License header prepended to generated files; may use {{.Year}} and {{.Version}}.
+# header: |
+#   Copyright {{.Year}} Acme, Inc. All rights reserved.
+
+# Stamp generated files with the versions of the toolchain and the hash of their source.
+# provenance: true
+
+# Proto roots of a monorepo, each with its own directory (relative to this
+# file), protoc arguments and, optionally, plugins and flags, which a run
+# without protoc arguments processes (up to -parallel=N at a time).
+# roots:
+#   - dir: services/billing/proto
+#     args: [--go_out=.., --twirp_out=..]
+#   - dir: services/search/proto
+#     plugins: [{name: go}, {name: grpc}]
+
+# Report newer releases of proto-gen-go (see 'proto-gen-go self-update').
+# update_check: true
+
+# Struct tags added to the fields of the generated Go messages.
+# tags:
+#   auto: [db]
+#   fields:
+#     User.email: 'validate:"required,email"'
+#   comments: true  # // @gotags: ... comments on fields of the .proto files
+
+# gomock mocks of the generated Twirp and gRPC service interfaces, in a
+# mocks package beside each generated package.
+# mocks:
+#   enabled: true
+
+# ParseX, XValues and text and JSON marshalers of each generated Go enum X,
+# with the names of its values in a case convention (proto, lower, kebab,
+# camel or pascal).
+# enums:
+#   enabled: true
+#   case: kebab
+#   trim_prefix: true
+
+# Typed Clone and CopyInto deep-copy methods of each generated Go message.
+# clone: true
+
+# ApplyFieldMask methods, which apply a google.protobuf.FieldMask update,
+# and field path constants of each generated Go message (requires clone).
+# field_masks: true
+
+# Constants of the full names of the generated services, and of the names,
+# gRPC method names and Twirp paths of their methods.
+# services:
+#   enabled: true
+#   twirp_prefix: /twirp
+
+# Redact and LogSafe methods of each generated Go message, which clear
+# (zero) or hash the sensitive fields, listed by Go type and proto field
+# name or marked by "// @redact" or "// @redact: hash" comments.
+# redact:
+#   fields:
+#     User.email: hash
+#   comments: true
+
+# NewFakeX(seed) constructors of each generated Go message X for tests,
+# with every field set to values derived from the seed, in a package
+# beside each generated package.
+# fakes:
+#   enabled: true
+
+# Fuzz targets of each generated Go message, which check its round trips
+# through the wire, JSON and text formats, except those of skip.
+# fuzz:
+#   enabled: true
+#   skip: [User_Address]
+
+# Benchmarks of the encoding (Marshal and Unmarshal, and MarshalVT and
+# UnmarshalVT of vtproto) of the fake of each generated Go message.
+# bench: true
+
+# Tests that golden files of the fake of each generated Go message, written
+# with PROTO_GEN_GO_UPDATE_GOLDEN=1 go test, still decode the same.
+# golden: true
+
+# Skeleton servers, to be edited by hand, of the Twirp, gRPC and Connect
+# services whose server (e.g. HaberdasherServer) the package beside the
+# generated one does not yet declare, a main package that serves them,
+# with the gRPC health and reflection services and the interceptors, and a
+# package of their clients, with client interceptors.
+# scaffold:
+#   enabled: true
+#   dir: server
+#   main:
+#     dir: cmd/server
+#     health: true
+#     reflection: true
+#     unary_interceptors: [example.com/x/obs.UnaryInterceptor]
+#     connect_interceptors: [example.com/x/obs.NewConnectInterceptor()]
+#   client:
+#     dir: client
+#     unary_interceptors: [example.com/x/obs.UnaryClientInterceptor]
+#     connect_interceptors: [example.com/x/obs.NewConnectInterceptor()]
+
+# Base image of the toolchain image, and access to private registries
+# and Docker Hub mirrors, where Docker Hub is blocked.
+# base_image: registry.acme.com/golang:1.19.1
+# registry:
+#   mirror: registry.acme.com/dockerhub
+#   username: ci-bot
+#   password_env: REGISTRY_TOKEN
+
+# Verification of the cosign signature of the prebuilt -image before it runs.
+# verify:
+#   key: cosign.pub
+
+# Access to Go plugins in private repositories, using the host's SSH agent or ~/.netrc.
+# private:
+#   goprivate: github.com/acme/*
+#   ssh: true
+
+# Flags preceding those of the command line. $PWD is the working directory.
+flags:
+  - --proto_path=$PWD
+%s
+# API documentation generated by protoc-gen-doc (.md, .html, .json or .xml).
+# docs:
+#   out: docs/api.md
+
+# Go package (directory) that embeds the FileDescriptorSet of the protos,
+# optionally with a helper to register gRPC server reflection.
+# embed:
+#   out: api
+#   reflection: true
+
+# JSON Schemas of the messages, generated by protoc-gen-jsonschema
+# (draft-04, draft-06 or draft-07).
+# jsonschema:
+#   out: schemas
+#   draft: draft-07
+
+# OpenAPI v3 document (openapi.yaml) of the services with google.api.http
+# annotations, generated by protoc-gen-openapi, merging all services.
+# openapi:
+#   out: api
+#   title: Acme API
+
+# JavaScript messages and gRPC-Web clients for browsers, generated by
+# protoc-gen-js and protoc-gen-grpc-web.
+# web:
+#   out: web/src/gen
+#   import_style: typescript
+
+# Files rendered by Go text/templates (relative to this file) from the
+# descriptors of the .proto files, once or for each of them.
+# templates:
+#   - template: tools/routes.go.tmpl
+#     out: "gen/{{.File.Dir}}/{{.File.Base}}_routes.go"
+#     each: file
+
+# Go import paths of .proto files (or directories of them), passed as
+# M options to the Go plugins; check requires every compiled file to
+# have one (or an option go_package) within the module of go.mod.
+# go_package:
+#   check: true
+#   map:
+#     acme/billing/v1: example.com/api/gen/billing/v1
+
+# Standalone Go module into which all the Go code is generated, whose
+# go.mod requires the runtimes of the Go plugins; it is tidied and built.
+# go_module:
+#   dir: gen
+#   go: "1.21"
+
+# Downstream repository to which 'proto-gen-go publish' commits the
+# generated code (by default, go_module's dir).
+# publish:
+#   repo: git@github.com:acme/apis-go.git
+#   branch: main
+
+# Shell commands run on the host before protoc and after generation; post
+# hooks find the generated files in the JSON file $PROTO_GEN_GO_MANIFEST.
+# hooks:
+#   post:
+#     - go run ./tools/inject-tags
+#     - gofmt -w .
+
+# Commit of github.com/googleapis/googleapis whose google/api, google/rpc,
+# google/type and google/longrunning protos may be imported.
+# googleapis: <full commit hash>
+
+# Third-party protos copied into third_party/proto by 'proto-gen-go vendor-protos'.
+# deps:
+#   - name: validate
+#   - name: acme
+#     git: https://github.com/acme/protos
+#     rev: v1.2.0
+`
+
+// generateFile is the content of the Go file, created by the init
+// command, whose go:generate directive runs the tool. The module option
+// strips the module path from the Go import paths of the generated
+// files, so that they are written into the packages of the module.
+const generateFile = `package %[1]s
+
+//go:generate go run github.com/github/proto-gen-go@%[2]s -- --go_out=%[3]s --go_opt=module=%[4]s --twirp_out=%[3]s --twirp_opt=module=%[4]s --go-grpc_out=%[3]s --go-grpc_opt=module=%[4]s *.proto
+`
+
+// makeTarget is the Makefile rule, added by the init command, that
+// regenerates the code of the proto directory.
+const makeTarget = `
+.PHONY: proto
+proto:
+	go generate %s
+`
+
+// runInit implements the init command.
+func runInit(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	force := fs.Bool("f", false, "overwrite existing files")
+	makefile := fs.Bool("make", false, "add a 'proto' target to the module's Makefile")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	dir := "."
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		dir = fs.Arg(0)
+	default:
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	// Without a Go module, create only the config file, in dir.
+	root, modPath, err := findModule(dir)
+	if err != nil {
+		return err
+	}
+	if root == "" {
+		return writeNew(filepath.Join(dir, protogen.ConfigFile), fmt.Sprintf(sampleConfig, protogen.DefaultConfig.Protoc, "  - --go_opt=paths=source_relative\n"), *force)
+	}
+
+	// Otherwise, create the config file at the module root, and in dir
+	// a Go file whose go:generate directive writes to the module root.
+	if err := writeNew(filepath.Join(root, protogen.ConfigFile), fmt.Sprintf(sampleConfig, protogen.DefaultConfig.Protoc, ""), *force); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(abs, root)
+	if err != nil {
+		return err
+	}
+	out := filepath.ToSlash(rel)
+	version := protogen.Version()
+	if !strings.HasPrefix(version, "v") || strings.Contains(version, "+") {
+		version = "latest" // not a published version; the user should pin a release
+	}
+	pkg := packageName(filepath.Base(abs))
+	if abs == root {
+		pkg = packageName(path.Base(modPath))
+	}
+	if err := writeNew(filepath.Join(dir, "generate.go"), fmt.Sprintf(generateFile, pkg, version, out, modPath), *force); err != nil {
+		return err
+	}
+
+	if *makefile {
+		pkgDir, err := filepath.Rel(root, abs)
+		if err != nil {
+			return err
+		}
+		if err := addMakeTarget(filepath.Join(root, "Makefile"), "./"+filepath.ToSlash(pkgDir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNew writes the content to the named file, unless it exists and force is not set.
+func writeNew(filename, content string, force bool) error {
+	if _, err := os.Stat(filename); err == nil && !force {
+		return fmt.Errorf("%s already exists (use -f to overwrite)", filename)
+	}
+	if err := os.WriteFile(filename, []byte(content), 0666); err != nil {
+		return err
+	}
+	log.Printf("created %s", filename)
+	return nil
+}
+
+// addMakeTarget appends a 'proto' target that runs go generate in the
+// package directory pkg to the named Makefile, creating it if necessary.
+func addMakeTarget(filename, pkg string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "proto:") {
+			return fmt.Errorf("%s already has a proto target", filename)
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	target := makeTarget
+	if len(data) == 0 {
+		target = strings.TrimPrefix(target, "\n")
+	}
+	if _, err := fmt.Fprintf(f, target, pkg); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("added proto target to %s", filename)
+	return nil
+}
+
+// findModule returns the root directory and path of the Go module
+// containing dir, according to the nearest go.mod file, or "" if none.
+func findModule(dir string) (root, modPath string, err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if f := strings.Fields(line); len(f) == 2 && f[0] == "module" {
+					return dir, strings.Trim(f[1], `"`), nil
+				}
+			}
+			return "", "", fmt.Errorf("%s: no module directive", filepath.Join(dir, "go.mod"))
+		} else if !os.IsNotExist(err) {
+			return "", "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", nil
+		}
+		dir = parent
+	}
+}
+
+// packageName returns a Go package name derived from a directory name.
+func packageName(name string) string {
+	name = strings.ToLower(name)
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "proto" + name
+	}
+	return name
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// runLock implements the lock command.
+func runLock(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	fs.StringVar(&tf.config, "config", "", "project config file (default: nearest "+protogen.ConfigFile+")")
+	fs.StringVar(&tf.runtime, "runtime", "", "container runtime: docker, podman or nerdctl (default: first found in PATH)")
+	fs.IntVar(&tf.retries, "retries", 2, "times to retry image builds, pulls and downloads that fail with network errors, with exponential backoff")
+	fs.StringVar(&tf.plugins, "plugins", "", "comma-separated list of additional plugins to lock (e.g. gateway,openapiv2,validate)")
+	fs.BoolVar(&tf.local, "local", false, "lock only the artifacts of local toolchains, without a container runtime")
+	update := fs.Bool("update", false, "resolve every artifact anew, ignoring the existing lock file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	filename := tf.config
+	if filename == "" {
+		filename = protogen.FindConfig(pwd)
+	}
+	if filename == "" {
+		return fmt.Errorf("no %s found; run 'proto-gen-go init' to create one", protogen.ConfigFile)
+	}
+	tf.config = filename
+	cfg, err := tf.loadConfig(pwd)
+	if err != nil {
+		return err
+	}
+	if *update {
+		cfg.Lock = nil
+	}
+	lock, err := protogen.LockToolchain(ctx, protogen.Options{Config: *cfg, Dir: pwd, Runtime: tf.runtime, Local: tf.local, Retries: tf.retries, Logf: log.Printf})
+	if err != nil {
+		return err
+	}
+	lockfile := filepath.Join(filepath.Dir(filename), protogen.ToolchainLockFile)
+	if err := lock.WriteFile(lockfile); err != nil {
+		return err
+	}
+	log.Printf("locked %d modules in %s", len(lock.Modules), lockfile)
+	return nil
+}
@@ -1,16 +1,141 @@
 // The proto-gen-go command runs an explicitly versioned protoc
-// command, with Go and Twirp plugins, inside a container, to generate
-// Go declarations for protocol messages and Twirp RPC interfaces in a
-// set of .proto files.  Run this program manually (or via Make) after
+// command, with Go, Twirp and gRPC plugins, inside a container, to
+// generate Go declarations for protocol messages and Twirp or gRPC RPC
+// interfaces in a set of .proto files.  Run this program manually (or via Make) after
 // changing your .proto files.
 //
 // Usage:
 //
 //    $ go run github.com/github/proto-gen-go@v1.0.0 [flags] [--] [protoc-flags] [proto files]
+//    $ go run github.com/github/proto-gen-go@v1.0.0 command [flags] [args]
+//
+// The commands are:
+//
+//    generate         generate code by running protoc (the default)
+//    check            check that generated files are up to date
+//    lint             run buf lint on proto files
+//    clean            remove warm containers, toolchain images (or old ones) and caches
+//    vendor-protos    copy third-party proto dependencies into the vendor directory
+//    print-dockerfile print the effective toolchain Dockerfile, for auditing or ejecting
+//    export-image     save the toolchain image to a tarball for offline use with -image-tar
+//    sbom             write an SPDX or CycloneDX SBOM of the toolchain image
+//    publish          commit the generated code to the config's downstream repository
+//    lock             pin the toolchain's artifacts by digest in proto-gen-go.lock
+//    init             create a sample config file and go:generate directive
+//    version          print the tool and toolchain versions
+//    self-update      update the pinned versions of the tool to the latest release
+//    help             print help
+//
+// Each command has its own flags, so tool options need not collide
+// with protoc's; see 'proto-gen-go help command'.
+//
+// The -version flag, like the version command, prints the tool's
+// version and the effective versions of its toolchain, as selected by
+// the config and the lock file: the base image, protoc, and each plugin
+// and tool, with the digests that the lock file pins, if any.
+//
+// With the config's update_check setting (or PROTO_GEN_GO_UPDATE_CHECK=1),
+// the tool reports, after generating, a release newer than the running
+// one, checking at most once a day, and the self-update command updates
+// the versions of the tool and its image pinned by the go:generate
+// directives and Makefiles of the current module.
 //
 // When invoked from build scripts, it is best to use an explicit
 // module version (not 'latest') to ensure build reproducibility.
 // All of the tool's own dependencies are explicitly versioned.
+// The protoc release archive is verified, whether in an image build or
+// a local install, against the SHA256 checksum that the tool records
+// for each version and platform (or, for other versions, the checksum
+// in the config file's protoc_sha256 table), and a mismatch is an error.
+// (The config's protoc version defaults to a release that supports
+// Editions; for releases 3.12 to 3.14, the tool adds the flag
+// --experimental_allow_proto3_optional that they require.)
+// Versions and tags may nonetheless be republished, so the lock command
+// records the digest of the base image, the SHA256 checksums of the
+// protoc release archives, and the go.sum hashes of the modules of the
+// Go plugins in a proto-gen-go.lock file beside the config file. Once it
+// is committed, image builds and local installs fail if any artifact
+// does not match the lock, or if the config has changed since; run
+// 'proto-gen-go lock' again to update it.
+//
+// The toolchain may be customized by a .proto-gen-go.yaml file in the
+// working directory or one of its ancestors (typically the repository
+// root). It selects the protoc version, the plugins to install (by
+// name, such as go, twirp, twirp_ruby or grpc, or by Go package path)
+// and their versions, and default protoc flags that precede those of
+// the command line. See pkg/protogen/config.go for the format.
+// A subtree's own config file applies to the .proto files beneath it,
+// which are compiled by a separate protoc run, and, with "inherit: true",
+// extends the config of its nearest ancestor, whose plugins it may
+// override or, with "disable: true", remove by name. An
+// in-house plugin may be installed from its Go package path and version,
+// or downloaded from a URL and verified against its SHA256 checksum, and
+// its out and opt settings add its --NAME_out and --NAME_opt flags.
+// While developing a plugin, --plugin=protoc-gen-foo=./bin/protoc-gen-foo
+// runs a locally built executable (for linux, as GOOS=linux go build
+// produces, unless -local), whose directory is mounted read-only.
+// Optional plugins such as gateway (protoc-gen-grpc-gateway, for
+// --grpc-gateway_out) and openapiv2 (protoc-gen-openapiv2, for
+// --openapiv2_out) and validate (protoc-gen-validate, for
+// --validate_out=lang=go:DIR, whose validate/validate.proto is importable
+// without a --proto_path) and gql and gogql (protoc-gen-gql and
+// protoc-gen-gogql, for --gql_out and --gogql_out, which generate GraphQL
+// schemas and gqlgen resolvers) and connect (protoc-gen-connect-go, for
+// --connect-go_out) and vtproto (protoc-gen-go-vtproto, for
+// --go-vtproto_out, whose plugin config may select its features, as in
+// "features: [marshal, unmarshal, size, pool]") may also be added using
+// the -plugins flag.
+// Language profiles, selected by the langs setting or the -langs flag
+// (e.g. -langs=go,java,ts), add the plugins of each language: go (go,
+// grpc and twirp), python (mypy), ts (ts_proto and twirp_ts) and swift
+// (swift and grpc-swift, protoc-gen-swift and protoc-gen-grpc-swift,
+// built from source in a Swift image); java and kotlin need none, since
+// protoc generates them itself (--java_out, --kotlin_out).
+// The googleapis setting of the config file makes the common protos of
+// a googleapis commit, such as google/api/annotations.proto,
+// importable in the same way. Alternatively, the vendor-protos command
+// copies the protos of the config's deps (googleapis, validate, gateway,
+// or any git repository at a pinned revision) into third_party/proto,
+// recording their commits in its deps.lock file, so that generation
+// with --proto_path=third_party/proto needs no network access.
+// Plugins may also be npm packages, such as ts_proto (ts-proto, for
+// --ts_proto_out) and twirp_ts (twirp-ts, for --twirp_ts_out), which
+// generate TypeScript for frontends; the image then includes Node.js.
+// Likewise, pip packages such as mypy (mypy-protobuf, for --mypy_out)
+// generate .pyi stubs for the _pb2.py modules of protoc's --python_out.
+// The docs setting (e.g. "docs: {out: docs/api.md}") adds the doc
+// plugin (protoc-gen-doc) and its flags, to generate Markdown, HTML,
+// JSON or DocBook API documentation in the same run.
+// The embed setting (e.g. "embed: {out: api, reflection: true}") writes
+// the FileDescriptorSet of the protos to the Go package in api, with a
+// Go file that embeds it and registers it for gRPC server reflection.
+// The jsonschema setting (e.g. "jsonschema: {out: schemas, draft: draft-07}")
+// adds the jsonschema plugin (protoc-gen-jsonschema) and its flags, to
+// generate a JSON Schema of each message in the same run.
+// The openapi setting (e.g. "openapi: {out: api, title: Acme API}")
+// adds the openapi plugin (protoc-gen-openapi of gnostic) and its flags,
+// to describe the annotated services in a single OpenAPI v3 document.
+// The web setting (e.g. "web: {out: web/src/gen, import_style: typescript}")
+// adds the js and grpc-web plugins (protoc-gen-js and protoc-gen-grpc-web,
+// from npm) and their flags, to generate clients for browsers.
+// The templates setting renders Go text/templates, such as route tables,
+// with the descriptors of the protos, from a descriptor set that protoc
+// writes in the same run, once or once per .proto file ("each: file").
+// The go_package setting maps .proto files (or directories) to Go import
+// paths, passed as M options (--go_opt=Mfile=path) to the Go plugins,
+// and, with "check: true", fails before generation if a .proto file has
+// no go_package option or map entry, or one outside the go.mod module.
+// The go_module setting (e.g. "go_module: {dir: gen}") writes the output
+// of the Go plugins to a standalone Go module in gen, whose go.mod it
+// creates or updates with the plugins' runtimes, tidies and builds.
+// The publish command commits such a directory of generated code to the
+// branch of the downstream repository of the config's publish setting
+// (e.g. "publish: {repo: git@github.com:acme/apis-go.git}"), with a
+// message recording the source commit and the toolchain's versions.
+// The hooks setting lists shell commands run on the host before protoc
+// (pre) and after a successful generation (post), such as further
+// post-processing; post hooks find the generated files in the JSON
+// manifest (see -manifest) named by $PROTO_GEN_GO_MANIFEST.
 //
 // If you add this special comment to a Go source file in your proto/ directory:
 //
@@ -22,83 +147,693 @@
 //
 //    $ go generate ./proto
 //
-// All flags and arguments are passed directly to protoc.  Assuming a
-// go:generate directive in the proto/ directory, typical arguments are:
+// The 'init ./proto' command creates such a file, generate.go, whose
+// directive writes the generated Go files into the packages of the
+// enclosing module (using the plugins' module=PATH option), and a
+// sample config file at the module root. With -make, it also adds a
+// 'proto' target that runs go generate to the module's Makefile.
+//
+// After protoc runs, the tool formats the generated Go files as gofmt
+// does, regardless of the quirks of the plugins that produced them,
+// unless the -no-format flag is set.
+//
+// Protoc's standard output and standard error are those of the tool,
+// so flags such as --descriptor_set_out=/dev/stdout work as expected.
+// Otherwise the descriptor set (--descriptor_set_out=FILE, or -o FILE)
+// may be written anywhere on the host, and its directory is created if
+// missing; if FILE ends in .gz, the FileDescriptorSet is gzip-compressed.
+// The tool's own messages are written to standard error. File names in
+// protoc's diagnostics are rewritten relative to the working directory,
+// so that editors can jump to the failing line.
+// If protoc fails, the tool exits with protoc's exit status.
+//
+// The -dry-run flag prints, instead of running, the commands (such as
+// 'docker build' and 'docker run', with their mounts and arguments) that
+// would change anything, which is useful for debugging CI failures.
+// The -v flag logs each command as it is run and shows the full output
+// of image builds, and the -q flag suppresses all but error messages.
+// A run ends with a summary of the number of .proto files compiled and
+// files generated, and of the time taken by the image build (or whether
+// the image was cached), protoc and post-processing.
+//
+// For tools that stage, diff or review the output, the -manifest=FILE
+// flag writes the files created or modified by the run, with their
+// SHA256 hashes, to FILE as JSON; -manifest=json prints it instead:
+//
+//	{"image": "proto-gen-go:...", "files": [{"name": "a.pb.go", "sha256": "..."}]}
+//
+// With -log=json, the log on standard error is instead a stream of
+// JSON events, one per line, for build observability tools: progress
+// messages ("log"), the end of each phase with its duration ("phase"),
+// protoc's diagnostics with their file, line and column ("diagnostic"),
+// the runtime's output ("output"), and finally the outcome, with the
+// generated files and the summary's timings, or the error ("result").
+// See protogen.Event.
+//
+// The tool's flags precede "--", and the arguments after it are passed
+// to protoc, so that new tool flags cannot collide with protoc's. For
+// compatibility, "--" may be omitted: the tool's flags are then the
+// leading single-dash arguments that it defines, and protoc's begin at
+// the first that is not one, such as --go_out=. or -I. or a file.
 //
-//   --proto_path=$(pwd)              Root of proto import tree; absolute path recommended.
+// Protoc's flags and arguments are passed directly to it, except that
+// .proto file patterns are expanded: *.proto matches the .proto files
+// of a directory, and ** any number of directories, as in api/**/*.proto.
+// The -r=DIR flag adds the .proto files beneath DIR, so that new files
+// need not be added to the go:generate line by hand. Both skip hidden,
+// vendor and node_modules directories, the vendor-protos directory,
+// and the paths matched by the config's exclude patterns.
+// Hundreds of .proto files would exceed the limits of the command line
+// (ARG_MAX) and of protoc's memory, so beyond 256 files (see -chunk),
+// the tool splits them, a directory at a time, across several protoc
+// runs in the same container, and reports the failures of all of them.
+// Outputs that describe all the files at once (--descriptor_set_out,
+// --dependency_out, docs, or merged OpenAPI) prevent the split.
+// The -jobs=N flag instead splits the files by directory (which usually
+// corresponds to the proto package) and runs up to N protoc processes
+// at a time in the same container, prefixing their messages with
+// the directory, which speeds up generation in large repositories.
+// In a monorepo, the config's roots list may instead name several proto
+// roots, each with its own directory, protoc arguments, plugins and
+// flags (see protogen.WorkspaceRoot); a run without protoc arguments
+// then processes them all, up to -parallel=N at a time.
+// Assuming a go:generate directive in the proto/ directory, typical
+// arguments are:
+//
+//   --proto_path=.                   Root of proto import tree.
 //   --go_out=..                      Root of tree for generated files for messages.
 //   --twirp_out=.                    Root of tree for generated files for Twirp services.
+//   --go-grpc_out=.                  Root of tree for generated files for gRPC services.
 //   --go_opt=paths=source_relative   Generated filenames mirror source file names.
-//   messages.proto services.proto    List of proto files.
+//   --go-grpc_opt=paths=source_relative  Likewise, for gRPC services.
+//   messages.proto services.proto    List of proto files (or *.proto, or -r=. before --).
+//
+// With the -lint flag (or the config's lint stanza), the tool runs
+// 'buf lint', using a pinned buf version in the same image, on the
+// .proto files before generating code, and fails on lint errors.
+// Similarly, with -breaking=REV (or the config's breaking stanza), it
+// runs 'buf breaking' to compare the .proto files beneath the first
+// import directory with those of the git revision REV, and fails on
+// breaking changes.
+//
+// The check command (or the -check flag) runs protoc on a copy of the
+// working directory and prints the differences between the generated
+// files and those of the original tree, failing if there are any. This
+// is useful in CI to verify that generated files are up to date.
+//
+// With the -watch flag, the tool keeps a container running and reruns
+// protoc in it whenever a .proto file beneath the import directories
+// changes, until interrupted.
+//
+// The tool records a fingerprint of each .proto file, covering its
+// content and that of the files it imports, after each successful run,
+// and the next run with the same flags and toolchain compiles only the
+// files whose fingerprints changed; if none did, it does nothing, which
+// makes 'go generate ./...' fast when the .proto files are untouched.
+// The -force flag compiles all of them regardless, as is needed after
+// deleting or editing a generated file by hand.
+//
+// The tool also records the files generated from each .proto file in
+// .proto-gen-go.manifest, in the working directory, which should be
+// committed. When a .proto file is deleted or renamed, the next run
+// reports its stale outputs, and removes them if the -prune flag is set.
+//
+// The -compile-check flag builds the Go packages of the generated files
+// after generation ('go build' in the container, with the image's Go,
+// against the module versions of the nearest go.mod and the host's
+// module cache), failing if they don't compile, as when protoc-gen-go
+// is newer than the google.golang.org/protobuf runtime that go.mod
+// requires. Such a failure leaves the .proto files to be recompiled
+// and checked again by the next run.
+//
+// Starting a container dominates the time taken by small runs. With
+// the -warm flag, the tool instead runs protoc in a long-lived container
+// for the working directory, starting it if necessary, and leaves it
+// running for later runs with -warm, for up to an hour. A change to the
+// config (and thus the image) or to the mounted directories starts a
+// new container, replacing the stale one. The clean command removes
+// warm containers.
+//
+// Projects that use 'buf generate' can be migrated with the -buf-gen
+// flag, which reads a buf.gen.yaml file (v1 or v2) and the buf.work.yaml
+// file beside it: their plugins, out directories and options replace
+// those of the config, and the .proto files of their directories are
+// compiled, each directory being an import directory. Remote plugins
+// of the Buf Schema Registry are mapped to the equivalent local plugins
+// where known; protoc's built-in generators, such as java, are used as is.
+//
+// Behind a proxy, the proxy variables of the environment (HTTP_PROXY,
+// HTTPS_PROXY, NO_PROXY and ALL_PROXY, in either case), or those set
+// by the -proxy and -no-proxy flags, are passed to image builds and
+// containers. The -ca-cert flag (or the config's ca_certs list) adds
+// CA certificates, such as that of a TLS-intercepting proxy, to the
+// image's trust store, for both the build and protoc's plugins.
+//
+// The config's base_image setting replaces the golang base image, for
+// example with a copy in an internal registry, and its registry stanza
+// names a Docker Hub mirror for the default base images, the directory
+// of the docker config.json with the registries' credentials, and a
+// username and password variable with which to log in before a build
+// or pull, so that images build where Docker Hub is blocked.
+//
+// The -dockerfile flag (or the config's dockerfile setting) names a
+// Dockerfile that replaces the generated one, if it has a FROM
+// instruction, or else extends it, its instructions being appended.
+// The print-dockerfile command prints the effective Dockerfile, which
+// may be ejected, edited (e.g. to rebase it onto an approved internal
+// base image) and passed back with -dockerfile. The image's tag is a
+// hash of the effective Dockerfile, so that it is rebuilt when it
+// changes.
+//
+// Image builds, image pulls and downloads that fail with what look like
+// transient errors (network errors, server errors, or an apt mirror
+// caught mid-sync) are retried, after 2s, then 4s, and so on, as many
+// times as the -retries flag permits (2 by default). Other failures,
+// such as checksum mismatches, are reported at once.
+//
+// A hung image build (or pull, or load) is killed after 30 minutes,
+// and a hung protoc run after 10 minutes, with an error naming the
+// -build-timeout or -run-timeout flag that sets the limit (0: none).
+// A killed run in a warm container also removes the container.
+//
+// On machines without network access, the toolchain image cannot be
+// built. Instead, run 'proto-gen-go export-image -o image.tar' (with
+// the same config, and -platform if the architectures differ) on a
+// connected machine, copy the tarball, and run with -image-tar=image.tar,
+// which loads the image if it is not already present and fails if the
+// tarball holds the image of a different config.
+//
+// The sbom command writes a software bill of materials of the toolchain
+// image (SPDX 2.3 JSON, or CycloneDX 1.5 with -format=cyclonedx): the
+// base image, the Debian packages, protoc with its checksum, and the
+// modules of the Go plugins and their dependencies, with their go.sum
+// hashes, as recorded in the executables.
+//
+// With the -local flag, no container is used. Instead, the tool
+// downloads the pinned protoc release for the host platform, verifies
+// its SHA256 checksum, installs the pinned plugins using 'go install', and runs them
+// natively. Both are cached in the user's cache directory.
+// The -fallback-local flag does the same whenever no container runtime
+// is usable. Otherwise, if the runtime is not installed or its daemon
+// does not respond, the error suggests a remedy.
+//
+// If the default docker daemon does not respond, and neither
+// DOCKER_HOST nor DOCKER_CONTEXT selects another, the tool uses the
+// first daemon that does among those of Colima, Rancher Desktop,
+// OrbStack, Lima, podman machine and Docker Desktop, found by their
+// sockets in the home directory, and then those of the docker
+// contexts. The -docker-context flag selects a context explicitly.
 //
 // Protoc is quite particular about the use of absolute vs. relative
-// paths, which is why the example above used "sh -c", to allow
-// arguments to reference $(pwd).
+// paths, and in the container it does not run in the host's working
+// directory, so the tool rewrites the relative paths of --proto_path
+// (or -I), --*_out, --descriptor_set_in/out, --dependency_out and
+// --plugin flags to absolute ones, relative to the working directory,
+// and runs protoc there. Arguments therefore need not reference $(pwd),
+// nor the directive use "sh -c" to expand it.
+//
+// The implementation is available to other Go programs as the
+// github.com/github/proto-gen-go/pkg/protogen package.
 //
 // This program uses Docker to ensure maximum reproducibility and
-// minimum side effects. In particular:
+// minimum side effects. Podman and nerdctl may be used instead; the
+// -runtime flag selects one explicitly, and by default the first of
+// docker, podman and nerdctl found in PATH is used. In particular:
 // - Thanks to volume mounts, the program can only change files
-//   beneath $(pwd); changes outside this tree are not reflected
-//   outside the container. If you want the command to write the
-//   generated files outside the proto/ tree, you'll need to use
-//   'cd .. && go run ...' and adjust the flags accordingly.
+//   beneath $(pwd) and beneath the output directories named by
+//   absolute --*_out flags; other directories named by absolute
+//   --proto_path (or -I) flags are mounted read-only, at the same
+//   paths. Changes elsewhere are not reflected outside the container.
+//   With the -isolate-outputs flag, $(pwd) and the output directories
+//   are mounted read-only too, and protoc writes to a separate writable
+//   mount, from which the files it generated are copied to their output
+//   directories, so that a misconfigured plugin cannot change sources.
+// - When the daemon cannot see the host's files, because DOCKER_HOST
+//   (or, for podman, CONTAINER_HOST) names a remote machine, or with
+//   the -remote flag, as for docker-in-docker, the same directories
+//   are copied into the container (docker cp) instead of mounted, and
+//   the generated files are copied back.
+// - On Windows, each directory is mounted at the Unix path of its
+//   drive (C:\src\api at /c/src/api), and the Windows paths of
+//   protoc's arguments are translated to such paths. Files that differ
+//   from the generated ones only in their CRLF line endings, as checked
+//   out with core.autocrlf, are up to date.
 // - By always running protoc on Linux, we needn't worry about
-//   downloading an appropriate executable.
+//   downloading an appropriate executable. The image matches the
+//   host's architecture (amd64 or arm64, as on Apple Silicon), so
+//   protoc runs without emulation; the -platform flag overrides it.
+// - Protoc runs as the host user (see the -user flag), so that
+//   generated files are owned by the invoking user, not root. With
+//   rootless podman, docker or nerdctl, whose containers' root is the
+//   host user, it runs as root instead, and with a daemon that remaps
+//   users to subordinate ids (userns-remap), it runs with --userns=host,
+//   lest the bind-mounted files be unwritable (EACCES).
+// - Each container is removed when it exits. If the tool is
+//   interrupted (SIGINT or SIGTERM), it kills and removes the running
+//   container before exiting with status 130.
+// - The -memory, -cpus and -pids-limit flags bound the resources of
+//   each container, as the docker run flags of the same names do, so
+//   that a runaway plugin cannot starve other jobs of a shared host.
+// - Protoc needs no network access, and with the -hermetic flag (or
+//   -network=none) its containers have none, so that plugins cannot
+//   reach the network and generation is verifiably hermetic. Only the
+//   image build (or pull) uses the network.
+// - The image is tagged proto-gen-go:<hash>, where hash is derived
+//   from the content of the Dockerfile, so it is built only once
+//   for each toolchain configuration. Images are labeled
+//   com.github.proto-gen-go.toolchain; after each build, all but the
+//   three most recent (or the config's keep_images) are removed, and
+//   'proto-gen-go clean -keep=N' prunes them likewise.
+// - Image builds use BuildKit (or podman), whose cache mounts keep the
+//   Go module and build caches from one build to the next, so that
+//   changing the version of one plugin does not download and compile
+//   the modules of the others anew. ('docker builder prune' frees them.)
+// - Concurrent invocations, such as those that 'go generate ./...'
+//   starts at once, build each image only once, and those in the same
+//   working directory generate one at a time, so that they don't
+//   overwrite each other's files; they wait on lock files in the
+//   user's cache directory (proto-gen-go/locks).
+// - Alternatively, the -image flag names a prebuilt image, such as
+//   ghcr.io/github/proto-gen-go:<version> (published for each release,
+//   for linux/amd64 and linux/arm64), which is pulled if necessary
+//   and run instead. This avoids network access to apt, GitHub and
+//   the Go module proxy at generation time. For reproducibility,
+//   refer to the image by digest (name@sha256:...). The config's verify
+//   stanza requires the image's cosign signature (and attestation) to
+//   verify, with a key or a keyless identity, before it runs.
 package main
 
 import (
-	"bytes"
-	_ "embed"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
 )
 
-// dockerfile contains the docker specification for our versioned dependencies
-//go:embed Dockerfile
-var dockerfile string
+// A command is a subcommand of proto-gen-go.
+type command struct {
+	name    string
+	args    string // synopsis of arguments
+	summary string
+	run     func(ctx context.Context, cmd *command, args []string) error
+}
+
+// commands lists the subcommands. The first is the default.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"generate", "[flags] [--] [protoc flags] [proto files]", "generate code by running protoc", runGenerate},
+		{"check", "[flags] [--] [protoc flags] [proto files]", "check that generated files are up to date", runCheck},
+		{"lint", "[flags] [--] [protoc flags] [proto files]", "run buf lint on proto files", runLint},
+		{"clean", "[flags]", "remove warm containers, toolchain images (or old ones) and caches", runClean},
+		{"vendor-protos", "[flags]", "copy third-party proto dependencies into the vendor directory", runVendor},
+		{"print-dockerfile", "[flags]", "print the effective toolchain Dockerfile, for auditing or ejecting", runPrintDockerfile},
+		{"export-image", "[flags]", "save the toolchain image to a tarball for offline use with -image-tar", runExportImage},
+		{"sbom", "[flags]", "write an SPDX or CycloneDX SBOM of the toolchain image", runSBOM},
+		{"publish", "[flags]", "commit the generated code to the config's downstream repository", runPublish},
+		{"lock", "[flags]", "pin the toolchain's artifacts by digest in " + protogen.ToolchainLockFile, runLock},
+		{"init", "[flags] [dir]", "create a sample config file and go:generate directive", runInit},
+		{"version", "[flags]", "print the tool and toolchain versions", runVersion},
+		{"self-update", "[flags]", "update the pinned versions of the tool to the latest release", runSelfUpdate},
+		{"help", "[command]", "print help", runHelp},
+	}
+}
 
 func main() {
 	log.SetPrefix("proto-gen-go: ")
 	log.SetFlags(0)
-	flag.Parse()
 
+	// For compatibility, 'proto-gen-go [flags] [protoc args]'
+	// is short for 'proto-gen-go generate [flags] [protoc args]'.
+	cmd, args := commands[0], os.Args[1:]
+	if len(args) > 0 {
+		if c := lookupCommand(args[0]); c != nil {
+			cmd, args = c, args[1:]
+		}
+	}
+
+	// On interrupt, cancel the command, which stops and removes its containers.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := cmd.run(ctx, cmd, args); err != nil {
+		if ctx.Err() != nil {
+			err = errors.New("interrupted")
+		}
+		if events != nil {
+			events.fail(err)
+		} else if err != flag.ErrHelp {
+			log.Print(err)
+		}
+		if ctx.Err() != nil {
+			os.Exit(130)
+		}
+		// Exit with protoc's status, so that callers can
+		// distinguish usage errors from compilation errors.
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() > 0 {
+			os.Exit(exit.ExitCode())
+		}
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// lookupCommand returns the named command, or nil.
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// flagSet returns a new flag set for the command.
+func (cmd *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: proto-gen-go %s %s\n\n%s.\n", cmd.name, cmd.args, strings.ToUpper(cmd.summary[:1])+cmd.summary[1:])
+		if hasFlags(fs) {
+			fmt.Fprintf(fs.Output(), "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// parseToolArgs parses the tool flags of args, the arguments of a
+// command that runs protoc, and returns the protoc arguments.
+//
+// Conventionally, the tool flags precede "--", and all arguments after
+// it are protoc's, so that tool flags cannot collide with protoc's.
+// Without "--", for compatibility, the tool flags are the leading
+// arguments that name them, with a single dash (-force, -v), and the
+// protoc arguments begin at the first that does not: a .proto file or
+// a flag such as --go_out=. or -I. that the tool does not define.
+func parseToolArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	for _, arg := range args {
+		if arg == "--" {
+			if err := fs.Parse(args); err != nil {
+				return nil, err
+			}
+			if n := len(args) - fs.NArg(); n == 0 || args[n-1] != "--" {
+				return nil, fmt.Errorf("unexpected argument %q before --; protoc arguments follow --", fs.Arg(0))
+			}
+			return fs.Args(), nil
+		}
+	}
+	n := 0
+	for n < len(args) {
+		arg := args[n]
+		if len(arg) < 2 || arg[0] != '-' || arg[1] == '-' {
+			break
+		}
+		name, _, hasValue := strings.Cut(arg[1:], "=")
+		f := fs.Lookup(name)
+		if f == nil && name != "h" && name != "help" {
+			break
+		}
+		n++
+		if f == nil {
+			continue // fs.Parse prints the usage
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && b.IsBoolFlag()) {
+			n++ // the value is the next argument
+		}
+	}
+	if n > len(args) {
+		n = len(args) // fs.Parse reports the missing value
+	}
+	if err := fs.Parse(args[:n]); err != nil {
+		return nil, err
+	}
+	return args[n:], nil
+}
+
+// hasFlags reports whether any flags are defined in the flag set.
+func hasFlags(fs *flag.FlagSet) bool {
+	any := false
+	fs.VisitAll(func(*flag.Flag) { any = true })
+	return any
+}
+
+// runHelp prints the list of commands, or the usage of one.
+func runHelp(ctx context.Context, cmd *command, args []string) error {
+	if len(args) == 1 {
+		if c := lookupCommand(args[0]); c != nil {
+			if err := c.run(ctx, c, []string{"-help"}); err != flag.ErrHelp {
+				return err
+			}
+			return nil
+		}
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	w := os.Stderr
+	fmt.Fprintf(w, "usage: proto-gen-go [command] [flags] [--] [protoc flags] [proto files]\n\n")
+	fmt.Fprintf(w, "Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nThe default command is generate. Use 'proto-gen-go help [command]' for details.\n")
+	return nil
+}
+
+// toolFlags are the flags common to the commands that run the toolchain.
+type toolFlags struct {
+	config, runtime, user, plugins, langs, platform, image, breaking, recursive             string
+	proxy, noProxy, caCerts, imageTar, bufGen, dockerfile, logFormat, dockerContext         string
+	memory, cpus, network                                                                   string
+	local, lint, noFormat, dryRun, verbose, quiet, remote, warm, force, prune, compileCheck bool
+	fallbackLocal, isolateOutputs, hermetic                                                 bool
+	chunk, jobs, retries, pidsLimit, parallel                                               int
+	buildTimeout, runTimeout                                                                time.Duration
+
+	bufArgs []string // protoc arguments of the -buf-gen file's inputs
+}
+
+func (f *toolFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "config", "", "project config file (default: nearest "+protogen.ConfigFile+")")
+	fs.StringVar(&f.runtime, "runtime", "", "container runtime: docker, podman or nerdctl (default: first found in PATH)")
+	fs.StringVar(&f.dockerContext, "docker-context", "", "docker context whose daemon to use (default: $DOCKER_HOST or the current context, or else the first responding daemon of Colima, Rancher Desktop, etc.)")
+	fs.StringVar(&f.user, "user", "", "container user: uid:gid, root, or chown (default: host user)")
+	fs.StringVar(&f.plugins, "plugins", "", "comma-separated list of additional plugins (e.g. gateway,openapiv2,validate)")
+	fs.StringVar(&f.langs, "langs", "", "comma-separated list of language profiles whose plugins to add: go, python, java, kotlin, ts or swift")
+	fs.BoolVar(&f.local, "local", false, "run a natively installed protoc and plugins instead of a container")
+	fs.BoolVar(&f.fallbackLocal, "fallback-local", false, "if no container runtime is usable (not installed, or its daemon not running), run as -local does")
+	fs.BoolVar(&f.force, "force", false, "regenerate from all .proto files, even those unchanged since the last run")
+	fs.BoolVar(&f.prune, "prune", false, "remove generated files whose .proto files no longer exist (see "+protogen.ManifestFile+")")
+	fs.BoolVar(&f.compileCheck, "compile-check", false, "after generation, build the Go packages of the generated files in the toolchain's Go, against the module versions of go.mod")
+	fs.BoolVar(&f.warm, "warm", false, "run protoc in a long-lived container, reused by later runs until the config changes")
+	fs.BoolVar(&f.isolateOutputs, "isolate-outputs", false, "mount the working directory read-only, and copy protoc's outputs from a separate writable mount to their directories")
+	fs.BoolVar(&f.remote, "remote", false, "copy files to and from containers instead of mounting them, as for docker-in-docker (default: if DOCKER_HOST is remote)")
+	fs.StringVar(&f.memory, "memory", "", "memory limit of the toolchain's containers, as for docker run --memory (e.g. 2g; default: none)")
+	fs.StringVar(&f.cpus, "cpus", "", "CPU limit of the toolchain's containers, as for docker run --cpus (e.g. 1.5; default: none)")
+	fs.IntVar(&f.pidsLimit, "pids-limit", 0, "process limit of the toolchain's containers, as for docker run --pids-limit (default: none)")
+	fs.StringVar(&f.network, "network", "", "network of the toolchain's containers, as for docker run --network (e.g. none; default: the runtime's)")
+	fs.BoolVar(&f.hermetic, "hermetic", false, "run the toolchain's containers without network access (-network=none), so that plugins cannot reach the network")
+	fs.StringVar(&f.proxy, "proxy", "", "HTTP(S) proxy URL for image builds, containers and downloads (default: $HTTPS_PROXY etc.)")
+	fs.StringVar(&f.noProxy, "no-proxy", "", "comma-separated hosts to reach without the proxy (default: $NO_PROXY)")
+	fs.StringVar(&f.caCerts, "ca-cert", "", "comma-separated PEM files of additional CA certificates for the image to trust, as for a TLS-intercepting proxy")
+	fs.StringVar(&f.platform, "platform", "", "container platform: linux/amd64 or linux/arm64 (default: host's)")
+	fs.StringVar(&f.image, "image", "", "prebuilt toolchain image to pull and run (e.g. ghcr.io/github/proto-gen-go:v1.5.0)")
+	fs.StringVar(&f.dockerfile, "dockerfile", "", "Dockerfile that replaces the generated one (if it has a FROM instruction) or extends it (see print-dockerfile)")
+	fs.StringVar(&f.imageTar, "image-tar", "", "load the toolchain image from this tarball (see export-image) instead of building or pulling it, for offline use")
+	fs.BoolVar(&f.lint, "lint", false, "run buf lint before generation (see also the config's lint stanza)")
+	fs.BoolVar(&f.noFormat, "no-format", false, "don't gofmt the generated Go files")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "print the container (or local) commands that would be run, without running them")
+	fs.StringVar(&f.breaking, "breaking", "", "fail on breaking changes against this git revision (e.g. origin/main)")
+	fs.BoolVar(&f.verbose, "v", false, "verbose: log each command, and show the full output of image builds")
+	fs.BoolVar(&f.quiet, "q", false, "quiet: report only errors")
+	fs.StringVar(&f.logFormat, "log", "text", "log format: text, or json for one JSON event per line (progress, phases and their durations, protoc diagnostics, result)")
+	fs.IntVar(&f.retries, "retries", 2, "times to retry image builds, pulls and downloads that fail with network errors, with exponential backoff")
+	fs.DurationVar(&f.buildTimeout, "build-timeout", 30*time.Minute, "maximum duration of the image build (or pull or load), after which it is killed (0: no limit)")
+	fs.DurationVar(&f.runTimeout, "run-timeout", 10*time.Minute, "maximum duration of protoc's runs, after which they are killed (0: no limit)")
+	fs.IntVar(&f.parallel, "parallel", 1, "number of the workspace roots of the config (see its roots list) to generate at a time")
+	fs.IntVar(&f.jobs, "jobs", 1, "number of protoc runs, one or more per directory of .proto files, to run in parallel")
+	fs.IntVar(&f.chunk, "chunk", 0, "maximum number of .proto files per protoc run, beyond which they are split across runs (default 256; -1: no limit)")
+	fs.StringVar(&f.bufGen, "buf-gen", "", "generate as 'buf generate' would with this buf.gen.yaml file (and buf.work.yaml beside it)")
+	fs.StringVar(&f.recursive, "r", "", "also compile the .proto files found recursively beneath this directory (see the config's exclude list)")
+}
+
+// loadConfig loads the project config, if any, and applies the flags to it.
+func (f *toolFlags) loadConfig(pwd string) (*protogen.Config, error) {
+	filename := f.config
+	if filename == "" {
+		filename = protogen.FindConfig(pwd)
+	}
+	return f.loadConfigFile(filename, pwd)
+}
+
+// loadConfigFile loads the named config file (or, if "", the default
+// config) and applies the flags to it.
+func (f *toolFlags) loadConfigFile(filename, pwd string) (*protogen.Config, error) {
+	cfg, err := protogen.LoadConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	if f.bufGen != "" {
+		f.bufArgs, err = cfg.LoadBufGen(f.bufGen)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.plugins != "" {
+		for _, name := range strings.Split(f.plugins, ",") {
+			if err := cfg.AddPlugin(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if f.langs != "" {
+		cfg.Langs = append(cfg.Langs, strings.Split(f.langs, ",")...)
+	}
+	if f.dockerfile != "" {
+		cfg.CustomDockerfile = f.dockerfile
+		if !filepath.IsAbs(f.dockerfile) {
+			cfg.CustomDockerfile = filepath.Join(pwd, f.dockerfile)
+		}
+	}
+	if f.lint {
+		cfg.Lint.Enabled = true
+	}
+	if f.breaking != "" {
+		cfg.Breaking.Against = f.breaking
+	}
+	if f.caCerts != "" {
+		for _, cert := range strings.Split(f.caCerts, ",") {
+			if !filepath.IsAbs(cert) {
+				cert = filepath.Join(pwd, cert)
+			}
+			cfg.CACerts = append(cfg.CACerts, cert)
+		}
+	}
+	return cfg, nil
+}
+
+// noLimit maps the zero duration of a timeout flag, which means no
+// limit, to the negative duration that means the same in Options.
+func noLimit(d time.Duration) time.Duration {
+	if d == 0 {
+		return -1
+	}
+	return d
+}
+
+// memoryLimit matches a valid -memory flag: a number of bytes, with an
+// optional unit (b, k, m or g).
+var memoryLimit = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+
+// options returns the options for running the toolchain with the
+// specified protoc arguments in the current directory.
+func (f *toolFlags) options(protocArgs []string) (protogen.Options, error) {
+	if f.verbose && f.quiet {
+		return protogen.Options{}, fmt.Errorf("-v and -q are mutually exclusive")
+	}
+	switch f.logFormat {
+	case "", "text", "json":
+	default:
+		return protogen.Options{}, fmt.Errorf("invalid -log format %q (want text or json)", f.logFormat)
+	}
+	if f.memory != "" && !memoryLimit.MatchString(f.memory) {
+		return protogen.Options{}, fmt.Errorf("invalid -memory limit %q (want a number of bytes with an optional unit, e.g. 512m or 2g)", f.memory)
+	}
+	if n, err := strconv.ParseFloat(f.cpus, 64); f.cpus != "" && (err != nil || n <= 0) {
+		return protogen.Options{}, fmt.Errorf("invalid -cpus limit %q (want a positive number, e.g. 1.5)", f.cpus)
+	}
+	if f.pidsLimit < 0 {
+		return protogen.Options{}, fmt.Errorf("invalid -pids-limit %d (want a positive number)", f.pidsLimit)
+	}
+	network := f.network
+	if f.hermetic {
+		switch {
+		case network != "" && network != "none":
+			return protogen.Options{}, fmt.Errorf("-hermetic runs without network access, but -network=%s", network)
+		case f.local || f.fallbackLocal:
+			return protogen.Options{}, fmt.Errorf("-hermetic requires a container, whose network access can be denied, unlike -local")
+		}
+		network = "none"
+	}
 	pwd, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Build the protoc container image specified by the Dockerfile.
-	// The dockerized program assumes linux/amd64, and the --platform flag enables
-	// dynamic binary translation on M1 hardware.
-	// The docker context is empty.
-	log.Printf("building protoc container image...")
-	cmd := exec.Command("docker", "build", "--platform=linux/amd64", "-q", "-")
-	cmd.Stdin = strings.NewReader(dockerfile)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = new(bytes.Buffer)
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("docker build failed: %v", err)
-	}
-	id := strings.TrimSpace(fmt.Sprint(cmd.Stdout)) // docker image id
-
-	// Log the command, neatly.
-	protocArgs := flag.Args()
-	cmdstr := "protoc " + strings.ReplaceAll(strings.Join(protocArgs, " "), pwd, "$(pwd)")
-	log.Println(cmdstr)
-
-	// Run protoc, in a container.
-	// We assume pwd does not conflict with some critical part
-	// of the docker image, and volume-mount it.
-	cmd = exec.Command("docker", "run", "-v", pwd+":"+pwd, "--platform=linux/amd64", id)
-	cmd.Args = append(cmd.Args, protocArgs...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("protoc command failed: %v", err)
-	}
-	log.Println("done")
+		return protogen.Options{}, err
+	}
+	cfg, err := f.loadConfig(pwd)
+	if err != nil {
+		return protogen.Options{}, err
+	}
+
+	// Proxy flags override the environment, which image builds,
+	// containers and downloads inherit.
+	if f.proxy != "" {
+		for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+			os.Setenv(name, f.proxy)
+		}
+	}
+	if f.noProxy != "" {
+		os.Setenv("NO_PROXY", f.noProxy)
+		os.Setenv("no_proxy", f.noProxy)
+	}
+	opts := protogen.Options{
+		Config:         *cfg,
+		Dir:            pwd,
+		ProtocArgs:     append(f.bufArgs, protocArgs...),
+		Runtime:        f.runtime,
+		DockerContext:  f.dockerContext,
+		User:           f.user,
+		Local:          f.local,
+		FallbackLocal:  f.fallbackLocal,
+		Platform:       f.platform,
+		Memory:         f.memory,
+		CPUs:           f.cpus,
+		PidsLimit:      f.pidsLimit,
+		Network:        network,
+		Image:          f.image,
+		ImageTar:       f.imageTar,
+		NoFormat:       f.noFormat,
+		DryRun:         f.dryRun,
+		Verbose:        f.verbose,
+		Remote:         f.remote,
+		IsolateOutputs: f.isolateOutputs,
+		Warm:           f.warm,
+		Force:          f.force,
+		Prune:          f.prune,
+		CompileCheck:   f.compileCheck,
+		Recursive:      f.recursive,
+		ChunkSize:      f.chunk,
+		Jobs:           f.jobs,
+		Retries:        f.retries,
+		BuildTimeout:   noLimit(f.buildTimeout),
+		RunTimeout:     noLimit(f.runTimeout),
+	}
+	if !f.quiet {
+		opts.Logf = log.Printf
+	}
+	if f.logFormat == "json" {
+		startEventLog(&opts)
+	}
+	return opts, nil
+}
+
+// report logs a message about the outcome of a command,
+// unless the -q or -dry-run flag is set.
+func report(opts protogen.Options, format string, args ...interface{}) {
+	if opts.Logf != nil && !opts.DryRun {
+		opts.Logf(format, args...)
+	}
 }
@@ -0,0 +1,303 @@
+package protogen
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// protoPaths returns the import directories named by the --proto_path
+// (or -I) flags among the protoc arguments, made absolute relative to
+// dir. If there are none, the result is dir alone, as for protoc.
+func protoPaths(args []string, dir string) []string {
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		var value string
+		switch arg := args[i]; {
+		case arg == "--proto_path" || arg == "-I":
+			if i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+		case strings.HasPrefix(arg, "--proto_path="):
+			value = strings.TrimPrefix(arg, "--proto_path=")
+		case strings.HasPrefix(arg, "-I"):
+			value = strings.TrimPrefix(arg, "-I")
+		default:
+			continue
+		}
+		// Like $PATH, a proto_path may be a list of directories.
+		for _, p := range filepath.SplitList(value) {
+			if p == "" {
+				continue
+			}
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(dir, p)
+			}
+			paths = append(paths, filepath.Clean(p))
+		}
+	}
+	if paths == nil {
+		paths = []string{dir}
+	}
+	return paths
+}
+
+// A mount is a host directory mounted at the same container path.
+type mount struct {
+	dir      string
+	readOnly bool
+}
+
+// protocMounts returns the host directories outside pwd that are named
+// by the protoc arguments: import directories and the directories of
+// plugin executables, which are mounted read-only, and the directories
+// of outputs, which are writable. A directory beneath another is
+// subsumed by it. Devices such as /dev/stdout are not mounted, since
+// those of the container are connected to the tool's.
+func protocMounts(args []string, pwd string) []mount {
+	var all []mount
+	for _, dir := range protoPaths(args, pwd) {
+		all = append(all, mount{dir, true})
+	}
+	for _, file := range pluginFiles(args) {
+		all = append(all, mount{filepath.Dir(file), true})
+	}
+	for _, dir := range outputDirs(args) {
+		all = append(all, mount{dir, false})
+	}
+	for _, dir := range inputFileDirs(args) {
+		all = append(all, mount{dir, true})
+	}
+
+	// Shorter paths first, so that each directory precedes those beneath it.
+	sort.SliceStable(all, func(i, j int) bool { return len(all[i].dir) < len(all[j].dir) })
+	var mounts []mount
+outer:
+	for _, m := range all {
+		if !filepath.IsAbs(m.dir) || within(m.dir, pwd) || isDevice(m.dir) {
+			continue
+		}
+		for i := range mounts {
+			if within(m.dir, mounts[i].dir) {
+				mounts[i].readOnly = mounts[i].readOnly && m.readOnly
+				continue outer
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
+
+// within reports whether path is dir or beneath it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// outputDirs returns the cleaned output directories named by the
+// --*_out flags among the protoc arguments, which may have the form
+// --NAME_out=[PARAMS:]DIR, and the directories of the output files
+// named by --descriptor_set_out and --dependency_out.
+func outputDirs(args []string) []string {
+	var dirs []string
+	for i := 0; i < len(args); i++ {
+		name, value, ok := flagValue(args, &i)
+		if !ok || !strings.HasSuffix(name, "_out") {
+			continue
+		}
+		switch name {
+		case "--descriptor_set_out", "--dependency_out":
+			value = filepath.Dir(value)
+		default:
+			_, value = splitOut(value)
+		}
+		if value != "" {
+			dirs = append(dirs, filepath.Clean(value))
+		}
+	}
+	return dirs
+}
+
+// splitOut splits the value of a --NAME_out=[PARAMS:]DIR flag into the
+// parameters of the plugin, with the colon that ends them, and the
+// directory, whose drive, if it is an absolute Windows path such as
+// C:\gen, is not taken for the end of the parameters.
+func splitOut(value string) (params, dir string) {
+	colon := strings.LastIndex(value, ":")
+	if windowsPaths && colon > 0 && colon+1 < len(value) && (value[colon+1] == '\\' || value[colon+1] == '/') &&
+		(colon == 1 || value[colon-2] == ':') && isDriveLetter(value[colon-1]) {
+		colon -= 2 // C:\gen or PARAMS:C:\gen
+	}
+	if colon < 0 {
+		return "", value
+	}
+	return value[:colon+1], value[colon+1:]
+}
+
+// isDriveLetter reports whether c is the letter of a Windows drive.
+func isDriveLetter(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z'
+}
+
+// pluginFiles returns the absolute executables named by the
+// --plugin=[NAME=]PATH flags among the protoc arguments.
+func pluginFiles(args []string) []string {
+	var files []string
+	for i := 0; i < len(args); i++ {
+		name, value, ok := flagValue(args, &i)
+		if !ok || name != "--plugin" {
+			continue
+		}
+		if eq := strings.Index(value, "="); eq >= 0 {
+			value = value[eq+1:]
+		}
+		if filepath.IsAbs(value) {
+			files = append(files, filepath.Clean(value))
+		}
+	}
+	return files
+}
+
+// absArgs returns the protoc arguments with the relative paths named
+// by their flags (import directories, outputs, descriptor sets and
+// plugin executables) made absolute relative to pwd. Since pwd is
+// mounted at the same path in the container, the paths then have the
+// same meaning there as on the host, and directories outside pwd, such
+// as --go_out=.., are mounted. (The container also runs in pwd, so that
+// relative .proto file names resolve as on the host.) The short form
+// -o FILE becomes --descriptor_set_out=FILE.
+func absArgs(args []string, pwd string) []string {
+	abs := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(pwd, path)
+	}
+	absList := func(list string) string {
+		paths := filepath.SplitList(list)
+		for i := range paths {
+			paths[i] = abs(paths[i])
+		}
+		return strings.Join(paths, string(filepath.ListSeparator))
+	}
+
+	args = append([]string(nil), args...)
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-I":
+			if i+1 < len(args) {
+				i++
+				args[i] = absList(args[i])
+			}
+			continue
+		case strings.HasPrefix(arg, "-I"):
+			args[i] = "-I" + absList(strings.TrimPrefix(arg, "-I"))
+			continue
+		case arg == "-o" && i+1 < len(args):
+			// -o FILE is short for --descriptor_set_out=FILE.
+			args = append(args[:i], args[i+1:]...)
+			args[i] = "--descriptor_set_out=" + abs(args[i])
+			continue
+		case strings.HasPrefix(arg, "-o") && !strings.HasPrefix(arg, "--"):
+			args[i] = "--descriptor_set_out=" + abs(strings.TrimPrefix(arg, "-o"))
+			continue
+		}
+
+		start := i
+		name, value, ok := flagValue(args, &i)
+		if !ok || value == "" {
+			continue
+		}
+		switch {
+		case name == "--proto_path" || name == "--descriptor_set_in":
+			value = absList(value)
+		case name == "--descriptor_set_out" || name == "--dependency_out":
+			value = abs(value)
+		case name == "--plugin":
+			prefix, path := "", value
+			if eq := strings.Index(value, "="); eq >= 0 {
+				prefix, path = value[:eq+1], value[eq+1:]
+			}
+			// A bare name (without a separator) is sought in PATH.
+			if strings.ContainsAny(path, "/"+string(filepath.Separator)) {
+				path = abs(path)
+			}
+			value = prefix + path
+		case strings.HasSuffix(name, "_out"):
+			params, dir := splitOut(value)
+			value = params + abs(dir)
+		default:
+			continue
+		}
+		if i == start {
+			args[i] = name + "=" + value
+		} else {
+			args[i] = value
+		}
+	}
+	return args
+}
+
+// inputFileDirs returns the directories of the files named by the
+// --descriptor_set_in flags among the protoc arguments.
+func inputFileDirs(args []string) []string {
+	var dirs []string
+	for i := 0; i < len(args); i++ {
+		name, value, ok := flagValue(args, &i)
+		if !ok || name != "--descriptor_set_in" {
+			continue
+		}
+		for _, file := range filepath.SplitList(value) {
+			if file != "" {
+				dirs = append(dirs, filepath.Dir(file))
+			}
+		}
+	}
+	return dirs
+}
+
+// flagValue parses the long flag at args[*i], of the form --name=value
+// or --name value, advancing *i past the value in the latter case.
+func flagValue(args []string, i *int) (name, value string, ok bool) {
+	arg := args[*i]
+	if !strings.HasPrefix(arg, "--") {
+		return "", "", false
+	}
+	if eq := strings.Index(arg, "="); eq >= 0 {
+		return arg[:eq], arg[eq+1:], true
+	}
+	if *i+1 < len(args) && !strings.HasPrefix(args[*i+1], "-") {
+		*i++
+		return arg, args[*i], true
+	}
+	return arg, "", true
+}
+
+// protoFiles returns the .proto files named by the protoc arguments.
+func protoFiles(args []string) []string {
+	var files []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") && strings.HasSuffix(arg, ".proto") {
+			files = append(files, arg)
+		}
+	}
+	return files
+}
+
+// joinArgs joins the arguments for logging, abbreviating pwd as $(pwd).
+func joinArgs(args []string, pwd string) string {
+	return strings.ReplaceAll(strings.Join(args, " "), pwd, "$(pwd)")
+}
+
+// quoteArgs joins the arguments of a command, quoted as necessary for a POSIX shell.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`|&;<>()*?[]{}#~!") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
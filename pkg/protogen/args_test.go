@@ -0,0 +1,33 @@
+package protogen
+
+import "testing"
+
+// TestSplitOut checks that the drive of a Windows output directory is
+// not taken for the end of the parameters of the plugin.
+func TestSplitOut(t *testing.T) {
+	defer func(windows bool) { windowsPaths = windows }(windowsPaths)
+	for _, test := range []struct {
+		value, params, dir string
+		windows            bool
+	}{
+		{`C:\x`, "", `C:\x`, true},
+		{`paths=source_relative:C:\x`, "paths=source_relative:", `C:\x`, true},
+		{`paths=source_relative:C:/x`, "paths=source_relative:", `C:/x`, true},
+		{"plugins=grpc:rel", "plugins=grpc:", "rel", true},
+		{"plugins=grpc:rel", "plugins=grpc:", "rel", false},
+		{"gen", "", "gen", false},
+		{"x:/gen", "x:", "/gen", false},
+	} {
+		windowsPaths = test.windows
+		params, dir := splitOut(test.value)
+		if params != test.params || dir != test.dir {
+			t.Errorf("splitOut(%q) (Windows: %t) = %q, %q, want %q, %q", test.value, test.windows, params, dir, test.params, test.dir)
+		}
+	}
+
+	windowsPaths = true
+	dirs := outputDirs([]string{`--go_out=C:\x`, `--twirp_out=paths=source_relative:C:\y`, "--grpc_out", "plugins=grpc:rel"})
+	if len(dirs) != 3 || dirs[0] != `C:\x` || dirs[1] != `C:\y` || dirs[2] != "rel" {
+		t.Errorf("outputDirs = %q, want [C:\\x C:\\y rel]", dirs)
+	}
+}
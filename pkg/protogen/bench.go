@@ -0,0 +1,173 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// writeBenchmarks writes, if Config.Bench is set, the benchmarks of the
+// encoding of the messages of the generated files, named relative to
+// the host directory dir, which stands in for opts.Dir, and returns the
+// names of those it created or modified. The messages are the fakes of
+// Config.Fakes, which Config.Bench requires.
+func writeBenchmarks(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Bench {
+		return nil, nil
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") || strings.HasSuffix(file, "_vtproto.pb.go") {
+			continue
+		}
+		importPath, err := goImportPath(filepath.Dir(filepath.Join(opts.Dir, file)))
+		if err != nil {
+			return nil, fmt.Errorf("bench: %v", err)
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		stem := strings.TrimSuffix(file, ".pb.go")
+		vt, err := vtprotoMethods(filepath.Join(dir, stem+"_vtproto.pb.go"))
+		if err != nil {
+			return nil, err
+		}
+		benchmarks, err := benchFile(file, src, importPath, path.Join(importPath, filepath.ToSlash(opts.Fakes.Dir)), vt)
+		if err != nil {
+			return nil, err
+		}
+		if benchmarks == nil {
+			continue // no messages
+		}
+		name := stem + "_bench_test.go"
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, benchmarks) {
+			continue
+		}
+		if err := os.WriteFile(filename, benchmarks, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// vtprotoMethods returns the methods, as T.M, of the file generated by
+// protoc-gen-go-vtproto, if it exists, such as Invoice.MarshalVT.
+func vtprotoMethods(filename string) (map[string]bool, error) {
+	src, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), filename, src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("bench: %v", err)
+	}
+	methods := make(map[string]bool)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 {
+			continue
+		}
+		recv := fn.Recv.List[0].Type
+		if star, ok := recv.(*ast.StarExpr); ok {
+			recv = star.X
+		}
+		if id, ok := recv.(*ast.Ident); ok {
+			methods[id.Name+"."+fn.Name.Name] = true
+		}
+	}
+	return methods, nil
+}
+
+// benchFile returns the source of the benchmarks of the messages of the
+// generated Go file, whose package has the specified import path, or
+// nil if it has none: for each message, of proto.Marshal and
+// proto.Unmarshal and of the MarshalVT and UnmarshalVT methods of
+// protoc-gen-go-vtproto, of those of vt. The benchmarks are in the
+// external test package, which imports the package of the fakes.
+func benchFile(name string, src []byte, importPath, fakes string, vt map[string]bool) ([]byte, error) {
+	c, err := newCloner(name, src)
+	if err != nil {
+		return nil, fmt.Errorf("bench: %v", err)
+	}
+	gen, fakesName := c.file.Name.Name, path.Base(fakes)
+	c.pkg = gen + "_test"
+	c.imports[gen] = importPath
+	c.imports[fakesName] = fakes
+	for _, ts := range c.messageSpecs() {
+		msg := ts.Name.Name
+		for _, pkg := range []string{gen, fakesName, "proto", "testing"} {
+			c.used[pkg] = true
+		}
+		fmt.Fprintf(&c.w, `
+// Benchmark%[1]s benchmarks the encoding of a fake %[1]s.
+func Benchmark%[1]s(b *testing.B) {
+	x := %[2]s.NewFake%[1]s(1)
+	data, err := proto.Marshal(x)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := proto.Marshal(x); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if err := proto.Unmarshal(data, new(%[3]s.%[1]s)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+`, msg, fakesName, gen)
+		if vt[msg+".MarshalVT"] {
+			c.w.WriteString(`	b.Run("MarshalVT", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := x.MarshalVT(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+`)
+		}
+		if vt[msg+".UnmarshalVT"] {
+			fmt.Fprintf(&c.w, `	b.Run("UnmarshalVT", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if err := new(%s.%s).UnmarshalVT(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+`, gen, msg)
+		}
+		c.w.WriteString("}\n")
+	}
+	if c.w.Len() == 0 {
+		return nil, nil
+	}
+	out, err := c.source(name)
+	if err != nil {
+		return nil, fmt.Errorf("benchmarks of %s: %v", name, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,107 @@
+package protogen
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// breaking runs 'buf breaking' to compare the .proto files beneath the
+// first import directory with those of the git revision rev, with the
+// host directory dir standing in for opts.Dir.
+func (e *env) breaking(ctx context.Context, opts *Options, dir, rev string) error {
+	root := protoPaths(e.protocArgs, opts.Dir)[0]
+
+	// Export the baseline tree of the root directory at rev.
+	top, err := git(ctx, root, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	subdir, err := filepath.Rel(top, root)
+	if err != nil {
+		return err
+	}
+	tmpdir, err := os.MkdirTemp("", "proto-gen-go-breaking")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	cmd := exec.CommandContext(ctx, "git", "archive", "--format=tar", rev, "--", filepath.ToSlash(subdir))
+	cmd.Dir = top
+	var archive, stderr bytes.Buffer
+	cmd.Stdout = &archive
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git archive %s: %v: %s", rev, err, strings.TrimSpace(stderr.String()))
+	}
+	if err := untar(tmpdir, &archive); err != nil {
+		return fmt.Errorf("extracting %s: %v", rev, err)
+	}
+	against := filepath.Join(tmpdir, subdir)
+	if _, err := os.Stat(against); err != nil {
+		return fmt.Errorf("%s does not exist at %s", subdir, rev)
+	}
+
+	args := []string{"breaking", "--against", against}
+	paths, err := bufPaths(e.protocArgs, root)
+	if err != nil {
+		return err
+	}
+	args = append(args, paths...)
+	return e.buf(ctx, opts, dir, root, args, []string{tmpdir})
+}
+
+// git runs git with the specified arguments in dir and returns its
+// trimmed output.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// untar extracts the regular files and directories of a tar archive into dir.
+func untar(dir string, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !within(name, dir) {
+			return fmt.Errorf("invalid file name %q", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(name, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+				return err
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(name, data, 0666); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package protogen
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A bufGen is the content of a buf.gen.yaml file, of version v1 or v2.
+type bufGen struct {
+	Version string      `yaml:"version"`
+	Plugins []bufPlugin `yaml:"plugins"`
+	Inputs  []struct {
+		Directory string `yaml:"directory"`
+	} `yaml:"inputs"` // v2
+}
+
+// A bufPlugin is a plugin of a buf.gen.yaml file. Exactly one of the
+// fields that name it is set, depending on the file's version.
+type bufPlugin struct {
+	Plugin        string `yaml:"plugin"`         // v1: name, or remote plugin
+	Name          string `yaml:"name"`           // v1 (deprecated): name
+	Remote        string `yaml:"remote"`         // v1 (deprecated), v2: remote plugin
+	Local         string `yaml:"local"`          // v2: executable
+	ProtocBuiltin string `yaml:"protoc_builtin"` // v2: protoc's own generator
+	Out           string `yaml:"out"`
+	Opt           bufOpt `yaml:"opt"`
+}
+
+// bufOpt is the opt of a buf plugin, which is a string or a list of strings.
+type bufOpt []string
+
+func (o *bufOpt) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*o = bufOpt{node.Value}
+		return nil
+	}
+	return node.Decode((*[]string)(o))
+}
+
+// A bufWork is the content of a buf.work.yaml file.
+type bufWork struct {
+	Directories []string `yaml:"directories"`
+}
+
+// protocBuiltins are the languages whose generators are built into protoc.
+var protocBuiltins = map[string]bool{
+	"cpp": true, "csharp": true, "java": true, "js": true, "kotlin": true,
+	"objc": true, "php": true, "pyi": true, "python": true, "ruby": true,
+}
+
+// bufRemotePlugins maps the remote plugins of the Buf Schema Registry
+// to the names of the equivalent known plugins.
+var bufRemotePlugins = map[string]string{
+	"buf.build/protocolbuffers/go":               "go",
+	"buf.build/grpc/go":                          "grpc",
+	"buf.build/connectrpc/go":                    "connect",
+	"buf.build/twitchtv/twirp":                   "twirp",
+	"buf.build/grpc-ecosystem/gateway":           "gateway",
+	"buf.build/grpc-ecosystem/openapiv2":         "openapiv2",
+	"buf.build/community/pseudomuto-doc":         "doc",
+	"buf.build/community/chrusty-jsonschema":     "jsonschema",
+	"buf.build/community/google-gnostic-openapi": "openapi",
+	"buf.build/community/stephenh-ts-proto":      "ts_proto",
+	"buf.build/envoyproxy/protoc-gen-validate":   "validate",
+}
+
+// LoadBufGen reads a buf.gen.yaml file, and the buf.work.yaml file, if
+// any, beside it, and maps them onto the config, so that a project
+// generated by 'buf generate' may be generated by Run instead. The
+// config's plugins are replaced by those of the file, with their out
+// and opt settings; each is a plugin of the config, a known plugin, or
+// one of protoc's built-in generators (such as java). Remote plugins
+// of the Buf Schema Registry are mapped to the equivalent known plugins
+// (at the registry's version, if specified), and others are an error.
+//
+// LoadBufGen returns the protoc arguments of the file's inputs: an
+// import directory and a **/*.proto pattern for each directory of the
+// buf.work.yaml file (or of the inputs of a v2 file), or for the
+// directory of the buf.gen.yaml file if there are none. Like the out
+// directories, they are relative to the directory of the file, which is
+// the working directory of 'buf generate', and are made absolute.
+func (cfg *Config) LoadBufGen(filename string) ([]string, error) {
+	var gen bufGen
+	if err := readYAML(filename, &gen); err != nil {
+		return nil, err
+	}
+	switch gen.Version {
+	case "v1", "v2":
+	default:
+		return nil, fmt.Errorf("%s: unsupported version %q (want v1 or v2)", filename, gen.Version)
+	}
+	root, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	abs := func(name string) string {
+		if filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(root, filepath.FromSlash(name))
+	}
+
+	plugins := []Plugin{} // not nil, which means the default plugins
+	for _, bp := range gen.Plugins {
+		name := bp.Plugin + bp.Name + bp.Local + bp.Remote + bp.ProtocBuiltin
+		version := ""
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("%s: plugin has no name", filename)
+		case bp.Local != "":
+			name = strings.TrimPrefix(filepath.Base(name), "protoc-gen-")
+		case strings.Contains(name, "/"): // remote
+			ref := name
+			name, version, _ = strings.Cut(ref, ":")
+			known, ok := bufRemotePlugins[name]
+			if !ok {
+				return nil, fmt.Errorf("%s: remote plugin %s has no local equivalent; add it to the plugins of %s", filename, ref, ConfigFile)
+			}
+			name = known
+		}
+		out := abs(bp.Out)
+		opt := strings.Join(bp.Opt, ",")
+		if protocBuiltins[name] && (bp.ProtocBuiltin != "" || !cfg.hasPlugin(name)) {
+			cfg.Flags = append(cfg.Flags, "--"+name+"_out="+out)
+			if opt != "" {
+				cfg.Flags = append(cfg.Flags, "--"+name+"_opt="+opt)
+			}
+			continue
+		}
+		p, err := cfg.bufPlugin(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if version != "" && p.Module != "" {
+			p.Version = version
+		}
+		p.Out, p.Opt = out, opt
+		plugins = append(plugins, p)
+	}
+	cfg.Plugins = plugins
+
+	// Inputs.
+	var dirs []string
+	for _, in := range gen.Inputs {
+		if in.Directory != "" {
+			dirs = append(dirs, in.Directory)
+		}
+	}
+	if len(dirs) == 0 {
+		var work bufWork
+		err := readYAML(filepath.Join(root, "buf.work.yaml"), &work)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		dirs = work.Directories
+	}
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	var args []string
+	for _, dir := range dirs {
+		dir = abs(dir)
+		args = append(args, "--proto_path="+dir, filepath.ToSlash(dir)+"/**/*.proto")
+	}
+	return args, cfg.resolve()
+}
+
+// hasPlugin reports whether the config has the named plugin.
+func (cfg *Config) hasPlugin(name string) bool {
+	for _, p := range cfg.Plugins {
+		if p.Name == name || p.flagName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bufPlugin returns the plugin whose flag name (as in --NAME_out) is
+// name: that of the config, if any, or else the known one.
+func (cfg *Config) bufPlugin(name string) (Plugin, error) {
+	for _, p := range cfg.Plugins {
+		if p.Name == name || p.flagName() == name {
+			return p, nil
+		}
+	}
+	for known, p := range knownPlugins {
+		p.Name = known
+		if known == name || p.flagName() == name {
+			return p, nil
+		}
+	}
+	return Plugin{}, fmt.Errorf("unknown plugin %q; add it to the plugins of %s", name, ConfigFile)
+}
+
+// readYAML decodes the named YAML file into v.
+func readYAML(filename string, v interface{}) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package protogen
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// copyTree copies the regular files beneath src to dst, preserving
+// their relative names. It skips .git directories.
+func copyTree(dst, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir() && d.Name() == ".git":
+			return filepath.SkipDir
+		case d.IsDir():
+			return os.MkdirAll(target, 0777)
+		case d.Type().IsRegular():
+			return copyFile(target, path)
+		}
+		return nil // ignore symlinks, sockets, etc.
+	})
+}
+
+// copyFile copies the regular file src to dst, preserving its permissions.
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// compareTrees writes to w a diff of each regular file beneath got
+// that is absent from, or differs from, the corresponding file beneath
+// want, and returns the names of those files relative to the tree roots.
+func compareTrees(w io.Writer, want, got string) ([]string, error) {
+	var differ []string
+	err := filepath.WalkDir(got, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(got, path)
+		if err != nil {
+			return err
+		}
+		new, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		old, err := os.ReadFile(filepath.Join(want, rel))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && (bytes.Equal(old, new) || bytes.Equal(bytes.ReplaceAll(old, crlf, lf), new)) {
+			return nil
+		}
+		differ = append(differ, rel)
+		a := "a/" + filepath.ToSlash(rel)
+		if os.IsNotExist(err) {
+			a = "/dev/null"
+		}
+		unifiedDiff(w, a, "b/"+filepath.ToSlash(rel), old, new)
+		return nil
+	})
+	return differ, err
+}
+
+// crlf and lf are line endings. Files checked out with CRLF line
+// endings, as by git's core.autocrlf on Windows, are up to date if
+// they differ from the generated ones only in their line endings.
+var crlf, lf = []byte("\r\n"), []byte("\n")
+
+// A fileState records the modification time and size of a file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshot returns the state of each regular file beneath dir and the
+// other directories roots, keyed by its name relative to dir (which,
+// for files outside dir, begins with ".."). It skips .git directories.
+func snapshot(dir string, roots ...string) (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	for _, root := range append([]string{dir}, roots...) {
+		err := walkState(dir, root, files)
+		if err != nil && !(root != dir && os.IsNotExist(err)) {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// walkState adds the state of each regular file beneath root to files.
+func walkState(dir, root string, files map[string]fileState) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = fileState{info.ModTime(), info.Size()}
+		return nil
+	})
+}
+
+// changedFiles returns the sorted names of the regular files beneath
+// dir and roots that were created or modified since the snapshot.
+func changedFiles(dir string, before map[string]fileState, roots ...string) ([]string, error) {
+	after, err := snapshot(dir, roots...)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for name, state := range after {
+		if prev, ok := before[name]; !ok || prev != state {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
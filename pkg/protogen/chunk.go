@@ -0,0 +1,173 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// defaultChunkSize is the default maximum number of .proto files
+// compiled by a single protoc run (see Options.ChunkSize).
+const defaultChunkSize = 256
+
+// maxArgBytes is the maximum total length of the .proto file arguments
+// of a single protoc run, which keeps its command line well within the
+// ARG_MAX limit of any platform.
+const maxArgBytes = 64 << 10
+
+// chunkArgs splits the protoc arguments into those of successive
+// protoc runs, each with all of the flags and some of the .proto files:
+// at most size of them (unless size is negative), and at most
+// maxArgBytes. The files of a directory, which usually form a package,
+// are kept in the same run unless they alone exceed the limits; if
+// perDir is set, each directory has its own runs, so that they may run
+// in parallel (see Options.Jobs). Arguments whose outputs describe the
+// entire set of files, such as --descriptor_set_out, are never split.
+func chunkArgs(args []string, size int, perDir bool) [][]string {
+	if size == 0 {
+		size = defaultChunkSize
+	}
+	var flags, files []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") && strings.HasSuffix(arg, ".proto") {
+			files = append(files, arg)
+		} else {
+			flags = append(flags, arg)
+		}
+	}
+	if (size < 0 || len(files) <= size) && argBytes(files) <= maxArgBytes && !perDir || wholeSetOutputs(flags) {
+		return [][]string{args}
+	}
+
+	// Group the files by directory, in order of first appearance.
+	var dirs []string
+	byDir := make(map[string][]string)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if _, ok := byDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], file)
+	}
+
+	full := func(chunk []string, more int, moreBytes int) bool {
+		return len(chunk) > 0 && (size > 0 && len(chunk)+more > size || argBytes(chunk)+moreBytes > maxArgBytes)
+	}
+	var chunks [][]string
+	var chunk []string
+	for _, dir := range dirs {
+		group := byDir[dir]
+		if full(chunk, len(group), argBytes(group)) || perDir && len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+		for _, file := range group {
+			if full(chunk, 1, len(file)+1) {
+				chunks = append(chunks, chunk)
+				chunk = nil
+			}
+			chunk = append(chunk, file)
+		}
+	}
+	chunks = append(chunks, chunk)
+
+	runs := make([][]string, len(chunks))
+	for i, chunk := range chunks {
+		runs[i] = append(append([]string(nil), flags...), chunk...)
+	}
+	return runs
+}
+
+// argBytes returns the length of the arguments on a command line.
+func argBytes(args []string) int {
+	n := 0
+	for _, arg := range args {
+		n += len(arg) + 1
+	}
+	return n
+}
+
+// wholeSetOutputs reports whether the protoc flags request outputs
+// that describe all of the .proto files at once, and would be
+// overwritten by each run if the files were split across runs: a
+// descriptor set, a dependency file, API documentation, or a merged
+// OpenAPI document.
+func wholeSetOutputs(flags []string) bool {
+	for i := 0; i < len(flags); i++ {
+		name, value, ok := flagValue(flags, &i)
+		switch {
+		case !ok:
+		case name == "--descriptor_set_out" || name == "--dependency_out" || name == "--doc_out":
+			return true
+		case strings.HasSuffix(name, "_opt") && strings.Contains(value, "allow_merge"):
+			return true
+		}
+	}
+	return false
+}
+
+// chunkError is the error of a chunked generation in which one or more
+// protoc runs failed. It wraps the error of the first failed run.
+type chunkError struct {
+	failed, runs int
+	first        error
+}
+
+func (e *chunkError) Error() string {
+	return fmt.Sprintf("%d of %d protoc runs failed; first: %v", e.failed, e.runs, e.first)
+}
+
+func (e *chunkError) Unwrap() error { return e.first }
+
+// runName returns a name for a protoc run with the specified arguments,
+// for use in log prefixes: the directory of its first .proto file.
+func runName(args []string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") && strings.HasSuffix(arg, ".proto") {
+			return filepath.ToSlash(filepath.Dir(arg))
+		}
+	}
+	return "protoc"
+}
+
+// A prefixWriter writes each line written to it, prefixed, to w, whose
+// use is serialized by mu, so that the output of concurrent protoc runs
+// is interleaved only a whole line at a time.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// flush writes the final incomplete line, if any.
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.w, "%s%s", p.prefix, line)
+	return err
+}
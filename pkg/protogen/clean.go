@@ -0,0 +1,111 @@
+package protogen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Clean removes the warm containers and toolchain images of the tool,
+// using the runtime of the options, and the cache of local toolchains.
+// It returns the names of the removed images.
+func Clean(ctx context.Context, opts Options) ([]string, error) {
+	if rt, err := findRuntime(opts.Runtime); err == nil {
+		if opts.Stderr == nil {
+			opts.Stderr = os.Stderr
+		}
+		if err := removeWarmContainers(ctx, &opts, rt); err != nil {
+			return nil, err
+		}
+	}
+	removed, err := PruneImages(ctx, opts, 0)
+	if err != nil {
+		return removed, err
+	}
+
+	if cache, err := os.UserCacheDir(); err == nil {
+		cache = filepath.Join(cache, "proto-gen-go")
+		if _, err := os.Stat(cache); err == nil {
+			opts.logf("removing cache %s", cache)
+			if err := os.RemoveAll(cache); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// PruneImages removes the toolchain images built by the tool, except
+// the keep most recent ones, using the runtime of the options. It
+// returns the names of the removed images.
+func PruneImages(ctx context.Context, opts Options, keep int) ([]string, error) {
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	rt, err := findRuntime(opts.Runtime)
+	if err != nil {
+		if opts.Runtime != "" {
+			return nil, err
+		}
+		return nil, nil // no runtime, so no images
+	}
+	return pruneImages(ctx, &opts, rt, keep)
+}
+
+// pruneImages removes the toolchain images, except the keep most recent ones.
+func pruneImages(ctx context.Context, opts *Options, rt *runtime, keep int) ([]string, error) {
+	images, err := listImages(ctx, rt)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) <= keep {
+		return nil, nil
+	}
+	var removed []string
+	for _, image := range images[keep:] {
+		opts.logf("removing image %s", image)
+		cmd := rt.command(ctx, "rmi", image)
+		cmd.Stdout = io.Discard
+		cmd.Stderr = opts.Stderr
+		if err := opts.run(cmd); err != nil {
+			return removed, fmt.Errorf("%s rmi %s: %v", rt.name, image, err)
+		}
+		removed = append(removed, image)
+	}
+	return removed, nil
+}
+
+// listImages returns the references (or, if untagged, the IDs) of the
+// toolchain images built by the tool, most recent first. These are the
+// images with the tool's label, followed by those named proto-gen-go
+// that were built before the label was introduced.
+func listImages(ctx context.Context, rt *runtime) ([]string, error) {
+	var images []string
+	seen := make(map[string]bool) // image IDs
+	for _, filter := range []string{"label=" + imageLabel, "reference=" + imageName} {
+		cmd := rt.command(ctx, "image", "ls", "--filter", filter, "--format={{.ID}} {{.Repository}}:{{.Tag}}")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s image ls: %v: %s", rt.name, err, strings.TrimSpace(stderr.String()))
+		}
+		// Runtimes list images most recent first.
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			id, ref, ok := strings.Cut(line, " ")
+			if !ok || seen[id] {
+				continue
+			}
+			seen[id] = true
+			if strings.Contains(ref, "<none>") {
+				ref = id
+			}
+			images = append(images, ref)
+		}
+	}
+	return images, nil
+}
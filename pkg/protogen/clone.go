@@ -0,0 +1,428 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runtimeImports are the import paths, by name, of the packages to
+// which the generated methods may refer, other than those of the
+// generated file: the proto package of the Go protobuf runtime, whose
+// Clone and Merge copy the messages of other packages, and those of
+// the field mask, redaction and fake helpers and of the tests.
+var runtimeImports = map[string]string{
+	"proto":       "google.golang.org/protobuf/proto",
+	"fieldmaskpb": "google.golang.org/protobuf/types/known/fieldmaskpb",
+	"fmt":         "fmt",
+	"strings":     "strings",
+	"sha256":      "crypto/sha256",
+	"hex":         "encoding/hex",
+	"strconv":     "strconv",
+	"protojson":   "google.golang.org/protobuf/encoding/protojson",
+	"prototext":   "google.golang.org/protobuf/encoding/prototext",
+	"testing":     "testing",
+	"os":          "os",
+	"filepath":    "path/filepath",
+}
+
+// writeClones writes, if Config.Clone is set, the Clone and CopyInto
+// methods of the messages of the generated files, named relative to the
+// host directory dir, which stands in for opts.Dir, and returns the
+// names of those it created or modified.
+func writeClones(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Clone {
+		return nil, nil
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") {
+			continue
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		clones, skipped, err := cloneFile(file, src)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range skipped {
+			opts.logf("clone: skipping %s of %s, which has a field or method named Clone or CopyInto", msg, file)
+		}
+		if clones == nil {
+			continue // no messages
+		}
+		name := strings.TrimSuffix(file, ".pb.go") + "_clone.go"
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, clones) {
+			continue
+		}
+		if err := os.WriteFile(filename, clones, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// A cloner writes the Clone and CopyInto methods of the messages of a
+// Go file generated by protoc-gen-go.
+type cloner struct {
+	fset     *token.FileSet
+	file     *ast.File
+	pkg      string                     // package of the generated file (default: that of file)
+	messages map[string]bool            // struct types with a protoimpl.MessageState
+	oneofs   map[string][]*ast.TypeSpec // wrapper types by the name of the interface of their oneof
+	methods  map[string]bool            // methods of the types of the file, as T.M
+	imports  map[string]string          // import paths of the file by name
+	used     map[string]bool            // packages referred to by the methods
+	w        bytes.Buffer
+}
+
+// cloneFile returns the source of the Clone and CopyInto methods of
+// the messages of the Go file generated by protoc-gen-go, or nil if it
+// has none, and the messages skipped, for which the methods would
+// conflict with their fields or methods.
+func cloneFile(name string, src []byte) ([]byte, []string, error) {
+	c, err := newCloner(name, src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("clone: %v", err)
+	}
+	var skipped []string
+	for _, ts := range c.messageSpecs() {
+		msg := ts.Name.Name
+		st := ts.Type.(*ast.StructType)
+		if c.cloneConflict(msg, st) {
+			skipped = append(skipped, msg)
+			continue
+		}
+		c.writeMessage(msg, st)
+	}
+	if c.w.Len() == 0 {
+		return nil, skipped, nil
+	}
+	out, err := c.source(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("clone of %s: %v", name, err)
+	}
+	return out, skipped, nil
+}
+
+// newCloner parses the Go file generated by protoc-gen-go.
+func newCloner(name string, src []byte) (*cloner, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	c := &cloner{
+		fset:     fset,
+		file:     f,
+		pkg:      f.Name.Name,
+		messages: make(map[string]bool),
+		oneofs:   make(map[string][]*ast.TypeSpec),
+		methods:  make(map[string]bool),
+		imports:  make(map[string]string),
+		used:     make(map[string]bool),
+	}
+	for _, imp := range f.Imports {
+		p, _ := strconv.Unquote(imp.Path.Value)
+		if imp.Name != nil {
+			c.imports[imp.Name.Name] = p
+		} else {
+			c.imports[path.Base(p)] = p
+		}
+	}
+
+	// Find the messages, the wrapper types of the fields of their
+	// oneofs (whose interfaces have a single method of the same
+	// name), and the methods of each type.
+	specs := make(map[string]*ast.TypeSpec)
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.GenDecl:
+			if decl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				ts := spec.(*ast.TypeSpec)
+				specs[ts.Name.Name] = ts
+				if st, ok := ts.Type.(*ast.StructType); ok && hasMessageState(st) {
+					c.messages[ts.Name.Name] = true
+				}
+			}
+		case *ast.FuncDecl:
+			if decl.Recv == nil || len(decl.Recv.List) != 1 {
+				continue
+			}
+			recv := decl.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			if id, ok := recv.(*ast.Ident); ok {
+				c.methods[id.Name+"."+decl.Name.Name] = true
+				if strings.HasPrefix(decl.Name.Name, "is") {
+					if ts := specs[id.Name]; ts != nil {
+						c.oneofs[decl.Name.Name] = append(c.oneofs[decl.Name.Name], ts)
+					}
+				}
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// messageSpecs returns the type specs of the messages of the file, in
+// the order of declaration.
+func (c *cloner) messageSpecs() []*ast.TypeSpec {
+	var specs []*ast.TypeSpec
+	for _, decl := range c.file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			if ts := spec.(*ast.TypeSpec); c.messages[ts.Name.Name] {
+				specs = append(specs, ts)
+			}
+		}
+	}
+	return specs
+}
+
+// source returns the formatted Go file, generated from that of the
+// name, of the declarations written to c.w, with the imports they use.
+func (c *cloner) source(name string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by proto-gen-go from %s. DO NOT EDIT.\n\n", filepath.Base(name))
+	fmt.Fprintf(&buf, "package %s\n", c.pkg)
+	var names []string
+	for name := range c.used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		buf.WriteString("\nimport (\n")
+		for _, name := range names {
+			p := c.imports[name]
+			if p == "" {
+				p = runtimeImports[name]
+			}
+			fmt.Fprintf(&buf, "\t%s %q\n", name, p)
+		}
+		buf.WriteString(")\n")
+	}
+	buf.Write(c.w.Bytes())
+	return format.Source(buf.Bytes())
+}
+
+// cloneConflict reports whether the Clone and CopyInto methods of the
+// message would conflict with its fields or methods.
+func (c *cloner) cloneConflict(msg string, st *ast.StructType) bool {
+	return c.methods[msg+".Clone"] || c.methods[msg+".CopyInto"] || hasField(st, "Clone") || hasField(st, "CopyInto")
+}
+
+// hasMessageState reports whether the struct has the protoimpl.MessageState
+// field of a generated message.
+func hasMessageState(st *ast.StructType) bool {
+	for _, field := range st.Fields.List {
+		if sel, ok := field.Type.(*ast.SelectorExpr); ok && sel.Sel.Name == "MessageState" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasField reports whether the struct has a field of the name.
+func hasField(st *ast.StructType, name string) bool {
+	for _, field := range st.Fields.List {
+		for _, id := range field.Names {
+			if id.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeMessage writes the Clone and CopyInto methods of the message.
+// A message with internal fields other than those of every message,
+// such as the extensions of a proto2 message, is copied by proto.Merge.
+func (c *cloner) writeMessage(msg string, st *ast.StructType) {
+	fmt.Fprintf(&c.w, `
+// Clone returns a deep copy of x.
+func (x *%[1]s) Clone() *%[1]s {
+	if x == nil {
+		return nil
+	}
+	dst := new(%[1]s)
+	x.CopyInto(dst)
+	return dst
+}
+
+// CopyInto sets dst to a deep copy of x, or resets it if x is nil.
+func (x *%[1]s) CopyInto(dst *%[1]s) {
+	if dst == x {
+		return
+	}
+	dst.Reset()
+	if x == nil {
+		return
+	}
+`, msg)
+	var body bytes.Buffer
+	for _, field := range st.Fields.List {
+		for _, id := range field.Names {
+			switch {
+			case id.Name == "state" || id.Name == "sizeCache":
+			case id.Name == "unknownFields":
+				body.WriteString("\tif x.unknownFields != nil {\n\t\tdst.unknownFields = append(x.unknownFields[:0:0], x.unknownFields...)\n\t}\n")
+			case !id.IsExported():
+				c.used["proto"] = true
+				c.w.WriteString("\tproto.Merge(dst, x)\n}\n")
+				return
+			default:
+				c.copyField(&body, "dst."+id.Name, "x."+id.Name, field, 0)
+			}
+		}
+	}
+	c.w.Write(body.Bytes())
+	c.w.WriteString("}\n")
+}
+
+// copyField writes the statements that set dst to a deep copy of src,
+// a field, or an element of one, of the type of the struct field.
+func (c *cloner) copyField(w *bytes.Buffer, dst, src string, field *ast.Field, depth int) {
+	if id, ok := field.Type.(*ast.Ident); ok && c.oneofs[id.Name] != nil {
+		c.copyOneof(w, dst, src, id.Name, depth)
+		return
+	}
+	c.copyValue(w, dst, src, field.Type, wireType(field), depth)
+}
+
+// wireType returns the wire type of the protobuf struct tag of the
+// field, e.g. "bytes" or "varint", which tells messages from enums.
+func wireType(field *ast.Field) string {
+	if field.Tag == nil {
+		return ""
+	}
+	tag, _ := strconv.Unquote(field.Tag.Value)
+	wire, _, _ := strings.Cut(reflect.StructTag(tag).Get("protobuf"), ",")
+	return wire
+}
+
+// copyOneof writes the statements that set dst to a deep copy of src, a
+// oneof field of the interface type iface.
+func (c *cloner) copyOneof(w *bytes.Buffer, dst, src, iface string, depth int) {
+	v := fmt.Sprintf("v%d", depth)
+	fmt.Fprintf(w, "\tswitch %s := %s.(type) {\n", v, src)
+	for _, ts := range c.oneofs[iface] {
+		st, ok := ts.Type.(*ast.StructType)
+		if !ok || len(st.Fields.List) != 1 || len(st.Fields.List[0].Names) != 1 {
+			continue
+		}
+		field := st.Fields.List[0]
+		name := field.Names[0].Name
+		fmt.Fprintf(w, "\tcase *%s:\n\t\twrapper := new(%s)\n", ts.Name.Name, ts.Name.Name)
+		c.copyValue(w, "wrapper."+name, v+"."+name, field.Type, wireType(field), depth+1)
+		fmt.Fprintf(w, "\t\t%s = wrapper\n", dst)
+	}
+	w.WriteString("\t}\n")
+}
+
+// copyValue writes the statements that set dst to a deep copy of src,
+// of the type, whose elements have the wire type.
+func (c *cloner) copyValue(w *bytes.Buffer, dst, src string, typ ast.Expr, wire string, depth int) {
+	switch t := typ.(type) {
+	case *ast.StarExpr:
+		switch elem := t.X.(type) {
+		case *ast.Ident:
+			if c.messages[elem.Name] || wire == "bytes" && !predeclaredTypes[elem.Name] {
+				fmt.Fprintf(w, "\t%s = %s.Clone()\n", dst, src)
+				return
+			}
+		case *ast.SelectorExpr:
+			if wire == "bytes" {
+				// A message of another package, which may lack Clone.
+				c.used["proto"] = true
+				c.qualify(t)
+				fmt.Fprintf(w, "\tif %s != nil {\n\t\t%s = proto.Clone(%s).(%s)\n\t}\n", src, dst, src, c.typeString(t))
+				return
+			}
+		}
+		// An optional scalar or enum of proto2.
+		v := fmt.Sprintf("v%d", depth)
+		fmt.Fprintf(w, "\tif %s != nil {\n\t\t%s := *%s\n\t\t%s = &%s\n\t}\n", src, v, src, dst, v)
+
+	case *ast.ArrayType:
+		if scalarType(t.Elt) {
+			fmt.Fprintf(w, "\tif %s != nil {\n\t\t%s = append(%s[:0:0], %s...)\n\t}\n", src, dst, src, src)
+			return
+		}
+		c.qualify(t)
+		i, v := fmt.Sprintf("i%d", depth), fmt.Sprintf("v%d", depth)
+		fmt.Fprintf(w, "\tif %s != nil {\n\t\t%s = make(%s, len(%s))\n\t\tfor %s, %s := range %s {\n", src, dst, c.typeString(t), src, i, v, src)
+		c.copyValue(w, dst+"["+i+"]", v, t.Elt, wire, depth+1)
+		w.WriteString("\t\t}\n\t}\n")
+
+	case *ast.MapType:
+		c.qualify(t)
+		k, v, m := fmt.Sprintf("k%d", depth), fmt.Sprintf("v%d", depth), fmt.Sprintf("m%d", depth)
+		fmt.Fprintf(w, "\tif %s != nil {\n\t\t%s := make(%s, len(%s))\n\t\tfor %s, %s := range %s {\n", src, m, c.typeString(t), src, k, v, src)
+		if scalarType(t.Value) {
+			fmt.Fprintf(w, "\t\t%s[%s] = %s\n", m, k, v)
+		} else {
+			// The wire type of the tag is that of the map; its
+			// values are messages or bytes.
+			c.copyValue(w, m+"["+k+"]", v, t.Value, "bytes", depth+1)
+		}
+		fmt.Fprintf(w, "\t\t}\n\t\t%s = %s\n\t}\n", dst, m)
+
+	default: // scalars, strings and enums
+		fmt.Fprintf(w, "\t%s = %s\n", dst, src)
+	}
+}
+
+// scalarType reports whether values of the type are copied by assignment:
+// whether it is neither a pointer, a slice nor a map.
+func scalarType(t ast.Expr) bool {
+	switch t.(type) {
+	case *ast.StarExpr, *ast.ArrayType, *ast.MapType:
+		return false
+	}
+	return true
+}
+
+// qualify records the packages to which the type expression, which is
+// to be printed, refers.
+func (c *cloner) qualify(t ast.Expr) {
+	ast.Inspect(t, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && c.imports[x.Name] != "" {
+				c.used[x.Name] = true
+			}
+			return false
+		}
+		return true
+	})
+}
+
+// typeString returns the source of the type expression.
+func (c *cloner) typeString(t ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, c.fset, t)
+	return buf.String()
+}
@@ -0,0 +1,86 @@
+package protogen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// cloneTestMessage is a file of protoc-gen-go, reduced to a message
+// whose runtime types are stubbed.
+const cloneTestMessage = `package msg
+
+import protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+
+type Msg struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name string   ` + "`protobuf:\"bytes,1,opt,name=name,proto3\" json:\"name,omitempty\"`" + `
+	Tags []string ` + "`protobuf:\"bytes,2,rep,name=tags,proto3\" json:\"tags,omitempty\"`" + `
+}
+
+func (x *Msg) Reset() { *x = Msg{} }
+`
+
+// TestCloneCopyIntoSelf checks that the generated CopyInto leaves a
+// message copied into itself intact, and resets dst if x is nil.
+func TestCloneCopyIntoSelf(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs a program")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+	clone, _, err := cloneFile("msg.pb.go", []byte(cloneTestMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":                         "module example.com/m\n\ngo 1.19\n\nrequire google.golang.org/protobuf v1.28.1\n\nreplace google.golang.org/protobuf => ./stub\n",
+		"stub/go.mod":                    "module google.golang.org/protobuf\n\ngo 1.19\n",
+		"stub/runtime/protoimpl/impl.go": "package protoimpl\n\ntype (\n\tMessageState  struct{}\n\tSizeCache     int32\n\tUnknownFields []byte\n)\n",
+		"msg/msg.pb.go":                  cloneTestMessage,
+		"msg/msg_clone.go":               string(clone),
+		"main.go": `package main
+
+import (
+	"fmt"
+
+	"example.com/m/msg"
+)
+
+func main() {
+	x := &msg.Msg{Name: "a", Tags: []string{"b"}}
+	x.CopyInto(x)
+	dst := &msg.Msg{Name: "c"}
+	(*msg.Msg)(nil).CopyInto(dst)
+	fmt.Print(x.Name, len(x.Tags), dst.Name == "")
+}
+`,
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(goTool, "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOWORK=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run: %v\n%s\n%s", err, out, clone)
+	}
+	if got, want := string(out), "a1 true"; got != want {
+		t.Errorf("got %q (name, number of tags, dst reset), want %q", got, want)
+	}
+}
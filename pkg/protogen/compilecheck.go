@@ -0,0 +1,130 @@
+package protogen
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// compileCheck builds the Go packages of the generated files, named
+// relative to opts.Dir, with the Go toolchain of the environment and
+// the module versions required by the go.mod file of opts.Dir or its
+// ancestors, so that generated code that does not compile against the
+// module's google.golang.org/protobuf runtime (say, because the plugin
+// is newer than the runtime) is caught before it is committed.
+//
+// In a container, the host's module cache is mounted read-only and the
+// module proxy disabled, so the build uses exactly the modules required
+// by go.mod and go.sum, as downloaded on the host.
+func (e *env) compileCheck(ctx context.Context, opts *Options, files []string) error {
+	modFile, err := findGoMod(opts.Dir)
+	if err != nil {
+		return err
+	}
+	if modFile == "" {
+		return fmt.Errorf("compile check: no go.mod file in %s or its ancestors", opts.Dir)
+	}
+	root := filepath.Dir(modFile)
+	seen := make(map[string]bool)
+	var pkgs []string
+	for _, file := range files {
+		if filepath.Ext(file) != ".go" {
+			continue
+		}
+		pkg := filepath.Dir(filepath.Join(opts.Dir, file))
+		if !seen[pkg] && within(pkg, root) {
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	if len(pkgs) == 0 {
+		return nil
+	}
+	sort.Strings(pkgs)
+	args := append([]string{"build"}, pkgs...)
+	opts.logf("go %s", joinArgs(args, opts.Dir))
+
+	if e.local != nil {
+		err = e.local.run(ctx, opts, opts.Dir, opts.Dir, "go", args)
+	} else {
+		var flags, extra []string
+		if e.rt.user != "" {
+			flags = append(flags, "--user", e.rt.user)
+		}
+		flags = append(flags, "-w", opts.Dir, "-e", "GOCACHE=/tmp/go-build", "-e", "GOFLAGS=-mod=readonly")
+		if root != opts.Dir {
+			extra = append(extra, root)
+		}
+		if modCache := hostModCache(ctx); modCache != "" && !e.rt.remote {
+			flags = append(flags, "-e", "GOMODCACHE="+modCache, "-e", "GOPROXY=off")
+			extra = append(extra, modCache)
+		}
+		flags = append(flags, "--entrypoint=go", e.image)
+		err = e.runContainer(ctx, opts, opts.Dir, append(flags, args...), extra, opts.Stderr, opts.Stderr)
+	}
+	if err != nil {
+		hint := ""
+		if runtime := goModRequire(modFile, "google.golang.org/protobuf"); runtime != "" && opts.hasPlugin("go") {
+			gen := knownPlugins["go"].Version
+			if p, err := opts.bufPlugin("go"); err == nil && p.Version != "" {
+				gen = p.Version
+			}
+			hint = fmt.Sprintf(" (the code was generated by protoc-gen-go %s; %s requires google.golang.org/protobuf %s)", gen, modFile, runtime)
+		}
+		return fmt.Errorf("compile check failed: %v%s", err, hint)
+	}
+	return nil
+}
+
+// findGoMod returns the name of the go.mod file of dir or its nearest
+// ancestor, or "" if there is none.
+func findGoMod(dir string) (string, error) {
+	for {
+		filename := filepath.Join(dir, "go.mod")
+		if _, err := os.Stat(filename); err == nil {
+			return filename, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// goModRequire returns the version of the module path required by the
+// named go.mod file, or "" if none.
+func goModRequire(modFile, path string) string {
+	data, err := os.ReadFile(modFile)
+	if err != nil {
+		return ""
+	}
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) > 0 && fields[0] == "require" {
+			fields = fields[1:]
+		}
+		if len(fields) >= 2 && fields[0] == path {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// hostModCache returns the host's Go module cache, or "" if there is no
+// go command.
+func hostModCache(ctx context.Context) string {
+	out, err := exec.CommandContext(ctx, "go", "env", "GOMODCACHE").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,1133 @@
+package protogen
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the name of the optional project configuration file.
+// It is found by searching the working directory and its ancestors.
+const ConfigFile = ".proto-gen-go.yaml"
+
+// A Config describes the toolchain and default protoc flags of a project.
+//
+// Example:
+//
+//	protoc: "29.3"
+//	plugins:
+//	  - name: go
+//	  - name: grpc
+//	    version: v1.2.0
+//	flags:
+//	  - --proto_path=$PWD
+//	  - --go_opt=paths=source_relative
+type Config struct {
+	Protoc  string   `yaml:"protoc"`  // protoc release version, e.g. "29.3" or "3.19.6"
+	Plugins []Plugin `yaml:"plugins"` // plugins to install in the image
+	Flags   []string `yaml:"flags"`   // protoc flags, preceding those of the command line
+
+	// Inherit makes the config extend that of the nearest config file
+	// in an ancestor directory (see inheritFrom), so that a subtree may
+	// override settings of the repository's, such as its plugins.
+	Inherit bool `yaml:"inherit"`
+
+	// Langs names language profiles (see langProfiles), such as go,
+	// java or ts, whose plugins are installed in addition to Plugins.
+	Langs []string `yaml:"langs"`
+
+	// ProtocSHA256 maps each platform (e.g. "linux-x86_64", "osx-aarch_64")
+	// to the SHA256 checksum of the protoc release archive for that platform,
+	// against which downloads are verified. It is needed only for versions
+	// whose checksums are not embedded in the tool (see protoc.sum), and
+	// is required for such versions to download protoc for local use.
+	ProtocSHA256 map[string]string `yaml:"protoc_sha256"`
+
+	// Googleapis is the full commit hash of the github.com/googleapis/googleapis
+	// repository whose common .proto files (see googleapisDirs), such as
+	// google/api/annotations.proto, are installed in protoc's include
+	// directory, so that they may be imported. If empty, they are not installed.
+	Googleapis string `yaml:"googleapis"`
+
+	// Exclude lists the slash-separated patterns (relative to the working
+	// directory, and in which ** matches any number of directories) of
+	// the files and directories, such as "api/legacy/**", that .proto
+	// file patterns and Options.Recursive do not match. Directories whose
+	// names begin with a dot, node_modules and vendor directories, and
+	// VendorDir are always excluded.
+	Exclude []string `yaml:"exclude"`
+
+	// Header is a text/template for a header, such as a license or
+	// copyright notice, prepended as a comment to each generated file
+	// in a language with line comments. It may refer to {{.Year}} and
+	// {{.Version}}, that of proto-gen-go (see headerData).
+	Header string `yaml:"header"`
+
+	// Provenance, if set, appends to each generated file (in a language
+	// with line comments) a comment recording the versions of
+	// proto-gen-go, protoc and the plugins, and the SHA256 of the .proto
+	// file from which it was generated.
+	Provenance bool `yaml:"provenance"`
+
+	// Tags adds struct tags to the fields of the generated Go messages.
+	Tags TagsConfig `yaml:"tags"`
+
+	// Mocks generates gomock mocks of the generated service interfaces.
+	Mocks MocksConfig `yaml:"mocks"`
+
+	// Enums generates parsing and marshaling helpers of the generated Go enums.
+	Enums EnumsConfig `yaml:"enums"`
+
+	// Clone adds typed Clone and CopyInto methods, which make deep
+	// copies, to the generated Go messages.
+	Clone bool `yaml:"clone"`
+
+	// FieldMasks adds, to the generated Go messages, an ApplyFieldMask
+	// method, which applies the update of a google.protobuf.FieldMask,
+	// and constants of the paths of their fields. It requires Clone.
+	FieldMasks bool `yaml:"field_masks"`
+
+	// Services generates constants of the names and paths of the
+	// services of the compiled .proto files and their methods.
+	Services ServicesConfig `yaml:"services"`
+
+	// Redact adds Redact and LogSafe methods, which clear or hash
+	// sensitive fields, to the generated Go messages.
+	Redact RedactConfig `yaml:"redact"`
+
+	// Fakes generates constructors of fake messages for tests.
+	Fakes FakesConfig `yaml:"fakes"`
+
+	// Fuzz generates fuzz targets of round trips of the generated Go
+	// messages through their encodings.
+	Fuzz FuzzConfig `yaml:"fuzz"`
+
+	// Bench generates benchmarks of the encoding of the generated Go
+	// messages, with their fakes. It requires Fakes.
+	Bench bool `yaml:"bench"`
+
+	// Golden generates tests of the wire compatibility of the generated
+	// Go messages with golden files of their fakes. It requires Fakes.
+	Golden bool `yaml:"golden"`
+
+	// Scaffold writes skeleton servers of the Twirp, gRPC and Connect
+	// services that have none, a main package that serves them and a
+	// package of their clients, to be edited by hand.
+	Scaffold ScaffoldConfig `yaml:"scaffold"`
+
+	Deps      []ProtoDep `yaml:"deps"`       // third-party .proto files, vendored by VendorProtos
+	VendorDir string     `yaml:"vendor_dir"` // destination of Deps, relative to the working directory (default: "third_party/proto")
+
+	// UpdateCheck makes the tool check, at most once a day, for a newer
+	// release than the running one, and print how to update to it.
+	UpdateCheck bool `yaml:"update_check"`
+
+	// KeepImages is the number of the most recently built toolchain images
+	// to retain when a new one is built; older ones are removed. Zero
+	// means defaultKeepImages, and a negative number, all of them.
+	KeepImages int `yaml:"keep_images"`
+
+	Private PrivateConfig `yaml:"private"` // access to the private modules of Go plugins
+
+	// CACerts lists PEM files of additional CA certificates, such as that
+	// of a TLS-intercepting corporate proxy, that the image trusts, both
+	// while it is built and when it runs. Relative names are relative to
+	// the directory of the config file.
+	CACerts []string `yaml:"ca_certs"`
+
+	// BaseImage is the image from which the toolchain image is built
+	// (default: baseImage, from Registry.Mirror if set), such as a copy
+	// of it in an internal registry. It must be a Debian image with Go,
+	// git and curl, as the golang images are.
+	BaseImage string `yaml:"base_image"`
+
+	Registry RegistryConfig `yaml:"registry"` // access to private registries and Docker Hub mirrors
+	Verify   VerifyConfig   `yaml:"verify"`   // cosign verification of the prebuilt -image
+
+	// CustomDockerfile names a Dockerfile that replaces the one that the
+	// tool generates from the config, if it has a FROM instruction, or
+	// else extends it, its instructions being appended. A relative name
+	// is relative to the directory of the config file.
+	CustomDockerfile string `yaml:"dockerfile"`
+
+	Node  string      `yaml:"node"`  // Node.js version, for npm plugins (default: defaultNodeVersion)
+	Swift string      `yaml:"swift"` // Swift version, for Swift plugins (default: defaultSwiftVersion)
+	Buf   string      `yaml:"buf"`   // buf version, for lint and breaking (default: defaultBufVersion)
+	Docs  DocsConfig  `yaml:"docs"`  // API documentation generated by protoc-gen-doc
+	Embed EmbedConfig `yaml:"embed"` // Go package embedding the FileDescriptorSet
+
+	// JSONSchema generates JSON Schemas of the messages with protoc-gen-jsonschema.
+	JSONSchema JSONSchemaConfig `yaml:"jsonschema"`
+
+	// OpenAPI generates OpenAPI v3 documents of the annotated services with protoc-gen-openapi.
+	OpenAPI OpenAPIConfig `yaml:"openapi"`
+
+	// Web generates JavaScript messages and gRPC-Web clients for browsers.
+	Web WebConfig `yaml:"web"`
+
+	// Templates are files generated from the descriptors of the .proto
+	// files by Go text/templates.
+	Templates []TemplateConfig `yaml:"templates"`
+
+	// GoPackage maps .proto files to Go packages and checks their go_package options.
+	GoPackage GoPackageConfig `yaml:"go_package"`
+
+	// GoModule generates the Go code into a standalone Go module.
+	GoModule GoModuleConfig `yaml:"go_module"`
+
+	// Publish commits the generated code to a downstream repository.
+	Publish PublishConfig `yaml:"publish"`
+
+	// Hooks are commands that run on the host before and after generation.
+	Hooks HooksConfig `yaml:"hooks"`
+
+	// Roots, if set, make the config that of a workspace of proto roots,
+	// each with its own directory, arguments and plugins, which a single
+	// run of the generate command, without protoc arguments, processes
+	// (see RunWorkspace).
+	Roots []WorkspaceRoot `yaml:"roots"`
+
+	Lint     LintConfig     `yaml:"lint"`     // buf lint step preceding generation
+	Breaking BreakingConfig `yaml:"breaking"` // buf breaking step preceding generation
+
+	// Lock, if non-nil, pins the toolchain's artifacts to the digests
+	// it records. LoadConfig reads it from the ToolchainLockFile beside
+	// the config file, and LockToolchain creates it.
+	Lock *ToolchainLock `yaml:"-"`
+
+	// Filename is the name of the config file, if any, from which
+	// LoadConfig read the config.
+	Filename string `yaml:"-"`
+}
+
+// A DocsConfig configures the generation of API documentation for the
+// .proto files by the doc plugin (protoc-gen-doc), which is installed,
+// and whose --doc_out and --doc_opt flags are added, if Out is set.
+type DocsConfig struct {
+	Out    string `yaml:"out"`    // documentation file, relative to the working directory, e.g. "docs/api.md"
+	Format string `yaml:"format"` // markdown, html, json or docbook (default: by Out's extension)
+}
+
+// An EmbedConfig configures the generation, if Out is set, of a Go
+// file that embeds the FileDescriptorSet of the .proto files (and their
+// imports), with functions to decode it and, if Reflection is set, to
+// register it with a gRPC server for server reflection. It adds the
+// --include_imports and --descriptor_set_out flags, so it may not be
+// combined with another --descriptor_set_out.
+type EmbedConfig struct {
+	Out        string `yaml:"out"`        // directory of the Go package, relative to the working directory, e.g. "api"
+	Package    string `yaml:"package"`    // name of the Go package (default: the base name of Out)
+	Reflection bool   `yaml:"reflection"` // add RegisterReflection, which requires google.golang.org/grpc
+}
+
+// A GoPackageConfig configures the Go packages of the .proto files.
+// Map gives the Go import paths of .proto files, or of the .proto files
+// directly within directories, named relative to the import directories
+// (e.g. "acme/billing/v1": "github.com/acme/api/billing/v1"), which are
+// passed as the M options of the Go plugins (--go_opt=Mfile=path), and
+// take precedence over the files' go_package options. If Check is set,
+// every .proto file to be compiled must have an import path, either by
+// Map or its go_package option, within the module of the go.mod file of
+// the working directory or its ancestors, if any.
+type GoPackageConfig struct {
+	Check bool              `yaml:"check"`
+	Map   map[string]string `yaml:"map"`
+}
+
+// A JSONSchemaConfig configures the generation of a JSON Schema for each
+// message by the jsonschema plugin (protoc-gen-jsonschema), which is
+// installed, and whose --jsonschema_out and --jsonschema_opt flags are
+// added, if Out is set. The plugin writes draft-04 schemas; for a later
+// draft, the tool rewrites their $schema, the keywords they use having
+// the same meaning in drafts 06 and 07.
+type JSONSchemaConfig struct {
+	Out   string `yaml:"out"`   // directory of the schemas, relative to the working directory, e.g. "schemas"
+	Draft string `yaml:"draft"` // draft-04, draft-06 or draft-07 (default: draft-04)
+	Opt   string `yaml:"opt"`   // plugin options, e.g. "json_fieldnames,disallow_additional_properties"
+}
+
+// An OpenAPIConfig configures the generation of an OpenAPI v3 document
+// of the services, with google.api.http annotations, by the openapi
+// plugin (protoc-gen-openapi of gnostic), which is installed, and whose
+// --openapi_out and --openapi_opt flags are added, if Out is set. The
+// plugin merges the services of all the .proto files of a run into a
+// single openapi.yaml in Out, unless PerFile is set.
+type OpenAPIConfig struct {
+	Out     string `yaml:"out"`      // directory of openapi.yaml, relative to the working directory, e.g. "api"
+	PerFile bool   `yaml:"per_file"` // write a document for each .proto file, rather than merging them
+	Title   string `yaml:"title"`    // title of the document (default: the service's name, if only one)
+	Version string `yaml:"version"`  // version of the API described by the document
+	Opt     string `yaml:"opt"`      // further plugin options, e.g. "naming=proto,enum_type=string"
+}
+
+// A WebConfig configures the generation, if Out is set, of JavaScript
+// messages and gRPC-Web clients of the services, for browsers, by the
+// js plugin (protoc-gen-js of protobuf-javascript, which protoc no
+// longer includes) and the grpc-web plugin (protoc-gen-grpc-web), which
+// are installed from npm, and whose --js_out and --grpc-web_out flags
+// are added.
+type WebConfig struct {
+	Out         string `yaml:"out"`          // directory of the JavaScript files, relative to the working directory, e.g. "web/src/gen"
+	ImportStyle string `yaml:"import_style"` // closure, commonjs, commonjs+dts or typescript (default: commonjs)
+	Mode        string `yaml:"mode"`         // grpcwebtext or grpcweb (default: grpcwebtext)
+}
+
+// webImportStyles maps the import styles of protoc-gen-grpc-web to the
+// corresponding import styles of protoc-gen-js.
+var webImportStyles = map[string]string{
+	"closure":      "closure",
+	"commonjs":     "commonjs",
+	"commonjs+dts": "commonjs",
+	"typescript":   "commonjs",
+}
+
+// jsonSchemaDrafts maps the JSON Schema drafts to their meta-schemas.
+var jsonSchemaDrafts = map[string]string{
+	"draft-04": "http://json-schema.org/draft-04/schema#",
+	"draft-06": "http://json-schema.org/draft-06/schema#",
+	"draft-07": "http://json-schema.org/draft-07/schema#",
+}
+
+// docFormats maps the extensions of documentation files to their formats.
+var docFormats = map[string]string{".md": "markdown", ".html": "html", ".json": "json", ".xml": "docbook"}
+
+// A LintConfig configures the step that runs 'buf lint' on the .proto files
+// before generation, failing generation on lint errors. Buf reads its
+// rules from the buf.yaml file, if any, in the first import directory.
+type LintConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// A BreakingConfig configures the step that runs 'buf breaking' to compare
+// the .proto files beneath the first import directory with those of a
+// git revision, failing generation on breaking changes.
+type BreakingConfig struct {
+	Against string `yaml:"against"` // git revision of the baseline, e.g. "origin/main"
+}
+
+// A PrivateConfig configures access to private Go modules, such as
+// plugins in private repositories, when installing the Go plugins and
+// tools in the image (or, with Options.Local, on the host, where the
+// host's git configuration and credentials apply as usual).
+//
+// Credentials are never stored in the image: the host's SSH agent and
+// netrc file are made available only to the build steps that download
+// modules, as BuildKit secrets.
+type PrivateConfig struct {
+	// GoPrivate is the GOPRIVATE list of module path patterns, such as
+	// "github.com/acme/*", that are fetched directly from their
+	// repositories, without the module proxy or checksum database.
+	GoPrivate string `yaml:"goprivate"`
+
+	// SSH forwards the host's SSH agent (SSH_AUTH_SOCK) to the build,
+	// and, unless InsteadOf is set, makes git fetch the repositories of
+	// the hosts of the GoPrivate patterns by SSH instead of HTTPS. The
+	// build trusts those hosts' keys on first use.
+	SSH bool `yaml:"ssh"`
+
+	// Netrc makes the host's netrc file ($NETRC, or ~/.netrc), which
+	// holds HTTPS credentials, available to the build.
+	Netrc bool `yaml:"netrc"`
+
+	// InsteadOf maps URL prefixes to those that git should use instead,
+	// as by 'git config url.<value>.insteadOf <key>', for example
+	// "https://github.com/": "ssh://git@github.com/".
+	InsteadOf map[string]string `yaml:"insteadof"`
+}
+
+// gitRewrite is a git URL rewrite: git fetches URLs beginning with
+// From from those beginning with To instead.
+type gitRewrite struct{ From, To string }
+
+// rewrites returns the git URL rewrites of the config, in order.
+func (pc *PrivateConfig) rewrites() []gitRewrite {
+	var rewrites []gitRewrite
+	if len(pc.InsteadOf) > 0 {
+		for from, to := range pc.InsteadOf {
+			rewrites = append(rewrites, gitRewrite{from, to})
+		}
+	} else if pc.SSH {
+		seen := make(map[string]bool)
+		for _, pattern := range strings.Split(pc.GoPrivate, ",") {
+			host, _, _ := strings.Cut(strings.TrimSpace(pattern), "/")
+			if host == "" || strings.ContainsAny(host, "*?[") || seen[host] {
+				continue
+			}
+			seen[host] = true
+			rewrites = append(rewrites, gitRewrite{"https://" + host + "/", "ssh://git@" + host + "/"})
+		}
+	}
+	sort.Slice(rewrites, func(i, j int) bool { return rewrites[i].From < rewrites[j].From })
+	return rewrites
+}
+
+// goCacheMounts are the RUN --mount flags, each followed by a space, of
+// the build steps that download modules, that keep the module and build
+// caches of the go command in BuildKit cache mounts, which outlive the
+// build, so that a change to one plugin's version does not download and
+// compile the modules of all the others anew.
+const goCacheMounts = "--mount=type=cache,id=proto-gen-go-gomodcache,target=/go/pkg/mod " +
+	"--mount=type=cache,id=proto-gen-go-gocache,target=/root/.cache/go-build "
+
+// mounts returns the RUN --mount flags, each followed by a space, of
+// the build steps that download modules.
+func (pc *PrivateConfig) mounts() string {
+	var mounts string
+	if pc.SSH {
+		mounts += "--mount=type=ssh "
+	}
+	if pc.Netrc {
+		mounts += "--mount=type=secret,id=netrc,target=/root/.netrc "
+	}
+	return mounts
+}
+
+// buildFlags returns the flags of the image build that provide the
+// build's secrets.
+func (pc *PrivateConfig) buildFlags() ([]string, error) {
+	var flags []string
+	if pc.SSH {
+		if os.Getenv("SSH_AUTH_SOCK") == "" {
+			return nil, fmt.Errorf("private: ssh requires an SSH agent, but SSH_AUTH_SOCK is not set")
+		}
+		flags = append(flags, "--ssh", "default")
+	}
+	if pc.Netrc {
+		netrc := os.Getenv("NETRC")
+		if netrc == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			netrc = filepath.Join(home, ".netrc")
+		}
+		if _, err := os.Stat(netrc); err != nil {
+			return nil, fmt.Errorf("private: netrc: %v", err)
+		}
+		flags = append(flags, "--secret", "id=netrc,src="+netrc)
+	}
+	return flags, nil
+}
+
+// goEnv returns the environment variables of host go commands that
+// download the config's modules.
+func (cfg *Config) goEnv() []string {
+	if cfg.Private.GoPrivate != "" {
+		return []string{"GOPRIVATE=" + cfg.Private.GoPrivate}
+	}
+	return nil
+}
+
+// A ProtoDep is a dependency on the .proto files of a git repository.
+// Git, Rev and Dirs default to those of the known dependency of the same
+// name: googleapis (whose Rev is Config.Googleapis), validate (the
+// validate.proto of protoc-gen-validate), or gateway (the OpenAPI
+// annotations of grpc-gateway).
+type ProtoDep struct {
+	Name string   `yaml:"name"`
+	Git  string   `yaml:"git"`  // URL of the git repository
+	Rev  string   `yaml:"rev"`  // commit, tag or branch; the lock file records its commit
+	Dirs []string `yaml:"dirs"` // directories of .proto files to vendor (default: all)
+	Root string   `yaml:"root"` // directory that is the root of import paths (default: the repository's)
+}
+
+// knownDeps maps each dependency name to its repository, revision and directories.
+var knownDeps = map[string]ProtoDep{
+	"googleapis": {Git: "https://github.com/googleapis/googleapis", Dirs: googleapisDirs},
+	"validate":   {Git: "https://github.com/envoyproxy/protoc-gen-validate", Rev: knownPlugins["validate"].Version, Dirs: []string{"validate"}},
+	"gateway":    {Git: "https://github.com/grpc-ecosystem/grpc-gateway", Rev: knownPlugins["gateway"].Version, Dirs: []string{"protoc-gen-openapiv2/options"}},
+}
+
+// defaultNodeVersion is the default Node.js release for npm plugins.
+const defaultNodeVersion = "16.17.1"
+
+// defaultSwiftVersion is the default Swift release for Swift plugins.
+const defaultSwiftVersion = "5.10.1"
+
+// defaultKeepImages is the default number of toolchain images to retain.
+const defaultKeepImages = 3
+
+// defaultVendorDir is the default destination of vendored dependencies.
+const defaultVendorDir = "third_party/proto"
+
+// bufModule is the package of the buf command, and defaultBufVersion its default version.
+const (
+	bufModule         = "github.com/bufbuild/buf/cmd/buf"
+	defaultBufVersion = "v1.8.0"
+)
+
+// A Plugin is a protoc plugin installed in the image by 'go install',
+// or, if Npm or Pip is set, by 'npm install' or 'pip install', or, if
+// Swift is set, by 'swift build', or, if URL is set, by downloading its
+// executable. Module (or Npm, Pip or Swift) and Version default to those
+// of the known plugin of the same name.
+type Plugin struct {
+	Name    string `yaml:"name"`
+	Module  string `yaml:"module"`  // package path of the plugin command
+	Npm     string `yaml:"npm"`     // npm package of the plugin command, instead of Module
+	Pip     string `yaml:"pip"`     // Python package of the plugin command, instead of Module
+	Swift   string `yaml:"swift"`   // git repository of the Swift package of the plugin command (protoc-gen-<Name>), instead of Module
+	Version string `yaml:"version"` // module (or package) version, or git tag of a Swift package
+
+	// URL is the location of the plugin's executable, instead of Module,
+	// in which $GOOS and $GOARCH are replaced by the platform's. SHA256
+	// maps each platform, such as "linux/amd64", to the executable's
+	// checksum. The executable is installed as protoc-gen-<Name>.
+	URL    string            `yaml:"url"`
+	SHA256 map[string]string `yaml:"sha256"`
+
+	// Out and Opt, if set, add the --<plugin>_out and --<plugin>_opt
+	// flags, in which $PWD is replaced by the working directory.
+	Out string `yaml:"out"`
+	Opt string `yaml:"opt"`
+
+	// Features, if set, selects the features of a plugin that has them
+	// (see pluginFeatures), adding --<plugin>_opt=features=A+B.
+	Features []string `yaml:"features"`
+
+	// Protos lists directories of .proto files, relative to the root of
+	// the module (whose path must be Module), to install in protoc's
+	// include directory, so that they may be imported.
+	Protos []string `yaml:"protos"`
+
+	// Disable, in a config that inherits (see Config.Inherit), removes
+	// the inherited plugin of the same name.
+	Disable bool `yaml:"disable"`
+}
+
+// Package returns the plugin's Go package path, or its npm or pip package
+// prefixed by "npm:" or "pip:".
+func (p Plugin) Package() string {
+	switch {
+	case p.Npm != "":
+		return "npm:" + p.Npm
+	case p.Pip != "":
+		return "pip:" + p.Pip
+	case p.Swift != "":
+		return "swift:" + p.Swift
+	case p.URL != "":
+		return p.URL
+	}
+	return p.Module
+}
+
+// flagName returns the name of the plugin in protoc's --<name>_out flag,
+// which is that of its executable, protoc-gen-<name>.
+func (p Plugin) flagName() string {
+	if p.Module != "" {
+		if base := path.Base(p.Module); strings.HasPrefix(base, "protoc-gen-") {
+			return strings.TrimPrefix(base, "protoc-gen-")
+		}
+	}
+	return p.Name
+}
+
+// url returns the plugin's URL and checksum for the platform, such as "linux/amd64".
+func (p Plugin) url(platform string) (url, sha256 string, err error) {
+	goos, goarch, _ := strings.Cut(platform, "/")
+	url = os.Expand(p.URL, func(name string) string {
+		switch name {
+		case "GOOS":
+			return goos
+		case "GOARCH":
+			return goarch
+		}
+		return "$" + name
+	})
+	sha256, ok := p.SHA256[platform]
+	if !ok {
+		return "", "", fmt.Errorf("plugin %q has no SHA256 checksum for %s", p.Name, platform)
+	}
+	return url, sha256, nil
+}
+
+// knownPlugins maps each plugin name to its package and default version.
+var knownPlugins = map[string]Plugin{
+	"go":         {Module: "google.golang.org/protobuf/cmd/protoc-gen-go", Version: "v1.28.1"},
+	"twirp":      {Module: "github.com/twitchtv/twirp/protoc-gen-twirp", Version: "v8.1.3+incompatible"},
+	"twirp_ruby": {Module: "github.com/github/twirp-ruby/protoc-gen-twirp_ruby", Version: "v1.10.0"},
+	"grpc":       {Module: "google.golang.org/grpc/cmd/protoc-gen-go-grpc", Version: "v1.2.0"},
+	"connect":    {Module: "connectrpc.com/connect/cmd/protoc-gen-connect-go", Version: "v1.16.2"},
+	"gateway":    {Module: "github.com/grpc-ecosystem/grpc-gateway/v2/protoc-gen-grpc-gateway", Version: "v2.11.3"},
+	"openapiv2":  {Module: "github.com/grpc-ecosystem/grpc-gateway/v2/protoc-gen-openapiv2", Version: "v2.11.3"},
+	"doc":        {Module: "github.com/pseudomuto/protoc-gen-doc/cmd/protoc-gen-doc", Version: "v1.5.1"},
+	"ts_proto":   {Npm: "ts-proto", Version: "1.126.1"},
+	"twirp_ts":   {Npm: "twirp-ts", Version: "2.5.0"},
+	"mypy":       {Pip: "mypy-protobuf", Version: "3.3.0"},
+	"validate":   {Module: "github.com/envoyproxy/protoc-gen-validate", Version: "v0.6.13", Protos: []string{"validate"}},
+	"vtproto":    {Module: "github.com/planetscale/vtprotobuf/cmd/protoc-gen-go-vtproto", Version: "v0.6.0"},
+	"jsonschema": {Module: "github.com/chrusty/protoc-gen-jsonschema/cmd/protoc-gen-jsonschema", Version: "v1.4.1"},
+	"openapi":    {Module: "github.com/google/gnostic/cmd/protoc-gen-openapi", Version: "v0.7.0"},
+	"gql":        {Module: "github.com/danielvladco/go-proto-gql/protoc-gen-gql", Version: "v0.9.0"},
+	"gogql":      {Module: "github.com/danielvladco/go-proto-gql/protoc-gen-gogql", Version: "v0.9.0"},
+	"js":         {Npm: "protoc-gen-js", Version: "3.21.2"},
+	"grpc-web":   {Npm: "protoc-gen-grpc-web", Version: "1.5.0"},
+	"swift":      {Swift: "https://github.com/apple/swift-protobuf", Version: "1.28.2"},
+	"grpc-swift": {Swift: "https://github.com/grpc/grpc-swift", Version: "1.24.2"},
+}
+
+// DefaultConfig is the configuration used in the absence of a config file.
+var DefaultConfig = Config{
+	Protoc:  "29.3",
+	Plugins: []Plugin{{Name: "go"}, {Name: "twirp"}, {Name: "twirp_ruby"}, {Name: "grpc"}},
+}
+
+// FindConfig returns the name of the nearest config file in dir or
+// one of its ancestors, or "" if there is none.
+func FindConfig(dir string) string {
+	for {
+		filename := filepath.Join(dir, ConfigFile)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// LoadConfig reads the named config file. Unset fields take their
+// values from DefaultConfig. An empty filename yields the default.
+func LoadConfig(filename string) (*Config, error) {
+	cfg := new(Config)
+	if filename != "" {
+		var err error
+		cfg, err = readConfig(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.resolve(); err != nil {
+		if filename != "" {
+			err = fmt.Errorf("%s: %v", filename, err)
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readConfig reads the named config file, with its relative file names
+// made relative to its directory, and, if it inherits, merged with that
+// of its parent config file (see inheritFrom).
+func readConfig(filename string) (*Config, error) {
+	cfg := &Config{Filename: filename}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	cfg.Lock, err = readToolchainLock(filepath.Join(filepath.Dir(filename), ToolchainLockFile))
+	if err != nil {
+		return nil, err
+	}
+	for i, cert := range cfg.CACerts {
+		if !filepath.IsAbs(cert) {
+			cfg.CACerts[i] = filepath.Join(filepath.Dir(filename), cert)
+		}
+	}
+	if name := cfg.CustomDockerfile; name != "" && !filepath.IsAbs(name) {
+		cfg.CustomDockerfile = filepath.Join(filepath.Dir(filename), name)
+	}
+	for i := range cfg.Roots {
+		if dir := cfg.Roots[i].Dir; dir != "" && !filepath.IsAbs(dir) {
+			cfg.Roots[i].Dir = filepath.Join(filepath.Dir(filename), filepath.FromSlash(dir))
+		}
+	}
+	for i := range cfg.Templates {
+		if name := cfg.Templates[i].Template; name != "" && !filepath.IsAbs(name) {
+			cfg.Templates[i].Template = filepath.Join(filepath.Dir(filename), filepath.FromSlash(name))
+		}
+	}
+	if key := cfg.Verify.Key; key != "" && !filepath.IsAbs(key) && !strings.Contains(key, "://") {
+		cfg.Verify.Key = filepath.Join(filepath.Dir(filename), key) // not a KMS URI
+	}
+	if cfg.Inherit {
+		parentFile, err := parentConfig(filename)
+		if err != nil {
+			return nil, err
+		}
+		if parentFile == "" {
+			return nil, fmt.Errorf("%s: inherit: no %s in an ancestor directory", filename, ConfigFile)
+		}
+		parent, err := readConfig(parentFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.inheritFrom(parent); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return cfg, nil
+}
+
+// resolve sets unset fields of the config to their default values.
+func (cfg *Config) resolve() error {
+	if cfg.Protoc == "" {
+		cfg.Protoc = DefaultConfig.Protoc
+	}
+	if err := checkProtoc(cfg.Protoc); err != nil {
+		return err
+	}
+	if cfg.Plugins == nil {
+		cfg.Plugins = append(cfg.Plugins, DefaultConfig.Plugins...)
+	} else {
+		cfg.Plugins = append([]Plugin(nil), cfg.Plugins...) // don't mutate the caller's slice
+	}
+	if cfg.Buf == "" {
+		cfg.Buf = defaultBufVersion
+	}
+	if cfg.Node == "" {
+		cfg.Node = defaultNodeVersion
+	}
+	if cfg.Swift == "" {
+		cfg.Swift = defaultSwiftVersion
+	}
+	if cfg.BaseImage == "" {
+		cfg.BaseImage = hubImage(cfg.Registry.Mirror, baseImage)
+	}
+	if err := cfg.Registry.check(); err != nil {
+		return err
+	}
+	if err := cfg.Verify.check(); err != nil {
+		return err
+	}
+	if err := cfg.GoModule.check(); err != nil {
+		return err
+	}
+	if err := cfg.Publish.check(); err != nil {
+		return err
+	}
+	for i := range cfg.Templates {
+		if err := cfg.Templates[i].check(); err != nil {
+			return err
+		}
+	}
+	if err := checkRoots(cfg.Roots); err != nil {
+		return err
+	}
+	if err := cfg.addLangs(); err != nil {
+		return err
+	}
+	if cfg.Googleapis != "" && !isCommitHash(cfg.Googleapis) {
+		return fmt.Errorf("googleapis %q is not a full commit hash", cfg.Googleapis)
+	}
+	if cfg.Header != "" {
+		if _, err := renderHeader(cfg.Header); err != nil {
+			return err
+		}
+	}
+	if cfg.Docs.Out != "" {
+		if cfg.Docs.Format == "" {
+			cfg.Docs.Format = docFormats[filepath.Ext(cfg.Docs.Out)]
+		}
+		switch cfg.Docs.Format {
+		case "markdown", "html", "json", "docbook":
+		case "":
+			return fmt.Errorf("docs: unknown format of %s (want .md, .html, .json or .xml)", cfg.Docs.Out)
+		default:
+			return fmt.Errorf("docs: unknown format %q (want markdown, html, json or docbook)", cfg.Docs.Format)
+		}
+		if err := cfg.AddPlugin("doc"); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Tags.check(); err != nil {
+		return err
+	}
+	if err := cfg.Mocks.resolve(); err != nil {
+		return err
+	}
+	if err := cfg.Enums.resolve(); err != nil {
+		return err
+	}
+	if err := cfg.Services.resolve(); err != nil {
+		return err
+	}
+	if err := cfg.Redact.check(); err != nil {
+		return err
+	}
+	if err := cfg.Fakes.resolve(); err != nil {
+		return err
+	}
+	if err := cfg.Scaffold.resolve(); err != nil {
+		return err
+	}
+	if cfg.Bench && !cfg.Fakes.Enabled {
+		return fmt.Errorf("bench requires fakes: {enabled: true}, whose fake messages are encoded")
+	}
+	if cfg.Golden && !cfg.Fakes.Enabled {
+		return fmt.Errorf("golden requires fakes: {enabled: true}, whose fake messages are encoded")
+	}
+	if cfg.FieldMasks && !cfg.Clone {
+		return fmt.Errorf("field_masks requires clone: true, whose Clone methods copy the message fields")
+	}
+	if cfg.JSONSchema.Out != "" {
+		if cfg.JSONSchema.Draft == "" {
+			cfg.JSONSchema.Draft = "draft-04"
+		}
+		if _, ok := jsonSchemaDrafts[cfg.JSONSchema.Draft]; !ok {
+			return fmt.Errorf("jsonschema: unknown draft %q (want draft-04, draft-06 or draft-07)", cfg.JSONSchema.Draft)
+		}
+		if err := cfg.AddPlugin("jsonschema"); err != nil {
+			return err
+		}
+	}
+	if cfg.OpenAPI.Out != "" {
+		for _, s := range []string{cfg.OpenAPI.Title, cfg.OpenAPI.Version} {
+			if strings.ContainsAny(s, ",=") {
+				return fmt.Errorf("openapi: %q may not contain a comma or equals sign", s)
+			}
+		}
+		if err := cfg.AddPlugin("openapi"); err != nil {
+			return err
+		}
+	}
+	if cfg.Web.Out != "" {
+		if cfg.Web.ImportStyle == "" {
+			cfg.Web.ImportStyle = "commonjs"
+		}
+		if _, ok := webImportStyles[cfg.Web.ImportStyle]; !ok {
+			return fmt.Errorf("web: unknown import_style %q (want closure, commonjs, commonjs+dts or typescript)", cfg.Web.ImportStyle)
+		}
+		switch cfg.Web.Mode {
+		case "":
+			cfg.Web.Mode = "grpcwebtext"
+		case "grpcwebtext", "grpcweb":
+		default:
+			return fmt.Errorf("web: unknown mode %q (want grpcwebtext or grpcweb)", cfg.Web.Mode)
+		}
+		for _, name := range []string{"js", "grpc-web"} {
+			if err := cfg.AddPlugin(name); err != nil {
+				return err
+			}
+		}
+	}
+	if cfg.Embed.Out != "" {
+		if cfg.Embed.Package == "" {
+			cfg.Embed.Package = path.Base(filepath.ToSlash(cfg.Embed.Out))
+		}
+		if !token.IsIdentifier(cfg.Embed.Package) {
+			return fmt.Errorf("embed: %q is not a valid Go package name; set embed.package", cfg.Embed.Package)
+		}
+	}
+	if cfg.VendorDir == "" {
+		cfg.VendorDir = defaultVendorDir
+	}
+	cfg.Deps = append([]ProtoDep(nil), cfg.Deps...) // don't mutate the caller's slice
+	for i := range cfg.Deps {
+		d := &cfg.Deps[i]
+		known, ok := knownDeps[d.Name]
+		if d.Git == "" {
+			if !ok {
+				return fmt.Errorf("unknown dependency %q has no git repository", d.Name)
+			}
+			d.Git, d.Dirs = known.Git, known.Dirs
+		}
+		if d.Rev == "" && ok && d.Git == known.Git {
+			d.Rev = known.Rev
+			if d.Name == "googleapis" {
+				d.Rev = cfg.Googleapis
+			}
+		}
+		if d.Rev == "" {
+			return fmt.Errorf("dependency %q has no rev", d.Name)
+		}
+	}
+	for i := range cfg.Plugins {
+		p := &cfg.Plugins[i]
+		if p.Disable {
+			return fmt.Errorf("plugin %q: disable applies only to a config that inherits", p.Name)
+		}
+		known, ok := knownPlugins[p.Name]
+		sources := 0
+		for _, s := range []string{p.Module, p.Npm, p.Pip, p.Swift, p.URL} {
+			if s != "" {
+				sources++
+			}
+		}
+		switch {
+		case sources > 1:
+			return fmt.Errorf("plugin %q has more than one of module, npm, pip, swift and url", p.Name)
+		case p.URL != "":
+			continue // Version is optional
+		case sources == 0:
+			if !ok {
+				return fmt.Errorf("unknown plugin %q has no module", p.Name)
+			}
+			p.Module, p.Npm, p.Pip, p.Swift = known.Module, known.Npm, known.Pip, known.Swift
+		}
+		if p.Version == "" {
+			if !ok || p.Package() != known.Package() {
+				return fmt.Errorf("plugin %q has no version", p.Name)
+			}
+			p.Version = known.Version
+		}
+		if p.Protos == nil && ok && p.Module == known.Module {
+			p.Protos = known.Protos
+		}
+		if err := p.checkFeatures(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pluginFeatures lists the features of the known plugins that have them.
+var pluginFeatures = map[string][]string{
+	"vtproto": {"marshal", "marshal_strict", "unmarshal", "unmarshal_unsafe", "size", "pool", "equal", "clone", "grpc", "all"},
+}
+
+// checkFeatures reports an error if the plugin's features are not
+// among those it has.
+func (p Plugin) checkFeatures() error {
+	if len(p.Features) == 0 {
+		return nil
+	}
+	known, ok := pluginFeatures[p.Name]
+	if !ok {
+		return fmt.Errorf("plugin %q has no features", p.Name)
+	}
+outer:
+	for _, f := range p.Features {
+		for _, k := range known {
+			if f == k {
+				continue outer
+			}
+		}
+		return fmt.Errorf("plugin %q has no feature %q (want %s)", p.Name, f, strings.Join(known, ", "))
+	}
+	return nil
+}
+
+// AddPlugin adds the named known plugin to the config, if not already present.
+func (cfg *Config) AddPlugin(name string) error {
+	if _, ok := knownPlugins[name]; !ok {
+		return fmt.Errorf("unknown plugin %q", name)
+	}
+	for _, p := range cfg.Plugins {
+		if p.Name == name {
+			return nil
+		}
+	}
+	cfg.Plugins = append(cfg.Plugins, Plugin{Name: name})
+	return nil
+}
+
+// installs returns the commands to install in the toolchain:
+// the plugins, and the tools required by the enabled steps.
+func (cfg *Config) installs() []Plugin {
+	installs := append([]Plugin(nil), cfg.Plugins...)
+	if cfg.Lint.Enabled || cfg.Breaking.Against != "" {
+		installs = append(installs, Plugin{Name: "buf", Module: bufModule, Version: cfg.Buf})
+	}
+	return installs
+}
+
+// protocFlags returns the config's flags, with $PWD (or ${PWD}) expanded
+// to pwd and other variables expanded from the environment, followed
+// by those of the enabled pseudo-plugins, such as Docs and Embed.
+func (cfg *Config) protocFlags(pwd string) []string {
+	expand := func(name string) string {
+		if name == "PWD" {
+			return pwd
+		}
+		return os.Getenv(name)
+	}
+	var flags []string
+	for _, f := range cfg.Flags {
+		flags = append(flags, os.Expand(f, expand))
+	}
+	for _, p := range cfg.Plugins {
+		if p.Out != "" {
+			flags = append(flags, "--"+p.flagName()+"_out="+os.Expand(p.Out, expand))
+		}
+		if p.Opt != "" {
+			flags = append(flags, "--"+p.flagName()+"_opt="+os.Expand(p.Opt, expand))
+		}
+		if len(p.Features) > 0 {
+			flags = append(flags, "--"+p.flagName()+"_opt=features="+strings.Join(p.Features, "+"))
+		}
+	}
+	if out := cfg.Docs.Out; out != "" {
+		out = filepath.Join(pwd, filepath.FromSlash(out))
+		flags = append(flags,
+			"--doc_out="+filepath.Dir(out),
+			"--doc_opt="+cfg.Docs.Format+","+filepath.Base(out))
+	}
+	if out := cfg.JSONSchema.Out; out != "" {
+		flags = append(flags, "--jsonschema_out="+filepath.Join(pwd, filepath.FromSlash(out)))
+		if opt := cfg.JSONSchema.Opt; opt != "" {
+			flags = append(flags, "--jsonschema_opt="+opt)
+		}
+	}
+	if out := cfg.OpenAPI.Out; out != "" {
+		flags = append(flags, "--openapi_out="+filepath.Join(pwd, filepath.FromSlash(out)))
+		var opts []string
+		if cfg.OpenAPI.PerFile {
+			opts = append(opts, "output_mode=source_relative")
+		}
+		if title := cfg.OpenAPI.Title; title != "" {
+			opts = append(opts, "title="+title)
+		}
+		if version := cfg.OpenAPI.Version; version != "" {
+			opts = append(opts, "version="+version)
+		}
+		if opt := cfg.OpenAPI.Opt; opt != "" {
+			opts = append(opts, opt)
+		}
+		if len(opts) > 0 {
+			flags = append(flags, "--openapi_opt="+strings.Join(opts, ","))
+		}
+	}
+	if out := cfg.Web.Out; out != "" {
+		out = filepath.Join(pwd, filepath.FromSlash(out))
+		flags = append(flags,
+			"--js_out="+out, "--js_opt=import_style="+webImportStyles[cfg.Web.ImportStyle]+",binary",
+			"--grpc-web_out="+out, "--grpc-web_opt=import_style="+cfg.Web.ImportStyle+",mode="+cfg.Web.Mode)
+	}
+	if out := cfg.Embed.Out; out != "" {
+		out = filepath.Join(pwd, filepath.FromSlash(out), embedSetFile)
+		flags = append(flags, "--include_imports", "--descriptor_set_out="+out)
+	}
+	return flags
+}
+
+// nodePlatform returns the platform suffix of the Linux Node.js release
+// archive for the specified GOARCH.
+func nodePlatform(goarch string) string {
+	if goarch == "amd64" {
+		return "linux-x64"
+	}
+	return "linux-" + goarch
+}
+
+// dockerfileTemplate is the docker specification for our versioned dependencies,
+// parameterized by the config.
+//
+//go:embed Dockerfile.tmpl
+var dockerfileTemplate string
+
+var dockerfileTmpl = template.Must(template.New("Dockerfile").Parse(dockerfileTemplate))
+
+// Dockerfile returns the Dockerfile for the config's toolchain on the
+// specified container platform, such as "linux/arm64" ("" for the host's).
+func (cfg *Config) Dockerfile(platform string) (string, error) {
+	if err := cfg.resolve(); err != nil {
+		return "", err
+	}
+	platform, err := containerPlatform(platform)
+	if err != nil {
+		return "", err
+	}
+	goarch := strings.TrimPrefix(platform, "linux/")
+	protocPlatform, err := protocPlatform("linux", goarch)
+	if err != nil {
+		return "", err
+	}
+	if err := cfg.checkLock(); err != nil {
+		return "", err
+	}
+	protocSum, ok := cfg.protocSum(protocPlatform)
+	if !ok && cfg.Lock != nil {
+		return "", fmt.Errorf("%s: protoc %s for %s is not locked; run 'proto-gen-go lock'", ToolchainLockFile, cfg.Protoc, protocPlatform)
+	}
+	if !ok && !knownProtoc(cfg.Protoc) {
+		return "", fmt.Errorf("protoc %s is not a known release (%s); add the checksums of its archives to protoc_sha256 in %s, or run 'proto-gen-go lock'",
+			cfg.Protoc, strings.Join(protocReleases, ", "), ConfigFile)
+	}
+	base := cfg.BaseImage
+	var modules []LockedModule
+	if cfg.Lock != nil {
+		base = cfg.Lock.BaseImage
+		if base == "" {
+			return "", fmt.Errorf("%s: base image is not locked; run 'proto-gen-go lock' with a container runtime", ToolchainLockFile)
+		}
+	}
+	caSums, err := caCertSums(cfg.CACerts)
+	if err != nil {
+		return "", err
+	}
+	type download struct{ Name, URL, SHA256 string }
+	var goInstalls, npmInstalls, pipInstalls, swiftInstalls []Plugin
+	var downloads []download
+	for _, p := range cfg.installs() {
+		switch {
+		case p.URL != "":
+			url, sum, err := p.url(platform)
+			if err != nil {
+				return "", err
+			}
+			downloads = append(downloads, download{p.Name, url, sum})
+		case p.Npm != "":
+			npmInstalls = append(npmInstalls, p)
+		case p.Pip != "":
+			pipInstalls = append(pipInstalls, p)
+		case p.Swift != "":
+			swiftInstalls = append(swiftInstalls, p)
+		default:
+			goInstalls = append(goInstalls, p)
+			if cfg.Lock != nil {
+				m, _ := cfg.Lock.module(p)
+				modules = append(modules, m)
+			}
+		}
+	}
+	data := struct {
+		*Config
+		BaseImage      string         // base image, with digest if locked
+		ProtocSum      string         // SHA256 checksum of the protoc release archive, if known
+		LockedModules  []LockedModule // modules to verify before the Go installs
+		ProtocPlatform string         // platform suffix of the protoc release archive
+		NodePlatform   string         // platform suffix of the Node.js release archive
+		Installs       []Plugin       // Go commands to install
+		NpmInstalls    []Plugin       // npm commands to install
+		PipInstalls    []Plugin       // pip commands to install
+		SwiftInstalls  []Plugin       // Swift packages to build
+		SwiftImage     string         // image in which to build them
+		Downloads      []download     // plugin executables to download
+		GoogleapisDirs []string       // googleapis directories to install
+		GitRewrites    []gitRewrite   // git URL rewrites for private modules
+		GoMounts       string         // RUN --mount flags of the steps that download modules
+		CACertSums     []string       // SHA256 checksums of the CA certificates, which identify them
+	}{cfg, base, protocSum, modules, protocPlatform, nodePlatform(goarch), goInstalls, npmInstalls, pipInstalls, swiftInstalls, hubImage(cfg.Registry.Mirror, "swift:"+cfg.Swift+"-focal"), downloads, googleapisDirs,
+		cfg.Private.rewrites(), goCacheMounts + cfg.Private.mounts(), caSums}
+	var buf bytes.Buffer
+	if err := dockerfileTmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	if cfg.CustomDockerfile != "" {
+		custom, err := os.ReadFile(cfg.CustomDockerfile)
+		if err != nil {
+			return "", err
+		}
+		if hasFrom(string(custom)) {
+			return string(custom), nil
+		}
+		fmt.Fprintf(&buf, "\n# %s\n%s", filepath.Base(cfg.CustomDockerfile), custom)
+	}
+	return buf.String(), nil
+}
+
+// hasFrom reports whether the Dockerfile has a FROM instruction,
+// and so defines its own base image rather than extending ours.
+func hasFrom(dockerfile string) bool {
+	for _, line := range strings.Split(dockerfile, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && strings.EqualFold(fields[0], "FROM") {
+			return true
+		}
+	}
+	return false
+}
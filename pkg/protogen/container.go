@@ -0,0 +1,154 @@
+package protogen
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A container is a long-running container, with host directories
+// mounted, in which protoc may be run repeatedly without the cost of
+// starting a new container each time.
+type container struct {
+	rt   *runtime
+	id   string
+	dirs []string // container paths of writable mounts
+}
+
+// startContainer starts a container of the environment's image and
+// runtime, with the host directory dir mounted at the container path
+// opts.Dir. The container idles until stopped.
+func startContainer(ctx context.Context, opts *Options, e *env, dir string) (*container, error) {
+	cmd := e.rt.command(ctx, "run", "--detach", "--rm")
+	cmd.Args = append(cmd.Args, e.runFlags(opts, dir)...)
+	cmd.Args = append(cmd.Args, "--entrypoint=sleep", e.image, "infinity")
+	cmd.Stdout = new(bytes.Buffer)
+	cmd.Stderr = opts.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("starting container: %v", err)
+	}
+	id := strings.TrimSpace(fmt.Sprint(cmd.Stdout)) // container id
+	return &container{rt: e.rt, id: id, dirs: e.writableDirs(opts)}, nil
+}
+
+// protoc runs protoc with the specified arguments in the container.
+func (c *container) protoc(ctx context.Context, opts *Options, protocArgs []string) error {
+	cmd := c.rt.command(ctx, "exec", "-w", containerPath(opts.Dir))
+	if c.rt.user != "" {
+		cmd.Args = append(cmd.Args, "--user", c.rt.user)
+	}
+	cmd.Args = append(cmd.Args, c.id, "protoc")
+	cmd.Args = append(cmd.Args, containerArgs(protocArgs)...)
+	cmd.Stderr = opts.Stderr
+	cmd.Stdout = opts.Stdout
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			// Killing the runtime's client does not stop protoc,
+			// so remove the container (a warm one is recreated).
+			c.stop()
+		}
+		return killedByLimit(opts, err)
+	}
+
+	// Give the root-owned files written by protoc to the host user.
+	if c.rt.chown != "" {
+		cmd := c.rt.command(ctx, "exec", c.id, "find")
+		cmd.Args = append(cmd.Args, containerArgs(c.dirs)...)
+		cmd.Args = append(cmd.Args, "-user", "0", "-exec", "chown", c.rt.chown, "{}", "+")
+		cmd.Stderr = opts.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("chown failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// stop stops and removes the container.
+func (c *container) stop() error {
+	cmd := c.rt.command(context.Background(), "rm", "--force", c.id)
+	cmd.Stdout = io.Discard
+	return cmd.Run()
+}
+
+// warmLabel is the label that identifies warm containers (see
+// Options.Warm). Its value is a hash of the working directory.
+const warmLabel = "com.github.proto-gen-go.warm"
+
+// warmLifetime is the number of seconds for which a warm container runs.
+const warmLifetime = 3600
+
+// warmContainer returns the warm container for the environment and the
+// working directory opts.Dir, starting one if none is running. The
+// container's name is derived from the image (and thus the config) and
+// the mounts, so a change to either starts a new container, and the
+// stale warm containers of the working directory are then removed.
+func warmContainer(ctx context.Context, opts *Options, e *env) (*container, error) {
+	flags := e.runFlags(opts, opts.Dir)
+	hash := sha256.Sum256([]byte(strings.Join(append([]string{e.image}, flags...), "\x00")))
+	name := fmt.Sprintf("proto-gen-go-warm-%x", hash[:6])
+	dirHash := sha256.Sum256([]byte(opts.Dir))
+	label := fmt.Sprintf("%s=%x", warmLabel, dirHash[:8])
+	c := &container{rt: e.rt, id: name, dirs: e.writableDirs(opts)}
+
+	running := func() bool {
+		cmd := e.rt.command(ctx, "container", "inspect", "--format={{.State.Running}}", name)
+		cmd.Stderr = io.Discard
+		out, err := cmd.Output()
+		return err == nil && strings.TrimSpace(string(out)) == "true"
+	}
+	if running() {
+		opts.logf("using warm container %s", name)
+		return c, nil
+	}
+
+	// Remove the stale warm containers of the working directory.
+	ls := e.rt.command(ctx, "ps", "--all", "--filter", "label="+label, "--format={{.Names}}")
+	ls.Stderr = opts.Stderr
+	out, err := ls.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s ps: %v", e.rt.name, err)
+	}
+	for _, stale := range strings.Fields(string(out)) {
+		opts.logf("removing stale warm container %s", stale)
+		(&container{rt: e.rt, id: stale}).stop()
+	}
+
+	opts.logf("starting warm container %s", name)
+	cmd := e.rt.command(ctx, "run", "--detach", "--rm", "--name", name, "--label", label)
+	cmd.Args = append(cmd.Args, flags...)
+	cmd.Args = append(cmd.Args, "--entrypoint=sleep", e.image, fmt.Sprint(warmLifetime))
+	cmd.Stdout = io.Discard
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if running() { // started concurrently by another run
+			return c, nil
+		}
+		return nil, fmt.Errorf("starting warm container: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return c, nil
+}
+
+// removeWarmContainers removes all warm containers.
+func removeWarmContainers(ctx context.Context, opts *Options, rt *runtime) error {
+	ls := rt.command(ctx, "ps", "--all", "--filter", "label="+warmLabel, "--format={{.Names}}")
+	var stderr bytes.Buffer
+	ls.Stderr = &stderr
+	out, err := ls.Output()
+	if err != nil {
+		return fmt.Errorf("%s ps: %v: %s", rt.name, err, strings.TrimSpace(stderr.String()))
+	}
+	for _, name := range strings.Fields(string(out)) {
+		opts.logf("removing warm container %s", name)
+		cmd := rt.command(ctx, "rm", "--force", name)
+		cmd.Stdout = io.Discard
+		cmd.Stderr = opts.Stderr
+		if err := opts.run(cmd); err != nil {
+			return fmt.Errorf("%s rm %s: %v", rt.name, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package protogen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strings"
+)
+
+// desktopSockets are the sockets, relative to the home directory, of
+// the docker-compatible daemons of desktop distributions and virtual
+// machines, which the docker CLI does not use unless DOCKER_HOST (or
+// a docker context) selects them.
+var desktopSockets = []struct{ name, path string }{
+	{"Docker Desktop", ".docker/run/docker.sock"},
+	{"Colima", ".colima/default/docker.sock"},
+	{"Colima", ".colima/docker.sock"},
+	{"Rancher Desktop", ".rd/docker.sock"},
+	{"OrbStack", ".orbstack/run/docker.sock"},
+	{"Lima", ".lima/docker/sock/docker.sock"},
+	{"podman machine", ".local/share/containers/podman/machine/podman.sock"},
+	{"podman machine", ".local/share/containers/podman/machine/qemu/podman.sock"},
+}
+
+// usableRuntime returns the runtime of the options, having checked
+// that its daemon (or, for podman, its machine) responds. If the
+// default docker daemon does not, and neither DOCKER_HOST nor a docker
+// context was specified, it uses the first daemon that responds among
+// those of desktopSockets and of the docker contexts. Otherwise, the
+// error explains how to make the runtime usable.
+func usableRuntime(ctx context.Context, opts *Options) (*runtime, error) {
+	rt, err := findRuntime(opts.Runtime)
+	if err != nil {
+		return nil, fmt.Errorf("%v; install Docker (or Docker Desktop, Colima, Rancher Desktop or podman), or use -local to run a natively installed toolchain", err)
+	}
+	if opts.DockerContext != "" {
+		if rt.name != "docker" {
+			return nil, fmt.Errorf("a docker context (-docker-context) requires the docker runtime, not %s", rt.name)
+		}
+		rt.env = append(rt.env, "DOCKER_CONTEXT="+opts.DockerContext)
+	}
+	msg, ok := rt.ping(ctx)
+	if ok || ctx.Err() != nil {
+		return rt, nil
+	}
+	if rt.name == "docker" && opts.DockerContext == "" && os.Getenv("DOCKER_HOST") == "" && os.Getenv("DOCKER_CONTEXT") == "" {
+		if env, daemon := rt.probeDaemons(ctx); env != "" {
+			opts.logf("the default docker daemon is not running; using %s", daemon)
+			rt.env = append(rt.env, env)
+			return rt, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not usable (%s); %s", rt.name, msg, rt.daemonAdvice(msg))
+}
+
+// ping reports whether the runtime's daemon responds, with the
+// additional environment variables env, and, if not, the first line
+// of its error.
+func (r *runtime) ping(ctx context.Context, env ...string) (string, bool) {
+	cmd := r.command(ctx, "version", "--format", "{{.Server.Version}}")
+	if env != nil {
+		cmd.Env = append(cmd.Environ(), env...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return "", true
+	}
+	msg := strings.TrimSpace(stderr.String())
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	if msg == "" {
+		msg = err.Error()
+	}
+	return msg, false
+}
+
+// probeDaemons returns the environment variable, DOCKER_HOST or
+// DOCKER_CONTEXT, that directs the docker CLI to the first responding
+// daemon of desktopSockets or of the docker contexts, and a description
+// of the daemon, or "" if none responds.
+func (r *runtime) probeDaemons(ctx context.Context) (env, daemon string) {
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, s := range desktopSockets {
+			sock := filepath.Join(home, filepath.FromSlash(s.path))
+			if _, err := os.Stat(sock); err != nil {
+				continue
+			}
+			env := "DOCKER_HOST=unix://" + sock
+			if _, ok := r.ping(ctx, env); ok {
+				return env, fmt.Sprintf("that of %s (%s)", s.name, sock)
+			}
+		}
+	}
+	out, err := r.command(ctx, "context", "ls", "--format", "{{.Name}}").Output()
+	if err != nil {
+		return "", ""
+	}
+	for _, name := range strings.Fields(string(out)) {
+		env := "DOCKER_CONTEXT=" + name
+		if _, ok := r.ping(ctx, env); ok {
+			return env, fmt.Sprintf("that of docker context %s", name)
+		}
+	}
+	return "", ""
+}
+
+// daemonAdvice returns guidance for a runtime whose daemon did not
+// respond with the specified error message.
+func (r *runtime) daemonAdvice(msg string) string {
+	const local = "or use -local to run a natively installed toolchain"
+	switch {
+	case strings.Contains(msg, "permission denied"):
+		return "add your user to the docker group ('sudo usermod -aG docker $USER', then log in again), " + local
+	case r.name == "podman":
+		if goruntime.GOOS == "linux" {
+			return "check 'podman info', " + local
+		}
+		return "start its virtual machine ('podman machine init', then 'podman machine start'), " + local
+	case goruntime.GOOS == "linux":
+		return "start the daemon ('sudo systemctl start docker') or select another with -docker-context, " + local
+	default:
+		return "start the daemon (open Docker Desktop or Rancher Desktop, or run 'colima start') or select another with -docker-context, " + local
+	}
+}
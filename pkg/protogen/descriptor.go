@@ -0,0 +1,109 @@
+package protogen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isDevice reports whether the path names a device, such as
+// /dev/stdout, rather than a file or directory to be mounted.
+func isDevice(path string) bool {
+	return filepath.IsAbs(path) && within(path, "/dev")
+}
+
+// outputFiles returns the output files named by the --descriptor_set_out
+// and --dependency_out flags among the protoc arguments, except devices.
+func outputFiles(args []string) []string {
+	var files []string
+	for i := 0; i < len(args); i++ {
+		name, value, ok := flagValue(args, &i)
+		if !ok || value == "" || name != "--descriptor_set_out" && name != "--dependency_out" {
+			continue
+		}
+		if !isDevice(value) {
+			files = append(files, value)
+		}
+	}
+	return files
+}
+
+// A gzipOutput is a descriptor set that protoc writes to tmp, and that
+// is then compressed to file.
+type gzipOutput struct {
+	tmp, file string
+}
+
+// gzipOutputs returns the protoc arguments with each descriptor set
+// output whose name ends in .gz replaced by a temporary file beside it,
+// and the outputs to be compressed once protoc has written them.
+func gzipOutputs(args []string) ([]string, []gzipOutput) {
+	var outs []gzipOutput
+	args = append([]string(nil), args...)
+	for i := 0; i < len(args); i++ {
+		start := i
+		name, value, ok := flagValue(args, &i)
+		if !ok || name != "--descriptor_set_out" || !strings.HasSuffix(value, ".gz") {
+			continue
+		}
+		out := gzipOutput{tmp: strings.TrimSuffix(value, ".gz") + ".tmp", file: value}
+		outs = append(outs, out)
+		if i == start {
+			args[i] = name + "=" + out.tmp
+		} else {
+			args[i] = out.tmp
+		}
+	}
+	return args, outs
+}
+
+// compress compresses the descriptor sets written by protoc, with the
+// host directory dir standing in for the working directory opts.Dir.
+// The output is deterministic, so that unchanged descriptor sets are
+// not reported as changed.
+func (e *env) compress(opts *Options, dir string) error {
+	for _, out := range e.gzipOutputs {
+		tmp, file := hostPath(opts, dir, out.tmp), hostPath(opts, dir, out.file)
+		if err := gzipFile(file, tmp); err != nil {
+			return err
+		}
+		if err := os.Remove(tmp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gzipFile writes the gzip-compressed content of src to dst, without
+// a modification time, and leaves dst untouched if it is unchanged.
+func gzipFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if old, err := os.ReadFile(dst); err == nil && bytes.Equal(old, buf.Bytes()) {
+		return nil
+	}
+	return os.WriteFile(dst, buf.Bytes(), 0666)
+}
+
+// hostPath returns the host path of the absolute container path, with
+// the host directory dir standing in for the working directory opts.Dir.
+func hostPath(opts *Options, dir, path string) string {
+	if rel, err := filepath.Rel(opts.Dir, path); err == nil && within(path, opts.Dir) {
+		return filepath.Join(dir, rel)
+	}
+	return path
+}
@@ -0,0 +1,136 @@
+package protogen
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A diagWriter is an io.Writer that rewrites the file name at the
+// start of each line of protoc's diagnostics, of the form
+// "name:line:col: message" or "name: message", to a path relative to
+// the working directory, so that editors can jump to the failing line.
+//
+// Protoc reports files by their names relative to the import
+// directory (--proto_path) in which it found them, or by the
+// container path of the working directory, which need not be the
+// directory on the host, as with -check.
+//
+// With Options.Events, the lines are instead reported as diagnostic
+// events.
+type diagWriter struct {
+	w          io.Writer
+	event      func(Event) // if non-nil, reports each line instead of writing it to w
+	pwd        string      // working directory, as named in protoc arguments
+	dir        string      // host directory standing in for pwd
+	protoPaths []string    // import directories, as named in protoc arguments
+	buf        []byte      // incomplete last line
+}
+
+// diagnostics returns a diagWriter for protoc run in the environment
+// with the host directory dir standing in for opts.Dir. The caller
+// must flush it after protoc exits.
+func (e *env) diagnostics(opts *Options, dir string) *diagWriter {
+	d := &diagWriter{
+		w:          opts.Stderr,
+		pwd:        opts.Dir,
+		dir:        dir,
+		protoPaths: protoPaths(e.protocArgs, opts.Dir),
+	}
+	if opts.Events != nil {
+		d.event = opts.event
+	}
+	return d
+}
+
+func (d *diagWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	for {
+		i := bytes.IndexByte(d.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(d.buf[:i+1])
+		d.buf = d.buf[i+1:]
+		if err := d.write(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes the incomplete last line, if any.
+func (d *diagWriter) flush() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	line := string(d.buf)
+	d.buf = nil
+	return d.write(line)
+}
+
+// write writes a line of diagnostics, rewritten, or reports it.
+func (d *diagWriter) write(line string) error {
+	line, file := d.rewrite(line)
+	if d.event != nil {
+		d.event(diagnosticEvent(line, file))
+		return nil
+	}
+	_, err := io.WriteString(d.w, line)
+	return err
+}
+
+// rewrite rewrites the file name at the start of a line of
+// diagnostics. It returns the line and the rewritten file name, or ""
+// if the line does not start with that of an existing file.
+func (d *diagWriter) rewrite(line string) (string, string) {
+	colon := strings.Index(line, ":")
+	if colon <= 0 {
+		return line, ""
+	}
+	name, rest := line[:colon], line[colon:]
+	path := d.hostPath(name)
+	if path == "" {
+		return line, ""
+	}
+	if within(path, d.pwd) {
+		path, _ = filepath.Rel(d.pwd, path)
+	}
+	return path + rest, path
+}
+
+// hostPath returns the path, in terms of pwd, of the file named in a
+// diagnostic, or "" if it is not an existing file.
+func (d *diagWriter) hostPath(name string) string {
+	name = containerHostPath(name) // protoc's name for a file of a mounted Windows directory
+	// translate maps a path in terms of pwd to the host directory.
+	translate := func(path string) string {
+		if d.dir != d.pwd && within(path, d.pwd) {
+			rel, _ := filepath.Rel(d.pwd, path)
+			return filepath.Join(d.dir, rel)
+		}
+		return path
+	}
+
+	if filepath.IsAbs(name) {
+		if within(name, d.dir) && d.dir != d.pwd {
+			rel, _ := filepath.Rel(d.dir, name)
+			name = filepath.Join(d.pwd, rel)
+		}
+		if _, err := os.Stat(translate(name)); err == nil {
+			return name
+		}
+		return ""
+	}
+
+	// A relative name is relative to the first import directory that contains it.
+	for _, p := range d.protoPaths {
+		path := filepath.Join(p, name)
+		if _, err := os.Stat(translate(path)); err == nil {
+			return path
+		}
+	}
+	return ""
+}
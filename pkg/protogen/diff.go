@@ -0,0 +1,164 @@
+package protogen
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxDiffCells bounds the size of the table used to compute the
+// longest common subsequence of the differing region of two files.
+// Beyond it, the entire region is reported as replaced.
+const maxDiffCells = 4 << 20
+
+// unifiedDiff writes to w a unified diff (with 3 lines of context) of
+// the texts old and new, labeled by the names a and b.
+func unifiedDiff(w io.Writer, a, b string, old, new []byte) {
+	x, y := splitLines(string(old)), splitLines(string(new))
+	ops := diffLines(x, y)
+
+	const context = 3
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", a, b)
+	for i := 0; i < len(ops); {
+		// Skip to the next change.
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk while changes are within 2*context lines.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		end += context
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		var xn, yn int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				xn++
+			}
+			if op.kind != '-' {
+				yn++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(ops[start].x, xn), hunkRange(ops[start].y, yn))
+		for _, op := range ops[start:end] {
+			line := op.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n\\ No newline at end of file\n"
+			}
+			fmt.Fprintf(w, "%c%s", op.kind, line)
+		}
+		i = end
+	}
+}
+
+// hunkRange formats the range of n lines starting at 0-based line i.
+func hunkRange(i, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", i)
+	}
+	return fmt.Sprintf("%d,%d", i+1, n)
+}
+
+// A diffOp is a line common to both texts (' '), or only in the old ('-')
+// or new ('+') text. x and y are the positions in each text before it.
+type diffOp struct {
+	kind byte
+	x, y int
+	line string
+}
+
+// diffLines returns the edit script transforming x into y.
+func diffLines(x, y []string) []diffOp {
+	var ops []diffOp
+	equal := func(i, j int) { ops = append(ops, diffOp{' ', i, j, x[i]}) }
+	del := func(i, j int) { ops = append(ops, diffOp{'-', i, j, x[i]}) }
+	ins := func(i, j int) { ops = append(ops, diffOp{'+', i, j, y[j]}) }
+
+	// Trim the common prefix and suffix.
+	pre := 0
+	for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+		suf++
+	}
+	for i := 0; i < pre; i++ {
+		equal(i, i)
+	}
+
+	// Compute the LCS of the remaining regions, if not too large.
+	xs, ys := x[pre:len(x)-suf], y[pre:len(y)-suf]
+	n, m := len(xs), len(ys)
+	if n*m > maxDiffCells {
+		for i := range xs {
+			del(pre+i, pre)
+		}
+		for j := range ys {
+			ins(pre+n, pre+j)
+		}
+	} else {
+		// lcs[i*(m+1)+j] is the LCS length of xs[i:] and ys[j:].
+		lcs := make([]int, (n+1)*(m+1))
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				k := i*(m+1) + j
+				if xs[i] == ys[j] {
+					lcs[k] = lcs[k+m+2] + 1
+				} else if a, b := lcs[k+m+1], lcs[k+1]; a >= b {
+					lcs[k] = a
+				} else {
+					lcs[k] = b
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && xs[i] == ys[j]:
+				equal(pre+i, pre+j)
+				i++
+				j++
+			case j == m || i < n && lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+				del(pre+i, pre+j)
+				i++
+			default:
+				ins(pre+i, pre+j)
+				j++
+			}
+		}
+	}
+
+	for k := 0; k < suf; k++ {
+		i, j := len(x)-suf+k, len(y)-suf+k
+		equal(i, j)
+	}
+	return ops
+}
+
+// splitLines splits s into lines, each retaining its newline.
+func splitLines(s string) []string {
+	var lines []string
+	for s != "" {
+		i := strings.IndexByte(s, '\n') + 1
+		if i == 0 {
+			i = len(s)
+		}
+		lines = append(lines, s[:i])
+		s = s[i:]
+	}
+	return lines
+}
@@ -0,0 +1,106 @@
+package protogen
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// The files of Config.Embed, in its Out directory.
+const (
+	embedSetFile = "descriptors.pb" // the FileDescriptorSet written by protoc
+	embedGoFile  = "descriptors.go" // the Go file that embeds it
+)
+
+// embedTemplate is the Go file of Config.Embed. Its exported names are
+// unlikely to collide with those generated by protoc-gen-go.
+var embedTemplate = template.Must(template.New("embed").Parse(`// Code generated by proto-gen-go. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	_ "embed"
+	"sync"
+
+{{if .Reflection}}	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+{{end}}	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// embeddedFileDescriptorSet is the serialized FileDescriptorSet of the
+// .proto files of this package, including their imports.
+//
+//go:embed ` + embedSetFile + `
+var embeddedFileDescriptorSet []byte
+
+// FileDescriptorSet returns the FileDescriptorSet of the .proto files
+// from which this package was generated, including their imports.
+func FileDescriptorSet() (*descriptorpb.FileDescriptorSet, error) {
+	set := new(descriptorpb.FileDescriptorSet)
+	if err := proto.Unmarshal(embeddedFileDescriptorSet, set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+var descriptorFiles struct {
+	once  sync.Once
+	files *protoregistry.Files
+	err   error
+}
+
+// DescriptorFiles returns a registry of the file descriptors of
+// FileDescriptorSet, which is independent of protoregistry.GlobalFiles.
+func DescriptorFiles() (*protoregistry.Files, error) {
+	descriptorFiles.once.Do(func() {
+		set, err := FileDescriptorSet()
+		if err != nil {
+			descriptorFiles.err = err
+			return
+		}
+		descriptorFiles.files, descriptorFiles.err = protodesc.NewFiles(set)
+	})
+	return descriptorFiles.files, descriptorFiles.err
+}
+{{- if .Reflection}}
+
+// RegisterReflection registers the gRPC server reflection service with
+// s, resolving the services of s by the file descriptors of
+// DescriptorFiles, so that clients such as grpcurl can discover them
+// without access to the .proto files.
+func RegisterReflection(s reflection.GRPCServer) error {
+	files, err := DescriptorFiles()
+	if err != nil {
+		return err
+	}
+	reflectionpb.RegisterServerReflectionServer(s, reflection.NewServer(reflection.ServerOptions{
+		Services:           s,
+		DescriptorResolver: files,
+	}))
+	return nil
+}
+{{- end}}
+`))
+
+// writeEmbedFile writes the Go file of Config.Embed, if enabled, beside
+// the descriptor set written by protoc, with the host directory dir
+// standing in for the working directory opts.Dir.
+func writeEmbedFile(opts *Options, dir string) error {
+	if opts.Embed.Out == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := embedTemplate.Execute(&buf, opts.Embed); err != nil {
+		return err
+	}
+	out := hostPath(opts, dir, filepath.Join(opts.Dir, filepath.FromSlash(opts.Embed.Out)))
+	filename := filepath.Join(out, embedGoFile)
+	if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, buf.Bytes()) {
+		return nil
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0666)
+}
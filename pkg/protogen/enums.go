@@ -0,0 +1,351 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An EnumsConfig configures the generation, if enabled, of helpers for
+// the enums generated by protoc-gen-go, beside each generated file that
+// declares enums: for an enum X, ParseX and XValues functions, and the
+// JSON and text marshalers of X, which use the names of the values in
+// the case convention of Case.
+type EnumsConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Case       string `yaml:"case"`        // proto (default, e.g. STATUS_PAID), lower (status_paid), kebab (status-paid), camel (statusPaid) or pascal (StatusPaid)
+	TrimPrefix bool   `yaml:"trim_prefix"` // trim the enum's name from the names of its values (STATUS_PAID is PAID, or paid...)
+}
+
+// enumCases are the case conventions of EnumsConfig.Case, which convert
+// the words of a SCREAMING_SNAKE_CASE name.
+var enumCases = map[string]func(words []string) string{
+	"proto":  func(words []string) string { return strings.Join(words, "_") },
+	"lower":  func(words []string) string { return strings.ToLower(strings.Join(words, "_")) },
+	"kebab":  func(words []string) string { return strings.ToLower(strings.Join(words, "-")) },
+	"camel":  func(words []string) string { return lowerFirst(titleWords(words)) },
+	"pascal": titleWords,
+}
+
+// titleWords joins the words, each with only its first letter in upper case.
+func titleWords(words []string) string {
+	var b strings.Builder
+	for _, w := range words {
+		if w != "" {
+			b.WriteString(strings.ToUpper(w[:1]) + strings.ToLower(w[1:]))
+		}
+	}
+	return b.String()
+}
+
+// resolve sets the unset fields of the config to their defaults.
+func (ec *EnumsConfig) resolve() error {
+	if !ec.Enabled {
+		return nil
+	}
+	if ec.Case == "" {
+		ec.Case = "proto"
+	}
+	if enumCases[ec.Case] == nil {
+		return fmt.Errorf("enums: invalid case %q (want proto, lower, kebab, camel or pascal)", ec.Case)
+	}
+	return nil
+}
+
+// writeEnums writes the enum helpers of the generated files, named
+// relative to the host directory dir, which stands in for opts.Dir, and
+// returns the names of those it created or modified.
+func writeEnums(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Enums.Enabled {
+		return nil, nil
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") {
+			continue
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		helpers, err := enumFile(file, src, &opts.Enums)
+		if err != nil {
+			return nil, err
+		}
+		if helpers == nil {
+			continue // no enums
+		}
+		name := strings.TrimSuffix(file, ".pb.go") + "_enums.go"
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, helpers) {
+			continue
+		}
+		if err := os.WriteFile(filename, helpers, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// An enumValue is a value of a generated enum.
+type enumValue struct {
+	number int64
+	proto  string // name in the .proto file, e.g. STATUS_PAID
+	name   string // name in the case convention, e.g. paid
+}
+
+// enumFile returns the source of the helpers of the enums of the Go
+// file generated by protoc-gen-go, or nil if it has none. Enums are the
+// types T with a T_name map of the names of their values, in order.
+// Helpers that the file already declares, such as the UnmarshalJSON
+// method of a proto2 enum, are omitted.
+func enumFile(name string, src []byte, ec *EnumsConfig) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("enums: %v", err)
+	}
+	declared := make(map[string]bool) // functions, and methods as T.M
+	types := make(map[string]bool)
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				declared[decl.Name.Name] = true
+			} else if len(decl.Recv.List) == 1 {
+				recv := decl.Recv.List[0].Type
+				if star, ok := recv.(*ast.StarExpr); ok {
+					recv = star.X
+				}
+				if id, ok := recv.(*ast.Ident); ok {
+					declared[id.Name+"."+decl.Name.Name] = true
+				}
+			}
+		case *ast.GenDecl:
+			if decl.Tok == token.TYPE {
+				for _, spec := range decl.Specs {
+					types[spec.(*ast.TypeSpec).Name.Name] = true
+				}
+			}
+		}
+	}
+
+	var body bytes.Buffer
+	used := make(map[string]bool) // packages referred to by the helpers
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, id := range vs.Names {
+				enum := strings.TrimSuffix(id.Name, "_name")
+				if enum == id.Name || !types[enum] || i >= len(vs.Values) {
+					continue
+				}
+				lit, ok := vs.Values[i].(*ast.CompositeLit)
+				if !ok {
+					continue
+				}
+				values, err := enumValues(enum, lit, ec)
+				if err != nil {
+					return nil, fmt.Errorf("enums: %s: %v", name, err)
+				}
+				writeEnumHelpers(&body, enum, values, declared, used)
+			}
+		}
+	}
+	if body.Len() == 0 {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by proto-gen-go from %s. DO NOT EDIT.\n\n", filepath.Base(name))
+	fmt.Fprintf(&buf, "package %s\n\nimport (\n", f.Name.Name)
+	var pkgs []string
+	for pkg := range used {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		fmt.Fprintf(&buf, "\t%q\n", pkg)
+	}
+	buf.WriteString(")\n")
+	buf.Write(body.Bytes())
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("enums of %s: %v", name, err)
+	}
+	return out, nil
+}
+
+// enumValues returns the values of the enum of the literal of its
+// T_name map, such as map[int32]string{0: "STATUS_UNSPECIFIED", ...},
+// with their names in the case convention. Aliases (values with the
+// number of an earlier one) are not in the map.
+func enumValues(enum string, lit *ast.CompositeLit, ec *EnumsConfig) ([]enumValue, error) {
+	var values []enumValue
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		var number int64
+		switch k := kv.Key.(type) {
+		case *ast.BasicLit:
+			number, _ = strconv.ParseInt(k.Value, 0, 64)
+		case *ast.UnaryExpr: // a negative number
+			if b, ok := k.X.(*ast.BasicLit); ok && k.Op == token.SUB {
+				n, _ := strconv.ParseInt(b.Value, 0, 64)
+				number = -n
+			}
+		}
+		v, ok := kv.Value.(*ast.BasicLit)
+		if !ok {
+			continue
+		}
+		proto, err := strconv.Unquote(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, enumValue{number: number, proto: proto})
+	}
+
+	// The prefix of the values of a nested enum T_E is that of E.
+	prefix := ""
+	if ec.TrimPrefix {
+		goName := enum[strings.LastIndex(enum, "_")+1:]
+		prefix = strings.ToUpper(snakeCase(goName)) + "_"
+		for _, v := range values {
+			if !strings.HasPrefix(v.proto, prefix) || len(v.proto) == len(prefix) {
+				prefix = "" // not the convention of this enum
+				break
+			}
+		}
+	}
+	seen := make(map[string]string)
+	for i, v := range values {
+		name := enumCases[ec.Case](strings.Split(strings.TrimPrefix(v.proto, prefix), "_"))
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("the values %s and %s of %s have the same name %q in case %s", other, v.proto, enum, name, ec.Case)
+		}
+		seen[name] = v.proto
+		values[i].name = name
+	}
+	return values, nil
+}
+
+// writeEnumHelpers writes the helpers of the enum, other than those
+// declared already, and records in used the packages they import.
+func writeEnumHelpers(w *bytes.Buffer, enum string, values []enumValue, declared, used map[string]bool) {
+	fmt.Fprintf(w, "\nvar (\n\t_%[1]s_names = map[%[1]s]string{\n", enum)
+	for _, v := range values {
+		fmt.Fprintf(w, "\t\t%d: %q,\n", v.number, v.name)
+	}
+	fmt.Fprintf(w, "\t}\n\t_%[1]s_values = map[string]%[1]s{\n", enum)
+	for _, v := range values {
+		fmt.Fprintf(w, "\t\t%q: %d,\n", v.name, v.number)
+		if v.proto != v.name {
+			fmt.Fprintf(w, "\t\t%q: %d,\n", v.proto, v.number)
+		}
+	}
+	w.WriteString("\t}\n)\n")
+
+	if !declared["Parse"+enum] {
+		used["fmt"] = true
+		fmt.Fprintf(w, `
+// Parse%[1]s returns the %[1]s value of the name s, in the case
+// convention of its helpers or as in the .proto file.
+func Parse%[1]s(s string) (%[1]s, error) {
+	if x, ok := _%[1]s_values[s]; ok {
+		return x, nil
+	}
+	return 0, fmt.Errorf("invalid %[1]s %%q", s)
+}
+`, enum)
+	}
+	if !declared[enum+"Values"] {
+		fmt.Fprintf(w, "\n// %[1]sValues returns the values of %[1]s, in the order of their declaration.\nfunc %[1]sValues() []%[1]s {\n\treturn []%[1]s{", enum)
+		for i, v := range values {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			fmt.Fprintf(w, "%d", v.number)
+		}
+		w.WriteString("}\n}\n")
+	}
+	if !declared[enum+".MarshalText"] {
+		used["strconv"] = true
+		fmt.Fprintf(w, `
+// MarshalText implements encoding.TextMarshaler, with the name of the
+// value, or its number if it has none.
+func (x %[1]s) MarshalText() ([]byte, error) {
+	if name, ok := _%[1]s_names[x]; ok {
+		return []byte(name), nil
+	}
+	return []byte(strconv.FormatInt(int64(x), 10)), nil
+}
+`, enum)
+	}
+	if !declared[enum+".UnmarshalText"] {
+		used["strconv"] = true
+		fmt.Fprintf(w, `
+// UnmarshalText implements encoding.TextUnmarshaler, accepting a name,
+// as Parse%[1]s does, or a number.
+func (x *%[1]s) UnmarshalText(b []byte) error {
+	if n, err := strconv.ParseInt(string(b), 10, 32); err == nil {
+		*x = %[1]s(n)
+		return nil
+	}
+	v, err := Parse%[1]s(string(b))
+	if err != nil {
+		return err
+	}
+	*x = v
+	return nil
+}
+`, enum)
+	}
+	if !declared[enum+".MarshalJSON"] {
+		used["encoding/json"], used["strconv"] = true, true
+		fmt.Fprintf(w, `
+// MarshalJSON implements json.Marshaler, with the name of the value as
+// a string, or its number if it has none.
+func (x %[1]s) MarshalJSON() ([]byte, error) {
+	if name, ok := _%[1]s_names[x]; ok {
+		return json.Marshal(name)
+	}
+	return []byte(strconv.FormatInt(int64(x), 10)), nil
+}
+`, enum)
+	}
+	if !declared[enum+".UnmarshalJSON"] {
+		used["encoding/json"], used["fmt"] = true, true
+		fmt.Fprintf(w, `
+// UnmarshalJSON implements json.Unmarshaler, accepting a name, as a
+// string, or a number.
+func (x *%[1]s) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int32
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid %[1]s %%s", b)
+		}
+		*x = %[1]s(n)
+		return nil
+	}
+	return x.UnmarshalText([]byte(s))
+}
+`, enum)
+	}
+}
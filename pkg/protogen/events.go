@@ -0,0 +1,130 @@
+package protogen
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Event is a structured report of the progress of a Run, for
+// programs that monitor generation (see Options.Events). Its JSON
+// encoding is one object whose "type" field is that of the event.
+type Event struct {
+	Time time.Time `json:"time"`
+
+	// Type is one of:
+	//   - "log": a progress Message, as passed to Options.Logf;
+	//   - "phase": the end of a Phase ("image", "install", "protoc"
+	//     or "postprocess"), with its Duration, and Error if it failed;
+	//     for the image, whether it was Cached;
+	//   - "diagnostic": a line of protoc's diagnostics, with the File,
+	//     Line and Column it names, if any;
+	//   - "output": a line of the runtime's or a command's own output;
+	//   - "result": the end of the Run, with its Duration, Image,
+	//     generated Files, number of Protos compiled and Timings, and
+	//     Error if it failed.
+	Type string `json:"type"`
+
+	Message  string        `json:"message,omitempty"`
+	Phase    string        `json:"phase,omitempty"`
+	Duration time.Duration `json:"-"` // encoded as "duration_ms"
+	Image    string        `json:"image,omitempty"`
+	Cached   bool          `json:"cached,omitempty"`
+	File     string        `json:"file,omitempty"` // relative to Dir (if within it), slash-separated
+	Line     int           `json:"line,omitempty"`
+	Column   int           `json:"column,omitempty"`
+	Files    []string      `json:"files,omitempty"` // relative to Dir, slash-separated
+	Protos   int           `json:"protos,omitempty"`
+	Timings  *Timings      `json:"timings,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the event, with its duration in milliseconds.
+func (ev Event) MarshalJSON() ([]byte, error) {
+	type event Event // without the MarshalJSON method
+	return json.Marshal(struct {
+		event
+		DurationMS float64 `json:"duration_ms,omitempty"`
+	}{event(ev), float64(ev.Duration) / float64(time.Millisecond)})
+}
+
+// MarshalJSON encodes the timings in milliseconds.
+func (t Timings) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(struct {
+		ImageMS       float64 `json:"image_ms"`
+		ImageCached   bool    `json:"image_cached"`
+		ProtocMS      float64 `json:"protoc_ms"`
+		PostprocessMS float64 `json:"postprocess_ms"`
+		TotalMS       float64 `json:"total_ms"`
+	}{ms(t.Image), t.ImageCached, ms(t.Protoc), ms(t.Postprocess), ms(t.Total)})
+}
+
+// event reports the event, if events are enabled.
+func (opts *Options) event(ev Event) {
+	if opts.Events == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	opts.Events(ev)
+}
+
+// phase records the duration of the phase of the run that started at
+// start, which failed if err is non-nil, and reports its end. It
+// returns err.
+func (e *env) phase(opts *Options, name string, start time.Time, err error) error {
+	d := time.Since(start)
+	ev := Event{Type: "phase", Phase: name, Duration: d}
+	switch name {
+	case "image", "install":
+		e.timings.Image += d
+		ev.Image, ev.Cached = e.image, e.timings.ImageCached
+	case "protoc":
+		e.timings.Protoc += d
+	case "postprocess":
+		e.timings.Postprocess += d
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	opts.event(ev)
+	return err
+}
+
+// diagnosticEvent returns the event of a line of protoc's diagnostics,
+// of the form "file:line:col: message" or "file: message", where file,
+// if not empty, is that of the rewritten line (see diagWriter).
+func diagnosticEvent(line, file string) Event {
+	ev := Event{Type: "diagnostic", Message: strings.TrimRight(line, "\r\n")}
+	if file == "" {
+		return ev
+	}
+	ev.File = filepath.ToSlash(file)
+	rest := strings.TrimPrefix(ev.Message[len(file):], ":")
+	if n, after, ok := cutNumber(rest); ok {
+		ev.Line, rest = n, after
+		if n, after, ok := cutNumber(rest); ok {
+			ev.Column, rest = n, after
+		}
+	}
+	ev.Message = strings.TrimSpace(rest)
+	return ev
+}
+
+// cutNumber returns the decimal number before the first colon of s,
+// and the rest of s after the colon.
+func cutNumber(s string) (int, string, bool) {
+	num, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, s, false
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return 0, s, false
+	}
+	return n, rest, true
+}
@@ -0,0 +1,336 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A FakesConfig configures the generation, if enabled, of constructors
+// of fake messages for tests, in a package beside each generated
+// package: for a message X, NewFakeX(seed int64) returns an X whose
+// fields are all set to values derived from the seed.
+type FakesConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"` // subdirectory of each generated package that holds its fakes (default: "fakes")
+}
+
+// Defaults of FakesConfig.
+const (
+	defaultFakesDir = "fakes"
+
+	// fakeDepth is the depth of the nested messages of a fake message
+	// beyond which its message fields are left unset, so that the
+	// constructors of recursive messages terminate.
+	fakeDepth = 3
+)
+
+// resolve sets the unset fields of the config to their defaults.
+func (fc *FakesConfig) resolve() error {
+	if !fc.Enabled {
+		return nil
+	}
+	if fc.Dir == "" {
+		fc.Dir = defaultFakesDir
+	}
+	if name := path.Base(filepath.ToSlash(fc.Dir)); !token.IsIdentifier(name) {
+		return fmt.Errorf("fakes: the base name of dir %q is not a valid Go package name", fc.Dir)
+	}
+	return nil
+}
+
+// writeFakes writes the constructors of fake messages of the generated
+// files, named relative to the host directory dir, which stands in for
+// opts.Dir, and returns the names of those it created or modified.
+func writeFakes(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Fakes.Enabled {
+		return nil, nil
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") {
+			continue
+		}
+		importPath, err := goImportPath(filepath.Dir(filepath.Join(opts.Dir, file)))
+		if err != nil {
+			return nil, fmt.Errorf("fakes: %v", err)
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		fakes, err := fakeFile(file, src, importPath, &opts.Fakes)
+		if err != nil {
+			return nil, err
+		}
+		if fakes == nil {
+			continue // no messages
+		}
+		stem := strings.TrimSuffix(filepath.Base(file), ".pb.go")
+		name := filepath.Join(filepath.Dir(file), filepath.FromSlash(opts.Fakes.Dir), stem+"_fake.go")
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, fakes) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filename, fakes, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// A faker writes the constructors of the fake messages of a Go file
+// generated by protoc-gen-go.
+type faker struct {
+	*cloner
+	gen   string           // name of the generated package
+	enums map[string]int64 // the first nonzero value (or zero) of the enums of the file
+}
+
+// fakeFile returns the source of the constructors of the fake messages
+// of the generated Go file, whose package has the specified import
+// path, or nil if it has none. The constructors of the messages of the
+// same package, which the fake messages hold, are assumed to be those
+// of the other files of the package.
+func fakeFile(name string, src []byte, importPath string, fc *FakesConfig) ([]byte, error) {
+	c, err := newCloner(name, src)
+	if err != nil {
+		return nil, fmt.Errorf("fakes: %v", err)
+	}
+	f := &faker{cloner: c, gen: c.file.Name.Name, enums: make(map[string]int64)}
+	c.pkg = path.Base(filepath.ToSlash(fc.Dir))
+	c.imports[f.gen] = importPath
+	c.used[f.gen] = true
+
+	// The values of the enums of the file are the keys of their T_name
+	// maps (see enumFile).
+	for _, decl := range c.file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, id := range vs.Names {
+				enum := strings.TrimSuffix(id.Name, "_name")
+				if enum == id.Name || i >= len(vs.Values) {
+					continue
+				}
+				lit, ok := vs.Values[i].(*ast.CompositeLit)
+				if !ok {
+					continue
+				}
+				values, err := enumValues(enum, lit, &EnumsConfig{Case: "proto"})
+				if err != nil {
+					return nil, fmt.Errorf("fakes: %s: %v", name, err)
+				}
+				f.enums[enum] = 0
+				for _, v := range values {
+					if v.number != 0 {
+						f.enums[enum] = v.number
+						break
+					}
+				}
+			}
+		}
+	}
+
+	specs := c.messageSpecs()
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	for _, ts := range specs {
+		f.writeFake(ts.Name.Name, ts.Type.(*ast.StructType))
+	}
+	out, err := c.source(name)
+	if err != nil {
+		return nil, fmt.Errorf("fakes of %s: %v", name, err)
+	}
+	return out, nil
+}
+
+// writeFake writes the constructors of the fake message.
+func (f *faker) writeFake(msg string, st *ast.StructType) {
+	fmt.Fprintf(&f.w, `
+// NewFake%[1]s returns a %[2]s.%[1]s for tests whose fields are all
+// set to values derived from seed, so that the fakes of a seed are
+// equal. Repeated and map fields have two elements, the fields of a
+// oneof are set in turn by successive seeds, and messages are nested
+// down to %[3]d levels.
+func NewFake%[1]s(seed int64) *%[2]s.%[1]s {
+	return fake%[1]s(seed, 0)
+}
+
+func fake%[1]s(seed int64, depth int) *%[2]s.%[1]s {
+	x := new(%[2]s.%[1]s)
+`, msg, f.gen, fakeDepth)
+	var nested bytes.Buffer // statements that set message fields
+	for _, field := range st.Fields.List {
+		for _, id := range field.Names {
+			if !id.IsExported() {
+				continue
+			}
+			if t, ok := field.Type.(*ast.Ident); ok && f.oneofs[t.Name] != nil {
+				f.writeOneof(&f.w, "x."+id.Name, f.oneofs[t.Name])
+				continue
+			}
+			w := &f.w
+			if f.holdsMessage(field.Type, wireType(field)) {
+				w = &nested
+			}
+			fmt.Fprintf(w, "\tx.%s = %s\n", id.Name, f.fakeValue(field.Type, field, "seed"))
+		}
+	}
+	if nested.Len() > 0 {
+		fmt.Fprintf(&f.w, "\tif depth < %d {\n", fakeDepth)
+		f.w.Write(nested.Bytes())
+		f.w.WriteString("\t}\n")
+	}
+	f.w.WriteString("\treturn x\n}\n")
+}
+
+// writeOneof writes the statements that set the oneof field x to one of
+// the wrapper types, chosen by the seed.
+func (f *faker) writeOneof(w *bytes.Buffer, x string, wrappers []*ast.TypeSpec) {
+	fmt.Fprintf(w, "\tswitch uint64(seed) %% %d {\n", len(wrappers))
+	for i, ts := range wrappers {
+		fmt.Fprintf(w, "\tcase %d:\n", i)
+		st, ok := ts.Type.(*ast.StructType)
+		if !ok || len(st.Fields.List) != 1 || len(st.Fields.List[0].Names) != 1 {
+			continue
+		}
+		member := st.Fields.List[0]
+		set := fmt.Sprintf("%s = &%s.%s{%s: %s}", x, f.gen, ts.Name.Name, member.Names[0].Name, f.fakeValue(member.Type, member, "seed"))
+		if f.holdsMessage(member.Type, wireType(member)) {
+			fmt.Fprintf(w, "\t\tif depth < %d {\n\t\t\t%s\n\t\t}\n", fakeDepth, set)
+		} else {
+			fmt.Fprintf(w, "\t\t%s\n", set)
+		}
+	}
+	w.WriteString("\t}\n")
+}
+
+// holdsMessage reports whether values of the type, whose elements have
+// the wire type, hold messages of the same package, whose constructors
+// take the depth.
+func (f *faker) holdsMessage(t ast.Expr, wire string) bool {
+	switch t := t.(type) {
+	case *ast.StarExpr:
+		elem, ok := t.X.(*ast.Ident)
+		return ok && (f.messages[elem.Name] || wire == "bytes" && !predeclaredTypes[elem.Name])
+	case *ast.ArrayType:
+		return f.holdsMessage(t.Elt, wire)
+	case *ast.MapType:
+		return f.holdsMessage(t.Value, "bytes")
+	}
+	return false
+}
+
+// fakeValue returns the expression of the fake value, derived from
+// seed, of the type of the struct field, or of an element of it.
+func (f *faker) fakeValue(t ast.Expr, field *ast.Field, seed string) string {
+	name, number := protoName(field), fieldNumber(field)
+	switch t := t.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			f.used["strconv"] = true
+			return fmt.Sprintf("%q + strconv.FormatInt(%s, 10)", name+"-", seed)
+		case "bool":
+			return fmt.Sprintf("(%s+%d)%%2 == 0", seed, number)
+		case "int32", "int64", "uint32", "uint64":
+			return fmt.Sprintf("%s(%s + %d)", t.Name, seed, number)
+		case "float32", "float64":
+			return fmt.Sprintf("%s(%s+%d) / 2", t.Name, seed, number)
+		}
+		// An enum of the same package.
+		value, ok := f.enums[t.Name]
+		if !ok {
+			value = 1
+		}
+		return fmt.Sprintf("%s(%d)", f.typeString(t), value)
+	case *ast.SelectorExpr: // an enum of another package
+		return fmt.Sprintf("%s(1)", f.typeString(t))
+	case *ast.StarExpr:
+		switch elem := t.X.(type) {
+		case *ast.Ident:
+			if f.messages[elem.Name] || wireType(field) == "bytes" && !predeclaredTypes[elem.Name] {
+				return fmt.Sprintf("fake%s(%s, depth+1)", elem.Name, seed)
+			}
+			if predeclaredTypes[elem.Name] {
+				// An optional scalar, by the helpers of the proto
+				// package, such as proto.String.
+				f.used["proto"] = true
+				return fmt.Sprintf("proto.%s(%s)", titleWords([]string{elem.Name}), f.fakeValue(elem, field, seed))
+			}
+		case *ast.SelectorExpr:
+			if wireType(field) == "bytes" {
+				// A message of another package, such as a
+				// google.protobuf.Timestamp, is left empty.
+				return fmt.Sprintf("new(%s)", f.typeString(elem))
+			}
+		}
+		// An optional enum.
+		return fmt.Sprintf("%s.Enum()", f.fakeValue(t.X, field, seed))
+	case *ast.ArrayType:
+		if id, ok := t.Elt.(*ast.Ident); ok && id.Name == "byte" {
+			f.used["strconv"] = true
+			return fmt.Sprintf("[]byte(%q + strconv.FormatInt(%s, 10))", name+"-", seed)
+		}
+		return fmt.Sprintf("%s{%s, %s}", f.typeString(t), f.fakeValue(t.Elt, field, seed), f.fakeValue(t.Elt, field, seed+"+1"))
+	case *ast.MapType:
+		// The tag of the value is that of the map, a message or bytes.
+		value := &ast.Field{Tag: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(`protobuf:"bytes,` + strconv.Itoa(number) + `,rep,name=` + name + `"`)}}
+		return fmt.Sprintf("%s{%s: %s, %s: %s}", f.typeString(t),
+			f.fakeValue(t.Key, field, seed), f.fakeValue(t.Value, value, seed),
+			f.fakeValue(t.Key, field, seed+"+1"), f.fakeValue(t.Value, value, seed+"+1"))
+	}
+	return fmt.Sprintf("*new(%s)", f.typeString(t))
+}
+
+// typeString returns the source of the type expression in the package
+// of the fakes, in which the types of the generated package are
+// qualified.
+func (f *faker) typeString(t ast.Expr) string {
+	switch t := t.(type) {
+	case *ast.Ident:
+		if predeclaredTypes[t.Name] {
+			return t.Name
+		}
+		return f.gen + "." + t.Name
+	case *ast.StarExpr:
+		return "*" + f.typeString(t.X)
+	case *ast.ArrayType:
+		return "[]" + f.typeString(t.Elt)
+	case *ast.MapType:
+		return "map[" + f.typeString(t.Key) + "]" + f.typeString(t.Value)
+	}
+	f.qualify(t)
+	return f.cloner.typeString(t)
+}
+
+// fieldNumber returns the field number of the protobuf struct tag of
+// the field, or 0.
+func fieldNumber(field *ast.Field) int {
+	if field.Tag == nil {
+		return 0
+	}
+	tag, _ := strconv.Unquote(field.Tag.Value)
+	parts := strings.Split(reflect.StructTag(tag).Get("protobuf"), ",")
+	if len(parts) < 2 {
+		return 0
+	}
+	n, _ := strconv.Atoi(parts[1])
+	return n
+}
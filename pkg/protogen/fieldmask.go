@@ -0,0 +1,274 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// writeFieldMasks writes, if Config.FieldMasks is set, the field mask
+// helpers of the messages of the generated files, named relative to
+// the host directory dir, which stands in for opts.Dir, and returns the
+// names of those it created or modified.
+func writeFieldMasks(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.FieldMasks {
+		return nil, nil
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") {
+			continue
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		helpers, skipped, err := fieldMaskFile(file, src)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range skipped {
+			opts.logf("field_masks: skipping %s of %s, whose helpers would conflict with its fields or the declarations of the file", msg, file)
+		}
+		if helpers == nil {
+			continue // no messages
+		}
+		name := strings.TrimSuffix(file, ".pb.go") + "_fieldmask.go"
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, helpers) {
+			continue
+		}
+		if err := os.WriteFile(filename, helpers, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// A maskField is a field of a message that a field mask path may name.
+type maskField struct {
+	name   string     // proto name, the path of the field
+	goName string     // Go name of the struct field
+	field  *ast.Field // struct field, or that of the oneof wrapper
+	oneof  string     // Go name of the oneof field, if a member of one
+	spec   string     // with oneof, the wrapper type
+	nested string     // message type of the same package, which paths may descend into
+}
+
+// fieldMaskFile returns the source of the field mask helpers of the
+// messages of the Go file generated by protoc-gen-go, or nil if it has
+// none, and the messages skipped, for which the helpers would conflict
+// with their fields or methods or the declarations of the file. The
+// helpers copy message fields by their Clone methods (see cloneFile).
+func fieldMaskFile(name string, src []byte) ([]byte, []string, error) {
+	c, err := newCloner(name, src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("field_masks: %v", err)
+	}
+	decls := make(map[string]bool)
+	for _, decl := range c.file.Decls {
+		switch decl := decl.(type) {
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					decls[spec.Name.Name] = true
+				case *ast.ValueSpec:
+					for _, id := range spec.Names {
+						decls[id.Name] = true
+					}
+				}
+			}
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				decls[decl.Name.Name] = true
+			}
+		}
+	}
+
+	var skipped []string
+	for _, ts := range c.messageSpecs() {
+		msg := ts.Name.Name
+		st := ts.Type.(*ast.StructType)
+		fields := c.maskFields(st)
+		conflict := false
+		for _, m := range []string{"ApplyFieldMask", "applyFieldPath", "validFieldPath"} {
+			conflict = conflict || c.methods[msg+"."+m] || hasField(st, m)
+		}
+		for _, f := range fields {
+			conflict = conflict || decls[msg+"Field"+f.goName]
+		}
+		if conflict {
+			skipped = append(skipped, msg)
+			continue
+		}
+		c.writeFieldMask(msg, fields)
+	}
+	if c.w.Len() == 0 {
+		return nil, skipped, nil
+	}
+	out, err := c.source(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("field masks of %s: %v", name, err)
+	}
+	return out, skipped, nil
+}
+
+// maskFields returns the fields of the message, in the order of
+// declaration, with the members of its oneofs in place of the oneofs.
+func (c *cloner) maskFields(st *ast.StructType) []maskField {
+	var fields []maskField
+	for _, field := range st.Fields.List {
+		for _, id := range field.Names {
+			if !id.IsExported() {
+				continue
+			}
+			if t, ok := field.Type.(*ast.Ident); ok && c.oneofs[t.Name] != nil {
+				for _, ts := range c.oneofs[t.Name] {
+					wst, ok := ts.Type.(*ast.StructType)
+					if !ok || len(wst.Fields.List) != 1 || len(wst.Fields.List[0].Names) != 1 {
+						continue
+					}
+					member := wst.Fields.List[0]
+					fields = append(fields, maskField{
+						name:   protoName(member),
+						goName: member.Names[0].Name,
+						field:  member,
+						oneof:  id.Name,
+						spec:   ts.Name.Name,
+					})
+				}
+				continue
+			}
+			f := maskField{name: protoName(field), goName: id.Name, field: field}
+			if star, ok := field.Type.(*ast.StarExpr); ok {
+				if elem, ok := star.X.(*ast.Ident); ok && (c.messages[elem.Name] || wireType(field) == "bytes" && !predeclaredTypes[elem.Name]) {
+					f.nested = elem.Name
+				}
+			}
+			if f.name != "" {
+				fields = append(fields, f)
+			}
+		}
+	}
+	return fields
+}
+
+// protoName returns the name of the field in the .proto file, from the
+// protobuf struct tag of the field.
+func protoName(field *ast.Field) string {
+	if field.Tag == nil {
+		return ""
+	}
+	tag, _ := strconv.Unquote(field.Tag.Value)
+	for _, opt := range strings.Split(reflect.StructTag(tag).Get("protobuf"), ",") {
+		if strings.HasPrefix(opt, "name=") {
+			return strings.TrimPrefix(opt, "name=")
+		}
+	}
+	return ""
+}
+
+// writeFieldMask writes the field path constants and the ApplyFieldMask
+// method of the message, and the methods that validate and apply a
+// single path, through which the paths of a message field descend into
+// it.
+func (c *cloner) writeFieldMask(msg string, fields []maskField) {
+	c.used["fieldmaskpb"] = true
+	c.used["fmt"] = true
+	if len(fields) > 0 {
+		fmt.Fprintf(&c.w, "\n// Paths of the fields of %s, for the paths of a google.protobuf.FieldMask.\nconst (\n", msg)
+		for _, f := range fields {
+			fmt.Fprintf(&c.w, "\t%sField%s = %q\n", msg, f.goName, f.name)
+		}
+		c.w.WriteString(")\n")
+	}
+
+	fmt.Fprintf(&c.w, `
+// ApplyFieldMask sets the fields of x named by the paths of the mask
+// to deep copies of those of src (or clears them, if src is nil), as
+// an update with the mask does. A path may descend into a field of a
+// message of the same package, such as "a.b". An empty mask changes
+// nothing. ApplyFieldMask reports an error, and changes nothing, if a
+// path names no field.
+func (x *%[1]s) ApplyFieldMask(src *%[1]s, mask *fieldmaskpb.FieldMask) error {
+	for _, path := range mask.GetPaths() {
+		if !x.validFieldPath(path) {
+			return fmt.Errorf("%[1]s: invalid field mask path %%q", path)
+		}
+	}
+	for _, path := range mask.GetPaths() {
+		x.applyFieldPath(src, path)
+	}
+	return nil
+}
+`, msg)
+
+	nested := false
+	for _, f := range fields {
+		nested = nested || f.nested != ""
+	}
+
+	// validFieldPath
+	fmt.Fprintf(&c.w, "\n// validFieldPath reports whether the path names a field of %s.\nfunc (*%s) validFieldPath(path string) bool {\n", msg, msg)
+	if len(fields) > 0 {
+		var names []string
+		if nested {
+			c.used["strings"] = true
+			c.w.WriteString("\tname, rest, nested := strings.Cut(path, \".\")\n\tswitch name {\n")
+			for _, f := range fields {
+				if f.nested != "" {
+					fmt.Fprintf(&c.w, "\tcase %q:\n\t\treturn !nested || (*%s)(nil).validFieldPath(rest)\n", f.name, f.nested)
+				} else {
+					names = append(names, strconv.Quote(f.name))
+				}
+			}
+			if len(names) > 0 {
+				fmt.Fprintf(&c.w, "\tcase %s:\n\t\treturn !nested\n", strings.Join(names, ", "))
+			}
+		} else {
+			for _, f := range fields {
+				names = append(names, strconv.Quote(f.name))
+			}
+			fmt.Fprintf(&c.w, "\tswitch path {\n\tcase %s:\n\t\treturn true\n", strings.Join(names, ", "))
+		}
+		c.w.WriteString("\t}\n")
+	}
+	c.w.WriteString("\treturn false\n}\n")
+
+	// applyFieldPath
+	fmt.Fprintf(&c.w, "\n// applyFieldPath sets the field of x named by the valid path to a deep\n// copy of that of src.\nfunc (x *%[1]s) applyFieldPath(src *%[1]s, path string) {\n\tif src == nil {\n\t\tsrc = new(%[1]s)\n\t}\n", msg)
+	if len(fields) > 0 {
+		if nested {
+			c.w.WriteString("\tname, rest, nested := strings.Cut(path, \".\")\n\tswitch name {\n")
+		} else {
+			c.w.WriteString("\tswitch path {\n")
+		}
+		for _, f := range fields {
+			dst, from := "x."+f.goName, "src."+f.goName
+			fmt.Fprintf(&c.w, "\tcase %q:\n", f.name)
+			switch {
+			case f.oneof != "":
+				fmt.Fprintf(&c.w, "\t\tif v, ok := src.%s.(*%s); ok {\n\t\t\twrapper := new(%s)\n", f.oneof, f.spec, f.spec)
+				c.copyValue(&c.w, "wrapper."+f.goName, "v."+f.goName, f.field.Type, wireType(f.field), 1)
+				fmt.Fprintf(&c.w, "\t\t\tx.%s = wrapper\n\t\t} else if _, ok := x.%s.(*%s); ok {\n\t\t\tx.%s = nil\n\t\t}\n", f.oneof, f.oneof, f.spec, f.oneof)
+			case f.nested != "":
+				fmt.Fprintf(&c.w, "\t\tif !nested {\n\t\t\t%s = %s.Clone()\n\t\t} else if %s != nil || %s != nil {\n", dst, from, from, dst)
+				fmt.Fprintf(&c.w, "\t\t\tif %s == nil {\n\t\t\t\t%s = new(%s)\n\t\t\t}\n\t\t\t%s.applyFieldPath(%s, rest)\n\t\t}\n", dst, dst, f.nested, dst, from)
+			default:
+				if !scalarType(f.field.Type) {
+					fmt.Fprintf(&c.w, "\t\t%s = nil\n", dst)
+				}
+				c.copyValue(&c.w, dst, from, f.field.Type, wireType(f.field), 0)
+			}
+		}
+		c.w.WriteString("\t}\n")
+	}
+	c.w.WriteString("}\n")
+}
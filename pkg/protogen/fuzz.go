@@ -0,0 +1,153 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A FuzzConfig configures the generation, if enabled, of the fuzz
+// targets of the messages generated by protoc-gen-go, beside each
+// generated file, which check that the messages decoded from the fuzzed
+// input survive round trips through the wire, JSON and text formats.
+type FuzzConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Skip    []string `yaml:"skip"` // messages without fuzz targets, by Go type (e.g. "User_Address")
+}
+
+// writeFuzzTargets writes the fuzz targets of the messages of the
+// generated files, named relative to the host directory dir, which
+// stands in for opts.Dir, and returns the names of those it created or
+// modified. With Config.Fakes, the fakes of the messages seed the corpus.
+func writeFuzzTargets(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Fuzz.Enabled {
+		return nil, nil
+	}
+	skip := make(map[string]bool)
+	for _, msg := range opts.Fuzz.Skip {
+		skip[msg] = true
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") {
+			continue
+		}
+		importPath, err := goImportPath(filepath.Dir(filepath.Join(opts.Dir, file)))
+		if err != nil {
+			return nil, fmt.Errorf("fuzz: %v", err)
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		fakes := ""
+		if opts.Fakes.Enabled {
+			fakes = path.Join(importPath, filepath.ToSlash(opts.Fakes.Dir))
+		}
+		targets, err := fuzzFile(file, src, importPath, fakes, skip)
+		if err != nil {
+			return nil, err
+		}
+		if targets == nil {
+			continue // no messages
+		}
+		name := strings.TrimSuffix(file, ".pb.go") + "_fuzz_test.go"
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, targets) {
+			continue
+		}
+		if err := os.WriteFile(filename, targets, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// fuzzFile returns the source of the fuzz targets of the messages of
+// the generated Go file, whose package has the specified import path,
+// other than those to skip, or nil if it has none. The targets are in
+// the external test package, which may import the package of the fakes
+// of the messages, if fakes is its import path, to seed the corpus.
+func fuzzFile(name string, src []byte, importPath, fakes string, skip map[string]bool) ([]byte, error) {
+	c, err := newCloner(name, src)
+	if err != nil {
+		return nil, fmt.Errorf("fuzz: %v", err)
+	}
+	gen := c.file.Name.Name
+	c.pkg = gen + "_test"
+	c.imports[gen] = importPath
+	if fakes != "" {
+		c.imports[path.Base(fakes)] = fakes
+	}
+	for _, ts := range c.messageSpecs() {
+		msg := ts.Name.Name
+		if skip[msg] {
+			continue
+		}
+		for _, pkg := range []string{gen, "proto", "protojson", "prototext", "testing"} {
+			c.used[pkg] = true
+		}
+		fmt.Fprintf(&c.w, `
+// Fuzz%[1]s checks that the %[1]s messages decoded from the input
+// survive round trips through the wire, JSON and text formats.
+func Fuzz%[1]s(f *testing.F) {
+	f.Add([]byte{})
+`, msg)
+		if fakes != "" {
+			c.used[path.Base(fakes)] = true
+			fmt.Fprintf(&c.w, `	for seed := int64(0); seed < 2; seed++ {
+		data, err := proto.Marshal(%s.NewFake%s(seed))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+`, path.Base(fakes), msg)
+		}
+		fmt.Fprintf(&c.w, `	f.Fuzz(func(t *testing.T, data []byte) {
+		// Unknown fields do not survive JSON and text.
+		x := new(%[1]s.%[2]s)
+		if err := (proto.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, x); err != nil {
+			return
+		}
+		for _, format := range []struct {
+			name      string
+			marshal   func(proto.Message) ([]byte, error)
+			unmarshal func([]byte, proto.Message) error
+		}{
+			{"wire", proto.Marshal, proto.Unmarshal},
+			{"JSON", protojson.Marshal, protojson.Unmarshal},
+			{"text", prototext.Marshal, prototext.Unmarshal},
+		} {
+			out, err := format.marshal(x)
+			if err != nil {
+				if format.name == "wire" {
+					t.Fatalf("marshaling %%v: %%v", x, err)
+				}
+				continue // not representable in the format, e.g. an invalid timestamp
+			}
+			y := new(%[1]s.%[2]s)
+			if err := format.unmarshal(out, y); err != nil {
+				t.Fatalf("unmarshaling %%s of %%v: %%v", format.name, x, err)
+			}
+			if !proto.Equal(x, y) {
+				t.Fatalf("%%s round trip of %%v: got %%v", format.name, x, y)
+			}
+		}
+	})
+}
+`, gen, msg)
+	}
+	if c.w.Len() == 0 {
+		return nil, nil
+	}
+	out, err := c.source(name)
+	if err != nil {
+		return nil, fmt.Errorf("fuzz targets of %s: %v", name, err)
+	}
+	return out, nil
+}
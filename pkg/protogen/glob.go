@@ -0,0 +1,163 @@
+package protogen
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultExcludes are the names of the directories that are never
+// searched for .proto files, in addition to those beginning with a dot,
+// the vendor directory of the config, and its Exclude patterns.
+var defaultExcludes = []string{"node_modules", "vendor"}
+
+// expandProtoFiles returns the protoc arguments with each .proto file
+// pattern, such as *.proto or api/**/*.proto, replaced by the files
+// beneath pwd that match it, followed by the .proto files found in the
+// recursive directory, if any. Files are named relative to pwd if the
+// pattern or directory is relative.
+func expandProtoFiles(args []string, pwd, recursive string, cfg *Config) ([]string, error) {
+	var expanded []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") || !strings.HasSuffix(arg, ".proto") || !strings.ContainsAny(arg, "*?[") {
+			expanded = append(expanded, arg)
+			continue
+		}
+		files, err := globProtoFiles(arg, pwd, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no .proto files match %s", arg)
+		}
+		expanded = append(expanded, files...)
+	}
+	if recursive != "" {
+		files, err := globProtoFiles(path.Join(filepath.ToSlash(recursive), "**/*.proto"), pwd, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no .proto files beneath %s", recursive)
+		}
+		expanded = append(expanded, files...)
+	}
+	return expanded, nil
+}
+
+// globProtoFiles returns the files that match the pattern, whose
+// elements are separated by slashes and may be ** (matching any number
+// of directories), in sorted order.
+func globProtoFiles(pattern, pwd string, cfg *Config) ([]string, error) {
+	pattern = filepath.ToSlash(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+	}
+
+	// Walk from the longest directory prefix without metacharacters.
+	root := ""
+	elems := strings.Split(pattern, "/")
+	for len(elems) > 1 && !strings.ContainsAny(elems[0], "*?[") {
+		root = path.Join(root, elems[0])
+		if root == "" {
+			root = "/" // absolute pattern
+		}
+		elems = elems[1:]
+	}
+	rest := strings.Join(elems, "/")
+	dir := filepath.FromSlash(root)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(pwd, dir)
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	var files []string
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if file != dir && excluded(file, pwd, cfg) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !matchGlob(rest, rel) || excluded(file, pwd, cfg) {
+			return nil
+		}
+		files = append(files, filepath.FromSlash(path.Join(root, rel)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// excluded reports whether the file or directory is excluded from
+// the search for .proto files.
+func excluded(file, pwd string, cfg *Config) bool {
+	name := filepath.Base(file)
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, x := range defaultExcludes {
+		if name == x {
+			return true
+		}
+	}
+	rel, err := filepath.Rel(pwd, file)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if cfg.VendorDir != "" && rel == path.Clean(cfg.VendorDir) {
+		return true
+	}
+	for _, pattern := range cfg.Exclude {
+		if matchGlob(strings.TrimSuffix(path.Clean(pattern), "/"), rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether the slash-separated name matches the
+// pattern, in which ** matches any number of elements, and other
+// elements are matched as by path.Match.
+func matchGlob(pattern, name string) bool {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,138 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// updateGoldenEnv is the environment variable with which the tests of
+// Config.Golden rewrite their golden files.
+const updateGoldenEnv = "PROTO_GEN_GO_UPDATE_GOLDEN"
+
+// writeGoldenTests writes, if Config.Golden is set, the wire
+// compatibility tests of the messages of the generated files, named
+// relative to the host directory dir, which stands in for opts.Dir, and
+// returns the names of those it created or modified. The messages are
+// the fakes of Config.Fakes, which Config.Golden requires.
+func writeGoldenTests(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Golden {
+		return nil, nil
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") || strings.HasSuffix(file, "_vtproto.pb.go") {
+			continue
+		}
+		importPath, err := goImportPath(filepath.Dir(filepath.Join(opts.Dir, file)))
+		if err != nil {
+			return nil, fmt.Errorf("golden: %v", err)
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		tests, err := goldenFile(file, src, importPath, path.Join(importPath, filepath.ToSlash(opts.Fakes.Dir)))
+		if err != nil {
+			return nil, err
+		}
+		if tests == nil {
+			continue // no messages
+		}
+		name := strings.TrimSuffix(file, ".pb.go") + "_golden_test.go"
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, tests) {
+			continue
+		}
+		if err := os.WriteFile(filename, tests, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// goldenFile returns the source of the wire compatibility tests of the
+// messages of the generated Go file, whose package has the specified
+// import path, or nil if it has none. The test of a message X checks
+// that testdata/golden/X.pb, the wire format of its fake of seed 1 when
+// the golden files were written, decodes as testdata/golden/X.txtpb, its
+// text format, does: a reused field number or an incompatible change of
+// the type of a field makes them differ. The tests are in the external
+// test package, which imports the package of the fakes.
+func goldenFile(name string, src []byte, importPath, fakes string) ([]byte, error) {
+	c, err := newCloner(name, src)
+	if err != nil {
+		return nil, fmt.Errorf("golden: %v", err)
+	}
+	gen, fakesName := c.file.Name.Name, path.Base(fakes)
+	c.pkg = gen + "_test"
+	c.imports[gen] = importPath
+	c.imports[fakesName] = fakes
+	for _, ts := range c.messageSpecs() {
+		for _, pkg := range []string{gen, fakesName, "proto", "prototext", "testing", "os", "filepath"} {
+			c.used[pkg] = true
+		}
+		fmt.Fprintf(&c.w, `
+// Test%[1]sGolden checks that the golden wire format of a fake
+// %[1]s still decodes as its golden text format does, which it does
+// not if a field number is reused or the type of a field changes
+// incompatibly. %[4]s=1 rewrites the golden files.
+func Test%[1]sGolden(t *testing.T) {
+	name := filepath.Join("testdata", "golden", %[1]q)
+	if os.Getenv(%[4]q) != "" {
+		x := %[2]s.NewFake%[1]s(1)
+		wire, err := proto.MarshalOptions{Deterministic: true}.Marshal(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, err := prototext.MarshalOptions{Multiline: true}.Marshal(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name+".pb", wire, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name+".txtpb", text, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wire, err := os.ReadFile(name + ".pb")
+	if os.IsNotExist(err) {
+		t.Skipf("no golden file %%s.pb (written with %[4]s=1)", name)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	text, err := os.ReadFile(name + ".txtpb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fields removed since are unknown to both.
+	got, want := new(%[3]s.%[1]s), new(%[3]s.%[1]s)
+	if err := (proto.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(wire, got); err != nil {
+		t.Fatalf("decoding %%s.pb: %%v", name, err)
+	}
+	if err := (prototext.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(text, want); err != nil {
+		t.Fatalf("decoding %%s.txtpb: %%v", name, err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("%%s.pb decodes as\n%%v\nbut %%s.txtpb as\n%%v", name, got, name, want)
+	}
+}
+`, ts.Name.Name, fakesName, gen, updateGoldenEnv)
+	}
+	if c.w.Len() == 0 {
+		return nil, nil
+	}
+	out, err := c.source(name)
+	if err != nil {
+		return nil, fmt.Errorf("golden tests of %s: %v", name, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,207 @@
+package protogen
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A GoModuleConfig configures, if Dir is set, the generation of all the
+// Go code into a standalone Go module in Dir, to be published for the
+// consumers of the services: the output directories of the Go plugins
+// are replaced by Dir, with their module option (--go_opt=module=Path)
+// laying the files out by their go_package import paths, and after
+// generation the module's go.mod file is created or updated with the
+// runtime modules of the plugins in use, tidied, and the module built.
+type GoModuleConfig struct {
+	Dir     string            `yaml:"dir"`     // directory of the module, relative to the working directory, e.g. "gen"
+	Path    string            `yaml:"path"`    // module path (default: that of the enclosing go.mod's module, joined with Dir)
+	Go      string            `yaml:"go"`      // go directive of the go.mod file, e.g. "1.21" (default: that of the toolchain's Go, for a new file)
+	Require map[string]string `yaml:"require"` // further or overriding requirements, e.g. "google.golang.org/grpc": v1.64.0
+}
+
+// grpcRuntimeVersion is the version of google.golang.org/grpc that a Go
+// module of generated code requires for the code of protoc-gen-go-grpc,
+// which, unlike the other Go plugins, is not versioned with its runtime.
+const grpcRuntimeVersion = "v1.56.3"
+
+// goRuntimes maps the flag names of the Go plugins to the modules that
+// their generated code imports, which a Go module of generated code
+// requires, at the version of the plugin unless one is given.
+var goRuntimes = map[string]struct{ path, version string }{
+	"go":           {"google.golang.org/protobuf", ""},
+	"go-grpc":      {"google.golang.org/grpc", grpcRuntimeVersion},
+	"twirp":        {"github.com/twitchtv/twirp", ""},
+	"grpc-gateway": {"github.com/grpc-ecosystem/grpc-gateway/v2", ""},
+	"go-vtproto":   {"github.com/planetscale/vtprotobuf", ""},
+	"connect-go":   {"connectrpc.com/connect", ""},
+}
+
+// check reports an error if the go_module config is invalid.
+func (gm *GoModuleConfig) check() error {
+	if gm.Dir == "" {
+		if gm.Path != "" || gm.Go != "" || len(gm.Require) > 0 {
+			return fmt.Errorf("go_module: requires dir, the directory of the module")
+		}
+		return nil
+	}
+	dir := filepath.Clean(filepath.FromSlash(gm.Dir))
+	if filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("go_module: dir %q is not a subdirectory of the working directory", gm.Dir)
+	}
+	for mod, version := range gm.Require {
+		if mod == "" || !strings.HasPrefix(version, "v") {
+			return fmt.Errorf("go_module: invalid requirement %s %q (want a module path and a version, such as v1.2.3)", mod, version)
+		}
+	}
+	return nil
+}
+
+// goModuleArgs applies Config.GoModule to the protoc arguments: it
+// replaces the output directory of each Go plugin among them by the
+// module's directory, beneath pwd, and adds the plugin's module option.
+// If unset, it first sets the module path from the go.mod file of pwd
+// or its ancestors.
+func (cfg *Config) goModuleArgs(args []string, pwd string) ([]string, error) {
+	gm := &cfg.GoModule
+	if gm.Dir == "" {
+		return args, nil
+	}
+	dir := filepath.Join(pwd, filepath.FromSlash(gm.Dir))
+	if gm.Path == "" {
+		modFile, err := findGoMod(pwd)
+		if err != nil {
+			return nil, err
+		}
+		outer, err := goModule(pwd)
+		if err != nil {
+			return nil, err
+		}
+		if outer == "" {
+			return nil, fmt.Errorf("go_module: no go.mod file in %s or its ancestors; set go_module.path", pwd)
+		}
+		rel, err := filepath.Rel(filepath.Dir(modFile), dir)
+		if err != nil {
+			return nil, err
+		}
+		gm.Path = path.Join(outer, filepath.ToSlash(rel))
+	}
+
+	args = append([]string(nil), args...)
+	var flags []string
+	for i := 0; i < len(args); i++ {
+		start := i
+		name, value, ok := flagValue(args, &i)
+		if !ok {
+			continue
+		}
+		plugin := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, "--"), "_out"), "_opt")
+		if _, ok := goRuntimes[plugin]; !ok {
+			continue
+		}
+		if strings.Contains(value, "paths=source_relative") {
+			return nil, fmt.Errorf("go_module: %s=%s conflicts with the module option of the Go module in %s", name, value, gm.Dir)
+		}
+		if !strings.HasSuffix(name, "_out") {
+			continue
+		}
+		params, _ := splitOut(value)
+		if i == start {
+			args[i] = name + "=" + params + dir
+		} else {
+			args[i] = params + dir
+		}
+		flags = append(flags, "--"+plugin+"_opt=module="+gm.Path)
+	}
+	// Flags precede the .proto files, which follow them by convention.
+	return append(flags, args...), nil
+}
+
+// requirements returns the requirements (path@version) of the Go module
+// of generated code: the runtime modules of the Go plugins among the
+// protoc arguments, and those of the config, which take precedence.
+func (cfg *Config) requirements(args []string) []string {
+	versions := make(map[string]string)
+	for name, rt := range goRuntimes {
+		if !hasFlag(args, "--"+name+"_out") {
+			continue
+		}
+		version := rt.version
+		if version == "" {
+			if p, err := cfg.bufPlugin(name); err == nil {
+				version = p.Version
+			}
+		}
+		if version != "" {
+			versions[rt.path] = version
+		}
+	}
+	for mod, version := range cfg.GoModule.Require {
+		versions[mod] = version
+	}
+	var reqs []string
+	for mod, version := range versions {
+		reqs = append(reqs, mod+"@"+version)
+	}
+	sort.Strings(reqs)
+	return reqs
+}
+
+// buildGoModule creates or updates the go.mod file of Config.GoModule,
+// requiring the runtimes of the generated code, tidies it, and builds
+// the module, with the Go toolchain of the environment.
+func (e *env) buildGoModule(ctx context.Context, opts *Options) error {
+	gm := opts.GoModule
+	dir := filepath.Join(opts.Dir, filepath.FromSlash(gm.Dir))
+	var cmds [][]string
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); os.IsNotExist(err) {
+		cmds = append(cmds, []string{"mod", "init", gm.Path})
+	} else if err != nil {
+		return err
+	}
+	edit := []string{"mod", "edit", "-module=" + gm.Path}
+	if gm.Go != "" {
+		edit = append(edit, "-go="+gm.Go)
+	}
+	for _, req := range opts.requirements(e.protocArgs) {
+		edit = append(edit, "-require="+req)
+	}
+	cmds = append(cmds, edit, []string{"mod", "tidy"}, []string{"build", "./..."})
+	for _, args := range cmds {
+		opts.logf("go %s", joinArgs(args, opts.Dir))
+	}
+
+	if e.local != nil {
+		for _, args := range cmds {
+			if err := e.local.run(ctx, opts, opts.Dir, dir, "go", args); err != nil {
+				return fmt.Errorf("go module %s: go %s: %v", gm.Dir, strings.Join(args[:2], " "), err)
+			}
+		}
+		return nil
+	}
+	var script []string
+	for _, args := range cmds {
+		script = append(script, quoteArgs(append([]string{"go"}, args...)))
+	}
+	var flags, extra []string
+	if e.rt.user != "" {
+		flags = append(flags, "--user", e.rt.user)
+	}
+	flags = append(flags, "-w", dir, "-e", "GOCACHE=/tmp/go-build")
+	if opts.Network == "none" {
+		// Without a network, tidy can only use the host's module cache.
+		if modCache := hostModCache(ctx); modCache != "" && !e.rt.remote {
+			flags = append(flags, "-e", "GOMODCACHE="+modCache, "-e", "GOPROXY=off")
+			extra = append(extra, modCache)
+		}
+	}
+	flags = append(flags, "--entrypoint=sh", e.image, "-c", strings.Join(script, " && "))
+	if err := e.runContainer(ctx, opts, opts.Dir, flags, extra, opts.Stderr, opts.Stderr); err != nil {
+		return fmt.Errorf("go module %s: %v", gm.Dir, err)
+	}
+	return nil
+}
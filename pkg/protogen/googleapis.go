@@ -0,0 +1,108 @@
+package protogen
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// googleapisDirs are the directories of the googleapis repository
+// whose .proto files are installed in protoc's include directory.
+// They are those commonly imported by services, such as
+// google/api/annotations.proto for gRPC-Gateway.
+var googleapisDirs = []string{"google/api", "google/longrunning", "google/rpc", "google/type"}
+
+// googleapisURL returns the URL of the archive of a googleapis commit.
+func googleapisURL(commit string) string {
+	return "https://github.com/googleapis/googleapis/archive/" + commit + ".tar.gz"
+}
+
+// isCommitHash reports whether s is a full git commit hash.
+func isCommitHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// installGoogleapis installs the googleapis .proto files of the config's
+// commit in the include directory, if not already present.
+func installGoogleapis(ctx context.Context, opts *Options, include string) error {
+	stamp := filepath.Join(include, ".googleapis") // records the installed commit
+	if data, err := os.ReadFile(stamp); err == nil && string(data) == opts.Googleapis {
+		return nil
+	}
+	url := googleapisURL(opts.Googleapis)
+	if opts.DryRun {
+		_, err := fmt.Fprintf(opts.Stdout, "# download %s and extract %s to %s\n", url, strings.Join(googleapisDirs, " "), include)
+		return err
+	}
+
+	opts.logf("downloading googleapis %s...", opts.Googleapis)
+	body, err := httpGet(ctx, opts, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	for _, dir := range googleapisDirs {
+		if err := os.RemoveAll(filepath.Join(include, dir)); err != nil {
+			return err
+		}
+	}
+
+	// Extract the .proto files of googleapisDirs, beneath the archive's top directory.
+	prefix := "googleapis-" + opts.Googleapis + "/"
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", url, err)
+		}
+		name := strings.TrimPrefix(hdr.Name, prefix)
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(name, ".proto") || !inGoogleapisDirs(name) {
+			continue
+		}
+		path := filepath.Join(include, filepath.FromSlash(name))
+		if !within(path, include) {
+			return fmt.Errorf("%s: invalid file name %q", url, hdr.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", url, err)
+		}
+		if err := os.WriteFile(path, data, 0666); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(stamp, []byte(opts.Googleapis), 0666)
+}
+
+// inGoogleapisDirs reports whether the slash-separated name is beneath one of googleapisDirs.
+func inGoogleapisDirs(name string) bool {
+	for _, dir := range googleapisDirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
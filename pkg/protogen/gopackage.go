@@ -0,0 +1,221 @@
+package protogen
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// goPackagePattern matches the go_package option of a .proto file.
+var goPackagePattern = regexp.MustCompile(`^\s*option\s+go_package\s*=\s*"([^"]*)"\s*;`)
+
+// goPlugins are the flag names of the plugins that accept the M options
+// of protoc-gen-go, which map .proto files to Go import paths.
+var goPlugins = []string{"go", "go-grpc", "twirp", "grpc-gateway", "go-vtproto", "connect-go"}
+
+// goPackages applies Config.GoPackage to the protoc arguments: it adds
+// the M options of the table's .proto files to the Go plugins among
+// them, and, if enabled, checks the go_package options of their .proto
+// files, in the working directory pwd.
+func (cfg *Config) goPackages(args []string, pwd string) ([]string, error) {
+	gp := cfg.GoPackage
+	if len(gp.Map) == 0 && !gp.Check {
+		return args, nil
+	}
+	paths := protoPaths(args, pwd)
+	mapped, err := gp.mappings(paths)
+	if err != nil {
+		return nil, err
+	}
+	if gp.Check {
+		if err := checkGoPackages(protoFiles(args), paths, mapped, pwd); err != nil {
+			return nil, err
+		}
+	}
+	if len(mapped) == 0 {
+		return args, nil
+	}
+	files := make([]string, 0, len(mapped))
+	for file := range mapped {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var opt []string
+	for _, file := range files {
+		opt = append(opt, "M"+file+"="+mapped[file])
+	}
+	var flags []string
+	for _, name := range goPlugins {
+		if hasFlag(args, "--"+name+"_out") {
+			flags = append(flags, "--"+name+"_opt="+strings.Join(opt, ","))
+		}
+	}
+	// Flags precede the .proto files, which follow them by convention.
+	return append(flags, args...), nil
+}
+
+// mappings returns the Go import paths of the .proto files of the table,
+// by their names relative to the import directories paths. A directory
+// of the table maps the .proto files directly within it.
+func (gp *GoPackageConfig) mappings(paths []string) (map[string]string, error) {
+	mapped := make(map[string]string)
+	for name, importPath := range gp.Map {
+		name = path.Clean(filepath.ToSlash(name))
+		if strings.HasSuffix(name, ".proto") {
+			mapped[name] = importPath
+			continue
+		}
+		found := false
+		for _, dir := range paths {
+			matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(name), "*.proto"))
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range matches {
+				mapped[name+"/"+filepath.Base(match)] = importPath
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("go_package: no .proto files in %s beneath the import directories", name)
+		}
+	}
+	return mapped, nil
+}
+
+// checkGoPackages reports an error, listing every offending file, if
+// any of the .proto files lacks a Go import path (an option go_package,
+// or an entry of mapped), or if its import path is not within the Go
+// module of the go.mod file of pwd or its ancestors, if any.
+func checkGoPackages(files, paths []string, mapped map[string]string, pwd string) error {
+	module, err := goModule(pwd)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, file := range files {
+		abs := file
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(pwd, abs)
+		}
+		importPath, ok := mapped[importName(abs, paths)]
+		source := "the go_package map"
+		if !ok {
+			importPath, err = readGoPackage(abs)
+			if err != nil {
+				return err
+			}
+			source = "option go_package"
+		}
+		importPath, _, _ = strings.Cut(importPath, ";")
+		switch {
+		case importPath == "":
+			problems = append(problems, fmt.Sprintf("%s: missing option go_package (or an entry in the go_package map of %s)", file, ConfigFile))
+		case module != "" && importPath != module && !strings.HasPrefix(importPath, module+"/"):
+			problems = append(problems, fmt.Sprintf("%s: Go import path %q (from %s) is not within module %s of go.mod", file, importPath, source, module))
+		}
+	}
+	if problems != nil {
+		return fmt.Errorf("go_package check failed:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// importName returns the name by which protoc knows the .proto file:
+// its slash-separated path relative to the innermost import directory
+// that contains it, or else its base name.
+func importName(file string, paths []string) string {
+	best := ""
+	for _, dir := range paths {
+		if within(file, dir) && len(dir) > len(best) {
+			best = dir
+		}
+	}
+	if best == "" {
+		return filepath.Base(file)
+	}
+	rel, _ := filepath.Rel(best, file)
+	return filepath.ToSlash(rel)
+}
+
+// readGoPackage returns the value of the go_package option of the
+// .proto file, or "" if it has none.
+func readGoPackage(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if m := goPackagePattern.FindStringSubmatch(sc.Text()); m != nil {
+			return m[1], nil
+		}
+	}
+	return "", sc.Err()
+}
+
+// goModule returns the module path declared by the go.mod file of dir
+// or its nearest ancestor, or "" if there is none.
+func goModule(dir string) (string, error) {
+	filename, err := findGoMod(dir)
+	if err != nil || filename == "" {
+		return "", err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "module" {
+			if unquoted, err := strconv.Unquote(fields[1]); err == nil {
+				return unquoted, nil
+			}
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("%s: no module directive", filename)
+}
+
+// goImportPath returns the import path of the package in dir, given by
+// the module path of the go.mod file of dir or its nearest ancestor.
+func goImportPath(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	modFile, err := findGoMod(dir)
+	if err != nil {
+		return "", err
+	}
+	if modFile == "" {
+		return "", fmt.Errorf("no go.mod file in %s or its ancestors, whose module path would give its import path", dir)
+	}
+	module, err := goModule(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(filepath.Dir(modFile), dir)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(module, filepath.ToSlash(rel)), nil
+}
+
+// hasFlag reports whether the protoc arguments include the named flag.
+func hasFlag(args []string, name string) bool {
+	for i := 0; i < len(args); i++ {
+		if flag, _, ok := flagValue(args, &i); ok && flag == name {
+			return true
+		}
+	}
+	return false
+}
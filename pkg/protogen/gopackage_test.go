@@ -0,0 +1,28 @@
+package protogen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGoImportPath checks that the import path of a package is that of
+// the module of its nearest go.mod file, whether or not it exists yet.
+func TestGoImportPath(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/m\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for pkgDir, want := range map[string]string{
+		dir:                                     "example.com/m",
+		filepath.Join(dir, "api", "hats", "v1"): "example.com/m/api/hats/v1",
+	} {
+		got, err := goImportPath(pkgDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("goImportPath(%s) = %s, want %s", pkgDir, got, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package protogen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	goruntime "runtime"
+)
+
+// A HooksConfig lists shell commands that run on the host, in the
+// working directory, before protoc (Pre) and after a successful
+// generation (Post), such as further post-processing of the generated
+// files (e.g. "go run ./tools/inject-tags"). A post hook finds the
+// generated files in the JSON manifest named by $PROTO_GEN_GO_MANIFEST
+// (see Result.ManifestJSON). With Options.Check, the hooks run in the
+// copy of the working directory in which the files are generated, so
+// that their changes are part of the comparison.
+type HooksConfig struct {
+	Pre  []string `yaml:"pre"`
+	Post []string `yaml:"post"`
+}
+
+// A generatedFile is an element of the JSON manifest of a run.
+type generatedFile struct {
+	Name   string `json:"name"`   // relative to the working directory, slash-separated
+	SHA256 string `json:"sha256"` // hex SHA256 of the content
+}
+
+// ManifestJSON returns the JSON manifest of the files created or
+// modified by the run, with their hashes:
+//
+//	{"image": "...", "files": [{"name": "api/a.pb.go", "sha256": "..."}]}
+func (res *Result) ManifestJSON() ([]byte, error) {
+	files := []generatedFile{}
+	for _, file := range res.Files {
+		files = append(files, generatedFile{filepath.ToSlash(file), res.Hashes[file]})
+	}
+	data, err := json.MarshalIndent(struct {
+		Image string          `json:"image,omitempty"`
+		Files []generatedFile `json:"files"`
+	}{res.Image, files}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// runHooks runs the commands of a hook (pre or post) in dir, in order,
+// stopping at the first that fails. For a post hook, res describes
+// the generated files, whose manifest it writes to a temporary file.
+func runHooks(ctx context.Context, opts *Options, hook string, cmds []string, dir string, res *Result) error {
+	if len(cmds) == 0 {
+		return nil
+	}
+	env := append(os.Environ(), "PROTO_GEN_GO_DIR="+dir)
+	if res != nil {
+		data, err := res.ManifestJSON()
+		if err != nil {
+			return err
+		}
+		f, err := os.CreateTemp("", "proto-gen-go-manifest*.json")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		env = append(env, "PROTO_GEN_GO_MANIFEST="+f.Name())
+	}
+	for _, command := range cmds {
+		opts.logf("%s hook: %s", hook, command)
+		var cmd *exec.Cmd
+		if goruntime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/c", command)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", command)
+		}
+		cmd.Dir = dir
+		cmd.Env = env
+		// Stdout is reserved for the results of the run, such as the
+		// diffs of Check.
+		cmd.Stdout = opts.Stderr
+		cmd.Stderr = opts.Stderr
+		if err := opts.run(cmd); err != nil {
+			return fmt.Errorf("%s hook %q: %v", hook, command, err)
+		}
+	}
+	return nil
+}
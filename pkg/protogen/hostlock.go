@@ -0,0 +1,51 @@
+package protogen
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// hostLock acquires the exclusive lock of the specified key, which is
+// shared by all the tool's processes on the host, such as those that
+// 'go generate ./...' starts at once, and returns the function that
+// releases it. If another process holds the lock, it logs that it is
+// waiting for what, and polls until the lock is free or the context
+// is done. (An exiting process releases its locks.)
+func hostLock(ctx context.Context, opts *Options, key, what string) (func(), error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(cache, "proto-gen-go", "locks")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(key))
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%x.lock", hash[:12])), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	for waiting := false; ; waiting = true {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %v", f.Name(), err)
+		}
+		if ok {
+			return func() { f.Close() }, nil
+		}
+		if !waiting {
+			opts.logf("waiting for another proto-gen-go process to finish %s...", what)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package protogen
+
+import "os"
+
+// tryLockFile reports success, since the platform has no file locks.
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
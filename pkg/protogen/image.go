@@ -0,0 +1,227 @@
+package protogen
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+)
+
+// imageName is the repository name of the images built by the tool.
+const imageName = "proto-gen-go"
+
+// imageLabel is the label that identifies the images built by the tool,
+// even once they are untagged.
+const imageLabel = "com.github.proto-gen-go.toolchain"
+
+// imageTag returns the tag of the image built from the Dockerfile,
+// which is derived from a hash of its content.
+func imageTag(dockerfile string) string {
+	hash := sha256.Sum256([]byte(dockerfile))
+	return fmt.Sprintf("%s:%x", imageName, hash[:8])
+}
+
+// buildImage builds the image specified by the Dockerfile for the
+// specified platform, which is not present locally, and returns its tag.
+func buildImage(ctx context.Context, opts *Options, rt *runtime, dockerfile, platform string) (string, error) {
+	tag := imageTag(dockerfile)
+
+	// Concurrent invocations build the image only once.
+	if !opts.DryRun {
+		unlock, err := hostLock(ctx, opts, "image "+rt.name+" "+tag, "building "+tag)
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+		if imageExists(ctx, rt, tag) {
+			opts.logf("using protoc container image %s", tag)
+			return tag, nil
+		}
+	}
+	if err := useRegistry(ctx, opts, rt, opts.BaseImage); err != nil {
+		return "", err
+	}
+
+	// The --platform flag selects the image variant (and, if it is
+	// not the host's, enables dynamic binary translation).
+	// The docker context is an empty directory containing only the
+	// Dockerfile, since not all runtimes accept a Dockerfile on stdin.
+	contextDir, err := os.MkdirTemp("", "proto-gen-go-build")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(contextDir)
+	filename := filepath.Join(contextDir, "Dockerfile")
+	if err := os.WriteFile(filename, []byte(dockerfile), 0666); err != nil {
+		return "", err
+	}
+	opts.logf("building protoc container image %s...", tag)
+	cmd := rt.command(ctx, "build", "--platform="+platform, "--label", imageLabel+"=true")
+	if opts.Verbose {
+		cmd.Stdout = opts.Stderr // build steps
+	} else {
+		cmd.Args = append(cmd.Args, "-q")
+		cmd.Stdout = io.Discard // image id
+	}
+	cmd.Args = append(cmd.Args, proxyFlags("--build-arg")...)
+	secrets, err := opts.Private.buildFlags()
+	if err != nil {
+		return "", err
+	}
+	cmd.Args = append(cmd.Args, secrets...)
+	if rt.name == "docker" {
+		cmd.Env = append(cmd.Environ(), "DOCKER_BUILDKIT=1") // for RUN --mount
+	}
+	if len(opts.CACerts) > 0 {
+		if err := copyCACerts(filepath.Join(contextDir, caCertsDir), opts.CACerts); err != nil {
+			return "", err
+		}
+	}
+	cmd.Args = append(cmd.Args, "-t", tag, "-f", filename, contextDir)
+	cmd.Stderr = opts.Stderr
+	if err := opts.runRetrying(ctx, "image build", cmd); err != nil {
+		return "", err
+	}
+
+	// Retain only the most recent images.
+	if keep := opts.KeepImages; keep >= 0 {
+		if keep == 0 {
+			keep = defaultKeepImages
+		}
+		if _, err := pruneImages(ctx, opts, rt, keep); err != nil {
+			opts.logf("pruning old images: %v", err)
+		}
+	}
+	return tag, nil
+}
+
+// pullImage pulls the image of the specified reference for the
+// specified platform, which is not present locally.
+// A reference by digest (name@sha256:...) makes runs reproducible.
+func pullImage(ctx context.Context, opts *Options, rt *runtime, ref, platform string) error {
+	if err := useRegistry(ctx, opts, rt, ref); err != nil {
+		return err
+	}
+	opts.logf("pulling protoc container image %s...", ref)
+	cmd := rt.command(ctx, "pull", "--platform="+platform, ref)
+	cmd.Stdout = io.Discard // progress
+	if opts.Verbose {
+		cmd.Stdout = opts.Stderr
+	}
+	cmd.Stderr = opts.Stderr
+	return opts.runRetrying(ctx, "image pull", cmd)
+}
+
+// loadImage loads the image ref, which is not present locally, from
+// the tarball, for use without network access.
+func loadImage(ctx context.Context, opts *Options, rt *runtime, tarball, ref string) error {
+	opts.logf("loading protoc container image %s from %s...", ref, tarball)
+	cmd := rt.command(ctx, "load", "--input", tarball)
+	cmd.Stdout = io.Discard
+	if opts.Verbose {
+		cmd.Stdout = opts.Stderr
+	}
+	cmd.Stderr = opts.Stderr
+	if err := opts.run(cmd); err != nil {
+		return err
+	}
+	if !opts.DryRun && !imageExists(ctx, rt, ref) {
+		return fmt.Errorf("%s does not contain %s, the image of this config and platform; export it anew", tarball, ref)
+	}
+	return nil
+}
+
+// imageExists reports whether the image is present locally.
+func imageExists(ctx context.Context, rt *runtime, ref string) bool {
+	cmd := rt.command(ctx, "image", "inspect", "--format={{.Id}}", ref)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = io.Discard
+	return cmd.Run() == nil
+}
+
+// containerPlatform returns the container platform specified by spec,
+// which by default is that of the host's architecture, if supported,
+// or linux/amd64 otherwise.
+func containerPlatform(spec string) (string, error) {
+	switch spec {
+	case "":
+		if goruntime.GOARCH == "arm64" {
+			return "linux/arm64", nil
+		}
+		return "linux/amd64", nil
+	case "linux/amd64", "linux/arm64":
+		return spec, nil
+	}
+	return "", fmt.Errorf("unsupported container platform %q (want linux/amd64 or linux/arm64)", spec)
+}
+
+// caCertsDir is the directory of the docker context, and the name of
+// the directory beneath /usr/local/share/ca-certificates in the image,
+// that holds the CA certificates of Config.CACerts.
+const caCertsDir = "proto-gen-go"
+
+// caCertSums returns the hex SHA256 checksums of the named certificate files.
+func caCertSums(certs []string) ([]string, error) {
+	var sums []string
+	for _, cert := range certs {
+		sum, err := hashFile(cert)
+		if err != nil {
+			return nil, fmt.Errorf("ca_certs: %v", err)
+		}
+		sums = append(sums, sum)
+	}
+	return sums, nil
+}
+
+// copyCACerts copies the named certificate files to dir, with the .crt
+// extension that update-ca-certificates requires.
+func copyCACerts(dir string, certs []string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for i, cert := range certs {
+		if err := copyFile(filepath.Join(dir, fmt.Sprintf("ca-%d.crt", i)), cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportImage saves the toolchain image, built (or, with Options.Image,
+// pulled) if necessary, to the named tarball, so that Run may load it
+// with Options.ImageTar on a machine without network access. It
+// returns the image's name.
+func ExportImage(ctx context.Context, opts Options, tarball string) (string, error) {
+	if err := opts.Config.resolve(); err != nil {
+		return "", err
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	opts.ImageTar = ""
+	rt, err := usableRuntime(ctx, &opts)
+	if err != nil {
+		return "", err
+	}
+	platform, err := containerPlatform(opts.Platform)
+	if err != nil {
+		return "", err
+	}
+	image, _, err := toolchainImage(ctx, &opts, rt, platform)
+	if err != nil {
+		return "", err
+	}
+	opts.logf("saving %s to %s...", image, tarball)
+	cmd := rt.command(ctx, "save", "--output", tarball, image)
+	cmd.Stderr = opts.Stderr
+	if err := opts.run(cmd); err != nil {
+		return "", fmt.Errorf("%s save failed: %v", rt.name, err)
+	}
+	return image, nil
+}
@@ -0,0 +1,155 @@
+package protogen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A genState records the inputs of the last successful generation in
+// a working directory with a given set of protoc flags, so that the
+// next one may skip the .proto files that have not changed since.
+type genState struct {
+	Toolchain string            `json:"toolchain"` // identity of the toolchain (see toolchainKey) and of the config
+	Files     map[string]string `json:"files"`     // fingerprint of each .proto file (see fingerprinter)
+}
+
+// stateFile returns the name of the file, in the user's cache directory,
+// that holds the state of generation in pwd with the specified flags.
+func stateFile(pwd string, flags []string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(strings.Join(append([]string{pwd}, flags...), "\x00")))
+	return filepath.Join(cache, "proto-gen-go", "state", fmt.Sprintf("%x.json", hash[:12])), nil
+}
+
+// toolchainKey returns a string that changes whenever the toolchain does.
+func (e *env) toolchainKey() string {
+	if e.local != nil {
+		return strings.Join(append([]string{Version(), e.local.exe}, e.local.binDirs...), " ")
+	}
+	return Version() + " " + e.image
+}
+
+// incremental returns the protoc arguments with only the .proto files
+// that changed since the last successful run (all of them, if the
+// toolchain or the flags changed, or if an output describes the entire
+// set of files), and the state to save after a successful run. If the
+// arguments name no .proto files, it returns them unchanged and a nil
+// state.
+func (e *env) incremental(opts *Options) ([]string, *genState, string, error) {
+	var flags, files []string
+	for _, arg := range e.protocArgs {
+		if !strings.HasPrefix(arg, "-") && strings.HasSuffix(arg, ".proto") {
+			files = append(files, arg)
+		} else {
+			flags = append(flags, arg)
+		}
+	}
+	if len(files) == 0 || wholeSetOutputs(flags) {
+		return e.protocArgs, nil, "", nil
+	}
+	filename, err := stateFile(opts.Dir, flags)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// A new setting, such as one of post-processing, applies to every file.
+	config, err := yaml.Marshal(&opts.Config)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	next := &genState{Toolchain: fmt.Sprintf("%s %x", e.toolchainKey(), sha256.Sum256(config)), Files: make(map[string]string)}
+	fp := &fingerprinter{protoPaths: protoPaths(flags, opts.Dir), sums: make(map[string]string)}
+	for _, file := range files {
+		abs := file
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(opts.Dir, abs)
+		}
+		sum, err := fp.fingerprint(abs)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		next.Files[file] = sum
+	}
+
+	var prev genState
+	if data, err := os.ReadFile(filename); err == nil {
+		json.Unmarshal(data, &prev) // a corrupt state is a missing one
+	}
+	args := flags
+	for _, file := range files {
+		if prev.Toolchain != next.Toolchain || prev.Files[file] != next.Files[file] {
+			args = append(args, file)
+		}
+	}
+	return args, next, filename, nil
+}
+
+// save writes the state to the named file.
+func (s *genState) save(filename string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0666)
+}
+
+// A fingerprinter computes the fingerprints of .proto files: hashes of
+// their content and, recursively, that of the files they import, found
+// in the import directories. (Imports not found there, such as the
+// well-known types, are part of the toolchain.)
+type fingerprinter struct {
+	protoPaths []string
+	sums       map[string]string // fingerprints by file name ("" while in progress)
+}
+
+// importPattern matches the import statements of a .proto file.
+var importPattern = regexp.MustCompile(`^\s*import\s+(?:public\s+|weak\s+)?"([^"]+)"\s*;`)
+
+func (fp *fingerprinter) fingerprint(file string) (string, error) {
+	if sum, ok := fp.sums[file]; ok {
+		return sum, nil // an import cycle (which protoc rejects) is ignored
+	}
+	fp.sums[file] = ""
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(data)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		m := importPattern.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		for _, dir := range fp.protoPaths {
+			imp := filepath.Join(dir, filepath.FromSlash(m[1]))
+			if _, err := os.Stat(imp); err == nil {
+				sum, err := fp.fingerprint(imp)
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintf(h, "\x00%s %s", m[1], sum)
+				break
+			}
+		}
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	fp.sums[file] = sum
+	return sum, nil
+}
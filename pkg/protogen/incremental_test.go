@@ -0,0 +1,41 @@
+package protogen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestIncrementalConfig checks that a change of any setting of the
+// config recompiles every .proto file, and that none recompiles without.
+func TestIncrementalConfig(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.proto"), []byte("syntax = \"proto3\";\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	e := &env{image: "proto-gen-go:test", protocArgs: []string{"--go_out=.", "a.proto"}}
+	opts := &Options{Dir: dir}
+	run := func() []string {
+		args, next, filename, err := e.incremental(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := next.save(filename); err != nil {
+			t.Fatal(err)
+		}
+		return args
+	}
+
+	if args := run(); len(args) != 2 {
+		t.Fatalf("first run: got args %q, want a.proto compiled", args)
+	}
+	if args := run(); len(args) != 1 {
+		t.Fatalf("unchanged: got args %q, want none compiled", args)
+	}
+	opts.Exclude = []string{"vendor/**"}
+	if args := run(); len(args) != 2 {
+		t.Fatalf("changed config: got args %q, want a.proto compiled", args)
+	}
+}
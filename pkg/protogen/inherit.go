@@ -0,0 +1,143 @@
+package protogen
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// inheritFrom merges the config of an ancestor directory into the
+// config, which inherits from it (Config.Inherit): each setting that
+// the config leaves unset takes the parent's value, except its roots,
+// which are not inherited; the parent's flags precede its own; and its
+// plugins are merged into the parent's by name, each replacing the one
+// of the same name, unless disabled, in which case it removes it.
+func (cfg *Config) inheritFrom(parent *Config) error {
+	flags, plugins := cfg.Flags, cfg.Plugins
+	c, p := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(parent).Elem()
+	for i := 0; i < c.NumField(); i++ {
+		if c.Type().Field(i).Name == "Roots" {
+			continue
+		}
+		if f := c.Field(i); f.IsZero() {
+			f.Set(p.Field(i))
+		}
+	}
+	cfg.Flags = append(append([]string(nil), parent.Flags...), flags...)
+	if plugins == nil {
+		return nil
+	}
+	merged := parent.Plugins
+	if merged == nil {
+		merged = DefaultConfig.Plugins
+	}
+	merged = append([]Plugin(nil), merged...)
+	for _, plugin := range plugins {
+		i := 0
+		for i < len(merged) && merged[i].Name != plugin.Name {
+			i++
+		}
+		switch {
+		case plugin.Disable && i == len(merged):
+			return fmt.Errorf("plugin %q is disabled, but not inherited", plugin.Name)
+		case plugin.Disable:
+			merged = append(merged[:i], merged[i+1:]...)
+		case i == len(merged):
+			merged = append(merged, plugin)
+		default:
+			merged[i] = plugin
+		}
+	}
+	cfg.Plugins = merged
+	return nil
+}
+
+// parentConfig returns the name of the config file from which that of
+// the named config file inherits: the nearest one in an ancestor of its
+// directory.
+func parentConfig(filename string) (string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(filepath.Dir(abs))
+	if dir == filepath.Dir(abs) {
+		return "", nil
+	}
+	return FindConfig(dir), nil
+}
+
+// configFiles returns the nearest config file of the directory of each
+// .proto file (relative to pwd, unless absolute), in the order of their
+// first appearance, and the files of each.
+func configFiles(files []string, pwd string) ([]string, map[string][]string) {
+	var names []string
+	byConfig := make(map[string][]string)
+	nearest := make(map[string]string) // memoizes FindConfig by directory
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(pwd, dir)
+		}
+		name, ok := nearest[dir]
+		if !ok {
+			name = FindConfig(dir)
+			nearest[dir] = name
+		}
+		if _, ok := byConfig[name]; !ok {
+			names = append(names, name)
+		}
+		byConfig[name] = append(byConfig[name], file)
+	}
+	return names, byConfig
+}
+
+// SplitByConfig splits the run of the options by the nearest config
+// file of each of its .proto files, found by searching the directory of
+// the file and its ancestors, so that a subtree with a config file of
+// its own (which may inherit the settings of the repository's, see
+// Config.Inherit) is generated with its own plugins and flags. It
+// returns the options of each run: those of opts, with the protoc flags
+// of its arguments, the .proto files of one config file (patterns and
+// Options.Recursive having been expanded), and, for a config file other
+// than that of opts (Config.Filename), the config that load returns
+// for it. If all the files share the config of opts, it returns opts.
+// The names are those of the config files of the runs.
+func SplitByConfig(opts Options, load func(filename string) (*Config, error)) (all []Options, names []string, err error) {
+	pwd := opts.Dir
+	if pwd == "" {
+		if pwd, err = os.Getwd(); err != nil {
+			return nil, nil, err
+		}
+	}
+	args, err := expandProtoFiles(opts.ProtocArgs, pwd, opts.Recursive, &opts.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	names, byConfig := configFiles(protoFiles(args), pwd)
+	if len(names) == 0 || len(names) == 1 && names[0] == opts.Filename {
+		return []Options{opts}, []string{opts.Filename}, nil
+	}
+	var flags []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") || !strings.HasSuffix(arg, ".proto") {
+			flags = append(flags, arg)
+		}
+	}
+	for _, name := range names {
+		o := opts
+		o.ProtocArgs = append(append([]string(nil), flags...), byConfig[name]...)
+		o.Recursive = ""
+		if name != opts.Filename {
+			cfg, err := load(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			o.Config = *cfg
+		}
+		all = append(all, o)
+	}
+	return all, names, nil
+}
@@ -0,0 +1,134 @@
+package protogen
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An outputs is a temporary host directory to which protoc writes its
+// outputs in a container whose other mounts are read-only (see
+// Options.IsolateOutputs), and from which they are then copied to the
+// output directories named by the protoc arguments.
+type outputs struct {
+	tmp   string   // host directory, mounted writable at its own path
+	dests []string // host output directories, in order of tmp's numbered subdirectories
+}
+
+// isolate redirects the outputs of the protoc arguments to a new
+// outputs directory, with the host directory dir standing in for
+// opts.Dir, and mounts it writable and all else read-only. The
+// returned function, to be called after protoc, undoes this.
+func (e *env) isolate(opts *Options, dir string) (func(), error) {
+	tmp, err := os.MkdirTemp("", "proto-gen-go-out")
+	if err != nil {
+		return nil, err
+	}
+	out := &outputs{tmp: tmp}
+	args, err := out.redirect(e.protocArgs, opts.Dir, dir)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	mounts := []mount{{tmp, false}}
+	for _, m := range e.mounts {
+		mounts = append(mounts, mount{m.dir, true})
+	}
+	savedArgs, savedMounts := e.protocArgs, e.mounts
+	e.protocArgs, e.mounts, e.outputs = args, mounts, out
+	return func() {
+		e.protocArgs, e.mounts, e.outputs = savedArgs, savedMounts, nil
+		os.RemoveAll(tmp)
+	}, nil
+}
+
+// redirect returns the protoc arguments with each output directory
+// of their --NAME_out flags, and the directory of each output file of
+// their --descriptor_set_out and --dependency_out flags, replaced by
+// a numbered subdirectory of the outputs directory, one per distinct
+// host directory, so that plugins sharing a directory (as insertion
+// points require) share a subdirectory. Those beneath pwd are the same
+// paths beneath dir on the host. Devices such as /dev/stdout are kept.
+func (o *outputs) redirect(args []string, pwd, dir string) ([]string, error) {
+	sub := func(dest string) (string, error) {
+		if within(dest, pwd) {
+			rel, _ := filepath.Rel(pwd, dest)
+			dest = filepath.Join(dir, rel)
+		}
+		for i, d := range o.dests {
+			if d == dest {
+				return filepath.Join(o.tmp, strconv.Itoa(i)), nil
+			}
+		}
+		path := filepath.Join(o.tmp, strconv.Itoa(len(o.dests)))
+		o.dests = append(o.dests, dest)
+		return path, os.Mkdir(path, 0777)
+	}
+
+	args = append([]string(nil), args...)
+	for i := 0; i < len(args); i++ {
+		start := i
+		name, value, ok := flagValue(args, &i)
+		if !ok || value == "" || !strings.HasSuffix(name, "_out") || isDevice(value) {
+			continue
+		}
+		switch name {
+		case "--descriptor_set_out", "--dependency_out":
+			path, err := sub(filepath.Dir(value))
+			if err != nil {
+				return nil, err
+			}
+			value = filepath.Join(path, filepath.Base(value))
+		default:
+			params, dest := splitOut(value)
+			path, err := sub(filepath.Clean(dest))
+			if err != nil {
+				return nil, err
+			}
+			value = params + path
+		}
+		if i == start {
+			args[i] = name + "=" + value
+		} else {
+			args[i] = value
+		}
+	}
+	return args, nil
+}
+
+// sync copies the files that protoc wrote to the outputs directory to
+// their output directories, except those whose content is unchanged,
+// which keep their modification times, so that changedFiles omits them.
+func (o *outputs) sync() error {
+	for i, dest := range o.dests {
+		src := filepath.Join(o.tmp, strconv.Itoa(i))
+		err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(dest, rel)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if old, err := os.ReadFile(target); err == nil && bytes.Equal(old, data) {
+				return nil
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			return os.WriteFile(target, data, 0666)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package protogen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// langProfiles maps the languages of Config.Langs to the known plugins
+// that generate code in them, in addition to protoc's own generators
+// (such as --java_out, --kotlin_out, --python_out and --pyi_out), which
+// need no installation.
+var langProfiles = map[string][]string{
+	"go":     {"go", "grpc", "twirp"},
+	"python": {"mypy"},
+	"java":   {},
+	"kotlin": {},
+	"ts":     {"ts_proto", "twirp_ts"},
+	"swift":  {"swift", "grpc-swift"},
+}
+
+// addLangs adds the plugins of the config's language profiles.
+func (cfg *Config) addLangs() error {
+	for _, lang := range cfg.Langs {
+		plugins, ok := langProfiles[lang]
+		if !ok {
+			var langs []string
+			for lang := range langProfiles {
+				langs = append(langs, lang)
+			}
+			sort.Strings(langs)
+			return fmt.Errorf("langs: unknown language %q (want one of %s)", lang, strings.Join(langs, ", "))
+		}
+		for _, name := range plugins {
+			if err := cfg.AddPlugin(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package protogen
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// Lint runs 'buf lint' as Run does when Config.Lint is enabled, but
+// without generating code.
+func Lint(ctx context.Context, opts Options) error {
+	opts.Lint.Enabled = true
+	e, err := prepare(ctx, &opts)
+	if err != nil {
+		return err
+	}
+	return e.lint(ctx, &opts, opts.Dir)
+}
+
+// lint runs 'buf lint' on the .proto files named by the protoc
+// arguments (or, if none, all files) beneath the first import
+// directory, with the host directory dir standing in for opts.Dir.
+func (e *env) lint(ctx context.Context, opts *Options, dir string) error {
+	root := protoPaths(e.protocArgs, opts.Dir)[0]
+	args := []string{"lint"}
+	paths, err := bufPaths(e.protocArgs, root)
+	if err != nil {
+		return err
+	}
+	args = append(args, paths...)
+	return e.buf(ctx, opts, dir, root, args, nil)
+}
+
+// bufPaths returns the --path flags that restrict buf to the .proto
+// files named by the protoc arguments, relative to the root directory.
+func bufPaths(protocArgs []string, root string) ([]string, error) {
+	var flags []string
+	for _, file := range protoFiles(protocArgs) {
+		if filepath.IsAbs(file) {
+			if !within(file, root) {
+				return nil, fmt.Errorf("%s is not beneath import directory %s", file, root)
+			}
+			file, _ = filepath.Rel(root, file)
+		}
+		flags = append(flags, "--path", filepath.ToSlash(file))
+	}
+	return flags, nil
+}
+
+// buf runs buf with the specified arguments in the directory root, with
+// the host directory dir standing in for opts.Dir, and the host
+// directories extra mounted read-only at the same paths.
+func (e *env) buf(ctx context.Context, opts *Options, dir, root string, args, extra []string) error {
+	opts.logf("buf %s", joinArgs(args, opts.Dir))
+
+	diag := e.diagnostics(opts, dir)
+	defer diag.flush()
+	o := *opts
+	o.Stderr = diag
+	o.Stdout = diag // buf reports errors on stdout
+	if e.local != nil {
+		return e.local.run(ctx, &o, dir, root, "buf", args)
+	}
+	var flags []string
+	if e.rt.user != "" {
+		flags = append(flags, "--user", e.rt.user)
+	}
+	flags = append(flags, "-w", root, "-e", "BUF_CACHE_DIR=/tmp/buf", "--entrypoint=buf", e.image)
+	return e.runContainer(ctx, opts, dir, append(flags, args...), extra, o.Stdout, o.Stderr)
+}
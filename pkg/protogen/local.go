@@ -0,0 +1,376 @@
+package protogen
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	goruntime "runtime"
+	"strings"
+)
+
+// A localToolchain is a natively installed protoc and set of plugins
+// (and tools), used in place of a container when Options.Local is set.
+type localToolchain struct {
+	exe     string   // protoc executable
+	binDirs []string // directories containing the plugins and tools
+}
+
+// installLocal installs the config's protoc release and plugins, if not
+// already present, in the user's cache directory.
+func installLocal(ctx context.Context, opts *Options) (*localToolchain, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cache = filepath.Join(cache, "proto-gen-go")
+	if err := opts.Config.checkLock(); err != nil {
+		return nil, err
+	}
+	if !opts.DryRun {
+		// Concurrent invocations install each artifact only once.
+		unlock, err := hostLock(ctx, opts, "local", "installing the local toolchain")
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	platform, err := protocPlatform(goruntime.GOOS, goruntime.GOARCH)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(cache, "protoc-"+opts.Protoc+"-"+platform)
+	exe := filepath.Join(dir, "bin", "protoc")
+	if goruntime.GOOS == "windows" {
+		exe += ".exe"
+	}
+	if _, err := os.Stat(exe); err != nil && opts.DryRun {
+		fmt.Fprintf(opts.Stdout, "# download and verify %s\n", protocURL(opts.Protoc, platform))
+	} else if err != nil {
+		opts.logf("downloading protoc %s for %s...", opts.Protoc, platform)
+		if err := downloadProtoc(ctx, opts, platform, dir); err != nil {
+			return nil, err
+		}
+	}
+	tc := &localToolchain{exe: exe}
+
+	// protoc imports from the include directory beside its bin directory.
+	include := filepath.Join(dir, "include")
+	if opts.Googleapis != "" {
+		if err := installGoogleapis(ctx, opts, include); err != nil {
+			return nil, fmt.Errorf("installing googleapis: %v", err)
+		}
+	}
+
+	for _, p := range opts.Config.installs() {
+		prefix := filepath.Join(cache, "plugins", strings.NewReplacer("/", "_", ":", "_").Replace(p.Package())+"@"+p.Version)
+		if p.URL != "" {
+			if err := downloadPlugin(ctx, opts, p, prefix); err != nil {
+				return nil, fmt.Errorf("installing plugin %s: %v", p.Name, err)
+			}
+			tc.binDirs = append(tc.binDirs, prefix)
+			continue
+		}
+		bin, cmds := installCommands(ctx, &opts.Config, p, prefix)
+		if entries, _ := os.ReadDir(bin); len(entries) == 0 {
+			opts.logf("installing %s@%s...", p.Package(), p.Version)
+			if opts.Lock != nil && p.Module != "" {
+				m, _ := opts.Lock.module(p) // present, by checkLock
+				if err := verifyModule(ctx, opts, m); err != nil {
+					return nil, fmt.Errorf("installing plugin %s: %v", p.Name, err)
+				}
+			}
+			for _, cmd := range cmds {
+				// Show the installer's messages only if verbose or on failure.
+				var output bytes.Buffer
+				cmd.Stdout = &output
+				cmd.Stderr = &output
+				if opts.Verbose {
+					cmd.Stdout = opts.Stderr
+					cmd.Stderr = opts.Stderr
+				}
+				if err := opts.runRetrying(ctx, "installing "+p.Package(), cmd); err != nil {
+					opts.Stderr.Write(output.Bytes())
+					os.RemoveAll(prefix)
+					return nil, fmt.Errorf("installing plugin %s: %v", p.Name, err)
+				}
+			}
+		}
+		tc.binDirs = append(tc.binDirs, bin)
+
+		for _, protos := range p.Protos {
+			if err := installProtos(ctx, opts, p, protos, filepath.Join(include, protos)); err != nil {
+				return nil, fmt.Errorf("installing %s protos: %v", p.Name, err)
+			}
+		}
+	}
+	return tc, nil
+}
+
+// installCommands returns the commands that install the plugin beneath
+// the directory prefix, and the directory of its executables. Plugins
+// from npm, pip and Swift packages require Node.js, Python 3 and Swift
+// on the host.
+func installCommands(ctx context.Context, cfg *Config, p Plugin, prefix string) (bin string, cmds []*exec.Cmd) {
+	switch {
+	case p.Npm != "":
+		cmd := exec.CommandContext(ctx, "npm", "install", "--prefix", prefix, p.Npm+"@"+p.Version)
+		return filepath.Join(prefix, "node_modules", ".bin"), []*exec.Cmd{cmd}
+	case p.Pip != "":
+		// Install the package in its own virtual environment.
+		bin := filepath.Join(prefix, "bin")
+		return bin, []*exec.Cmd{
+			exec.CommandContext(ctx, "python3", "-m", "venv", prefix),
+			exec.CommandContext(ctx, filepath.Join(bin, "pip"), "install", p.Pip+"=="+p.Version),
+		}
+	case p.Swift != "":
+		src := filepath.Join(prefix, "src")
+		return filepath.Join(src, ".build", "release"), []*exec.Cmd{
+			exec.CommandContext(ctx, "git", "clone", "--quiet", "--depth=1", "--branch="+p.Version, p.Swift, src),
+			exec.CommandContext(ctx, "swift", "build", "--package-path="+src, "--configuration=release", "--product=protoc-gen-"+p.Name),
+		}
+	default:
+		cmd := exec.CommandContext(ctx, "go", "install", p.Module+"@"+p.Version)
+		cmd.Env = append(append(os.Environ(), cfg.goEnv()...), "GOBIN="+prefix)
+		return prefix, []*exec.Cmd{cmd}
+	}
+}
+
+// downloadPlugin downloads the plugin's executable for the host platform,
+// verifies its checksum, and installs it in dir, if not already present.
+func downloadPlugin(ctx context.Context, opts *Options, p Plugin, dir string) error {
+	exe := filepath.Join(dir, "protoc-gen-"+p.Name)
+	if goruntime.GOOS == "windows" {
+		exe += ".exe"
+	}
+	if _, err := os.Stat(exe); err == nil {
+		return nil
+	}
+	url, want, err := p.url(goruntime.GOOS + "/" + goruntime.GOARCH)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		_, err := fmt.Fprintf(opts.Stdout, "# download and verify %s\n", url)
+		return err
+	}
+	opts.logf("downloading %s...", url)
+	body, err := httpGet(ctx, opts, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+	if got := sha256.Sum256(data); hex.EncodeToString(got[:]) != strings.ToLower(want) {
+		return fmt.Errorf("GET %s: SHA256 checksum is %x, want %s", url, got, want)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(exe, data, 0777)
+}
+
+// installProtos copies the directory protos of the plugin's module
+// to dst, if not already present.
+func installProtos(ctx context.Context, opts *Options, p Plugin, protos, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if opts.DryRun {
+		_, err := fmt.Fprintf(opts.Stdout, "# copy %s@%s/%s to %s\n", p.Module, p.Version, protos, dst)
+		return err
+	}
+	out, err := exec.CommandContext(ctx, "go", "list", "-m", "-f", "{{.Dir}}", p.Module+"@"+p.Version).Output()
+	if err != nil {
+		return fmt.Errorf("locating module %s: %v", p.Module, err)
+	}
+	src := filepath.Join(strings.TrimSpace(string(out)), filepath.FromSlash(protos))
+	if err := copyTree(dst, src); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return nil
+}
+
+// protoc runs the local protoc with the specified arguments, with the
+// directory dir standing in for the working directory opts.Dir.
+func (tc *localToolchain) protoc(ctx context.Context, opts *Options, dir string, protocArgs []string) error {
+	return tc.run(ctx, opts, dir, dir, tc.exe, protocArgs)
+}
+
+// run runs the named command of the toolchain in the directory workdir
+// (in terms of opts.Dir), with the host directory dir standing in for
+// the working directory opts.Dir.
+func (tc *localToolchain) run(ctx context.Context, opts *Options, dir, workdir, name string, args []string) error {
+	translate := func(s string) string { return s }
+	if dir != opts.Dir {
+		translate = func(s string) string { return strings.ReplaceAll(s, opts.Dir, dir) }
+	}
+	cmd := exec.CommandContext(ctx, tc.lookPath(name))
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, translate(arg))
+	}
+	cmd.Dir = translate(workdir)
+	path := append(append([]string(nil), tc.binDirs...), os.Getenv("PATH"))
+	cmd.Env = append(os.Environ(), "PATH="+strings.Join(path, string(os.PathListSeparator)))
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+	return opts.run(cmd)
+}
+
+// lookPath returns the path of the named command in the toolchain's
+// directories, or failing that, the name itself, to be found in PATH.
+func (tc *localToolchain) lookPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	for _, dir := range tc.binDirs {
+		if path, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			return path
+		}
+	}
+	return name
+}
+
+// protocPlatform returns the platform suffix of the protoc release
+// archive for the specified GOOS and GOARCH.
+func protocPlatform(goos, goarch string) (string, error) {
+	switch goos + "/" + goarch {
+	case "linux/amd64":
+		return "linux-x86_64", nil
+	case "linux/arm64":
+		return "linux-aarch_64", nil
+	case "darwin/amd64":
+		return "osx-x86_64", nil
+	case "darwin/arm64":
+		return "osx-aarch_64", nil
+	case "windows/amd64":
+		return "win64", nil
+	case "windows/386":
+		return "win32", nil
+	}
+	return "", fmt.Errorf("no protoc release for %s/%s", goos, goarch)
+}
+
+// protocURL returns the URL of the protoc release archive.
+func protocURL(version, platform string) string {
+	return fmt.Sprintf("https://github.com/protocolbuffers/protobuf/releases/download/v%s/%s", version, protocArchive(version, platform))
+}
+
+// downloadProtoc downloads the config's protoc release for the platform,
+// verifies its SHA256 checksum, and extracts it into dir.
+func downloadProtoc(ctx context.Context, opts *Options, platform, dir string) error {
+	cfg := &opts.Config
+	want, ok := cfg.protocSum(platform)
+	if !ok && cfg.Lock != nil {
+		return fmt.Errorf("%s: protoc %s for %s is not locked; run 'proto-gen-go lock'", ToolchainLockFile, cfg.Protoc, platform)
+	} else if !ok {
+		return fmt.Errorf("no SHA256 checksum for protoc %s on %s; add it to protoc_sha256 in %s", cfg.Protoc, platform, ConfigFile)
+	}
+
+	url := protocURL(cfg.Protoc, platform)
+	body, err := httpGet(ctx, opts, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+	if got := sha256.Sum256(data); hex.EncodeToString(got[:]) != strings.ToLower(want) {
+		return fmt.Errorf("GET %s: SHA256 checksum is %x, want %s", url, got, want)
+	}
+
+	// Extract into a temporary directory, then rename it,
+	// so that an interrupted extraction is not mistaken for an installation.
+	if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return err
+	}
+	tmpdir, err := os.MkdirTemp(filepath.Dir(dir), "tmp-protoc")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := unzip(tmpdir, data); err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	return os.Rename(tmpdir, dir)
+}
+
+// httpGet returns the body of a successful HTTP GET request for url,
+// retrying network errors and server errors as opts.Retries permits.
+func httpGet(ctx context.Context, opts *Options, url string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := retry(ctx, opts, "GET "+url, func(io.Writer) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return &transientError{err}
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err := fmt.Errorf("GET %s: %s", url, resp.Status)
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+				return &transientError{err}
+			}
+			return err
+		}
+		body = resp.Body
+		return nil
+	})
+	return body, err
+}
+
+// unzip extracts the zip archive data into dir.
+func unzip(dir string, data []byte) error {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		name := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(name, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file name %q", f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(name, 0777); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			return err
+		}
+		in, err := f.Open()
+		if err != nil {
+			return err
+		}
+		out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode().Perm()|0600)
+		if err == nil {
+			_, err = io.Copy(out, in)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+		}
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package protogen
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	goruntime "runtime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ToolchainLockFile is the name of the lock file, beside the config
+// file, that pins the toolchain's artifacts to their exact content.
+const ToolchainLockFile = "proto-gen-go.lock"
+
+// baseImage is the default image from which the toolchain image is built.
+const baseImage = "golang:1.19.1"
+
+// A ToolchainLock records the content digests of the artifacts of a
+// config's toolchain, so that the toolchain is the same wherever it is
+// built, even if a tag or release is republished. When a config has a
+// lock, image builds and local installs fail if an artifact does not
+// match it, or if the lock does not cover the config.
+type ToolchainLock struct {
+	BaseImage    string            `yaml:"base_image"`    // base image, with digest, e.g. "golang:1.19.1@sha256:..."
+	Protoc       string            `yaml:"protoc"`        // protoc release version
+	ProtocSHA256 map[string]string `yaml:"protoc_sha256"` // SHA256 checksums of the protoc release archives, by platform
+	Modules      []LockedModule    `yaml:"modules"`       // modules of the Go plugins and tools
+}
+
+// A LockedModule is a module version and its go.sum hash ("h1:...").
+type LockedModule struct {
+	Path    string `yaml:"path"`
+	Version string `yaml:"version"`
+	Sum     string `yaml:"sum"`
+}
+
+// module returns the locked module that provides the Go plugin p.
+func (l *ToolchainLock) module(p Plugin) (LockedModule, bool) {
+	var best LockedModule
+	for _, m := range l.Modules {
+		if m.Version == p.Version && (p.Module == m.Path || strings.HasPrefix(p.Module, m.Path+"/")) && len(m.Path) > len(best.Path) {
+			best = m
+		}
+	}
+	return best, best.Path != ""
+}
+
+// readToolchainLock reads the named lock file, returning nil if it does not exist.
+func readToolchainLock(filename string) (*ToolchainLock, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lock := new(ToolchainLock)
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return lock, nil
+}
+
+// WriteFile writes the lock to the named file.
+func (l *ToolchainLock) WriteFile(filename string) error {
+	var buf bytes.Buffer
+	buf.WriteString("# Code generated by proto-gen-go lock. DO NOT EDIT.\n")
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(l); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0666)
+}
+
+// checkLock reports an error if the config has a lock that does not
+// cover its protoc release and the modules of its Go plugins and tools.
+func (cfg *Config) checkLock() error {
+	if cfg.Lock == nil {
+		return nil
+	}
+	stale := func(what string) error {
+		return fmt.Errorf("%s: %s is not locked; run 'proto-gen-go lock'", ToolchainLockFile, what)
+	}
+	if cfg.Lock.Protoc != cfg.Protoc {
+		return stale("protoc " + cfg.Protoc)
+	}
+	if base := cfg.Lock.BaseImage; base != "" && !strings.HasPrefix(base, cfg.BaseImage+"@") {
+		return stale("base image " + cfg.BaseImage)
+	}
+	for _, p := range cfg.installs() {
+		if p.Module == "" {
+			continue // npm, pip, Swift and URL plugins are pinned by other means
+		}
+		if _, ok := cfg.Lock.module(p); !ok {
+			return stale(p.Module + "@" + p.Version)
+		}
+	}
+	return nil
+}
+
+// LockToolchain resolves the artifacts of the config's toolchain and
+// returns a lock that records their digests. Entries of the config's
+// existing lock (Config.Lock) are retained if they still apply, so
+// that, for example, a base image retagged since it was locked remains
+// pinned to its locked digest; to resolve everything anew, clear it.
+//
+// Resolving the base image requires a container runtime, unless Local
+// is set; resolving the modules requires a go command.
+func LockToolchain(ctx context.Context, opts Options) (*ToolchainLock, error) {
+	if err := opts.Config.resolve(); err != nil {
+		return nil, err
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	old := opts.Config.Lock
+	if old == nil {
+		old = new(ToolchainLock)
+	}
+	lock := &ToolchainLock{Protoc: opts.Protoc, ProtocSHA256: make(map[string]string)}
+
+	// Base image.
+	if strings.HasPrefix(old.BaseImage, opts.BaseImage+"@") {
+		lock.BaseImage = old.BaseImage
+	} else if !opts.Local {
+		rt, err := findRuntime(opts.Runtime)
+		if err != nil {
+			return nil, err
+		}
+		if err := useRegistry(ctx, &opts, rt, opts.BaseImage); err != nil {
+			return nil, err
+		}
+		digest, err := imageDigest(ctx, &opts, rt, opts.BaseImage)
+		if err != nil {
+			return nil, err
+		}
+		lock.BaseImage = opts.BaseImage + "@" + digest
+	}
+
+	// protoc release archives, for each container platform and the host.
+	platforms := []string{"linux-x86_64", "linux-aarch_64"}
+	if host, err := protocPlatform(goruntime.GOOS, goruntime.GOARCH); err == nil && goruntime.GOOS != "linux" {
+		platforms = append(platforms, host)
+	}
+	for _, platform := range platforms {
+		if sum, ok := old.ProtocSHA256[platform]; ok && old.Protoc == opts.Protoc {
+			lock.ProtocSHA256[platform] = sum
+			continue
+		}
+		url := protocURL(opts.Protoc, platform)
+		opts.logf("downloading %s...", url)
+		sum, err := sha256URL(ctx, &opts, url)
+		if err != nil {
+			return nil, err
+		}
+		lock.ProtocSHA256[platform] = sum
+	}
+
+	// Modules of the Go plugins and tools.
+	for _, p := range opts.Config.installs() {
+		if p.Module == "" {
+			continue
+		}
+		if m, ok := old.module(p); ok {
+			lock.Modules = append(lock.Modules, m)
+			continue
+		}
+		opts.logf("resolving %s@%s...", p.Module, p.Version)
+		m, err := resolveModule(ctx, opts.goEnv(), p.Module, p.Version)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %v", p.Name, err)
+		}
+		lock.Modules = append(lock.Modules, m)
+	}
+	return lock, nil
+}
+
+// imageDigest pulls the image and returns its repository digest.
+func imageDigest(ctx context.Context, opts *Options, rt *runtime, image string) (string, error) {
+	opts.logf("pulling %s...", image)
+	if err := retry(ctx, opts, "image pull", func(diag io.Writer) error {
+		cmd := rt.command(ctx, "pull", image)
+		cmd.Stdout = io.Discard
+		cmd.Stderr = io.MultiWriter(opts.Stderr, diag)
+		return cmd.Run()
+	}); err != nil {
+		return "", fmt.Errorf("%s pull %s: %v", rt.name, image, err)
+	}
+	cmd := rt.command(ctx, "image", "inspect", "--format={{index .RepoDigests 0}}", image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s image inspect %s: %v: %s", rt.name, image, err, strings.TrimSpace(stderr.String()))
+	}
+	_, digest, ok := strings.Cut(strings.TrimSpace(string(out)), "@")
+	if !ok {
+		return "", fmt.Errorf("%s image inspect %s: no repository digest", rt.name, image)
+	}
+	return digest, nil
+}
+
+// sha256URL returns the hex SHA256 checksum of the content at the URL.
+func sha256URL(ctx context.Context, opts *Options, url string) (string, error) {
+	body, err := httpGet(ctx, opts, url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", fmt.Errorf("GET %s: %v", url, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// A moduleInfo is the output of 'go mod download -json'.
+type moduleInfo struct {
+	Path, Version, Sum, Error string
+}
+
+// downloadModule runs 'go mod download -json' for the module version,
+// with the additional environment variables env.
+func downloadModule(ctx context.Context, env []string, path, version string) (*moduleInfo, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "go", "mod", "download", "-json", path+"@"+version)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	info := new(moduleInfo)
+	if jerr := json.Unmarshal(stdout.Bytes(), info); jerr != nil {
+		if err == nil {
+			err = jerr
+		}
+		return nil, fmt.Errorf("go mod download %s@%s: %v: %s", path, version, err, strings.TrimSpace(stderr.String()))
+	}
+	if info.Error != "" {
+		return nil, fmt.Errorf("go mod download %s@%s: %s", path, version, info.Error)
+	}
+	return info, nil
+}
+
+// resolveModule returns the locked module that provides the package
+// pkg at the version: the longest prefix of pkg that is a module.
+// The go commands run with the additional environment variables env.
+func resolveModule(ctx context.Context, env []string, pkg, version string) (LockedModule, error) {
+	var firstErr error
+	for p := pkg; strings.Contains(p, "/"); p = path.Dir(p) {
+		info, err := downloadModule(ctx, env, p, version)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		return LockedModule{info.Path, info.Version, info.Sum}, nil
+	}
+	return LockedModule{}, firstErr
+}
+
+// verifyModule reports an error if the content of the locked module
+// (downloaded to the module cache, if necessary) does not match its sum.
+func verifyModule(ctx context.Context, opts *Options, m LockedModule) error {
+	if opts.DryRun {
+		_, err := fmt.Fprintf(opts.Stdout, "# verify %s@%s %s\n", m.Path, m.Version, m.Sum)
+		return err
+	}
+	info, err := downloadModule(ctx, opts.goEnv(), m.Path, m.Version)
+	if err != nil {
+		return err
+	}
+	if info.Sum != m.Sum {
+		return fmt.Errorf("%s@%s has sum %s, but %s has %s", m.Path, m.Version, info.Sum, ToolchainLockFile, m.Sum)
+	}
+	return nil
+}
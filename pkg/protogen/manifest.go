@@ -0,0 +1,176 @@
+package protogen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestFile is the name of the file, in the working directory, that
+// records the files generated from each .proto file, so that those of
+// deleted .proto files may be found and removed (see Options.Prune).
+// It should be committed along with the generated files.
+const ManifestFile = ".proto-gen-go.manifest"
+
+// A manifest records the outputs generated from each .proto file.
+type manifest struct {
+	// Sources maps each .proto file, as named on the protoc command
+	// line, to the files generated from it. All names are relative to
+	// the working directory and slash-separated.
+	Sources map[string][]string `json:"sources"`
+}
+
+// readManifest reads the manifest of the directory, which is empty if absent.
+func readManifest(dir string) (*manifest, error) {
+	m := &manifest{Sources: make(map[string][]string)}
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", ManifestFile, err)
+	}
+	if m.Sources == nil {
+		m.Sources = make(map[string][]string)
+	}
+	return m, nil
+}
+
+// write writes the manifest to the directory.
+func (m *manifest) write(dir string) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), append(data, '\n'), 0666)
+}
+
+// record sets the outputs of the .proto files compiled by a run to the
+// generated files attributed to them (see sourceOf). Files attributed
+// to no source, such as documentation, are not recorded.
+func (m *manifest) record(sources, generated []string) {
+	outputs := make(map[string][]string)
+	for _, file := range generated {
+		if src := sourceOf(sources, file); src != "" {
+			outputs[src] = append(outputs[src], filepath.ToSlash(file))
+		}
+	}
+	for _, src := range sources {
+		if files, ok := outputs[src]; ok {
+			sort.Strings(files)
+			m.Sources[filepath.ToSlash(src)] = files
+		}
+	}
+}
+
+// sourceOf returns the .proto file, among sources, from which the
+// generated file was presumably generated: the one whose base name,
+// less .proto, is the longest prefix of the file's base name followed
+// by "." or "_", as foo.pb.go and foo_grpc.pb.go are generated from
+// foo.proto. It returns "" if there is none.
+func sourceOf(sources []string, file string) string {
+	base := path.Base(filepath.ToSlash(file))
+	best, bestLen := "", 0
+	for _, src := range sources {
+		stem := strings.TrimSuffix(path.Base(filepath.ToSlash(src)), ".proto")
+		if len(stem) > bestLen && (strings.HasPrefix(base, stem+".") || strings.HasPrefix(base, stem+"_")) {
+			best, bestLen = src, len(stem)
+		}
+	}
+	return best
+}
+
+// stale returns the .proto files of the manifest that no longer exist
+// beneath dir, and their outputs that are not also outputs of an
+// existing .proto file.
+func (m *manifest) stale(dir string) (sources, outputs []string) {
+	live := make(map[string]bool)
+	for src, files := range m.Sources {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(src))); err != nil {
+			sources = append(sources, src)
+			continue
+		}
+		for _, file := range files {
+			live[file] = true
+		}
+	}
+	sort.Strings(sources)
+	for _, src := range sources {
+		for _, file := range m.Sources[src] {
+			if !live[file] {
+				outputs = append(outputs, file)
+			}
+		}
+	}
+	return sources, outputs
+}
+
+// prune removes the outputs of the .proto files of the manifest that
+// no longer exist, if opts.Prune is set, and otherwise reports them. It
+// reports whether the manifest changed.
+func (m *manifest) prune(opts *Options) (bool, error) {
+	sources, outputs := m.stale(opts.Dir)
+	if len(sources) == 0 {
+		return false, nil
+	}
+	if !opts.Prune {
+		if len(outputs) > 0 {
+			opts.logf("%d generated files are stale, since their .proto files no longer exist (use -prune to remove them)", len(outputs))
+		}
+		return false, nil
+	}
+	for _, file := range outputs {
+		opts.logf("removing stale %s", file)
+		if err := os.Remove(filepath.Join(opts.Dir, filepath.FromSlash(file))); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	for _, src := range sources {
+		delete(m.Sources, src)
+	}
+	return true, nil
+}
+
+// equal reports whether the manifests have the same content.
+func (m *manifest) equal(other *manifest) bool {
+	x, _ := json.Marshal(m)
+	y, _ := json.Marshal(other)
+	return bytes.Equal(x, y)
+}
+
+// hashFiles returns the hex SHA256 of the content of each of the named
+// files, relative to dir.
+func hashFiles(dir string, files []string) (map[string]string, error) {
+	hashes := make(map[string]string, len(files))
+	for _, file := range files {
+		sum, err := hashFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		hashes[file] = sum
+	}
+	return hashes, nil
+}
+
+// hashFile returns the hex SHA256 of the content of the named file.
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,338 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A MocksConfig configures the generation, if enabled, of gomock mocks
+// of the service interfaces generated by the twirp plugin (Service) and
+// the grpc plugin (ServiceClient and, unless it requires an unexported
+// method, ServiceServer), in a package beside each generated package.
+type MocksConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`    // subdirectory of each generated package that holds its mocks (default: "mocks")
+	Gomock  string `yaml:"gomock"` // import path of gomock (default: "go.uber.org/mock/gomock")
+}
+
+// Defaults of MocksConfig.
+const (
+	defaultMocksDir = "mocks"
+	defaultGomock   = "go.uber.org/mock/gomock"
+)
+
+// resolve sets the unset fields of the config to their defaults.
+func (mc *MocksConfig) resolve() error {
+	if !mc.Enabled {
+		return nil
+	}
+	if mc.Dir == "" {
+		mc.Dir = defaultMocksDir
+	}
+	if name := path.Base(filepath.ToSlash(mc.Dir)); !token.IsIdentifier(name) {
+		return fmt.Errorf("mocks: the base name of dir %q is not a valid Go package name", mc.Dir)
+	}
+	if mc.Gomock == "" {
+		mc.Gomock = defaultGomock
+	}
+	return nil
+}
+
+// writeMocks writes the mocks of the service interfaces of the generated
+// files, named relative to the host directory dir, which stands in for
+// opts.Dir, and returns the names of those it created or modified.
+func writeMocks(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Mocks.Enabled {
+		return nil, nil
+	}
+	var written []string
+	for _, file := range files {
+		base := filepath.Base(file)
+		var stem string
+		switch {
+		case strings.HasSuffix(base, ".twirp.go"):
+			stem = strings.TrimSuffix(base, ".twirp.go") + "_twirp"
+		case strings.HasSuffix(base, "_grpc.pb.go"):
+			stem = strings.TrimSuffix(base, ".pb.go")
+		default:
+			continue
+		}
+		importPath, err := goImportPath(filepath.Dir(filepath.Join(opts.Dir, file)))
+		if err != nil {
+			return nil, fmt.Errorf("mocks: %v", err)
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		mock, err := mockFile(file, src, importPath, &opts.Mocks)
+		if err != nil {
+			return nil, err
+		}
+		if mock == nil {
+			continue // no service interfaces
+		}
+		name := filepath.Join(filepath.Dir(file), filepath.FromSlash(opts.Mocks.Dir), stem+"_mock.go")
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, mock) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filename, mock, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// predeclaredTypes are the names of Go's predeclared types, which are
+// not qualified by the package of the generated file in its mocks.
+var predeclaredTypes = map[string]bool{
+	"any": true, "bool": true, "byte": true, "comparable": true, "complex64": true, "complex128": true,
+	"error": true, "float32": true, "float64": true, "int": true, "int8": true, "int16": true,
+	"int32": true, "int64": true, "rune": true, "string": true, "uint": true, "uint8": true,
+	"uint16": true, "uint32": true, "uint64": true, "uintptr": true,
+}
+
+// mockFile returns the source of the mocks of the service interfaces of
+// the generated Go file, whose package has the specified import path,
+// or nil if it has none. Service interfaces are those with constructors
+// (NewServiceProtobufClient, NewServiceClient) or registration functions
+// (RegisterServiceServer).
+func mockFile(name string, src []byte, importPath string, mc *MocksConfig) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mocks: %v", err)
+	}
+	funcs := make(map[string]bool)
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil {
+			funcs[fn.Name.Name] = true
+		}
+	}
+	imports := make(map[string]string) // import paths by name
+	for _, imp := range f.Imports {
+		p, _ := strconv.Unquote(imp.Path.Value)
+		if imp.Name != nil {
+			imports[imp.Name.Name] = p
+		} else {
+			imports[path.Base(p)] = p
+		}
+	}
+
+	pkg := f.Name.Name
+	used := make(map[string]bool) // packages referred to by the mocks
+	var body bytes.Buffer
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			it, ok := ts.Type.(*ast.InterfaceType)
+			name := ts.Name.Name
+			if !ok || !(funcs["New"+name+"ProtobufClient"] || funcs["New"+name] || funcs["Register"+name]) {
+				continue
+			}
+			if !mockable(it) {
+				continue // e.g. a server with mustEmbedUnimplemented...
+			}
+			for _, m := range it.Methods.List {
+				qualify(m.Type, pkg, used)
+			}
+			writeMock(&body, fset, name, it)
+		}
+	}
+	if body.Len() == 0 {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by proto-gen-go from %s. DO NOT EDIT.\n\n", filepath.Base(name))
+	fmt.Fprintf(&buf, "// Package %s holds gomock mocks of the services of package %s.\n", path.Base(filepath.ToSlash(mc.Dir)), pkg)
+	fmt.Fprintf(&buf, "package %s\n\nimport (\n\t\"reflect\"\n\n\tgomock %q\n", path.Base(filepath.ToSlash(mc.Dir)), mc.Gomock)
+	var names []string
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case name == pkg:
+			fmt.Fprintf(&buf, "\t%s %q\n", name, importPath)
+		case imports[name] != "":
+			fmt.Fprintf(&buf, "\t%s %q\n", name, imports[name])
+		}
+	}
+	buf.WriteString(")\n")
+	buf.Write(body.Bytes())
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("mocks of %s: %v", name, err)
+	}
+	return out, nil
+}
+
+// mockable reports whether the interface may be implemented by a mock
+// in another package: whether its methods are exported, and it embeds
+// no other interface.
+func mockable(it *ast.InterfaceType) bool {
+	for _, m := range it.Methods.List {
+		if len(m.Names) != 1 || !m.Names[0].IsExported() {
+			return false
+		}
+	}
+	return true
+}
+
+// qualify qualifies the names of the types declared by the package pkg
+// in the type expression, and records in used the packages it refers to.
+func qualify(expr ast.Expr, pkg string, used map[string]bool) {
+	ast.Inspect(expr, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if x, ok := n.X.(*ast.Ident); ok {
+				used[x.Name] = true
+			}
+			return false
+		case *ast.Field:
+			qualify(n.Type, pkg, used) // not the parameter names
+			return false
+		case *ast.Ident:
+			if !predeclaredTypes[n.Name] {
+				n.Name = pkg + "." + n.Name
+				used[pkg] = true
+			}
+		}
+		return true
+	})
+}
+
+// writeMock writes the gomock mock of the named interface, whose
+// method types have been qualified, in the manner of mockgen.
+func writeMock(w *bytes.Buffer, fset *token.FileSet, name string, it *ast.InterfaceType) {
+	mock, recorder := "Mock"+name, "Mock"+name+"MockRecorder"
+	fmt.Fprintf(w, `
+// %[1]s is a mock of the %[3]s interface.
+type %[1]s struct {
+	ctrl     *gomock.Controller
+	recorder *%[2]s
+}
+
+// %[2]s is the mock recorder for %[1]s.
+type %[2]s struct {
+	mock *%[1]s
+}
+
+// New%[1]s creates a new mock instance.
+func New%[1]s(ctrl *gomock.Controller) *%[1]s {
+	mock := &%[1]s{ctrl: ctrl}
+	mock.recorder = &%[2]s{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *%[1]s) EXPECT() *%[2]s {
+	return m.recorder
+}
+`, mock, recorder, name)
+
+	typeString := func(expr ast.Expr) string {
+		var buf bytes.Buffer
+		printer.Fprint(&buf, fset, expr)
+		return buf.String()
+	}
+	for _, m := range it.Methods.List {
+		method := m.Names[0].Name
+		ft := m.Type.(*ast.FuncType)
+
+		// Parameters, named arg0, arg1, ...
+		var params, args, recParams []string
+		variadic := ""
+		i := 0
+		for _, field := range ft.Params.List {
+			n := len(field.Names)
+			if n == 0 {
+				n = 1
+			}
+			for j := 0; j < n; j++ {
+				arg := fmt.Sprintf("arg%d", i)
+				i++
+				if ell, ok := field.Type.(*ast.Ellipsis); ok {
+					variadic = arg
+					params = append(params, arg+" ..."+typeString(ell.Elt))
+					recParams = append(recParams, arg+" ...interface{}")
+					continue
+				}
+				params = append(params, arg+" "+typeString(field.Type))
+				args = append(args, arg)
+				recParams = append(recParams, arg+" interface{}")
+			}
+		}
+		var results []string
+		if ft.Results != nil {
+			for _, field := range ft.Results.List {
+				n := len(field.Names)
+				if n == 0 {
+					n = 1
+				}
+				for j := 0; j < n; j++ {
+					results = append(results, typeString(field.Type))
+				}
+			}
+		}
+
+		// The mock method.
+		fmt.Fprintf(w, "\n// %s mocks base method.\nfunc (m *%s) %s(%s)", method, mock, method, strings.Join(params, ", "))
+		if len(results) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(results, ", "))
+		}
+		w.WriteString(" {\n\tm.ctrl.T.Helper()\n")
+		callArgs := ""
+		if variadic != "" {
+			fmt.Fprintf(w, "\tvarargs := []interface{}{%s}\n\tfor _, a := range %s {\n\t\tvarargs = append(varargs, a)\n\t}\n", strings.Join(args, ", "), variadic)
+			callArgs = ", varargs..."
+		} else if len(args) > 0 {
+			callArgs = ", " + strings.Join(args, ", ")
+		}
+		if len(results) == 0 {
+			fmt.Fprintf(w, "\tm.ctrl.Call(m, %q%s)\n}\n", method, callArgs)
+		} else {
+			fmt.Fprintf(w, "\tret := m.ctrl.Call(m, %q%s)\n", method, callArgs)
+			var rets []string
+			for i, r := range results {
+				fmt.Fprintf(w, "\tret%d, _ := ret[%d].(%s)\n", i, i, r)
+				rets = append(rets, fmt.Sprintf("ret%d", i))
+			}
+			fmt.Fprintf(w, "\treturn %s\n}\n", strings.Join(rets, ", "))
+		}
+
+		// The recorder method.
+		fmt.Fprintf(w, "\n// %s indicates an expected call of %s.\nfunc (mr *%s) %s(%s) *gomock.Call {\n\tmr.mock.ctrl.T.Helper()\n",
+			method, method, recorder, method, strings.Join(recParams, ", "))
+		callArgs = ""
+		if variadic != "" {
+			fmt.Fprintf(w, "\tvarargs := append([]interface{}{%s}, %s...)\n", strings.Join(args, ", "), variadic)
+			callArgs = ", varargs..."
+		} else if len(args) > 0 {
+			callArgs = ", " + strings.Join(args, ", ")
+		}
+		fmt.Fprintf(w, "\treturn mr.mock.ctrl.RecordCallWithMethodType(mr.mock, %q, reflect.TypeOf((*%s)(nil).%s)%s)\n}\n", method, mock, method, callArgs)
+	}
+}
@@ -0,0 +1,201 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// postprocess applies the enabled post-processing steps to the
+// generated files, named relative to dir, of the .proto files sources.
+func postprocess(opts *Options, dir string, files, sources []string) error {
+	if draft := opts.JSONSchema.Draft; draft != "" && draft != "draft-04" {
+		out := filepath.Clean(filepath.FromSlash(opts.JSONSchema.Out)) + string(filepath.Separator)
+		for _, file := range files {
+			if strings.HasPrefix(file, out) {
+				if err := setSchemaDraft(filepath.Join(dir, file), draft); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if opts.Tags.enabled() {
+		for _, file := range files {
+			if strings.HasSuffix(file, ".pb.go") {
+				if err := injectTags(filepath.Join(dir, file), &opts.Tags); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if opts.Header != "" {
+		header, err := renderHeader(opts.Header)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := addHeader(filepath.Join(dir, file), header); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.Provenance {
+		toolchain := opts.provenance()
+		for _, file := range files {
+			if err := stampFile(dir, file, toolchain, sourceOf(sources, file)); err != nil {
+				return err
+			}
+		}
+	}
+	if !opts.NoFormat {
+		for _, file := range files {
+			if strings.HasSuffix(file, ".go") {
+				if err := formatFile(filepath.Join(dir, file)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setSchemaDraft rewrites the $schema of the named draft-04 JSON Schema
+// file, if it has one, to that of the specified draft.
+func setSchemaDraft(filename, draft string) error {
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	old := strconv.Quote(jsonSchemaDrafts["draft-04"])
+	if !bytes.Contains(src, []byte(old)) {
+		return nil
+	}
+	return os.WriteFile(filename, bytes.Replace(src, []byte(old), []byte(strconv.Quote(jsonSchemaDrafts[draft])), 1), 0666)
+}
+
+// formatFile formats the named Go file as gofmt does, if necessary.
+func formatFile(filename string) error {
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	formatted, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("formatting %s: %v", filename, err)
+	}
+	if bytes.Equal(src, formatted) {
+		return nil
+	}
+	return os.WriteFile(filename, formatted, 0666)
+}
+
+// headerData is the data of the Config.Header template.
+type headerData struct {
+	Year    int    // current year, or that of $SOURCE_DATE_EPOCH if set
+	Version string // version of proto-gen-go
+}
+
+// renderHeader executes the header template.
+func renderHeader(text string) (string, error) {
+	tmpl, err := template.New("header").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("header: %v", err)
+	}
+	now := time.Now()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", epoch)
+		}
+		now = time.Unix(sec, 0).UTC()
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, headerData{Year: now.Year(), Version: Version()}); err != nil {
+		return "", fmt.Errorf("header: %v", err)
+	}
+	return strings.TrimRight(buf.String(), "\n"), nil
+}
+
+// commentPrefixes maps the extensions of generated files to the line
+// comment syntax of their languages. Files of other types, such as
+// JSON, which has no comments, are left without a header.
+var commentPrefixes = map[string]string{
+	".go": "//", ".ts": "//", ".js": "//", ".java": "//", ".swift": "//",
+	".kt": "//", ".dart": "//", ".cc": "//", ".h": "//", ".cs": "//", ".rs": "//",
+	".php": "//", ".proto": "//", ".py": "#", ".pyi": "#", ".rb": "#",
+	".yaml": "#", ".yml": "#", ".graphql": "#",
+}
+
+// provenance returns a description of the toolchain for the comments
+// of Config.Provenance: the versions of proto-gen-go, protoc and the
+// plugins.
+func (cfg *Config) provenance() string {
+	parts := []string{"proto-gen-go " + Version(), "protoc " + cfg.Protoc}
+	for _, p := range cfg.Plugins {
+		if p.Version != "" {
+			parts = append(parts, "protoc-gen-"+p.flagName()+" "+p.Version)
+		} else {
+			parts = append(parts, "protoc-gen-"+p.flagName())
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// stampFile appends to the generated file, named relative to dir, a
+// comment recording the toolchain that generated it and the SHA256 of
+// the .proto file src, if known, from which it was generated.
+func stampFile(dir, file, toolchain, src string) error {
+	filename := filepath.Join(dir, file)
+	prefix, ok := commentPrefixes[filepath.Ext(filename)]
+	if !ok {
+		return nil
+	}
+	stamp := fmt.Sprintf("\n%s Generated by %s.\n", prefix, toolchain)
+	if src != "" {
+		abs := src
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(dir, abs)
+		}
+		sum, err := hashFile(abs)
+		if err != nil {
+			return err
+		}
+		stamp += fmt.Sprintf("%s Source: %s (sha256:%s)\n", prefix, filepath.ToSlash(src), sum)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if bytes.HasSuffix(data, []byte(stamp)) {
+		return nil
+	}
+	return os.WriteFile(filename, append(data, stamp...), 0666)
+}
+
+// addHeader prepends the header, commented out in the syntax of the
+// named file's language, to the file, unless it already begins with it.
+func addHeader(filename, header string) error {
+	prefix, ok := commentPrefixes[filepath.Ext(filename)]
+	if !ok {
+		return nil
+	}
+	var comment bytes.Buffer
+	for _, line := range strings.Split(header, "\n") {
+		comment.WriteString(strings.TrimRight(prefix+" "+line, " ") + "\n")
+	}
+	comment.WriteString("\n") // keep the header apart from any doc comment
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(src, comment.Bytes()) {
+		return nil
+	}
+	return os.WriteFile(filename, append(comment.Bytes(), src...), 0666)
+}
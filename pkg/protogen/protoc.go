@@ -0,0 +1,123 @@
+package protogen
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// protocReleases are the protoc releases known to the tool, which the
+// config may name without checksums of their archives: the last patch
+// release of each minor version (and 3.19.4, the former default), from
+// the first to support optional fields in proto3 (3.12, experimentally),
+// to those supporting Editions (27.0 and later). Other releases require
+// checksums (see protocSum).
+var protocReleases = []string{
+	"3.12.4", "3.13.0", "3.14.0", "3.15.8", "3.16.3", "3.17.3", "3.18.3", "3.19.4", "3.19.6", "3.20.3",
+	"21.12", "22.5", "23.4", "24.4", "25.5", "26.1", "27.3", "28.3", "29.3",
+}
+
+// protocMinor returns the minor version of a protoc release: Y of the
+// releases 3.Y.Z, and X of the releases X.Y since 21.0, which continued
+// the minor versions of 3.x.
+func protocMinor(version string) (int, bool) {
+	parts := strings.Split(version, ".")
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			return 0, false
+		}
+	}
+	switch {
+	case len(parts) == 3 && parts[0] == "3":
+		minor, _ := strconv.Atoi(parts[1])
+		return minor, true
+	case len(parts) == 2:
+		if major, _ := strconv.Atoi(parts[0]); major >= 21 {
+			return major, true
+		}
+	}
+	return 0, false
+}
+
+// checkProtoc reports an error if version is not the name of a protoc release.
+func checkProtoc(version string) error {
+	if _, ok := protocMinor(version); !ok {
+		return fmt.Errorf("protoc %q is not a release version, such as %s or 3.19.6", version, DefaultConfig.Protoc)
+	}
+	return nil
+}
+
+// knownProtoc reports whether version is one of protocReleases.
+func knownProtoc(version string) bool {
+	for _, v := range protocReleases {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// proto3OptionalFlag is the flag that enables optional fields in proto3
+// files in protoc releases 3.12 to 3.14, before they became standard.
+const proto3OptionalFlag = "--experimental_allow_proto3_optional"
+
+// withProto3Optional returns the protoc arguments, preceded by
+// proto3OptionalFlag if the protoc version requires it and they lack it.
+func withProto3Optional(version string, args []string) []string {
+	if minor, ok := protocMinor(version); !ok || minor < 12 || minor >= 15 {
+		return args
+	}
+	for _, arg := range args {
+		if arg == proto3OptionalFlag {
+			return args
+		}
+	}
+	return append([]string{proto3OptionalFlag}, args...)
+}
+
+// protocSums holds the checksums of known protoc release archives.
+//
+//go:embed protoc.sum
+var protocSums string
+
+// knownProtocSums maps the file names of protoc release archives
+// (see protocArchive) to their SHA256 checksums, from protocSums.
+var knownProtocSums = parseSums(protocSums)
+
+// parseSums parses the output of sha256sum, ignoring comments.
+func parseSums(data string) map[string]string {
+	sums := make(map[string]string)
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if sum, file, ok := strings.Cut(line, "  "); ok {
+			sums[file] = sum
+		}
+	}
+	return sums
+}
+
+// protocArchive returns the file name of a protoc release archive.
+func protocArchive(version, platform string) string {
+	return fmt.Sprintf("protoc-%s-%s.zip", version, platform)
+}
+
+// protocSum returns the SHA256 checksum of the config's protoc release
+// archive for the platform, from the lock if any, or else the config's
+// protoc_sha256 setting, or else the checksums embedded in the tool.
+func (cfg *Config) protocSum(platform string) (string, bool) {
+	if cfg.Lock != nil {
+		sum, ok := cfg.Lock.ProtocSHA256[platform]
+		return sum, ok
+	}
+	if sum, ok := cfg.ProtocSHA256[platform]; ok {
+		return sum, ok
+	}
+	sum, ok := knownProtocSums[protocArchive(cfg.Protoc, platform)]
+	return sum, ok
+}
@@ -0,0 +1,636 @@
+package protogen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// descriptorSetFile is the name of the descriptor set, in the working
+// directory, that protoc writes for Config.Templates and
+// Config.Services, if it does not already write one. It is removed
+// once read.
+const descriptorSetFile = ".proto-gen-go.descriptors.pb"
+
+// descriptorSetArgs adds to the protoc arguments, if Config.Templates
+// or Config.Services are set, the flags of the descriptor set from which
+// they are generated, and returns its name: that of a
+// --descriptor_set_out flag among the arguments (which must then
+// include --include_source_info for the templates to have comments), or
+// else descriptorSetFile, beneath pwd.
+func (cfg *Config) descriptorSetArgs(args []string, pwd string) ([]string, string) {
+	if len(cfg.Templates) == 0 && !cfg.Services.Enabled {
+		return args, ""
+	}
+	for i := 0; i < len(args); i++ {
+		if name, value, ok := flagValue(args, &i); ok && name == "--descriptor_set_out" {
+			return args, value
+		}
+	}
+	set := filepath.Join(pwd, descriptorSetFile)
+	// Flags precede the .proto files, which follow them by convention.
+	return append([]string{"--include_source_info", "--descriptor_set_out=" + set}, args...), set
+}
+
+// readDescriptorSet returns the .proto files of the descriptor set
+// written by protoc, if any, with the host directory dir standing in
+// for the working directory opts.Dir, with those compiled by the run
+// marked by ProtoFile.Generate. It removes the set if it is that of
+// descriptorSetFile.
+func (e *env) readDescriptorSet(opts *Options, dir string) ([]*ProtoFile, error) {
+	if e.descriptorSet == "" {
+		return nil, nil
+	}
+	set := hostPath(opts, dir, e.descriptorSet)
+	data, err := os.ReadFile(set)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Base(e.descriptorSet) == descriptorSetFile {
+		if err := os.Remove(set); err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasSuffix(set, ".gz") {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", set, err)
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("%s: %v", set, err)
+		}
+	}
+	files, err := parseDescriptorSet(data)
+	if err != nil {
+		return nil, err
+	}
+	paths := protoPaths(e.protocArgs, opts.Dir)
+	compiled := make(map[string]bool)
+	for _, file := range protoFiles(e.protocArgs) {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(opts.Dir, file)
+		}
+		compiled[importName(file, paths)] = true
+	}
+	for _, f := range files {
+		f.Generate = compiled[f.Name]
+	}
+	return files, nil
+}
+
+// The types below describe the .proto files of a FileDescriptorSet, as
+// decoded by parseDescriptorSet, for the templates of Config.Templates
+// and the constants of Config.Services.
+// They are a simplified form of those of google/protobuf/descriptor.proto,
+// whose messages are decoded here from the wire format, so that the
+// tool need not depend on the protobuf module.
+
+// A ProtoFile describes a .proto file.
+type ProtoFile struct {
+	Name         string // import name, e.g. "acme/billing/v1/billing.proto"
+	Package      string // proto package, e.g. "acme.billing.v1"
+	GoPackage    string // go_package option, if any
+	Syntax       string // "proto2", "proto3" or "editions"
+	Dependencies []string
+	Messages     []*ProtoMessage // top-level messages
+	Enums        []*ProtoEnum    // top-level enums
+	Services     []*ProtoService
+
+	// Generate reports whether the file was compiled, rather than
+	// imported by a compiled file.
+	Generate bool
+}
+
+// Dir returns the directory of the file's import name, e.g. "acme/billing/v1".
+func (f *ProtoFile) Dir() string { return path.Dir(f.Name) }
+
+// Base returns the base name of the file without its .proto extension, e.g. "billing".
+func (f *ProtoFile) Base() string { return strings.TrimSuffix(path.Base(f.Name), ".proto") }
+
+// GoPackageName returns the name of the Go package of the file's
+// go_package option, e.g. "billingv1" for "example.com/api/billing/v1;billingv1".
+func (f *ProtoFile) GoPackageName() string {
+	if _, name, ok := strings.Cut(f.GoPackage, ";"); ok {
+		return name
+	}
+	return path.Base(f.GoPackage)
+}
+
+// AllMessages returns the messages of the file, including nested ones
+// but not the entries of map fields, in depth-first order.
+func (f *ProtoFile) AllMessages() []*ProtoMessage {
+	var all []*ProtoMessage
+	var walk func([]*ProtoMessage)
+	walk = func(msgs []*ProtoMessage) {
+		for _, m := range msgs {
+			if !m.MapEntry {
+				all = append(all, m)
+				walk(m.Messages)
+			}
+		}
+	}
+	walk(f.Messages)
+	return all
+}
+
+// A ProtoMessage describes a message.
+type ProtoMessage struct {
+	Name     string // e.g. "Invoice"
+	FullName string // e.g. "acme.billing.v1.Invoice"
+	Comments string // leading comments, without comment markers
+	Fields   []*ProtoField
+	Messages []*ProtoMessage // nested messages
+	Enums    []*ProtoEnum    // nested enums
+	MapEntry bool            // the synthetic entry message of a map field
+}
+
+// A ProtoField describes a field of a message.
+type ProtoField struct {
+	Name     string // e.g. "due_date"
+	JSONName string // e.g. "dueDate"
+	Number   int
+	Type     string // e.g. "string", "int64", "message" or "enum", as in descriptor.proto, without its TYPE_ prefix
+	TypeName string // full name of the message or enum type, e.g. "google.protobuf.Timestamp"
+	Repeated bool
+	Optional bool   // has explicit presence (proto3 optional)
+	Oneof    string // name of the containing oneof, if any (other than that of a proto3 optional field)
+	Comments string
+}
+
+// A ProtoEnum describes an enum.
+type ProtoEnum struct {
+	Name     string
+	FullName string
+	Comments string
+	Values   []*ProtoEnumValue
+}
+
+// A ProtoEnumValue describes a value of an enum.
+type ProtoEnumValue struct {
+	Name     string // e.g. "STATUS_PAID"
+	Number   int
+	Comments string
+}
+
+// A ProtoService describes a service.
+type ProtoService struct {
+	Name     string // e.g. "Billing"
+	FullName string // e.g. "acme.billing.v1.Billing"
+	Comments string
+	Methods  []*ProtoMethod
+}
+
+// A ProtoMethod describes a method of a service.
+type ProtoMethod struct {
+	Name            string // e.g. "GetInvoice"
+	Input           string // full name of the request message
+	Output          string // full name of the response message
+	ClientStreaming bool
+	ServerStreaming bool
+	Comments        string
+	HTTP            *ProtoHTTPRule // google.api.http option, if any
+}
+
+// A ProtoHTTPRule is the HTTP mapping of a method, as given by its
+// google.api.http option (without additional bindings).
+type ProtoHTTPRule struct {
+	Method string // e.g. "GET", or the kind of a custom pattern
+	Path   string // e.g. "/v1/invoices/{id}"
+	Body   string // request field of the body, "*" for the whole request, or ""
+}
+
+// protoTypes are the names of the field types of descriptor.proto, by number.
+var protoTypes = [...]string{1: "double", 2: "float", 3: "int64", 4: "uint64", 5: "int32",
+	6: "fixed64", 7: "fixed32", 8: "bool", 9: "string", 10: "group", 11: "message", 12: "bytes",
+	13: "uint32", 14: "enum", 15: "sfixed32", 16: "sfixed64", 17: "sint32", 18: "sint64"}
+
+// httpExtension is the field number of the google.api.http extension of
+// google.protobuf.MethodOptions.
+const httpExtension = 72295728
+
+// parseDescriptorSet decodes the .proto files of a serialized
+// FileDescriptorSet.
+func parseDescriptorSet(data []byte) ([]*ProtoFile, error) {
+	var files []*ProtoFile
+	err := wireFields(data, func(num int, _ uint64, b []byte) error {
+		if num != 1 || b == nil { // FileDescriptorSet.file
+			return nil
+		}
+		f, err := parseFile(b)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid FileDescriptorSet: %v", err)
+	}
+	return files, nil
+}
+
+// A descParser decodes the elements of a FileDescriptorProto, with the
+// leading comments of its SourceCodeInfo, keyed by their paths.
+type descParser struct {
+	comments map[string]string
+}
+
+// comment returns the leading comments of the element at the path.
+func (p *descParser) comment(path []int) string {
+	var key []string
+	for _, n := range path {
+		key = append(key, strconv.Itoa(n))
+	}
+	return p.comments[strings.Join(key, ".")]
+}
+
+// parseFile decodes a FileDescriptorProto.
+func parseFile(data []byte) (*ProtoFile, error) {
+	p := &descParser{comments: make(map[string]string)}
+	// The source info, which may follow the elements, first.
+	err := wireFields(data, func(num int, _ uint64, b []byte) error {
+		if num == 9 && b != nil {
+			return p.parseSourceInfo(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f := &ProtoFile{Syntax: "proto2"}
+	var messages, enums, services int
+	err = wireFields(data, func(num int, v uint64, b []byte) error {
+		var err error
+		switch num {
+		case 1:
+			f.Name = string(b)
+		case 2:
+			f.Package = string(b)
+		case 3:
+			f.Dependencies = append(f.Dependencies, string(b))
+		case 4:
+			var m *ProtoMessage
+			m, err = p.parseMessage(b, []int{4, messages})
+			f.Messages = append(f.Messages, m)
+			messages++
+		case 5:
+			var e *ProtoEnum
+			e, err = p.parseEnum(b, []int{5, enums})
+			f.Enums = append(f.Enums, e)
+			enums++
+		case 6:
+			var s *ProtoService
+			s, err = p.parseService(b, []int{6, services})
+			f.Services = append(f.Services, s)
+			services++
+		case 8: // FileOptions
+			err = wireFields(b, func(num int, _ uint64, b []byte) error {
+				if num == 11 {
+					f.GoPackage = string(b)
+				}
+				return nil
+			})
+		case 12:
+			f.Syntax = string(b)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Name, err)
+	}
+	for _, m := range f.Messages {
+		setScope(m, f.Package)
+	}
+	for _, e := range f.Enums {
+		e.FullName = fullName(f.Package, e.Name)
+	}
+	for _, s := range f.Services {
+		s.FullName = fullName(f.Package, s.Name)
+	}
+	return f, nil
+}
+
+// parseSourceInfo records the leading comments of a SourceCodeInfo.
+func (p *descParser) parseSourceInfo(data []byte) error {
+	return wireFields(data, func(num int, _ uint64, b []byte) error {
+		if num != 1 || b == nil { // location
+			return nil
+		}
+		var path []string
+		var comment string
+		err := wireFields(b, func(num int, v uint64, b []byte) error {
+			switch {
+			case num == 1 && b != nil: // packed path
+				for len(b) > 0 {
+					x, n := binary.Uvarint(b)
+					if n <= 0 {
+						return fmt.Errorf("invalid varint")
+					}
+					path = append(path, strconv.FormatUint(x, 10))
+					b = b[n:]
+				}
+			case num == 1:
+				path = append(path, strconv.FormatUint(v, 10))
+			case num == 3:
+				comment = string(b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if comment != "" {
+			p.comments[strings.Join(path, ".")] = strings.TrimSpace(comment)
+		}
+		return nil
+	})
+}
+
+// parseMessage decodes a DescriptorProto, at the path of the source
+// info. Its full name, and those of its nested types, are set by setScope.
+func (p *descParser) parseMessage(data []byte, at []int) (*ProtoMessage, error) {
+	m := new(ProtoMessage)
+	var oneofs []string
+	var fields []*ProtoField
+	var oneofIndexes []int
+	var messages, enums int
+	err := wireFields(data, func(num int, v uint64, b []byte) error {
+		var err error
+		switch num {
+		case 1:
+			m.Name = string(b)
+		case 2:
+			var f *ProtoField
+			var oneof int
+			f, oneof, err = p.parseField(b, appendPath(at, 2, len(fields)))
+			fields = append(fields, f)
+			oneofIndexes = append(oneofIndexes, oneof)
+		case 3:
+			var nested *ProtoMessage
+			nested, err = p.parseMessage(b, appendPath(at, 3, messages))
+			m.Messages = append(m.Messages, nested)
+			messages++
+		case 4:
+			var e *ProtoEnum
+			e, err = p.parseEnum(b, appendPath(at, 4, enums))
+			m.Enums = append(m.Enums, e)
+			enums++
+		case 7: // MessageOptions
+			err = wireFields(b, func(num int, v uint64, _ []byte) error {
+				if num == 7 {
+					m.MapEntry = v != 0
+				}
+				return nil
+			})
+		case 8: // OneofDescriptorProto
+			var name string
+			err = wireFields(b, func(num int, _ uint64, b []byte) error {
+				if num == 1 {
+					name = string(b)
+				}
+				return nil
+			})
+			oneofs = append(oneofs, name)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.Comments = p.comment(at)
+	for i, f := range fields {
+		if j := oneofIndexes[i]; j >= 0 && j < len(oneofs) && !f.Optional {
+			f.Oneof = oneofs[j]
+		}
+	}
+	m.Fields = fields
+	return m, nil
+}
+
+// setScope sets the full names of a message, and of its nested types,
+// in the scope of a package or the full name of its parent.
+func setScope(m *ProtoMessage, scope string) {
+	m.FullName = fullName(scope, m.Name)
+	for _, nested := range m.Messages {
+		setScope(nested, m.FullName)
+	}
+	for _, e := range m.Enums {
+		e.FullName = fullName(m.FullName, e.Name)
+	}
+}
+
+// parseField decodes a FieldDescriptorProto, and returns the index of
+// its oneof, or -1.
+func (p *descParser) parseField(data []byte, at []int) (*ProtoField, int, error) {
+	f := new(ProtoField)
+	oneof := -1
+	err := wireFields(data, func(num int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			f.Name = string(b)
+		case 3:
+			f.Number = int(v)
+		case 4:
+			f.Repeated = v == 3 // LABEL_REPEATED
+		case 5:
+			if v < uint64(len(protoTypes)) {
+				f.Type = protoTypes[v]
+			}
+		case 6:
+			f.TypeName = strings.TrimPrefix(string(b), ".")
+		case 9:
+			oneof = int(v)
+		case 10:
+			f.JSONName = string(b)
+		case 17:
+			f.Optional = v != 0
+		}
+		return nil
+	})
+	f.Comments = p.comment(at)
+	return f, oneof, err
+}
+
+// parseEnum decodes an EnumDescriptorProto, whose full name is set by
+// its parser's caller.
+func (p *descParser) parseEnum(data []byte, at []int) (*ProtoEnum, error) {
+	e := new(ProtoEnum)
+	err := wireFields(data, func(num int, _ uint64, b []byte) error {
+		switch num {
+		case 1:
+			e.Name = string(b)
+		case 2:
+			val := &ProtoEnumValue{Comments: p.comment(appendPath(at, 2, len(e.Values)))}
+			err := wireFields(b, func(num int, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					val.Name = string(b)
+				case 2:
+					val.Number = int(int32(v))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			e.Values = append(e.Values, val)
+		}
+		return nil
+	})
+	e.Comments = p.comment(at)
+	return e, err
+}
+
+// parseService decodes a ServiceDescriptorProto, whose full name is set
+// by parseFile.
+func (p *descParser) parseService(data []byte, at []int) (*ProtoService, error) {
+	s := new(ProtoService)
+	err := wireFields(data, func(num int, _ uint64, b []byte) error {
+		switch num {
+		case 1:
+			s.Name = string(b)
+		case 2:
+			m, err := p.parseMethod(b, appendPath(at, 2, len(s.Methods)))
+			if err != nil {
+				return err
+			}
+			s.Methods = append(s.Methods, m)
+		}
+		return nil
+	})
+	s.Comments = p.comment(at)
+	return s, err
+}
+
+// parseMethod decodes a MethodDescriptorProto.
+func (p *descParser) parseMethod(data []byte, at []int) (*ProtoMethod, error) {
+	m := &ProtoMethod{Comments: p.comment(at)}
+	err := wireFields(data, func(num int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			m.Name = string(b)
+		case 2:
+			m.Input = strings.TrimPrefix(string(b), ".")
+		case 3:
+			m.Output = strings.TrimPrefix(string(b), ".")
+		case 4: // MethodOptions
+			return wireFields(b, func(num int, _ uint64, b []byte) error {
+				if num != httpExtension || b == nil {
+					return nil
+				}
+				rule, err := parseHTTPRule(b)
+				m.HTTP = rule
+				return err
+			})
+		case 5:
+			m.ClientStreaming = v != 0
+		case 6:
+			m.ServerStreaming = v != 0
+		}
+		return nil
+	})
+	return m, err
+}
+
+// parseHTTPRule decodes a google.api.HttpRule.
+func parseHTTPRule(data []byte) (*ProtoHTTPRule, error) {
+	rule := new(ProtoHTTPRule)
+	err := wireFields(data, func(num int, _ uint64, b []byte) error {
+		switch num {
+		case 2, 3, 4, 5, 6:
+			rule.Method = [...]string{2: "GET", 3: "PUT", 4: "POST", 5: "DELETE", 6: "PATCH"}[num]
+			rule.Path = string(b)
+		case 7:
+			rule.Body = string(b)
+		case 8: // CustomHttpPattern
+			return wireFields(b, func(num int, _ uint64, b []byte) error {
+				switch num {
+				case 1:
+					rule.Method = string(b)
+				case 2:
+					rule.Path = string(b)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return rule, err
+}
+
+// fullName returns the full name of an element in the scope of a
+// package or message.
+func fullName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// appendPath returns the source info path of the i'th element of the
+// field num of the element at the path.
+func appendPath(at []int, num, i int) []int {
+	return append(append([]int(nil), at...), num, i)
+}
+
+// wireFields calls fn with the number of each field of the serialized
+// protobuf message, in order, and, depending on its wire type, its
+// varint or fixed-size value, or its length-delimited content, which
+// is nil only for the other wire types.
+func wireFields(data []byte, fn func(num int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		num, typ := key>>3, key&7
+		if num == 0 || num > math.MaxInt32 {
+			return fmt.Errorf("invalid field number %d", num)
+		}
+		var v uint64
+		var b []byte
+		switch typ {
+		case 0: // varint
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint of field %d", num)
+			}
+			data = data[n:]
+		case 1: // fixed64
+			if len(data) < 8 {
+				return fmt.Errorf("truncated field %d", num)
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return fmt.Errorf("truncated field %d", num)
+			}
+			b, data = data[n:n+int(size)], data[n+int(size):]
+			if b == nil {
+				b = []byte{}
+			}
+		case 5: // fixed32
+			if len(data) < 4 {
+				return fmt.Errorf("truncated field %d", num)
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default: // groups, which descriptors do not use
+			return fmt.Errorf("unsupported wire type %d of field %d", typ, num)
+		}
+		if err := fn(int(num), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
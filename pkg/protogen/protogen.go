@@ -0,0 +1,853 @@
+// Package protogen runs an explicitly versioned protoc command, with
+// Go, Twirp and gRPC plugins, inside a container, to generate Go
+// declarations for protocol messages and RPC interfaces in a set of
+// .proto files. It is the implementation of the proto-gen-go command,
+// for use by programs that embed code generation in their own tools.
+//
+// Example:
+//
+//	cfg, err := protogen.LoadConfig(protogen.FindConfig(dir))
+//	...
+//	res, err := protogen.Run(ctx, protogen.Options{
+//		Config:     *cfg,
+//		Dir:        dir,
+//		ProtocArgs: []string{"--proto_path=" + dir, "--go_out=.", "foo.proto"},
+//	})
+//	...
+//	fmt.Println(res.Files)
+package protogen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Options configures a Run.
+type Options struct {
+	// Config is the toolchain configuration. Its unset fields take
+	// their values from DefaultConfig. Its Flags precede ProtocArgs.
+	Config
+
+	Dir            string   // host working directory, mounted in the container (default: current directory)
+	ProtocArgs     []string // protoc flags and .proto files, which may be patterns such as **/*.proto (see expandProtoFiles)
+	Jobs           int      // number of protoc runs, one or more per directory of .proto files, to run in parallel (default: 1)
+	ChunkSize      int      // maximum number of .proto files per protoc run (default: defaultChunkSize; negative: no limit; see chunkArgs)
+	Recursive      string   // directory whose .proto files, found recursively (see Config.Exclude), follow ProtocArgs
+	Image          string   // image to use (and pull if necessary) instead of building one from Config
+	Retries        int      // number of times to retry image builds, pulls and downloads that fail transiently, with exponential backoff (see retry)
+	ImageTar       string   // tarball, made by ExportImage, from which to load the image instead of building or pulling it
+	Runtime        string   // container runtime: "docker", "podman", "nerdctl" or "" to autodetect
+	DockerContext  string   // docker context (as in 'docker --context') whose daemon to use, instead of the first that responds (see usableRuntime)
+	User           string   // container user: "uid:gid", "root", "chown" or "" for the host user
+	Check          bool     // compare generated files with Dir instead of writing them
+	Local          bool     // run a natively installed toolchain instead of a container
+	FallbackLocal  bool     // run the local toolchain, as with Local, if no container runtime is usable
+	NoFormat       bool     // don't gofmt the generated Go files
+	DryRun         bool     // print the commands that would change anything to Stdout instead of running them
+	Verbose        bool     // log each command, and show the full output of image builds and plugin installs
+	Prune          bool     // remove the generated files of .proto files deleted since they were generated (see ManifestFile)
+	CompileCheck   bool     // build the Go packages of the generated files, failing if they don't compile (see compileCheck)
+	Force          bool     // regenerate from all .proto files, even those unchanged since the last run (see incremental)
+	Warm           bool     // run protoc in a long-lived container, reused by later runs with the same toolchain and mounts (see warmContainer)
+	Remote         bool     // copy files to and from containers, as when the runtime's daemon is remote (see runRemote)
+	IsolateOutputs bool     // mount Dir and the other directories used by protoc read-only, and copy protoc's outputs from a separate writable mount to their directories (see isolate)
+	Platform       string   // container platform: "linux/amd64", "linux/arm64" or "" for the host's
+	Memory         string   // container memory limit, as for 'docker run --memory' (e.g. "2g"; default: none)
+	CPUs           string   // container CPU limit, as for 'docker run --cpus' (e.g. "1.5"; default: none)
+	PidsLimit      int      // container process limit, as for 'docker run --pids-limit' (default: none)
+	Network        string   // container network, as for 'docker run --network' (e.g. "none" for no network access; default: the runtime's)
+
+	// BuildTimeout and RunTimeout limit the duration of the image build
+	// (or pull or load) and of protoc's runs, after which their commands
+	// are killed. Zero means defaultBuildTimeout or defaultRunTimeout,
+	// and a negative duration, no limit.
+	BuildTimeout time.Duration
+	RunTimeout   time.Duration
+
+	Stdout io.Writer // destination of protoc's standard output and of Check's diffs (default: os.Stdout)
+	Stderr io.Writer // destination of protoc's and the runtime's diagnostics (default: os.Stderr)
+
+	// Logf, if non-nil, is called to report progress.
+	Logf func(format string, args ...interface{})
+
+	// Events, if non-nil, is called, perhaps concurrently, to report
+	// the progress of a Run as structured events: its progress
+	// messages, the durations of its phases, protoc's diagnostics
+	// (which are then not written to Stderr), and its result.
+	Events func(Event)
+}
+
+// logf reports progress, if enabled.
+func (opts *Options) logf(format string, args ...interface{}) {
+	if opts.Logf != nil {
+		opts.Logf(format, args...)
+	}
+	if opts.Events != nil {
+		opts.event(Event{Type: "log", Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// run runs the command, or, with DryRun, prints it.
+func (opts *Options) run(cmd *exec.Cmd) error {
+	if opts.DryRun {
+		_, err := fmt.Fprintln(opts.Stdout, quoteArgs(cmd.Args))
+		return err
+	}
+	if opts.Verbose {
+		opts.logf("+ %s", quoteArgs(cmd.Args))
+	}
+	return cmd.Run()
+}
+
+// A Result describes the outcome of a Run.
+type Result struct {
+	Image  string            // image in which protoc ran
+	Files  []string          // generated files that were created or modified (or, with Check, would be), relative to Dir (even if outside it)
+	Hashes map[string]string // hex SHA256 of the content of each of Files (unless Check or DryRun)
+
+	// Protos is the number of .proto files compiled, which, in an
+	// incremental run, are those that changed, and Timings the
+	// durations of the phases of the run, for tracking its performance.
+	Protos  int
+	Timings Timings
+}
+
+// Timings are the durations of the phases of a Run.
+type Timings struct {
+	Image       time.Duration // building, pulling or loading the image, or installing the local toolchain
+	ImageCached bool          // whether the image was already present, so that Image is only the time to find it
+	Protoc      time.Duration // protoc's runs
+	Postprocess time.Duration // compressing, formatting and otherwise post-processing the generated files
+	Total       time.Duration // the whole run
+}
+
+// ErrOutOfDate is returned by Run, with Options.Check, if any
+// generated file differs from the corresponding file in Dir.
+var ErrOutOfDate = errors.New("generated files are not up to date")
+
+// Run builds (if necessary) the toolchain image and runs protoc in a
+// container, with Dir mounted at the same path, so that generated
+// files are written beneath Dir. With Options.Local, it instead runs
+// a natively installed toolchain.
+//
+// Unless Options.Force (or Check or DryRun) is set, Run compiles only
+// the .proto files that have changed, or whose imports have changed,
+// since its last successful run in Dir with the same flags and
+// toolchain, and does nothing if there are none. Its record of those
+// runs is kept in the user's cache directory.
+//
+// Run records the files generated from each .proto file in ManifestFile
+// and reports those whose .proto files no longer exist, removing them
+// if Options.Prune is set.
+//
+// The commands of Config.Hooks run before protoc and, once it has
+// succeeded, after it; Result.Hashes are those of the files as the
+// post hooks leave them.
+//
+// If protoc fails, the error wraps an *exec.ExitError whose exit code
+// is that of protoc.
+func Run(ctx context.Context, opts Options) (res *Result, err error) {
+	start := time.Now()
+	if opts.Events != nil {
+		defer func() {
+			ev := Event{Type: "result", Duration: time.Since(start)}
+			if res != nil {
+				ev.Image = res.Image
+				ev.Protos = res.Protos
+				ev.Timings = &res.Timings
+				for _, file := range res.Files {
+					ev.Files = append(ev.Files, filepath.ToSlash(file))
+				}
+			}
+			if err != nil {
+				ev.Error = err.Error()
+			}
+			opts.event(ev)
+		}()
+	}
+
+	e, err := prepare(ctx, &opts)
+	if err != nil {
+		return nil, err
+	}
+	res = &Result{Image: e.image}
+	defer func() {
+		if res != nil {
+			res.Protos = len(protoFiles(e.protocArgs))
+			res.Timings = e.timings
+			res.Timings.Total = time.Since(start)
+		}
+	}()
+
+	// Concurrent invocations in the same working directory, which write
+	// the same files, generate one at a time.
+	if !opts.Check && !opts.DryRun {
+		unlock, err := hostLock(ctx, &opts, "dir "+opts.Dir, "generating in "+opts.Dir)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	// Find (and, with Prune, remove) the outputs of deleted .proto files.
+	var mf *manifest
+	if !opts.Check && !opts.DryRun {
+		mf, err = readManifest(opts.Dir)
+		if err != nil {
+			return nil, err
+		}
+		pruned, err := mf.prune(&opts)
+		if err != nil {
+			return nil, err
+		}
+		if pruned {
+			if err := mf.write(opts.Dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Skip the .proto files that have not changed since the last run.
+	var state *genState
+	var stateName string
+	if !opts.Check && !opts.Force && !opts.DryRun {
+		var args []string
+		args, state, stateName, err = e.incremental(&opts)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil && protoFiles(args) == nil {
+			e.protocArgs = args
+			opts.logf("no .proto files changed since the last run (use -force to regenerate)")
+			return res, nil
+		}
+		if n, total := len(protoFiles(args)), len(protoFiles(e.protocArgs)); n < total {
+			opts.logf("compiling the %d of %d .proto files that changed since the last run", n, total)
+		}
+		e.protocArgs = args
+	}
+
+	if opts.Warm && opts.IsolateOutputs {
+		opts.logf("not using a warm container, whose working directory is writable, with isolated outputs")
+	} else if opts.Warm && !opts.Check && !opts.DryRun && e.rt != nil && !e.rt.remote {
+		e.container, err = warmContainer(ctx, &opts, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.preflight(ctx, &opts, opts.Dir); err != nil {
+		return nil, err
+	}
+
+	if opts.Check {
+		res.Files, err = check(ctx, &opts, e)
+		return res, err
+	}
+
+	if err := runHooks(ctx, &opts, "pre", opts.Hooks.Pre, opts.Dir, nil); err != nil {
+		return nil, err
+	}
+	res.Files, err = e.generate(ctx, &opts, opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	res.Hashes, err = hashFiles(opts.Dir, res.Files)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Hooks.Post) > 0 {
+		if err := runHooks(ctx, &opts, "post", opts.Hooks.Post, opts.Dir, res); err != nil {
+			return nil, err
+		}
+		// The hooks may have modified the files.
+		res.Hashes, err = hashFiles(opts.Dir, res.Files)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mf != nil {
+		prev, _ := readManifest(opts.Dir)
+		mf.record(protoFiles(e.protocArgs), res.Files)
+		if len(mf.Sources) > 0 && !mf.equal(prev) {
+			if err := mf.write(opts.Dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.GoModule.Dir != "" {
+		if err := e.buildGoModule(ctx, &opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CompileCheck {
+		// Before saving the state, lest the next run skip the check.
+		if err := e.compileCheck(ctx, &opts, res.Files); err != nil {
+			return nil, err
+		}
+	}
+	if state != nil {
+		if err := state.save(stateName); err != nil {
+			opts.logf("saving generation state: %v", err)
+		}
+	}
+	return res, nil
+}
+
+// generate runs protoc in the environment, with the host directory
+// dir standing in for opts.Dir, and post-processes the generated
+// files. It returns the names of the files created or modified
+// beneath dir, relative to it, and, if dir is opts.Dir, beneath the
+// output directories outside it.
+func (e *env) generate(ctx context.Context, opts *Options, dir string) ([]string, error) {
+	var roots []string
+	if dir == opts.Dir {
+		for _, m := range protocMounts(e.protocArgs, opts.Dir) {
+			if !m.readOnly {
+				roots = append(roots, m.dir)
+			}
+		}
+	}
+	before, err := snapshot(dir, roots...)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if opts.IsolateOutputs && e.rt != nil {
+		restore, err := e.isolate(opts, dir)
+		if err != nil {
+			return nil, err
+		}
+		defer restore()
+	}
+	runCtx, cancel, limit := withTimeout(ctx, opts.RunTimeout, defaultRunTimeout)
+	err = e.protoc(runCtx, opts, dir)
+	cancel()
+	if err := timedOut(runCtx, err, "protoc", limit, "-run-timeout"); err != nil {
+		return nil, e.phase(opts, "protoc", start, fmt.Errorf("protoc command failed: %w", err))
+	}
+	if e.outputs != nil {
+		if err := e.outputs.sync(); err != nil {
+			return nil, e.phase(opts, "protoc", start, fmt.Errorf("copying protoc's outputs: %v", err))
+		}
+	}
+	e.phase(opts, "protoc", start, nil)
+
+	start = time.Now()
+	files, err := e.collect(opts, dir, before, roots)
+	return files, e.phase(opts, "postprocess", start, err)
+}
+
+// collect compresses, embeds, and post-processes the files that protoc
+// generated beneath dir and roots, which held the files of before, and
+// returns the names of those created or modified, with the files
+// generated from them and from the descriptor set of the run.
+func (e *env) collect(opts *Options, dir string, before map[string]fileState, roots []string) ([]string, error) {
+	var descs []*ProtoFile
+	if !opts.DryRun {
+		if err := e.compress(opts, dir); err != nil {
+			return nil, err
+		}
+		if err := writeEmbedFile(opts, dir); err != nil {
+			return nil, err
+		}
+		var err error
+		if descs, err = e.readDescriptorSet(opts, dir); err != nil {
+			return nil, fmt.Errorf("reading the descriptor set: %v", err)
+		}
+		if err := renderTemplates(opts, dir, descs); err != nil {
+			return nil, err
+		}
+	}
+	files, err := changedFiles(dir, before, roots...)
+	if err != nil {
+		return nil, err
+	}
+	mocks, err := writeMocks(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, mocks...)
+	enums, err := writeEnums(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, enums...)
+	clones, err := writeClones(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, clones...)
+	masks, err := writeFieldMasks(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, masks...)
+	redactions, err := writeRedactions(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, redactions...)
+	fakes, err := writeFakes(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, fakes...)
+	fuzz, err := writeFuzzTargets(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, fuzz...)
+	benchmarks, err := writeBenchmarks(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, benchmarks...)
+	golden, err := writeGoldenTests(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, golden...)
+	services, err := writeServices(opts, dir, files, descs)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, services...)
+	if err := postprocess(opts, dir, files, protoFiles(e.protocArgs)); err != nil {
+		return nil, err
+	}
+	// Skeleton servers are not generated code, to be stamped or formatted.
+	scaffolds, err := writeScaffolds(opts, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, scaffolds...)
+	sort.Strings(files)
+	return files, nil
+}
+
+// An env is an environment prepared for running protoc: either a
+// container runtime and image, or a local toolchain.
+type env struct {
+	rt            *runtime        // container runtime (nil if local)
+	platform      string          // container platform (empty if local)
+	image         string          // container image (empty if local)
+	local         *localToolchain // native toolchain (nil unless local)
+	container     *container      // long-running container in which to run protoc, if any
+	protocArgs    []string        // complete protoc arguments
+	gzipOutputs   []gzipOutput    // descriptor sets to compress after protoc
+	descriptorSet string          // descriptor set for Config.Templates and Config.Services, if any
+	mounts        []mount         // host directories outside the working directory used by protoc
+	outputs       *outputs        // writable directory of protoc's outputs, if isolated (see isolate)
+	timings       Timings         // durations of the phases run so far
+}
+
+// protoc runs protoc in the environment, with the host directory dir
+// standing in for the working directory opts.Dir. (A long-running
+// container always has opts.Dir mounted.) If there are too many .proto
+// files for one run, or Options.Jobs calls for parallel runs, it runs
+// protoc on successive chunks of them (see chunkArgs), all in the same
+// container, and reports the failures of all runs.
+func (e *env) protoc(ctx context.Context, opts *Options, dir string) error {
+	jobs := opts.Jobs
+	if jobs < 1 || opts.DryRun || e.rt != nil && e.rt.remote {
+		jobs = 1 // copies to and from remote containers would conflict
+	}
+	runs := chunkArgs(e.protocArgs, opts.ChunkSize, jobs > 1)
+	c := e.container
+	if len(runs) > 1 {
+		opts.logf("compiling the .proto files in %d protoc runs", len(runs))
+		if c == nil && e.rt != nil && !e.rt.remote && !opts.DryRun {
+			var err error
+			c, err = startContainer(ctx, opts, e, dir)
+			if err != nil {
+				return err
+			}
+			defer c.stop()
+		}
+	}
+
+	// Run at most jobs runs at a time, in order. The outputs of
+	// concurrent runs are prefixed by the directory of their files.
+	errs := make([]error, len(runs))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, args := range runs {
+		o := *opts
+		var prefixed []*prefixWriter
+		if jobs > 1 && len(runs) > 1 {
+			stdout := &prefixWriter{mu: &mu, w: opts.Stdout}
+			stderr := &prefixWriter{mu: &mu, w: opts.Stderr, prefix: "[" + runName(args) + "] "}
+			o.Stdout, o.Stderr = stdout, stderr
+			prefixed = append(prefixed, stdout, stderr)
+		}
+		diag := e.diagnostics(&o, dir)
+		o.Stderr = diag
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, args []string) {
+			defer func() { <-sem; wg.Done() }()
+			switch {
+			case e.local != nil:
+				errs[i] = e.local.protoc(ctx, &o, dir, args)
+			case c != nil:
+				errs[i] = c.protoc(ctx, &o, args)
+			default:
+				errs[i] = runProtoc(ctx, &o, e, dir, args)
+			}
+			diag.flush()
+			for _, w := range prefixed {
+				w.flush()
+			}
+		}(i, args)
+	}
+	wg.Wait()
+
+	var first error
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 && len(runs) > 1 && ctx.Err() == nil {
+		return &chunkError{failed, len(runs), first}
+	}
+	return first
+}
+
+// prepare sets the defaults of the options and prepares the
+// environment: it finds the runtime and builds (if necessary) the
+// image or, with Options.Local, installs the local toolchain.
+func prepare(ctx context.Context, opts *Options) (*env, error) {
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	if opts.Dir == "" {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		opts.Dir = pwd
+	}
+	if err := opts.Config.resolve(); err != nil {
+		return nil, err
+	}
+	pwd := opts.Dir
+	args, err := expandProtoFiles(append(opts.Config.protocFlags(pwd), opts.ProtocArgs...), pwd, opts.Recursive, &opts.Config)
+	if err != nil {
+		return nil, err
+	}
+	args = withProto3Optional(opts.Protoc, args)
+	args, err = opts.goPackages(args, pwd)
+	if err != nil {
+		return nil, err
+	}
+	args, err = opts.goModuleArgs(args, pwd)
+	if err != nil {
+		return nil, err
+	}
+
+	e := new(env)
+	var rt *runtime
+	if !opts.Local {
+		rt, err = usableRuntime(ctx, opts)
+		if err != nil && opts.FallbackLocal {
+			opts.logf("%v", err)
+			opts.logf("falling back to the local toolchain (-local)")
+			opts.Local, err = true, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Local {
+		start := time.Now()
+		local, err := installLocal(ctx, opts)
+		if err := e.phase(opts, "install", start, err); err != nil {
+			return nil, err
+		}
+		e.local = local
+	} else {
+		if err := rt.setUser(ctx, opts.User); err != nil {
+			return nil, err
+		}
+		rt.remote = opts.Remote || rt.remoteHost()
+		e.rt = rt
+		e.platform, err = containerPlatform(opts.Platform)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		e.image, e.timings.ImageCached, err = toolchainImage(ctx, opts, rt, e.platform)
+		if err := e.phase(opts, "image", start, err); err != nil {
+			return nil, err
+		}
+	}
+
+	// Log the command, neatly.
+	e.protocArgs = absArgs(args, pwd)
+	e.protocArgs, e.descriptorSet = opts.descriptorSetArgs(e.protocArgs, pwd)
+	opts.logf("protoc %s", joinArgs(e.protocArgs, pwd))
+	e.protocArgs, e.gzipOutputs = gzipOutputs(e.protocArgs)
+
+	if !opts.DryRun {
+		// protoc does not create missing output directories,
+		// so create those named by the config, and those of
+		// output files such as descriptor sets.
+		dirs := outputDirs(opts.Config.protocFlags(pwd))
+		if dir := opts.GoModule.Dir; dir != "" {
+			dirs = append(dirs, filepath.FromSlash(dir))
+		}
+		for _, file := range outputFiles(e.protocArgs) {
+			dirs = append(dirs, filepath.Dir(file))
+		}
+		for _, dir := range dirs {
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(pwd, dir)
+			}
+			if within(dir, pwd) {
+				if err := os.MkdirAll(dir, 0777); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if e.rt != nil {
+		e.mounts = protocMounts(e.protocArgs, pwd)
+		for _, m := range e.mounts {
+			if !m.readOnly && !opts.DryRun {
+				// Create missing output directories, lest the runtime create them as root.
+				if err := os.MkdirAll(m.dir, 0777); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// preflight runs the enabled steps that precede generation,
+// with the host directory dir standing in for opts.Dir.
+func (e *env) preflight(ctx context.Context, opts *Options, dir string) error {
+	if opts.Lint.Enabled {
+		if err := e.lint(ctx, opts, dir); err != nil {
+			return fmt.Errorf("buf lint failed: %v", err)
+		}
+	}
+	if rev := opts.Breaking.Against; rev != "" {
+		if err := e.breaking(ctx, opts, dir, rev); err != nil {
+			return fmt.Errorf("breaking changes against %s: %v", rev, err)
+		}
+	}
+	return nil
+}
+
+// runProtoc runs protoc with the specified arguments in a container of
+// the environment's image and runtime, with the host directory dir
+// mounted at the container path opts.Dir, and other directories used
+// by protoc mounted at their own paths.
+func runProtoc(ctx context.Context, opts *Options, e *env, dir string, protocArgs []string) error {
+	args := []string{"-w", opts.Dir}
+	if e.rt.user != "" {
+		args = append(args, "--user", e.rt.user)
+	}
+	args = append(args, e.image)
+	args = append(args, protocArgs...)
+	if err := e.runContainer(ctx, opts, dir, args, nil, opts.Stdout, opts.Stderr); err != nil {
+		return err
+	}
+
+	// Give the root-owned files written by protoc to the host user.
+	// (Files copied from a remote container already belong to the host user.)
+	if e.rt.chown != "" && !e.rt.remote {
+		args := []string{"--entrypoint=find", e.image}
+		args = append(args, e.writableDirs(opts)...)
+		args = append(args, "-user", "0", "-exec", "chown", e.rt.chown, "{}", "+")
+		if err := e.runContainer(ctx, opts, dir, args, nil, io.Discard, opts.Stderr); err != nil {
+			return fmt.Errorf("chown failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// runContainer runs a container of the environment's runtime with the
+// specified arguments (flags, image, and command arguments), with the
+// host directory dir mounted at the container path opts.Dir, the other
+// directories used by protoc mounted at their own paths, and the host
+// directories extra mounted read-only at their own paths. If the runtime
+// is remote, the directories are copied instead (see runRemote).
+func (e *env) runContainer(ctx context.Context, opts *Options, dir string, args, extra []string, stdout, stderr io.Writer) error {
+	if e.rt.remote {
+		return killedByLimit(opts, e.runRemote(ctx, opts, dir, args, extra, stdout, stderr))
+	}
+	name := containerName()
+	cmd := e.rt.command(ctx, "run", "--rm", "--name", name)
+	cmd.Args = append(cmd.Args, e.runFlags(opts, dir)...)
+	for _, x := range extra {
+		cmd.Args = append(cmd.Args, "-v", e.rt.volume(x, x, true))
+	}
+	cmd.Args = append(cmd.Args, containerArgs(args)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := opts.run(cmd)
+	if ctx.Err() != nil {
+		// Killing the runtime's client does not stop the container.
+		e.rt.kill(opts, name)
+	}
+	return killedByLimit(opts, err)
+}
+
+// toolchainImage returns the image in which to run protoc: the
+// specified image, pulled if necessary, or the protoc container image
+// specified by the Dockerfile, built unless an image for the same
+// Dockerfile already exists. With Options.ImageTar, the image is
+// instead loaded from the tarball, if not already present, and, like a
+// pulled image, verified as Config.Verify requires, which a tarball
+// without Options.Image, the reference whose signature cosign verifies
+// in its registry, cannot be. It reports whether the image was already
+// present.
+func toolchainImage(ctx context.Context, opts *Options, rt *runtime, platform string) (string, bool, error) {
+	if opts.ImageTar != "" && opts.Image == "" && opts.Verify.enabled() {
+		return "", false, fmt.Errorf("-image-tar: the verify config requires -image, the reference of the image in the tarball, whose signature cosign verifies in its registry")
+	}
+	image := opts.Image
+	var dockerfile string
+	if image == "" {
+		var err error
+		dockerfile, err = opts.Config.Dockerfile(platform)
+		if err != nil {
+			return "", false, err
+		}
+		image = imageTag(dockerfile)
+	}
+	if imageExists(ctx, rt, image) {
+		opts.logf("using cached protoc container image %s", image)
+		if opts.Image != "" && opts.Verify.enabled() {
+			if err := verifyImage(ctx, opts, rt, image); err != nil {
+				return "", false, err
+			}
+		}
+		return image, true, nil
+	}
+	ctx, cancel, limit := withTimeout(ctx, opts.BuildTimeout, defaultBuildTimeout)
+	defer cancel()
+	switch {
+	case opts.ImageTar != "":
+		if err := loadImage(ctx, opts, rt, opts.ImageTar, image); err != nil {
+			return "", false, fmt.Errorf("%s load failed: %v", rt.name, timedOut(ctx, err, "image load", limit, "-build-timeout"))
+		}
+		if opts.Image != "" && opts.Verify.enabled() {
+			if err := verifyImage(ctx, opts, rt, image); err != nil {
+				return "", false, err
+			}
+		}
+	case opts.Image != "":
+		if err := pullImage(ctx, opts, rt, image, platform); err != nil {
+			return "", false, fmt.Errorf("%s pull failed: %v", rt.name, timedOut(ctx, err, "image pull", limit, "-build-timeout"))
+		}
+		if opts.Verify.enabled() {
+			if err := verifyImage(ctx, opts, rt, image); err != nil {
+				return "", false, err
+			}
+		}
+	default:
+		if _, err := buildImage(ctx, opts, rt, dockerfile, platform); err != nil {
+			return "", false, fmt.Errorf("%s build failed: %v", rt.name, timedOut(ctx, err, "image build", limit, "-build-timeout"))
+		}
+	}
+	return image, false, nil
+}
+
+// runFlags returns the flags of a container run command that mount
+// the host directory dir at the container path opts.Dir, and the other
+// directories used by protoc at their own paths.
+func (e *env) runFlags(opts *Options, dir string) []string {
+	// We assume pwd does not conflict with some critical part
+	// of the docker image, and volume-mount it.
+	flags := []string{"-v", e.rt.volume(dir, opts.Dir, e.outputs != nil)}
+	for _, m := range e.mounts {
+		flags = append(flags, "-v", e.rt.volume(m.dir, m.dir, m.readOnly))
+	}
+	if e.rt.userns != "" {
+		flags = append(flags, "--userns="+e.rt.userns)
+	}
+	flags = append(flags, limitFlags(opts)...)
+	flags = append(flags, networkFlags(opts)...)
+	return append(flags, "--platform="+e.platform)
+}
+
+// writableDirs returns the container paths of the writable mounts.
+func (e *env) writableDirs(opts *Options) []string {
+	var dirs []string
+	if e.outputs == nil {
+		dirs = append(dirs, opts.Dir)
+	}
+	for _, m := range e.mounts {
+		if !m.readOnly {
+			dirs = append(dirs, m.dir)
+		}
+	}
+	return dirs
+}
+
+// check runs protoc on a copy of the pwd tree, standing in for the
+// original, and writes to opts.Stdout a diff of each generated
+// file that differs from the original. It returns the names of those
+// files, and ErrOutOfDate if there are any.
+func check(ctx context.Context, opts *Options, e *env) ([]string, error) {
+	pwd := opts.Dir
+	tmpdir, err := os.MkdirTemp("", "proto-gen-go-check")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := copyTree(tmpdir, pwd); err != nil {
+		return nil, err
+	}
+
+	if err := runHooks(ctx, opts, "pre", opts.Hooks.Pre, tmpdir, nil); err != nil {
+		return nil, err
+	}
+	files, err := e.generate(ctx, opts, tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Hooks.Post) > 0 {
+		res := &Result{Image: e.image, Files: files}
+		if res.Hashes, err = hashFiles(tmpdir, files); err != nil {
+			return nil, err
+		}
+		if err := runHooks(ctx, opts, "post", opts.Hooks.Post, tmpdir, res); err != nil {
+			return nil, err
+		}
+	}
+
+	stale, err := compareTrees(opts.Stdout, pwd, tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	if len(stale) > 0 {
+		return stale, ErrOutOfDate
+	}
+	return nil, nil
+}
@@ -0,0 +1,45 @@
+package protogen
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestToolchainImageTarVerify checks that an image loaded from a
+// tarball is verified, as Config.Verify requires, or, without the
+// reference of the image, rejected.
+func TestToolchainImageTarVerify(t *testing.T) {
+	verify := VerifyConfig{Key: "cosign.pub"}
+
+	t.Run("no image", func(t *testing.T) {
+		opts := &Options{ImageTar: "image.tar", Config: Config{Verify: verify}}
+		_, _, err := toolchainImage(context.Background(), opts, nil, "linux/amd64")
+		if err == nil || !strings.Contains(err.Error(), "requires -image") {
+			t.Fatalf("got error %v, want one that -image-tar requires -image", err)
+		}
+	})
+
+	t.Run("image", func(t *testing.T) {
+		// A fake runtime, whose image exists once loaded, on a PATH
+		// without cosign, so that verification fails closed.
+		dir := t.TempDir()
+		state := filepath.Join(dir, "loaded")
+		script := "#!/bin/sh\ncase \"$1\" in\nload) : > " + state + ";;\nimage) [ -f " + state + " ];;\nesac\n"
+		if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0777); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("PATH", dir)
+
+		opts := &Options{ImageTar: "image.tar", Image: "registry.example/proto-gen-go:v1", Config: Config{Verify: verify}}
+		_, _, err := toolchainImage(context.Background(), opts, &runtime{name: "docker"}, "linux/amd64")
+		if err == nil || !strings.Contains(err.Error(), "cosign is not installed") {
+			t.Fatalf("got error %v, want the failed verification of the loaded image", err)
+		}
+		if _, err := os.Stat(state); err != nil {
+			t.Fatalf("the image was not loaded: %v", err)
+		}
+	})
+}
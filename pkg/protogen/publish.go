@@ -0,0 +1,231 @@
+package protogen
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A PublishConfig configures the publication of generated code, by
+// Publish, to a downstream git repository from which the consumers of
+// the services take their stubs.
+type PublishConfig struct {
+	Repo   string `yaml:"repo"`   // URL of the downstream repository, e.g. "git@github.com:acme/apis-go.git"
+	Branch string `yaml:"branch"` // branch to which to commit (default: main)
+	Dir    string `yaml:"dir"`    // directory of the generated code to publish, relative to the working directory (default: that of go_module)
+	Path   string `yaml:"path"`   // directory of the repository that it replaces (default: the root)
+	Author string `yaml:"author"` // author and committer of the commits, "Name <email>" (default: git's user)
+}
+
+// check reports an error if the publish config is invalid.
+func (p *PublishConfig) check() error {
+	if p.Repo == "" {
+		if p.Branch != "" || p.Dir != "" || p.Path != "" || p.Author != "" {
+			return fmt.Errorf("publish: requires repo, the URL of the downstream repository")
+		}
+		return nil
+	}
+	for _, dir := range []string{p.Dir, p.Path} {
+		clean := filepath.Clean(filepath.FromSlash(dir))
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("publish: %q is not a relative path beneath its root", dir)
+		}
+	}
+	if p.Author != "" {
+		if _, err := mail.ParseAddress(p.Author); err != nil {
+			return fmt.Errorf("publish: invalid author %q (want \"Name <email>\")", p.Author)
+		}
+	}
+	return nil
+}
+
+// A PublishResult describes the commit made by Publish.
+type PublishResult struct {
+	Commit string   // commit made in the downstream repository, or "" if there was nothing to publish
+	Files  []string // files added, modified or deleted, as reported by 'git diff --name-status'
+}
+
+// Publish commits the generated code of Config.Publish.Dir, beneath
+// opts.Dir, to the branch of the downstream repository of
+// Config.Publish, replacing the contents of its Path, with a message
+// that records the commit of the working directory's repository and
+// the versions of the toolchain, and pushes it. With DryRun, the commit
+// is made in a temporary clone but not pushed. If the code is unchanged,
+// it does nothing.
+func Publish(ctx context.Context, opts Options) (*PublishResult, error) {
+	if err := opts.Config.resolve(); err != nil {
+		return nil, err
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	if opts.Dir == "" {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		opts.Dir = pwd
+	}
+	p := opts.Publish
+	if p.Repo == "" {
+		return nil, fmt.Errorf("no publish.repo in %s", ConfigFile)
+	}
+	if p.Dir == "" {
+		p.Dir = opts.GoModule.Dir
+	}
+	if p.Dir == "" {
+		return nil, fmt.Errorf("publish: no dir to publish (set publish.dir or go_module.dir)")
+	}
+	if p.Branch == "" {
+		p.Branch = "main"
+	}
+	src := filepath.Join(opts.Dir, filepath.FromSlash(p.Dir))
+	if info, err := os.Stat(src); err != nil {
+		return nil, fmt.Errorf("publish: %v", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("publish: %s is not a directory", src)
+	}
+
+	// The source commit, which the message records.
+	head, err := git(ctx, opts.Dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("publish: %s is not in a git repository with a commit: %v", opts.Dir, err)
+	}
+	source := head
+	if url, err := git(ctx, opts.Dir, "remote", "get-url", "origin"); err == nil {
+		source = url + " " + head
+	}
+	if status, err := git(ctx, opts.Dir, "status", "--porcelain"); err == nil && status != "" {
+		opts.logf("the working tree has uncommitted changes, which commit %.12s does not include", head)
+		source += " (with uncommitted changes)"
+	}
+
+	// Clone the branch, or, if it does not exist yet, the default
+	// branch (if any), from which it is created.
+	clone, err := os.MkdirTemp("", "proto-gen-go-publish")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(clone)
+	opts.logf("cloning %s %s...", p.Repo, p.Branch)
+	heads, err := git(ctx, "", "ls-remote", "--heads", p.Repo, "refs/heads/"+p.Branch)
+	if err != nil {
+		return nil, fmt.Errorf("publish: %v", err)
+	}
+	if heads != "" {
+		_, err = git(ctx, "", "clone", "-q", "--depth=1", "--branch", p.Branch, p.Repo, clone)
+	} else if _, err = git(ctx, "", "clone", "-q", "--depth=1", p.Repo, clone); err == nil {
+		_, err = git(ctx, clone, "checkout", "-q", "-b", p.Branch)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("publish: %v", err)
+	}
+
+	// Replace the contents of Path with those of Dir.
+	dst := filepath.Join(clone, filepath.FromSlash(p.Path))
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name() != ".git" {
+			if err := os.RemoveAll(filepath.Join(dst, e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+		return copyFile(target, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := git(ctx, clone, "add", "-A"); err != nil {
+		return nil, err
+	}
+	status, err := git(ctx, clone, "diff", "--cached", "--name-status")
+	if err != nil {
+		return nil, err
+	}
+	res := new(PublishResult)
+	if status == "" {
+		opts.logf("%s is unchanged in %s %s; nothing to publish", p.Dir, p.Repo, p.Branch)
+		return res, nil
+	}
+	res.Files = strings.Split(status, "\n")
+
+	commit := exec.CommandContext(ctx, "git", "commit", "-q", "-F", "-")
+	commit.Dir = clone
+	commit.Stdin = strings.NewReader(publishMessage(&opts.Config, p.Dir, head, source))
+	commit.Stderr = opts.Stderr
+	if p.Author != "" {
+		addr, _ := mail.ParseAddress(p.Author)
+		commit.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME="+addr.Name, "GIT_AUTHOR_EMAIL="+addr.Address,
+			"GIT_COMMITTER_NAME="+addr.Name, "GIT_COMMITTER_EMAIL="+addr.Address)
+	}
+	if err := commit.Run(); err != nil {
+		return nil, fmt.Errorf("publish: git commit: %v", err)
+	}
+	res.Commit, err = git(ctx, clone, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	opts.logf("pushing %.12s to %s %s...", res.Commit, p.Repo, p.Branch)
+	push := exec.CommandContext(ctx, "git", "push", "-q", "origin", "HEAD:refs/heads/"+p.Branch)
+	push.Dir = clone
+	push.Stdout = opts.Stderr
+	push.Stderr = opts.Stderr
+	if err := opts.run(push); err != nil {
+		return nil, fmt.Errorf("publish: git push: %v (has %s %s moved on? run publish again to commit onto it)", err, p.Repo, p.Branch)
+	}
+	return res, nil
+}
+
+// publishMessage returns the message of a commit of generated code
+// from the directory dir of the source commit head, described by
+// source, generated by the toolchain of the config.
+func publishMessage(cfg *Config, dir, head, source string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Generate %s from %.12s\n\n", dir, head)
+	fmt.Fprintf(&b, "Source: %s\n", source)
+	fmt.Fprintf(&b, "proto-gen-go: %s\n", Version())
+	for _, v := range cfg.Versions() {
+		if v.Package != "" {
+			fmt.Fprintf(&b, "%s: %s %s\n", v.Name, v.Package, v.Version)
+		} else {
+			fmt.Fprintf(&b, "%s: %s\n", v.Name, v.Version)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,332 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A RedactConfig configures the generation, if enabled, of the Redact
+// and LogSafe methods of the messages generated by protoc-gen-go, which
+// clear or hash their sensitive fields, such as personal data, so that
+// they can be logged.
+type RedactConfig struct {
+	// Fields maps sensitive fields, named by their Go type and proto
+	// field name as in TagsConfig.Fields (e.g. "User.email"), to how
+	// they are redacted: "zero", which clears them, or "hash", which
+	// replaces a string (or bytes) with a prefix of its SHA-256 hash,
+	// so that log lines of the same value can still be correlated.
+	Fields map[string]string `yaml:"fields"`
+
+	// Comments, if set, marks as sensitive the fields of the .proto
+	// files with "@redact" comments, as in:
+	//
+	//	// @redact: hash
+	//	string email = 2;
+	Comments bool `yaml:"comments"`
+}
+
+// redactModes are the modes of RedactConfig.Fields.
+var redactModes = map[string]bool{"zero": true, "hash": true}
+
+// redactPattern matches the "@redact" comments of fields.
+var redactPattern = regexp.MustCompile(`@redact(?::\s*(\S+))?\s*$`)
+
+// enabled reports whether any fields are marked as sensitive.
+func (rc *RedactConfig) enabled() bool {
+	return len(rc.Fields) > 0 || rc.Comments
+}
+
+// check reports an error if a field of the config is malformed.
+func (rc *RedactConfig) check() error {
+	for field, mode := range rc.Fields {
+		if typ, name, ok := strings.Cut(field, "."); !ok || typ == "" || name == "" {
+			return fmt.Errorf("redact: field %q is not of the form Type.field", field)
+		}
+		if !redactModes[mode] {
+			return fmt.Errorf("redact: %s: invalid mode %q (want zero or hash)", field, mode)
+		}
+	}
+	return nil
+}
+
+// writeRedactions writes, if Config.Redact is enabled, the Redact and
+// LogSafe methods of the messages of the generated files, named
+// relative to the host directory dir, which stands in for opts.Dir, and
+// returns the names of those it created or modified.
+func writeRedactions(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Redact.enabled() {
+		return nil, nil
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") {
+			continue
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		methods, skipped, err := redactFile(file, src, &opts.Redact, opts.Clone)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range skipped {
+			opts.logf("redact: skipping %s of %s, which has a field or method named Redact or LogSafe", msg, file)
+		}
+		if methods == nil {
+			continue // no messages
+		}
+		name := strings.TrimSuffix(file, ".pb.go") + "_redact.go"
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, methods) {
+			continue
+		}
+		if err := os.WriteFile(filename, methods, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// redactFile returns the source of the Redact and LogSafe methods of
+// the messages of the Go file generated by protoc-gen-go, or nil if it
+// has none, and the messages skipped, for which the methods would
+// conflict with their fields or methods. Every message has the methods,
+// through which Redact descends into the message fields of the same
+// package; LogSafe copies the message by its Clone method if clone is
+// set, or else by proto.Clone.
+func redactFile(name string, src []byte, rc *RedactConfig, clone bool) ([]byte, []string, error) {
+	c, err := newCloner(name, src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("redact: %v", err)
+	}
+	var skipped []string
+	for _, ts := range c.messageSpecs() {
+		msg := ts.Name.Name
+		st := ts.Type.(*ast.StructType)
+		if c.methods[msg+".Redact"] || c.methods[msg+".LogSafe"] || hasField(st, "Redact") || hasField(st, "LogSafe") {
+			skipped = append(skipped, msg)
+			continue
+		}
+		if err := c.writeRedact(msg, st, rc, clone); err != nil {
+			return nil, nil, fmt.Errorf("redact: %s: %v", name, err)
+		}
+	}
+	if c.w.Len() == 0 {
+		return nil, skipped, nil
+	}
+	out, err := c.source(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("redaction of %s: %v", name, err)
+	}
+	return out, skipped, nil
+}
+
+// redactMode returns how the field of the message is redacted, by the
+// config or an "@redact" comment, or "" if it is not sensitive.
+func redactMode(msg string, field *ast.Field, rc *RedactConfig) (string, error) {
+	if mode, ok := rc.Fields[msg+"."+protoName(field)]; ok {
+		return mode, nil
+	}
+	if rc.Comments && field.Doc != nil {
+		for _, c := range field.Doc.List {
+			if m := redactPattern.FindStringSubmatch(c.Text); m != nil {
+				mode := m[1]
+				if mode == "" {
+					mode = "zero"
+				}
+				if !redactModes[mode] {
+					return "", fmt.Errorf("%s.%s: @redact: invalid mode %q (want zero or hash)", msg, protoName(field), mode)
+				}
+				return mode, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// writeRedact writes the Redact and LogSafe methods of the message.
+func (c *cloner) writeRedact(msg string, st *ast.StructType, rc *RedactConfig, clone bool) error {
+	var body bytes.Buffer
+	for _, field := range st.Fields.List {
+		for _, id := range field.Names {
+			if id.Name == "unknownFields" {
+				// They may hold sensitive fields unknown to this
+				// version of the message.
+				body.WriteString("\tx.unknownFields = nil\n")
+			}
+			if !id.IsExported() {
+				continue
+			}
+			if t, ok := field.Type.(*ast.Ident); ok && c.oneofs[t.Name] != nil {
+				for _, ts := range c.oneofs[t.Name] {
+					wst, ok := ts.Type.(*ast.StructType)
+					if !ok || len(wst.Fields.List) != 1 || len(wst.Fields.List[0].Names) != 1 {
+						continue
+					}
+					member := wst.Fields.List[0]
+					var w bytes.Buffer
+					if err := c.redactField(&w, msg, "v."+member.Names[0].Name, member, rc); err != nil {
+						return err
+					}
+					if w.Len() > 0 {
+						fmt.Fprintf(&body, "\tif v, ok := x.%s.(*%s); ok {\n", id.Name, ts.Name.Name)
+						body.Write(w.Bytes())
+						body.WriteString("\t}\n")
+					}
+				}
+				continue
+			}
+			if err := c.redactField(&body, msg, "x."+id.Name, field, rc); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Fprintf(&c.w, `
+// Redact clears or hashes, in place, the sensitive fields of x and of
+// its message fields, and its unknown fields.
+func (x *%s) Redact() {
+	if x == nil {
+		return
+	}
+`, msg)
+	c.w.Write(body.Bytes())
+	c.w.WriteString("}\n")
+	dup := "x.Clone()"
+	if !clone || c.cloneConflict(msg, st) {
+		c.used["proto"] = true
+		dup = fmt.Sprintf("proto.Clone(x).(*%s)", msg)
+	}
+	fmt.Fprintf(&c.w, `
+// LogSafe returns a copy of x whose sensitive fields are redacted (see
+// Redact), for logging.
+func (x *%s) LogSafe() *%s {
+	if x == nil {
+		return nil
+	}
+	y := %s
+	y.Redact()
+	return y
+}
+`, msg, msg, dup)
+	return nil
+}
+
+// redactField writes the statements that redact the field, or value x
+// of the struct field, of the message, if it is sensitive, or else
+// that redact the messages of the same package that it holds.
+func (c *cloner) redactField(w *bytes.Buffer, msg, x string, field *ast.Field, rc *RedactConfig) error {
+	mode, err := redactMode(msg, field, rc)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case "zero":
+		switch t := field.Type.(type) {
+		case *ast.StarExpr, *ast.ArrayType, *ast.MapType:
+			fmt.Fprintf(w, "\t%s = nil\n", x)
+		case *ast.Ident:
+			switch {
+			case t.Name == "string":
+				fmt.Fprintf(w, "\t%s = \"\"\n", x)
+			case t.Name == "bool":
+				fmt.Fprintf(w, "\t%s = false\n", x)
+			default: // numbers and enums
+				fmt.Fprintf(w, "\t%s = 0\n", x)
+			}
+		case *ast.SelectorExpr: // enums of other packages
+			fmt.Fprintf(w, "\t%s = 0\n", x)
+		default:
+			return fmt.Errorf("%s.%s: cannot zero a field of type %s", msg, protoName(field), c.typeString(field.Type))
+		}
+	case "hash":
+		if !c.hashValue(w, x, field.Type, 0) {
+			return fmt.Errorf("%s.%s: cannot hash a field of type %s (want string or bytes)", msg, protoName(field), c.typeString(field.Type))
+		}
+	default:
+		c.redactValue(w, x, field.Type, wireType(field), 0)
+	}
+	return nil
+}
+
+// hashValue writes the statements that replace x, a string, bytes, an
+// optional string or a list of them, with a prefix of its SHA-256 hash,
+// and reports whether the type is one of those.
+func (c *cloner) hashValue(w *bytes.Buffer, x string, typ ast.Expr, depth int) bool {
+	sum := fmt.Sprintf("sum%d", depth)
+	switch t := typ.(type) {
+	case *ast.Ident:
+		if t.Name != "string" {
+			return false
+		}
+		c.used["sha256"], c.used["hex"] = true, true
+		fmt.Fprintf(w, "\tif %s != \"\" {\n\t\t%s := sha256.Sum256([]byte(%s))\n\t\t%s = \"sha256:\" + hex.EncodeToString(%s[:8])\n\t}\n", x, sum, x, x, sum)
+	case *ast.StarExpr:
+		if id, ok := t.X.(*ast.Ident); !ok || id.Name != "string" {
+			return false
+		}
+		c.used["sha256"], c.used["hex"] = true, true
+		h := fmt.Sprintf("h%d", depth)
+		fmt.Fprintf(w, "\tif %s != nil && *%s != \"\" {\n\t\t%s := sha256.Sum256([]byte(*%s))\n\t\t%s := \"sha256:\" + hex.EncodeToString(%s[:8])\n\t\t%s = &%s\n\t}\n", x, x, sum, x, h, sum, x, h)
+	case *ast.ArrayType:
+		if id, ok := t.Elt.(*ast.Ident); ok && id.Name == "byte" {
+			c.used["sha256"] = true
+			fmt.Fprintf(w, "\tif len(%s) > 0 {\n\t\t%s := sha256.Sum256(%s)\n\t\t%s = %s[:8]\n\t}\n", x, sum, x, x, sum)
+			return true
+		}
+		i := fmt.Sprintf("i%d", depth)
+		var elem bytes.Buffer
+		if !c.hashValue(&elem, x+"["+i+"]", t.Elt, depth+1) {
+			return false
+		}
+		fmt.Fprintf(w, "\tfor %s := range %s {\n", i, x)
+		w.Write(elem.Bytes())
+		w.WriteString("\t}\n")
+	default:
+		return false
+	}
+	return true
+}
+
+// redactValue writes the statements that redact the messages of the
+// same package held by x, of the type, whose elements have the wire
+// type.
+func (c *cloner) redactValue(w *bytes.Buffer, x string, typ ast.Expr, wire string, depth int) {
+	switch t := typ.(type) {
+	case *ast.StarExpr:
+		if elem, ok := t.X.(*ast.Ident); ok && (c.messages[elem.Name] || wire == "bytes" && !predeclaredTypes[elem.Name]) {
+			fmt.Fprintf(w, "\t%s.Redact()\n", x)
+		}
+	case *ast.ArrayType:
+		if _, ok := t.Elt.(*ast.StarExpr); ok {
+			v := fmt.Sprintf("v%d", depth)
+			var elem bytes.Buffer
+			c.redactValue(&elem, v, t.Elt, wire, depth+1)
+			if elem.Len() > 0 {
+				fmt.Fprintf(w, "\tfor _, %s := range %s {\n", v, x)
+				w.Write(elem.Bytes())
+				w.WriteString("\t}\n")
+			}
+		}
+	case *ast.MapType:
+		if _, ok := t.Value.(*ast.StarExpr); ok {
+			v := fmt.Sprintf("v%d", depth)
+			var elem bytes.Buffer
+			// The wire type of the tag is that of the map; its values
+			// are messages or bytes.
+			c.redactValue(&elem, v, t.Value, "bytes", depth+1)
+			if elem.Len() > 0 {
+				fmt.Fprintf(w, "\tfor _, %s := range %s {\n", v, x)
+				w.Write(elem.Bytes())
+				w.WriteString("\t}\n")
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package protogen
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRedactZeroEnum checks that a redacted field of an enum of another
+// package is zeroed.
+func TestRedactZeroEnum(t *testing.T) {
+	const src = `package msg
+
+import (
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	v1 "example.com/m/api/v1"
+)
+
+type Msg struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Level v1.Level ` + "`protobuf:\"varint,1,opt,name=level,proto3,enum=v1.Level\" json:\"level,omitempty\"`" + `
+}
+`
+	rc := &RedactConfig{Fields: map[string]string{"Msg.level": "zero"}}
+	out, _, err := redactFile("msg.pb.go", []byte(src), rc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "x.Level = 0\n") {
+		t.Errorf("Redact does not zero Level:\n%s", out)
+	}
+}
@@ -0,0 +1,100 @@
+package protogen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A RegistryConfig configures access to the registries from which the
+// base images of the toolchain image (and the -image) are pulled, for
+// environments in which Docker Hub is blocked or requires credentials.
+type RegistryConfig struct {
+	// Mirror is a registry (and path) that mirrors Docker Hub, such as
+	// "registry.acme.com/dockerhub", from which the default base images
+	// (golang, and swift for Swift plugins) are pulled instead.
+	Mirror string `yaml:"mirror"`
+
+	// DockerConfig is the directory of the config.json file holding
+	// the credentials of the registries (default: the runtime's own,
+	// such as ~/.docker). It is passed to the runtime as DOCKER_CONFIG
+	// or, for podman, as REGISTRY_AUTH_FILE.
+	DockerConfig string `yaml:"docker_config"`
+
+	// Username, if set, logs in to Server (default: the registry of the
+	// base image) before an image build or pull, with the password or
+	// token held in the environment variable named by PasswordEnv.
+	Username    string `yaml:"username"`
+	PasswordEnv string `yaml:"password_env"`
+	Server      string `yaml:"server"`
+}
+
+// hubImage returns the reference of the Docker Hub official image,
+// such as "golang:1.19.1", in the mirror, if any.
+func hubImage(mirror, image string) string {
+	if mirror == "" {
+		return image
+	}
+	return strings.TrimSuffix(mirror, "/") + "/library/" + image
+}
+
+// registryHost returns the registry of the image reference,
+// or "" for Docker Hub.
+func registryHost(ref string) string {
+	host, _, ok := strings.Cut(ref, "/")
+	if ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		return host
+	}
+	return ""
+}
+
+// check reports an error if the registry config is incomplete.
+func (reg *RegistryConfig) check() error {
+	if reg.Username != "" && reg.PasswordEnv == "" {
+		return fmt.Errorf("registry: username requires password_env, the environment variable of the password")
+	}
+	return nil
+}
+
+// useRegistry directs the runtime's commands to the registry
+// credentials of the options, logging in first if they specify a
+// username, ahead of an image build or pull. The registry of the
+// image ref, the base image or pulled image, is the default server.
+func useRegistry(ctx context.Context, opts *Options, rt *runtime, ref string) error {
+	reg := &opts.Registry
+	if dir := reg.DockerConfig; dir != "" {
+		if rt.name == "podman" {
+			rt.env = append(rt.env, "REGISTRY_AUTH_FILE="+filepath.Join(dir, "config.json"))
+		} else {
+			rt.env = append(rt.env, "DOCKER_CONFIG="+dir)
+		}
+	}
+	if reg.Username == "" {
+		return nil
+	}
+	password := os.Getenv(reg.PasswordEnv)
+	if password == "" && !opts.DryRun {
+		return fmt.Errorf("registry: $%s, the password of %s, is not set", reg.PasswordEnv, reg.Username)
+	}
+	server := reg.Server
+	if server == "" {
+		server = registryHost(ref)
+	}
+	cmd := rt.command(ctx, "login", "--username", reg.Username, "--password-stdin")
+	if server != "" {
+		opts.logf("logging in to %s as %s...", server, reg.Username)
+		cmd.Args = append(cmd.Args, server)
+	} else {
+		opts.logf("logging in to Docker Hub as %s...", reg.Username)
+	}
+	cmd.Stdin = strings.NewReader(password)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = opts.Stderr
+	if err := opts.run(cmd); err != nil {
+		return fmt.Errorf("%s login failed: %v", rt.name, err)
+	}
+	return nil
+}
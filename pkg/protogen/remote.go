@@ -0,0 +1,199 @@
+package protogen
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// runRemote runs a container as runContainer does, but for a runtime
+// whose daemon cannot see the host's file system, such as a remote
+// DOCKER_HOST or docker-in-docker. Instead of mounting directories, it
+// creates the container, copies the directories into it, starts it,
+// and then copies the writable directories back, updating only the
+// host files whose content changed.
+func (e *env) runRemote(ctx context.Context, opts *Options, dir string, args, extra []string, stdout, stderr io.Writer) error {
+	create := e.rt.command(ctx, "create", "--name", containerName(), "--platform="+e.platform)
+	create.Args = append(create.Args, limitFlags(opts)...)
+	create.Args = append(create.Args, networkFlags(opts)...)
+	create.Args = append(create.Args, containerArgs(args)...)
+	var out bytes.Buffer
+	create.Stdout = &out
+	create.Stderr = opts.Stderr
+	if err := opts.run(create); err != nil {
+		return fmt.Errorf("creating container: %v", err)
+	}
+	id := strings.TrimSpace(out.String())
+	if opts.DryRun {
+		id = "CONTAINER"
+	}
+	defer func() {
+		if ctx.Err() != nil {
+			e.rt.kill(opts, id)
+			return
+		}
+		rm := e.rt.command(context.Background(), "rm", "--force", id)
+		rm.Stdout = io.Discard
+		opts.run(rm)
+	}()
+
+	// Copy the host directories to their container paths.
+	type transfer struct {
+		host, ctr string
+		writable  bool
+	}
+	copies := []transfer{{dir, containerPath(opts.Dir), e.outputs == nil}}
+	for _, m := range e.mounts {
+		copies = append(copies, transfer{m.dir, containerPath(m.dir), !m.readOnly})
+	}
+	for _, x := range extra {
+		copies = append(copies, transfer{x, containerPath(x), false})
+	}
+	for _, c := range copies {
+		cp := e.rt.command(ctx, "cp", "-", id+":/")
+		cp.Stderr = opts.Stderr
+		r, w := io.Pipe()
+		if !opts.DryRun {
+			go func(c transfer) { w.CloseWithError(tarTree(w, c.host, c.ctr)) }(c)
+			cp.Stdin = r
+		}
+		err := opts.run(cp)
+		r.Close() // unblock tarTree if cp failed
+		if err != nil {
+			return fmt.Errorf("copying %s to container: %v", c.host, err)
+		}
+	}
+
+	start := e.rt.command(ctx, "start", "--attach", id)
+	start.Stdout = stdout
+	start.Stderr = stderr
+	if err := opts.run(start); err != nil {
+		return err
+	}
+
+	// Copy back the writable directories.
+	for _, c := range copies {
+		if !c.writable {
+			continue
+		}
+		cp := e.rt.command(ctx, "cp", id+":"+filepath.ToSlash(c.ctr), "-")
+		var archive bytes.Buffer
+		cp.Stdout = &archive
+		cp.Stderr = opts.Stderr
+		if err := opts.run(cp); err != nil {
+			return fmt.Errorf("copying %s from container: %v", c.ctr, err)
+		}
+		if opts.DryRun {
+			continue
+		}
+		if err := updateTree(c.host, &archive); err != nil {
+			return fmt.Errorf("copying %s from container: %v", c.ctr, err)
+		}
+	}
+	return nil
+}
+
+// tarTree writes to w a tar archive of the directories and regular
+// files beneath the host directory dir (except .git directories),
+// named by their container paths beneath ctr, and owned by the host
+// user, so that a container running as that user can write them.
+func tarTree(w io.Writer, dir, ctr string) error {
+	tw := tar.NewWriter(w)
+	uid, gid := os.Getuid(), os.Getgid()
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil // ignore symlinks, sockets, etc.
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = strings.TrimPrefix(path.Join(filepath.ToSlash(ctr), filepath.ToSlash(rel)), "/")
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		if uid > 0 { // -1 on Windows
+			hdr.Uid, hdr.Gid = uid, gid
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// updateTree writes the regular files of a tar archive of a directory,
+// as produced by 'docker cp CONTAINER:PATH -', whose names begin with
+// the directory's base name, to the corresponding files beneath dir,
+// unless their content is unchanged.
+func updateTree(dir string, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		_, rel, ok := strings.Cut(hdr.Name, "/") // strip the base name
+		if !ok {
+			continue
+		}
+		name := filepath.Join(dir, filepath.FromSlash(rel))
+		if !within(name, dir) {
+			return fmt.Errorf("invalid file name %q", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if old, err := os.ReadFile(name); err == nil && bytes.Equal(old, data) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(name, data, hdr.FileInfo().Mode().Perm()|0600); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package protogen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// retryDelay is the delay before the first retry of a failed
+// network-dependent step, which doubles with each further retry, up to
+// maxRetryDelay (see Options.Retries).
+const (
+	retryDelay    = 2 * time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// transientPatterns are substrings of the diagnostics of commands, such
+// as image builds and pulls, that indicate a failure that may not recur:
+// network errors, overloaded servers, and mirrors caught mid-sync.
+var transientPatterns = []string{
+	"connection reset",
+	"connection refused",
+	"connection timed out",
+	"i/o timeout",
+	"tls handshake timeout",
+	"timeout awaiting response headers",
+	"temporary failure in name resolution",
+	"no such host",
+	"could not resolve",
+	"unexpected eof",
+	"network is unreachable",
+	"too many requests",
+	"internal server error",
+	"bad gateway",
+	"service unavailable",
+	"gateway timeout",
+	"hash sum mismatch", // apt mirror mid-sync
+	"failed to fetch",   // apt
+	"error reading from server",
+}
+
+// A transientError is an error that may not recur if the failed step is
+// retried, such as a network error or an HTTP 503 status.
+type transientError struct{ err error }
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// retry calls f, which runs a network-dependent step described by what,
+// until it succeeds, fails with a fatal error, or has been retried
+// opts.Retries times, with exponential backoff between attempts. f
+// should copy its diagnostics to the writer it is passed, from which
+// retry judges whether a failure is transient (see transientPatterns);
+// errors wrapping a *transientError are always transient.
+func retry(ctx context.Context, opts *Options, what string, f func(diag io.Writer) error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		var diag bytes.Buffer
+		err := f(&diag)
+		if err == nil || attempt > opts.Retries || ctx.Err() != nil || !transient(err, diag.String()) {
+			return err
+		}
+		opts.logf("%s failed (%v); retrying in %v (%d of %d)...", what, err, delay, attempt, opts.Retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// runRetrying runs the command as opts.run does, retrying transient
+// failures (see retry) with fresh copies of the command.
+func (opts *Options) runRetrying(ctx context.Context, what string, cmd *exec.Cmd) error {
+	return retry(ctx, opts, what, func(diag io.Writer) error {
+		c := exec.CommandContext(ctx, cmd.Args[0], cmd.Args[1:]...)
+		c.Env, c.Dir, c.Stdout = cmd.Env, cmd.Dir, cmd.Stdout
+		c.Stderr = diag
+		if cmd.Stderr != nil {
+			c.Stderr = io.MultiWriter(cmd.Stderr, diag)
+		}
+		return opts.run(c)
+	})
+}
+
+// transient reports whether the error, with the step's diagnostics,
+// indicates a failure that may not recur.
+func transient(err error, diag string) bool {
+	var te *transientError
+	if errors.As(err, &te) {
+		return true
+	}
+	text := strings.ToLower(diag + "\n" + err.Error())
+	for _, pattern := range transientPatterns {
+		if strings.Contains(text, pattern) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package protogen
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// A runtime is the command-line interface of a docker-compatible
+// container runtime.
+type runtime struct {
+	name   string // "docker", "podman" or "nerdctl"
+	user   string // --user of protoc containers, or "" for the image's default (root)
+	chown  string // "uid:gid" owner to give root-owned outputs after a run, or ""
+	userns string // --userns of protoc containers, or "" for the daemon's default
+
+	// remote is set if the runtime cannot mount host directories,
+	// because its daemon runs on another machine or in a container.
+	remote bool
+
+	env []string // additional environment of its commands, such as DOCKER_CONFIG
+}
+
+// runtimes lists the supported runtimes in order of preference.
+var runtimes = []string{"docker", "podman", "nerdctl"}
+
+// findRuntime returns the named runtime, or, if name is empty,
+// the first supported runtime whose executable is found in PATH.
+func findRuntime(name string) (*runtime, error) {
+	if name != "" {
+		for _, r := range runtimes {
+			if r == name {
+				return &runtime{name: name}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown container runtime %q (want one of %v)", name, runtimes)
+	}
+	for _, r := range runtimes {
+		if _, err := exec.LookPath(r); err == nil {
+			return &runtime{name: r}, nil
+		}
+	}
+	return nil, fmt.Errorf("no container runtime found in PATH (want one of %v)", runtimes)
+}
+
+// command returns a command that runs the runtime with the given
+// arguments, and is killed if the context is done.
+func (r *runtime) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, r.name, args...)
+	if r.env != nil {
+		cmd.Env = append(os.Environ(), r.env...)
+	}
+	return cmd
+}
+
+// proxyVars are the environment variables of proxy settings, which
+// image builds and containers inherit from the host's environment.
+var proxyVars = []string{
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "ALL_PROXY",
+	"http_proxy", "https_proxy", "no_proxy", "all_proxy",
+}
+
+// proxyFlags returns the flags of a runtime command that pass the proxy
+// variables set in the host's environment, such as "--build-arg
+// HTTP_PROXY" for flag "--build-arg". Only the names appear on the
+// command line (the runtime reads the values from its environment), so
+// that credentials in proxy URLs are not logged.
+func proxyFlags(flag string) []string {
+	var flags []string
+	for _, name := range proxyVars {
+		if os.Getenv(name) != "" {
+			flags = append(flags, flag, name)
+		}
+	}
+	return flags
+}
+
+// limitFlags returns the flags of a container command that bound the
+// memory, CPUs and processes of the container, as the options specify.
+func limitFlags(opts *Options) []string {
+	var flags []string
+	if opts.Memory != "" {
+		flags = append(flags, "--memory="+opts.Memory)
+	}
+	if opts.CPUs != "" {
+		flags = append(flags, "--cpus="+opts.CPUs)
+	}
+	if opts.PidsLimit > 0 {
+		flags = append(flags, fmt.Sprintf("--pids-limit=%d", opts.PidsLimit))
+	}
+	return flags
+}
+
+// networkFlags returns the flags of a container command that select
+// its network, and pass the host's proxy variables unless it has none.
+func networkFlags(opts *Options) []string {
+	if opts.Network == "none" {
+		return []string{"--network=none"}
+	}
+	flags := proxyFlags("-e")
+	if opts.Network != "" {
+		flags = append(flags, "--network="+opts.Network)
+	}
+	return flags
+}
+
+// killedByLimit explains the error of a container command that exited
+// with status 137 (SIGKILL), as the kernel's OOM killer does when the
+// container exceeds its memory limit.
+func killedByLimit(opts *Options, err error) error {
+	var exit *exec.ExitError
+	if opts.Memory == "" || !errors.As(err, &exit) || exit.ExitCode() != 137 {
+		return err
+	}
+	return fmt.Errorf("%w (killed, perhaps for exceeding the memory limit of %s)", err, opts.Memory)
+}
+
+// containerName returns a new unique name for a container.
+func containerName() string {
+	var b [6]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("proto-gen-go-%x", b)
+}
+
+// kill stops the named container, if it is running, and removes it.
+// It cleans up after the context of a run is canceled, since killing
+// the runtime's client does not stop the container.
+func (r *runtime) kill(opts *Options, name string) {
+	for _, args := range [][]string{{"kill", name}, {"rm", "--force", name}} {
+		cmd := r.command(context.Background(), args...)
+		cmd.Stdout = io.Discard
+		cmd.Stderr = io.Discard // e.g. already removed by --rm
+		opts.run(cmd)
+	}
+}
+
+// remoteHost reports whether the environment directs the runtime to the
+// daemon of another machine, such as tcp:// or ssh:// in DOCKER_HOST.
+func (r *runtime) remoteHost() bool {
+	host := os.Getenv("DOCKER_HOST")
+	if r.name == "podman" {
+		host = os.Getenv("CONTAINER_HOST")
+	}
+	return host != "" && !strings.HasPrefix(host, "unix://") && !strings.HasPrefix(host, "npipe://")
+}
+
+// volume returns the -v flag value that mounts the host directory dir
+// at the container path mnt, optionally read-only. (On Windows, mnt is
+// a host path, which is translated; see containerPath.)
+func (r *runtime) volume(dir, mnt string, readOnly bool) string {
+	var options []string
+	if readOnly {
+		options = append(options, "ro")
+	}
+	if r.name == "podman" {
+		// Relabel the volume so that it is accessible on SELinux hosts,
+		// which are the norm for podman.
+		options = append(options, "z")
+	}
+	v := dir + ":" + containerPath(mnt)
+	if options != nil {
+		v += ":" + strings.Join(options, ",")
+	}
+	return v
+}
+
+// setUser determines the user as which protoc containers run, so that
+// generated files are owned by the invoking user. The spec is one of:
+//
+//	""         the host user, unless it is root or the runtime is podman
+//	           or rootless docker (or nerdctl), which map root in the
+//	           container to the host user; if the daemon remaps users
+//	           to subordinate ids (userns-remap), the container opts out
+//	           of the remapping (--userns=host) so that the host user's
+//	           files are writable
+//	"uid:gid"  the specified numeric user and group
+//	"root"     root, leaving generated files owned by root
+//	"chown"    root, followed by a chown of root-owned files in the
+//	           working directory to the host user; this is a fallback
+//	           for runtimes that cannot run as an arbitrary user
+func (r *runtime) setUser(ctx context.Context, spec string) error {
+	host := ""
+	if uid, gid := os.Getuid(), os.Getgid(); uid > 0 { // -1 on Windows
+		host = fmt.Sprintf("%d:%d", uid, gid)
+	}
+	switch {
+	case spec == "":
+		if r.name == "podman" || host == "" {
+			break
+		}
+		switch r.usernsMode(ctx) {
+		case "rootless":
+		case "remap":
+			r.user, r.userns = host, "host"
+		default:
+			r.user = host
+		}
+	case spec == "root":
+	case spec == "chown":
+		r.chown = host
+	case userPattern.MatchString(spec):
+		r.user = spec
+	default:
+		return fmt.Errorf("invalid user %q (want uid:gid, root or chown)", spec)
+	}
+	return nil
+}
+
+var userPattern = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+
+// usernsMode returns how the runtime's daemon maps the users of
+// containers to those of the host: "rootless" if the daemon runs as an
+// unprivileged user, whose id root in a container has, "remap" if it
+// maps them to subordinate ids (userns-remap), or "" if neither (or if
+// it cannot tell). Either way, a container running as the host user's
+// id could not write to the host user's bind-mounted files.
+func (r *runtime) usernsMode(ctx context.Context) string {
+	out, err := r.command(ctx, "info", "--format", "{{json .SecurityOptions}}").Output()
+	if err != nil {
+		return ""
+	}
+	var options []string // e.g. "name=seccomp,profile=default"
+	if json.Unmarshal(out, &options) != nil {
+		return ""
+	}
+	for _, opt := range options {
+		for _, field := range strings.Split(opt, ",") {
+			switch field {
+			case "name=rootless":
+				return "rootless"
+			case "name=userns":
+				return "remap"
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,319 @@
+package protogen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An SBOM is a software bill of materials of the toolchain image: the
+// base image, the Debian packages installed in it, protoc, the modules
+// (with their dependencies) of the Go plugins and tools as recorded in
+// their executables, and the other plugins.
+type SBOM struct {
+	Image      string // toolchain image
+	Platform   string // container platform, e.g. "linux/amd64"
+	Components []SBOMComponent
+}
+
+// An SBOMComponent is a component of the toolchain image.
+type SBOMComponent struct {
+	Type    string // "image" (the base image), "deb", "protoc", "go-module", "npm", "pip", "swift" or "file" (a downloaded plugin)
+	Name    string
+	Version string
+	PURL    string // package URL (https://github.com/package-url/purl-spec), if any
+	SHA256  string // hex SHA256 of the archive, image manifest or file, if known
+	GoSum   string // go.sum hash ("h1:...") of a Go module, if known
+	Main    bool   // the module of a Go plugin or tool, rather than a dependency
+}
+
+// sbomScript lists, in a container of the toolchain image, the version
+// of protoc, the Debian packages and the module information of the Go
+// executables.
+const sbomScript = `printf 'protoc\t%s\n' "$(protoc --version)"
+dpkg-query -W -f='deb\t${Package}\t${Version}\t${Architecture}\n'
+for dir in "$(go env GOPATH)/bin" /usr/local/bin; do go version -m "$dir" 2>/dev/null; done
+exit 0`
+
+// ToolchainSBOM returns the SBOM of the toolchain image, built (or,
+// with Options.Image, pulled) if necessary, which it inspects.
+func ToolchainSBOM(ctx context.Context, opts Options) (*SBOM, error) {
+	if err := opts.Config.resolve(); err != nil {
+		return nil, err
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	rt, err := usableRuntime(ctx, &opts)
+	if err != nil {
+		return nil, err
+	}
+	platform, err := containerPlatform(opts.Platform)
+	if err != nil {
+		return nil, err
+	}
+	image, _, err := toolchainImage(ctx, &opts, rt, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.logf("inspecting %s...", image)
+	cmd := rt.command(ctx, "run", "--rm", "--platform="+platform, "--entrypoint=sh", image, "-c", sbomScript)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = opts.Stderr
+	if err := opts.run(cmd); err != nil {
+		return nil, fmt.Errorf("inspecting %s: %v", image, err)
+	}
+
+	sbom := &SBOM{Image: image, Platform: platform}
+	cfg := &opts.Config
+	inventory := parseInventory(out.String())
+	if opts.Image != "" {
+		// A prebuilt image's components are only those it records.
+		sbom.Components = inventory
+		return sbom, nil
+	}
+	base, digest, _ := strings.Cut(cfg.BaseImage, "@")
+	if cfg.Lock != nil && cfg.Lock.BaseImage != "" {
+		base, digest, _ = strings.Cut(cfg.Lock.BaseImage, "@")
+	}
+	name, tag := base, ""
+	if i := strings.LastIndex(base, ":"); i > strings.LastIndex(base, "/") {
+		name, tag = base[:i], base[i+1:]
+	}
+	c := SBOMComponent{Type: "image", Name: name, Version: tag, SHA256: strings.TrimPrefix(digest, "sha256:"), PURL: "pkg:docker/" + name}
+	if tag != "" {
+		c.PURL += "@" + tag
+	}
+	sbom.Components = append(sbom.Components, c)
+	for _, c := range inventory {
+		// protoc 21.5 reports itself as libprotoc 3.21.5.
+		if c.Type == "protoc" && (c.Version == cfg.Protoc || c.Version == "3."+cfg.Protoc) {
+			c.Version, c.PURL = cfg.Protoc, "pkg:github/protocolbuffers/protobuf@v"+cfg.Protoc
+			if pp, err := protocPlatform("linux", strings.TrimPrefix(platform, "linux/")); err == nil {
+				c.SHA256, _ = cfg.protocSum(pp)
+			}
+		}
+		sbom.Components = append(sbom.Components, c)
+	}
+	for _, p := range cfg.installs() {
+		c := SBOMComponent{Name: p.Name, Version: p.Version}
+		switch {
+		case p.Npm != "":
+			c.Type, c.Name, c.PURL = "npm", p.Npm, "pkg:npm/"+url.PathEscape(p.Npm)+"@"+p.Version
+		case p.Pip != "":
+			c.Type, c.Name, c.PURL = "pip", p.Pip, "pkg:pypi/"+strings.ToLower(p.Pip)+"@"+p.Version
+		case p.Swift != "":
+			repo := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(p.Swift, "https://"), "http://"), ".git")
+			c.Type, c.Name, c.PURL = "swift", p.Swift, "pkg:swift/"+repo+"@"+p.Version
+		case p.URL != "":
+			c.Type, c.Name, c.SHA256 = "file", "protoc-gen-"+p.Name, p.SHA256[platform]
+		default:
+			continue // listed, with its dependencies, by parseInventory
+		}
+		sbom.Components = append(sbom.Components, c)
+	}
+	return sbom, nil
+}
+
+// parseInventory returns the components listed by sbomScript: protoc,
+// the Debian packages, and the Go modules of the executables, each once.
+func parseInventory(out string) []SBOMComponent {
+	var protoc, debs, mods []SBOMComponent
+	seen := make(map[string]int) // index in mods, by path@version
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		f := strings.Split(strings.TrimPrefix(sc.Text(), "\t"), "\t")
+		switch {
+		case f[0] == "protoc" && len(f) == 2:
+			// "libprotoc 3.21.5", or "libprotoc 29.3" for protoc 29.3
+			version := f[1][strings.LastIndex(f[1], " ")+1:]
+			protoc = append(protoc, SBOMComponent{Type: "protoc", Name: "protoc", Version: version,
+				PURL: "pkg:github/protocolbuffers/protobuf@v" + version})
+		case f[0] == "deb" && len(f) == 4:
+			debs = append(debs, SBOMComponent{
+				Type: "deb", Name: f[1], Version: f[2],
+				PURL: fmt.Sprintf("pkg:deb/debian/%s@%s?arch=%s", f[1], url.PathEscape(f[2]), f[3]),
+			})
+		case (f[0] == "mod" || f[0] == "dep") && len(f) >= 3 && f[2] != "(devel)":
+			key := f[1] + "@" + f[2]
+			i, ok := seen[key]
+			if !ok {
+				i = len(mods)
+				seen[key] = i
+				mods = append(mods, SBOMComponent{Type: "go-module", Name: f[1], Version: f[2], PURL: "pkg:golang/" + key})
+			}
+			if len(f) >= 4 && f[3] != "" {
+				mods[i].GoSum = f[3]
+			}
+			mods[i].Main = mods[i].Main || f[0] == "mod"
+		}
+	}
+	byName := func(cs []SBOMComponent) {
+		sort.Slice(cs, func(i, j int) bool {
+			if cs[i].Name != cs[j].Name {
+				return cs[i].Name < cs[j].Name
+			}
+			return cs[i].Version < cs[j].Version
+		})
+	}
+	byName(debs)
+	byName(mods)
+	return append(append(protoc, debs...), mods...)
+}
+
+// SPDX returns the SBOM as an SPDX 2.3 JSON document.
+func (s *SBOM) SPDX() ([]byte, error) {
+	type checksum struct {
+		Algorithm string `json:"algorithm"`
+		Value     string `json:"checksumValue"`
+	}
+	type externalRef struct {
+		Category string `json:"referenceCategory"`
+		Type     string `json:"referenceType"`
+		Locator  string `json:"referenceLocator"`
+	}
+	type pkg struct {
+		SPDXID           string        `json:"SPDXID"`
+		Name             string        `json:"name"`
+		Version          string        `json:"versionInfo,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		FilesAnalyzed    bool          `json:"filesAnalyzed"`
+		Checksums        []checksum    `json:"checksums,omitempty"`
+		ExternalRefs     []externalRef `json:"externalRefs,omitempty"`
+		Comment          string        `json:"comment,omitempty"`
+	}
+	type relationship struct {
+		Element string `json:"spdxElementId"`
+		Type    string `json:"relationshipType"`
+		Related string `json:"relatedSpdxElement"`
+	}
+	doc := struct {
+		SPDXVersion       string `json:"spdxVersion"`
+		DataLicense       string `json:"dataLicense"`
+		SPDXID            string `json:"SPDXID"`
+		Name              string `json:"name"`
+		DocumentNamespace string `json:"documentNamespace"`
+		CreationInfo      struct {
+			Created  string   `json:"created"`
+			Creators []string `json:"creators"`
+		} `json:"creationInfo"`
+		Packages      []pkg          `json:"packages"`
+		Relationships []relationship `json:"relationships"`
+	}{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              "proto-gen-go toolchain " + s.Image,
+		DocumentNamespace: "https://github.com/github/proto-gen-go/sbom/" + uuid(),
+	}
+	doc.CreationInfo.Created = time.Now().UTC().Format(time.RFC3339)
+	doc.CreationInfo.Creators = []string{"Tool: proto-gen-go-" + Version()}
+	doc.Packages = append(doc.Packages, pkg{SPDXID: "SPDXRef-Image", Name: s.Image, DownloadLocation: "NOASSERTION",
+		Comment: "proto-gen-go toolchain image for " + s.Platform})
+	doc.Relationships = append(doc.Relationships, relationship{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"})
+	for i, c := range s.Components {
+		p := pkg{SPDXID: fmt.Sprintf("SPDXRef-Package-%d", i+1), Name: c.Name, Version: c.Version, DownloadLocation: "NOASSERTION"}
+		if c.SHA256 != "" {
+			p.Checksums = []checksum{{"SHA256", c.SHA256}}
+		}
+		if c.PURL != "" {
+			p.ExternalRefs = []externalRef{{"PACKAGE-MANAGER", "purl", c.PURL}}
+		}
+		if c.GoSum != "" {
+			p.Comment = "go.sum " + c.GoSum
+		}
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, relationship{"SPDXRef-Image", "CONTAINS", p.SPDXID})
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// CycloneDX returns the SBOM as a CycloneDX 1.5 JSON document.
+func (s *SBOM) CycloneDX() ([]byte, error) {
+	type hash struct {
+		Alg     string `json:"alg"`
+		Content string `json:"content"`
+	}
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type component struct {
+		Type       string     `json:"type"`
+		BOMRef     string     `json:"bom-ref,omitempty"`
+		Name       string     `json:"name"`
+		Version    string     `json:"version,omitempty"`
+		PURL       string     `json:"purl,omitempty"`
+		Hashes     []hash     `json:"hashes,omitempty"`
+		Properties []property `json:"properties,omitempty"`
+	}
+	type tool struct {
+		Type    string `json:"type"`
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	doc := struct {
+		BOMFormat    string `json:"bomFormat"`
+		SpecVersion  string `json:"specVersion"`
+		SerialNumber string `json:"serialNumber"`
+		Version      int    `json:"version"`
+		Metadata     struct {
+			Timestamp string `json:"timestamp"`
+			Tools     struct {
+				Components []tool `json:"components"`
+			} `json:"tools"`
+			Component  component  `json:"component"`
+			Properties []property `json:"properties"`
+		} `json:"metadata"`
+		Components []component `json:"components"`
+	}{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + uuid(),
+		Version:      1,
+	}
+	doc.Metadata.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	doc.Metadata.Tools.Components = []tool{{"application", "proto-gen-go", Version()}}
+	doc.Metadata.Component = component{Type: "container", BOMRef: "image", Name: s.Image}
+	doc.Metadata.Properties = []property{{"proto-gen-go:platform", s.Platform}}
+	for i, c := range s.Components {
+		typ := "library"
+		switch {
+		case c.Type == "image":
+			typ = "container"
+		case c.Type == "protoc" || c.Type == "file" || c.Main:
+			typ = "application"
+		}
+		cc := component{Type: typ, BOMRef: fmt.Sprintf("component-%d", i+1), Name: c.Name, Version: c.Version, PURL: c.PURL}
+		if c.SHA256 != "" {
+			cc.Hashes = []hash{{"SHA-256", c.SHA256}}
+		}
+		if c.GoSum != "" {
+			cc.Properties = []property{{"go:sum", c.GoSum}}
+		}
+		doc.Components = append(doc.Components, cc)
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// uuid returns a random (version 4) UUID.
+func uuid() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
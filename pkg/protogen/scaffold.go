@@ -0,0 +1,939 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A ScaffoldConfig configures the scaffolding, if enabled, of skeleton
+// servers of the Twirp, gRPC and Connect services, in a package beside
+// each generated package, of a main package that serves them, and of a
+// package of their clients. Unlike the other generated files, a
+// skeleton is written once, for a service whose server the package does
+// not yet declare, and is then the user's to edit.
+type ScaffoldConfig struct {
+	Enabled bool                 `yaml:"enabled"`
+	Dir     string               `yaml:"dir"`    // subdirectory of each generated package that holds the servers (default: "server")
+	Main    ScaffoldMainConfig   `yaml:"main"`   // main package that serves the servers, if its dir is set
+	Client  ScaffoldClientConfig `yaml:"client"` // package of the clients of the services, if its dir is set
+}
+
+// A ScaffoldMainConfig configures the main package, written once like
+// the servers, that serves the servers of the gRPC services on a
+// grpc.Server, and those of the Twirp and Connect services on an
+// http.ServeMux. The interceptors are Go expressions, each a member of
+// a package, or a call of it without arguments, qualified by the import
+// path of the package, such as example.com/x/obs.UnaryInterceptor or
+// example.com/x/obs.NewConnectInterceptor().
+type ScaffoldMainConfig struct {
+	Dir                 string   `yaml:"dir"`                  // directory of the main package, relative to the working directory (none if empty)
+	Health              bool     `yaml:"health"`               // serve the gRPC health checking protocol
+	Reflection          bool     `yaml:"reflection"`           // serve gRPC server reflection
+	UnaryInterceptors   []string `yaml:"unary_interceptors"`   // gRPC unary server interceptors, outermost first
+	StreamInterceptors  []string `yaml:"stream_interceptors"`  // gRPC stream server interceptors, outermost first
+	ConnectInterceptors []string `yaml:"connect_interceptors"` // Connect interceptors, outermost first
+}
+
+// A ScaffoldClientConfig configures the package, written once like the
+// main package, that connects to the servers it serves: it dials the
+// gRPC server and constructs the clients of each service, with the
+// interceptors, Go expressions as those of ScaffoldMainConfig.
+type ScaffoldClientConfig struct {
+	Dir                 string   `yaml:"dir"`                  // directory of the client package, relative to the working directory (none if empty)
+	UnaryInterceptors   []string `yaml:"unary_interceptors"`   // gRPC unary client interceptors, outermost first
+	StreamInterceptors  []string `yaml:"stream_interceptors"`  // gRPC stream client interceptors, outermost first
+	ConnectInterceptors []string `yaml:"connect_interceptors"` // Connect interceptors of the clients, outermost first
+}
+
+// defaultScaffoldDir is the default of ScaffoldConfig.Dir.
+const defaultScaffoldDir = "server"
+
+// goExprPattern matches a qualified Go expression of
+// ScaffoldMainConfig: the import path of a package, and a member of it,
+// or a call of it without arguments.
+var goExprPattern = regexp.MustCompile(`^((?:[^/]+/)*[^/.]+)\.([A-Za-z_][A-Za-z0-9_]*(?:\(\))?)$`)
+
+// resolve sets the unset fields of the config to their defaults.
+func (sc *ScaffoldConfig) resolve() error {
+	if !sc.Enabled {
+		return nil
+	}
+	if sc.Dir == "" {
+		sc.Dir = defaultScaffoldDir
+	}
+	if name := path.Base(filepath.ToSlash(sc.Dir)); !token.IsIdentifier(name) {
+		return fmt.Errorf("scaffold: the base name of dir %q is not a valid Go package name", sc.Dir)
+	}
+	if cc := &sc.Client; cc.Dir != "" && !token.IsIdentifier(path.Base(filepath.ToSlash(cc.Dir))) {
+		return fmt.Errorf("scaffold: the base name of client dir %q is not a valid Go package name", cc.Dir)
+	}
+	mc, cc := &sc.Main, &sc.Client
+	for _, exprs := range [][]string{mc.UnaryInterceptors, mc.StreamInterceptors, mc.ConnectInterceptors, cc.UnaryInterceptors, cc.StreamInterceptors, cc.ConnectInterceptors} {
+		for _, expr := range exprs {
+			m := goExprPattern.FindStringSubmatch(expr)
+			if m == nil || !token.IsIdentifier(path.Base(m[1])) {
+				return fmt.Errorf("scaffold: invalid interceptor %q (want an import path and a member of its package, such as example.com/x/obs.UnaryInterceptor)", expr)
+			}
+		}
+	}
+	return nil
+}
+
+// A skeleton is the skeleton server of a service, in the scaffold
+// package beside its generated package.
+type skeleton struct {
+	service    string // name of the service, e.g. Haberdasher
+	typ        string // server type, e.g. HaberdasherServer or, of Connect, HaberdasherHandler
+	gen        string // name of the generated package
+	genPath    string // import path of the generated package
+	importPath string // import path of the scaffold package
+	nameConst  string // constant of the full name of the service, of Connect (e.g. HaberdasherName), if any
+	twirp      bool   // Register registers its Twirp server on an http.ServeMux
+	grpc       bool   // RegisterGRPC registers its gRPC service on a grpc.ServiceRegistrar
+	connect    bool   // Register registers its Connect handler on an http.ServeMux
+	src        []byte
+}
+
+// writeScaffolds writes the skeleton servers of the Twirp, gRPC and
+// Connect services of the generated files, named relative to the host
+// directory dir, which stands in for opts.Dir, that have none, and the
+// main package of ScaffoldMainConfig and the client package of
+// ScaffoldClientConfig, if they have none, and returns their names. With Options.Check, it writes none, as skeletons are not kept
+// up to date.
+func writeScaffolds(opts *Options, dir string, files []string) ([]string, error) {
+	if !opts.Scaffold.Enabled || opts.Check {
+		return nil, nil
+	}
+	var (
+		written   []string
+		skeletons []*skeleton             // those that the package declares, to be served by main
+		seen      = make(map[string]bool) // generated files, by stem, whose services are done
+	)
+	for _, file := range files {
+		var stem string
+		connect := strings.HasSuffix(file, ".connect.go")
+		switch {
+		case strings.HasSuffix(file, ".twirp.go"):
+			stem = strings.TrimSuffix(file, ".twirp.go")
+		case strings.HasSuffix(file, "_grpc.pb.go"):
+			stem = strings.TrimSuffix(file, "_grpc.pb.go")
+		case connect:
+			stem = strings.TrimSuffix(file, ".connect.go") + ".connect"
+		default:
+			continue
+		}
+		if seen[stem] {
+			continue // the Twirp and gRPC services of the same .proto file
+		}
+		seen[stem] = true
+		importPath, err := goImportPath(filepath.Dir(filepath.Join(opts.Dir, file)))
+		if err != nil {
+			return nil, fmt.Errorf("scaffold: %v", err)
+		}
+		pkg := path.Base(filepath.ToSlash(opts.Scaffold.Dir))
+
+		var found []*skeleton
+		if connect {
+			g, err := parseGenFile(filepath.Join(dir, file), importPath)
+			if err != nil {
+				return nil, err
+			}
+			if found, err = scaffoldHandlers(g, pkg); err != nil {
+				return nil, err
+			}
+		} else {
+			twirp, err := parseGenFile(filepath.Join(dir, stem+".twirp.go"), importPath)
+			if err != nil {
+				return nil, err
+			}
+			grpc, err := parseGenFile(filepath.Join(dir, stem+"_grpc.pb.go"), importPath)
+			if err != nil {
+				return nil, err
+			}
+			if found, err = scaffoldServers(twirp, grpc, pkg); err != nil {
+				return nil, err
+			}
+		}
+
+		scaffoldDir := filepath.Join(filepath.Dir(file), filepath.FromSlash(opts.Scaffold.Dir))
+		declared, err := declaredTypes(filepath.Join(dir, scaffoldDir))
+		if err != nil {
+			return nil, err
+		}
+		for _, sk := range found {
+			sk.importPath = path.Join(importPath, filepath.ToSlash(opts.Scaffold.Dir))
+			if declared[sk.typ] {
+				skeletons = append(skeletons, sk)
+				continue
+			}
+			name := filepath.Join(scaffoldDir, snakeCase(sk.service)+".go")
+			filename := filepath.Join(dir, name)
+			if _, err := os.Stat(filename); err == nil {
+				continue // the user's, whatever it declares
+			}
+			if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(filename, sk.src, 0666); err != nil {
+				return nil, err
+			}
+			opts.logf("scaffolded the %s server in %s", sk.service, name)
+			written = append(written, name)
+			skeletons = append(skeletons, sk)
+		}
+	}
+
+	sort.Slice(skeletons, func(i, j int) bool {
+		if skeletons[i].importPath != skeletons[j].importPath {
+			return skeletons[i].importPath < skeletons[j].importPath
+		}
+		return skeletons[i].typ < skeletons[j].typ
+	})
+	for _, pkg := range []struct {
+		dir, file, what string
+		source          func() ([]byte, error)
+	}{
+		{opts.Scaffold.Main.Dir, "main.go", "the main package that serves", func() ([]byte, error) { return scaffoldMain(&opts.Scaffold.Main, skeletons) }},
+		{opts.Scaffold.Client.Dir, "client.go", "the client package of", func() ([]byte, error) { return scaffoldClient(&opts.Scaffold.Client, skeletons) }},
+	} {
+		if pkg.dir == "" || len(skeletons) == 0 {
+			continue
+		}
+		name := filepath.Join(filepath.FromSlash(pkg.dir), pkg.file)
+		filename := filepath.Join(dir, name)
+		if _, err := os.Stat(filename); err == nil {
+			continue // the user's
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		src, err := pkg.source()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filename, src, 0666); err != nil {
+			return nil, err
+		}
+		opts.logf("scaffolded %s %d servers in %s", pkg.what, len(skeletons), name)
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// declaredTypes returns the names of the types declared by the Go files
+// of the directory, if it exists, other than its tests.
+func declaredTypes(dir string) (map[string]bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	types := make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, fmt.Errorf("scaffold: %v", err)
+		}
+		for _, decl := range f.Decls {
+			if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.TYPE {
+				for _, spec := range gen.Specs {
+					types[spec.(*ast.TypeSpec).Name.Name] = true
+				}
+			}
+		}
+	}
+	return types, nil
+}
+
+// A genFile is a generated Go file, parsed for scaffolding.
+type genFile struct {
+	fset    *token.FileSet
+	file    *ast.File
+	funcs   map[string]*ast.FuncDecl // functions, by name
+	decls   map[string]bool          // names of the types and constants
+	imports map[string]string        // import paths, by name, including that of the file's own package
+}
+
+// parseGenFile parses the named generated Go file, of the package with
+// the specified import path, or returns nil if it does not exist.
+func parseGenFile(filename, importPath string) (*genFile, error) {
+	src, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("scaffold: %v", err)
+	}
+	g := &genFile{
+		fset:    fset,
+		file:    f,
+		funcs:   make(map[string]*ast.FuncDecl),
+		decls:   make(map[string]bool),
+		imports: map[string]string{f.Name.Name: importPath},
+	}
+	for _, imp := range f.Imports {
+		p, _ := strconv.Unquote(imp.Path.Value)
+		if imp.Name != nil {
+			g.imports[imp.Name.Name] = p
+		} else {
+			g.imports[path.Base(p)] = p
+		}
+	}
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				g.funcs[decl.Name.Name] = decl
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					g.decls[spec.Name.Name] = true
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						g.decls[name.Name] = true
+					}
+				}
+			}
+		}
+	}
+	return g, nil
+}
+
+// interfaces returns the interface types declared by the file, in order.
+func (g *genFile) interfaces() []*ast.TypeSpec {
+	var specs []*ast.TypeSpec
+	for _, decl := range g.file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.TYPE {
+			for _, spec := range gen.Specs {
+				if ts := spec.(*ast.TypeSpec); isInterface(ts) {
+					specs = append(specs, ts)
+				}
+			}
+		}
+	}
+	return specs
+}
+
+// isInterface reports whether the type spec declares an interface.
+func isInterface(ts *ast.TypeSpec) bool {
+	_, ok := ts.Type.(*ast.InterfaceType)
+	return ok
+}
+
+// typeString returns the source of the type expression.
+func (g *genFile) typeString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, g.fset, expr)
+	return buf.String()
+}
+
+// param returns the source of the type of the ith parameter of the
+// named function of the file, qualified by its package, or def if it
+// has no such parameter.
+func (g *genFile) param(fn string, i int, used map[string]bool, def string) string {
+	decl := g.funcs[fn]
+	if decl == nil || len(decl.Type.Params.List) <= i {
+		return def
+	}
+	t := decl.Type.Params.List[i].Type
+	qualify(t, g.file.Name.Name, used)
+	return g.typeString(t)
+}
+
+// scaffoldServers returns the skeleton servers, in package pkg, of the
+// services of the files generated by the twirp plugin and by the grpc
+// plugin from the same .proto file, either of which may be nil. A Twirp
+// service X is an interface with constructors of its server (NewXServer)
+// and protobuf client (NewXProtobufClient), and a gRPC service is an
+// interface XServer with a registration function (RegisterXServer). A
+// service of both has a single skeleton, XServer, whose methods are
+// those of the Twirp interface, as those of the gRPC interface, but for
+// the streaming methods that Twirp does not support, are the same.
+func scaffoldServers(twirp, grpc *genFile, pkg string) ([]*skeleton, error) {
+	type service struct{ twirp, grpc *ast.InterfaceType }
+	services := make(map[string]*service)
+	var names []string
+	add := func(name string) *service {
+		if services[name] == nil {
+			services[name] = new(service)
+			names = append(names, name)
+		}
+		return services[name]
+	}
+	imports := make(map[string]string)
+	for _, g := range []*genFile{grpc, twirp} {
+		if g == nil {
+			continue
+		}
+		for name, p := range g.imports {
+			imports[name] = p
+		}
+		for _, ts := range g.interfaces() {
+			name, it := ts.Name.Name, ts.Type.(*ast.InterfaceType)
+			switch {
+			case g == twirp && g.funcs["New"+name+"Server"] != nil && g.funcs["New"+name+"ProtobufClient"] != nil:
+				add(name).twirp = it
+			case g == grpc && strings.HasSuffix(name, "Server") && g.funcs["Register"+name] != nil:
+				add(strings.TrimSuffix(name, "Server")).grpc = it
+			}
+		}
+	}
+	for name, p := range map[string]string{
+		"http":   "net/http",
+		"twirp":  "github.com/twitchtv/twirp",
+		"grpc":   "google.golang.org/grpc",
+		"codes":  "google.golang.org/grpc/codes",
+		"status": "google.golang.org/grpc/status",
+	} {
+		if imports[name] == "" {
+			imports[name] = p
+		}
+	}
+
+	var skeletons []*skeleton
+	for _, svc := range names {
+		s := services[svc]
+		g := twirp
+		if g == nil {
+			g = grpc
+		}
+		gen := g.file.Name.Name
+		sk := &skeleton{service: svc, typ: svc + "Server", gen: gen, genPath: g.imports[gen], twirp: s.twirp != nil, grpc: s.grpc != nil}
+		used := map[string]bool{gen: true}
+		var impls []string
+		if sk.twirp {
+			impls = append(impls, fmt.Sprintf("the %s.%s Twirp service", gen, svc))
+		}
+		if sk.grpc {
+			impls = append(impls, fmt.Sprintf("the %s.%sServer gRPC service", gen, svc))
+		}
+
+		var body bytes.Buffer
+		fmt.Fprintf(&body, "\n// %s implements %s.\ntype %s struct {\n", sk.typ, strings.Join(impls, "\n// and "), sk.typ)
+		if sk.grpc && grpc.decls["Unimplemented"+svc+"Server"] {
+			fmt.Fprintf(&body, "\t// The methods added to the service later return codes.Unimplemented.\n\t%s.Unimplemented%sServer\n\n", gen, svc)
+		}
+		fmt.Fprintf(&body, `	// TODO: add the dependencies of the service.
+}
+
+// New%[1]s returns a new %[1]s.
+func New%[1]s() *%[1]s {
+	return &%[1]s{}
+}
+`, sk.typ)
+		if sk.twirp {
+			used["http"] = true
+			fmt.Fprintf(&body, `
+// Register registers the routes of the service on mux, with the
+// options (such as twirp.WithServerHooks) of its Twirp server.
+func (s *%[3]s) Register(mux *http.ServeMux, opts %[4]s) {
+	h := %[1]s.New%[2]sServer(s, opts...)
+	mux.Handle(h.PathPrefix(), h)
+}
+
+var _ %[1]s.%[2]s = (*%[3]s)(nil)
+`, gen, svc, sk.typ, twirp.param("New"+svc+"Server", 1, used, "...interface{}"))
+		}
+		if sk.grpc {
+			fmt.Fprintf(&body, `
+// RegisterGRPC registers the gRPC service on r.
+func (s *%[3]s) RegisterGRPC(r %[4]s) {
+	%[1]s.Register%[2]sServer(r, s)
+}
+
+var _ %[1]s.%[2]sServer = (*%[3]s)(nil)
+`, gen, svc, sk.typ, grpc.param("Register"+svc+"Server", 0, used, "*grpc.Server"))
+		}
+
+		it, iface := s.twirp, gen+"."+svc
+		unimplemented := func(method string) string {
+			used["twirp"] = true
+			return fmt.Sprintf("twirp.NewError(twirp.Unimplemented, %q)", method+" is not implemented")
+		}
+		if it == nil {
+			g, it, iface = grpc, s.grpc, gen+"."+svc+"Server"
+			unimplemented = func(method string) string {
+				used["status"], used["codes"] = true, true
+				return fmt.Sprintf("status.Error(codes.Unimplemented, %q)", method+" is not implemented")
+			}
+		}
+		writeSkeletonMethods(&body, g, it, "s", sk.typ, iface, used, unimplemented)
+
+		var err error
+		if sk.src, err = skeletonSource(pkg, imports, used, body.Bytes()); err != nil {
+			return nil, fmt.Errorf("skeleton server of %s: %v", svc, err)
+		}
+		skeletons = append(skeletons, sk)
+	}
+	return skeletons, nil
+}
+
+// scaffoldHandlers returns the skeleton servers, in package pkg, of the
+// Connect services of the file generated by the connect plugin. A
+// Connect service X is an interface XHandler with a constructor of its
+// handler (NewXHandler), whose skeleton, also XHandler, registers it.
+func scaffoldHandlers(g *genFile, pkg string) ([]*skeleton, error) {
+	gen := g.file.Name.Name
+	imports := make(map[string]string)
+	for name, p := range g.imports {
+		imports[name] = p
+	}
+	imports["http"], imports["errors"] = "net/http", "errors"
+	if imports["connect"] == "" {
+		imports["connect"] = "connectrpc.com/connect"
+	}
+
+	var skeletons []*skeleton
+	for _, ts := range g.interfaces() {
+		name := ts.Name.Name
+		svc := strings.TrimSuffix(name, "Handler")
+		if svc == name || g.funcs["New"+name] == nil {
+			continue
+		}
+		sk := &skeleton{service: svc, typ: name, gen: gen, genPath: g.imports[gen], connect: true}
+		if g.decls[svc+"Name"] {
+			sk.nameConst = svc + "Name"
+		}
+		used := map[string]bool{gen: true, "http": true}
+		var body bytes.Buffer
+		fmt.Fprintf(&body, "\n// %[3]s implements the %[1]s.%[3]s Connect service.\ntype %[3]s struct {\n", gen, svc, name)
+		if g.decls["Unimplemented"+name] {
+			fmt.Fprintf(&body, "\t// The methods added to the service later return connect.CodeUnimplemented.\n\t%s.Unimplemented%s\n\n", gen, name)
+		}
+		fmt.Fprintf(&body, `	// TODO: add the dependencies of the service.
+}
+
+// New%[2]s returns a new %[2]s.
+func New%[2]s() *%[2]s {
+	return &%[2]s{}
+}
+
+// Register registers the Connect handler of the service on mux, with
+// the options (such as connect.WithInterceptors) of the handler.
+func (h *%[2]s) Register(mux *http.ServeMux, opts %[3]s) {
+	mux.Handle(%[1]s.New%[2]s(h, opts...))
+}
+
+var _ %[1]s.%[2]s = (*%[2]s)(nil)
+`, gen, name, g.param("New"+name, 1, used, "...connect.HandlerOption"))
+		writeSkeletonMethods(&body, g, ts.Type.(*ast.InterfaceType), "h", name, gen+"."+name, used, func(method string) string {
+			used["connect"], used["errors"] = true, true
+			return fmt.Sprintf("connect.NewError(connect.CodeUnimplemented, errors.New(%q))", method+" is not implemented")
+		})
+
+		var err error
+		if sk.src, err = skeletonSource(pkg, imports, used, body.Bytes()); err != nil {
+			return nil, fmt.Errorf("skeleton handler of %s: %v", svc, err)
+		}
+		skeletons = append(skeletons, sk)
+	}
+	return skeletons, nil
+}
+
+// writeSkeletonMethods writes the methods of the skeleton type typ, with
+// receiver recv, that implement those of the interface it, of the file
+// g, named iface, and return the error unimplemented(method), recording
+// in used the packages they refer to.
+func writeSkeletonMethods(w *bytes.Buffer, g *genFile, it *ast.InterfaceType, recv, typ, iface string, used map[string]bool, unimplemented func(method string) string) {
+	for _, m := range it.Methods.List {
+		if len(m.Names) != 1 || !m.Names[0].IsExported() {
+			continue // e.g. mustEmbedUnimplemented...
+		}
+		method := m.Names[0].Name
+		ft := m.Type.(*ast.FuncType)
+		qualify(ft, g.file.Name.Name, used)
+		var params []string
+		names := make(map[string]bool)
+		for _, field := range ft.Params.List {
+			t := g.typeString(field.Type)
+			param := "req"
+			switch {
+			case t == "context.Context":
+				param = "ctx"
+			case strings.Contains(t, "Stream") || strings.HasSuffix(t, "Server"):
+				param = "stream" // e.g. *connect.ServerStream[T] or, of gRPC, Service_MethodServer
+			}
+			for i := 2; names[param]; i++ {
+				param = strings.TrimRight(param, "0123456789") + strconv.Itoa(i)
+			}
+			names[param] = true
+			params = append(params, param+" "+t)
+		}
+		var results, zeros []string
+		if ft.Results != nil {
+			for _, field := range ft.Results.List {
+				t := g.typeString(field.Type)
+				results = append(results, t)
+				switch {
+				case t == "error":
+					zeros = append(zeros, unimplemented(method))
+				case strings.HasPrefix(t, "*"):
+					zeros = append(zeros, "nil")
+				default:
+					zeros = append(zeros, t+"{}")
+				}
+			}
+		}
+		fmt.Fprintf(w, `
+// %[1]s implements %[2]s.
+func (%[3]s *%[4]s) %[1]s(%[5]s) (%[6]s) {
+	// TODO: implement %[1]s.
+	return %[7]s
+}
+`, method, iface, recv, typ, strings.Join(params, ", "), strings.Join(results, ", "), strings.Join(zeros, ", "))
+	}
+}
+
+// skeletonSource returns the formatted source of a file of package pkg
+// with the body, which refers to the used packages of imports.
+func skeletonSource(pkg string, imports map[string]string, used map[string]bool, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "package %s\n\n%s", pkg, importDecl(imports, used))
+	buf.Write(body)
+	return format.Source(buf.Bytes())
+}
+
+// importDecl returns the import declaration of the used packages of
+// imports, those of the standard library first, as goimports groups
+// them, naming those whose names differ from the base of their paths.
+func importDecl(imports map[string]string, used map[string]bool) string {
+	var std, other []string
+	for name := range used {
+		p := imports[name]
+		spec := strconv.Quote(p)
+		if path.Base(p) != name {
+			spec = name + " " + spec
+		}
+		switch {
+		case p == "":
+		case strings.Contains(strings.SplitN(p, "/", 2)[0], "."):
+			other = append(other, spec)
+		default:
+			std = append(std, spec)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+	groups := []string{strings.Join(std, "\n\t"), strings.Join(other, "\n\t")}
+	if len(std) == 0 || len(other) == 0 {
+		groups = []string{strings.Join(append(std, other...), "\n\t")}
+	}
+	return fmt.Sprintf("import (\n\t%s\n)\n", strings.Join(groups, "\n\n\t"))
+}
+
+// scaffoldMain returns the source of the main package of mc, which
+// serves the skeleton servers, in order: those of the gRPC services,
+// with the gRPC interceptors, on a grpc.Server, and those of the Twirp
+// and Connect services, the latter with the Connect interceptors, on an
+// http.ServeMux, with the health checking and reflection services of
+// mc on either.
+func scaffoldMain(mc *ScaffoldMainConfig, skeletons []*skeleton) ([]byte, error) {
+	imports := make(map[string]string)
+	used := make(map[string]bool)
+	use := func(name, p string) string {
+		imports[name], used[name] = p, true
+		return name
+	}
+	exprs := func(list []string) string {
+		var qualified []string
+		for _, expr := range list {
+			m := goExprPattern.FindStringSubmatch(expr)
+			qualified = append(qualified, use(path.Base(m[1]), m[1])+"."+m[2])
+		}
+		return strings.Join(qualified, ", ")
+	}
+
+	var (
+		servers  bytes.Buffer
+		grpcRegs []string // registrations on the grpc.Server s
+		httpRegs []string // registrations on the http.ServeMux mux
+		names    []string // constants of the full names of the Connect services
+		connect  bool
+		aliases  = make(map[string]string) // of the scaffold packages, by import path
+		vars     = make(map[string]bool)
+	)
+	for _, sk := range skeletons {
+		alias, ok := aliases[sk.importPath]
+		if !ok {
+			base := sk.gen + path.Base(sk.importPath)
+			alias = base
+			for i := 2; imports[alias] != ""; i++ {
+				alias = base + strconv.Itoa(i)
+			}
+			aliases[sk.importPath] = use(alias, sk.importPath)
+		}
+		v := lowerFirst(sk.typ)
+		for i := 2; vars[v]; i++ {
+			v = lowerFirst(sk.typ) + strconv.Itoa(i)
+		}
+		vars[v] = true
+		fmt.Fprintf(&servers, "\t%s := %s.New%s()\n", v, alias, sk.typ)
+		if sk.grpc {
+			grpcRegs = append(grpcRegs, v+".RegisterGRPC(s)")
+		}
+		if sk.twirp {
+			httpRegs = append(httpRegs, v+".Register(mux)")
+		}
+		if sk.connect {
+			connect = true
+			if len(mc.ConnectInterceptors) > 0 {
+				httpRegs = append(httpRegs, v+".Register(mux, interceptors)")
+			} else {
+				httpRegs = append(httpRegs, v+".Register(mux)")
+			}
+			if sk.nameConst != "" {
+				names = append(names, use(sk.gen, sk.genPath)+"."+sk.nameConst)
+			}
+		}
+	}
+
+	var body bytes.Buffer
+	use("flag", "flag")
+	use("log", "log")
+	body.WriteString("\nvar (\n")
+	if len(grpcRegs) > 0 {
+		body.WriteString("\tgrpcAddr = flag.String(\"grpc_addr\", \":9090\", \"address on which to serve gRPC\")\n")
+	}
+	if len(httpRegs) > 0 {
+		body.WriteString("\thttpAddr = flag.String(\"http_addr\", \":8080\", \"address on which to serve HTTP, for Twirp and Connect\")\n")
+	}
+	body.WriteString(")\n\nfunc main() {\n\tflag.Parse()\n\n")
+	body.Write(servers.Bytes())
+	body.WriteString("\terrc := make(chan error, 2)\n")
+
+	if len(grpcRegs) > 0 {
+		use("grpc", "google.golang.org/grpc")
+		use("net", "net")
+		var options []string
+		if len(mc.UnaryInterceptors) > 0 {
+			options = append(options, "grpc.ChainUnaryInterceptor("+exprs(mc.UnaryInterceptors)+")")
+		}
+		if len(mc.StreamInterceptors) > 0 {
+			options = append(options, "grpc.ChainStreamInterceptor("+exprs(mc.StreamInterceptors)+")")
+		}
+		if len(options) > 0 {
+			fmt.Fprintf(&body, "\n\ts := grpc.NewServer(\n\t\t%s,\n\t)\n", strings.Join(options, ",\n\t\t"))
+		} else {
+			body.WriteString("\n\ts := grpc.NewServer()\n")
+		}
+		for _, reg := range grpcRegs {
+			fmt.Fprintf(&body, "\t%s\n", reg)
+		}
+		if mc.Health {
+			use("health", "google.golang.org/grpc/health")
+			use("healthpb", "google.golang.org/grpc/health/grpc_health_v1")
+			body.WriteString("\thealthpb.RegisterHealthServer(s, health.NewServer())\n")
+		}
+		if mc.Reflection {
+			use("reflection", "google.golang.org/grpc/reflection")
+			body.WriteString("\treflection.Register(s)\n")
+		}
+		body.WriteString(`	go func() {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			errc <- err
+			return
+		}
+		log.Printf("serving gRPC on %s", lis.Addr())
+		errc <- s.Serve(lis)
+	}()
+`)
+	}
+
+	if len(httpRegs) > 0 {
+		use("http", "net/http")
+		body.WriteString("\n\tmux := http.NewServeMux()\n")
+		if connect && len(mc.ConnectInterceptors) > 0 {
+			fmt.Fprintf(&body, "\tinterceptors := %s.WithInterceptors(%s)\n", use("connect", "connectrpc.com/connect"), exprs(mc.ConnectInterceptors))
+		}
+		for _, reg := range httpRegs {
+			fmt.Fprintf(&body, "\t%s\n", reg)
+		}
+		handler := "mux"
+		if connect {
+			if mc.Health {
+				use("grpchealth", "connectrpc.com/grpchealth")
+				fmt.Fprintf(&body, "\tmux.Handle(grpchealth.NewHandler(grpchealth.NewStaticChecker(%s)))\n", strings.Join(names, ", "))
+			}
+			if mc.Reflection {
+				use("grpcreflect", "connectrpc.com/grpcreflect")
+				fmt.Fprintf(&body, "\treflector := grpcreflect.NewStaticReflector(%s)\n", strings.Join(names, ", "))
+				body.WriteString("\tmux.Handle(grpcreflect.NewHandlerV1(reflector))\n\tmux.Handle(grpcreflect.NewHandlerV1Alpha(reflector))\n")
+			}
+			// The gRPC protocol of Connect requires HTTP/2, without TLS.
+			use("http2", "golang.org/x/net/http2")
+			use("h2c", "golang.org/x/net/http2/h2c")
+			handler = "h2c.NewHandler(mux, &http2.Server{})"
+		}
+		fmt.Fprintf(&body, `	go func() {
+		log.Printf("serving HTTP on %%s", *httpAddr)
+		errc <- http.ListenAndServe(*httpAddr, %s)
+	}()
+`, handler)
+	}
+	body.WriteString("\n\tlog.Fatal(<-errc)\n}\n")
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Command %s serves the scaffolded servers of the generated services.\npackage main\n\n%s", path.Base(filepath.ToSlash(mc.Dir)), importDecl(imports, used))
+	buf.Write(body.Bytes())
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("scaffolded main package: %v", err)
+	}
+	return out, nil
+}
+
+// scaffoldClient returns the source of the client package of cc, which
+// constructs the clients of the services of the skeleton servers, in
+// order, of the main package of ScaffoldMainConfig: those of gRPC on a
+// connection of DialGRPC, with the gRPC interceptors, and those of
+// Twirp and Connect, the latter with the Connect interceptors, at the
+// base URL of its HTTP server.
+func scaffoldClient(cc *ScaffoldClientConfig, skeletons []*skeleton) ([]byte, error) {
+	imports := make(map[string]string)
+	used := make(map[string]bool)
+	use := func(name, p string) string {
+		imports[name], used[name] = p, true
+		return name
+	}
+	exprs := func(list []string) string {
+		var qualified []string
+		for _, expr := range list {
+			m := goExprPattern.FindStringSubmatch(expr)
+			qualified = append(qualified, use(path.Base(m[1]), m[1])+"."+m[2])
+		}
+		return strings.Join(qualified, ", ")
+	}
+	aliases := make(map[string]string) // of the generated packages, by import path
+	gen := func(sk *skeleton) string {
+		alias, ok := aliases[sk.genPath]
+		if !ok {
+			alias = sk.gen
+			for i := 2; imports[alias] != ""; i++ {
+				alias = sk.gen + strconv.Itoa(i)
+			}
+			aliases[sk.genPath] = use(alias, sk.genPath)
+		}
+		return alias
+	}
+	funcs := make(map[string]bool)
+	funcName := func(name string) string {
+		fn := name
+		for i := 2; funcs[fn]; i++ {
+			fn = strings.TrimSuffix(name, "Client") + strconv.Itoa(i) + "Client"
+		}
+		funcs[fn] = true
+		return fn
+	}
+
+	var clients bytes.Buffer
+	grpcClients, connectClients := false, false
+	for _, sk := range skeletons {
+		if sk.grpc {
+			grpcClients = true
+			g := gen(sk)
+			fmt.Fprintf(&clients, `
+// %[1]s returns a client of the %[2]s.%[3]s gRPC
+// service on conn (see DialGRPC).
+func %[1]s(conn *grpc.ClientConn) %[2]s.%[3]sClient {
+	return %[2]s.New%[3]sClient(conn)
+}
+`, funcName("New"+sk.service+"GRPCClient"), g, sk.service)
+		}
+		if sk.twirp {
+			use("http", "net/http")
+			use("twirp", "github.com/twitchtv/twirp")
+			g := gen(sk)
+			fmt.Fprintf(&clients, `
+// %[1]s returns a protobuf client of the
+// %[2]s.%[3]s Twirp service at baseURL, such as
+// http://localhost:8080, with the options (such as twirp.WithClientHooks).
+func %[1]s(baseURL string, opts ...twirp.ClientOption) %[2]s.%[3]s {
+	return %[2]s.New%[3]sProtobufClient(baseURL, http.DefaultClient, opts...)
+}
+`, funcName("New"+sk.service+"TwirpClient"), g, sk.service)
+		}
+		if sk.connect {
+			connectClients = true
+			use("http", "net/http")
+			use("connect", "connectrpc.com/connect")
+			g := gen(sk)
+			opts := "opts..."
+			if len(cc.ConnectInterceptors) > 0 {
+				opts = "append([]connect.ClientOption{interceptors}, opts...)..."
+			}
+			fmt.Fprintf(&clients, `
+// %[1]s returns a client of the
+// %[2]s.%[3]sHandler Connect service at baseURL, such as
+// http://localhost:8080, with the Connect interceptors, then the options.
+func %[1]s(baseURL string, opts ...connect.ClientOption) %[2]s.%[3]sClient {
+	return %[2]s.New%[3]sClient(http.DefaultClient, baseURL, %[4]s)
+}
+`, funcName("New"+sk.service+"ConnectClient"), g, sk.service, opts)
+		}
+	}
+
+	var body bytes.Buffer
+	if connectClients && len(cc.ConnectInterceptors) > 0 {
+		fmt.Fprintf(&body, "\n// interceptors are the Connect interceptors of the clients.\nvar interceptors = connect.WithInterceptors(%s)\n", exprs(cc.ConnectInterceptors))
+	}
+	if grpcClients {
+		use("grpc", "google.golang.org/grpc")
+		use("insecure", "google.golang.org/grpc/credentials/insecure")
+		options := []string{"grpc.WithTransportCredentials(insecure.NewCredentials())"}
+		if len(cc.UnaryInterceptors) > 0 {
+			options = append(options, "grpc.WithChainUnaryInterceptor("+exprs(cc.UnaryInterceptors)+")")
+		}
+		if len(cc.StreamInterceptors) > 0 {
+			options = append(options, "grpc.WithChainStreamInterceptor("+exprs(cc.StreamInterceptors)+")")
+		}
+		fmt.Fprintf(&body, `
+// DialGRPC returns a connection to the gRPC server at target, such as
+// localhost:9090, without TLS, as the scaffolded main package serves it,
+// with the gRPC interceptors, then the options.
+func DialGRPC(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{
+		%s,
+	}, opts...)
+	return grpc.Dial(target, opts...)
+}
+`, strings.Join(options, ",\n\t\t"))
+	}
+	body.Write(clients.Bytes())
+
+	pkg := path.Base(filepath.ToSlash(cc.Dir))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Package %[1]s constructs the clients of the scaffolded servers of the\n// generated services.\npackage %[1]s\n\n%[2]s", pkg, importDecl(imports, used))
+	buf.Write(body.Bytes())
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("scaffolded client package: %v", err)
+	}
+	return out, nil
+}
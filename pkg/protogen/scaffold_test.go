@@ -0,0 +1,36 @@
+package protogen
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestScaffoldClient checks that the client package constructs the
+// clients of each protocol of the services, with their interceptors.
+func TestScaffoldClient(t *testing.T) {
+	cc := &ScaffoldClientConfig{
+		Dir:                 "internal/client",
+		UnaryInterceptors:   []string{"example.com/x/obs.UnaryClientInterceptor"},
+		ConnectInterceptors: []string{"example.com/x/obs.NewConnectInterceptor()"},
+	}
+	skeletons := []*skeleton{
+		{service: "Haberdasher", typ: "HaberdasherServer", gen: "hatsv1", genPath: "example.com/x/api", twirp: true, grpc: true},
+		{service: "Closet", typ: "ClosetHandler", gen: "hatsv1connect", genPath: "example.com/x/api/hatsv1connect", connect: true},
+	}
+	src, err := scaffoldClient(cc, skeletons)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"package client\n",
+		"grpc.WithChainUnaryInterceptor(obs.UnaryClientInterceptor)",
+		"var interceptors = connect.WithInterceptors(obs.NewConnectInterceptor())",
+		"func NewHaberdasherGRPCClient(conn *grpc.ClientConn) hatsv1.HaberdasherClient {",
+		"func NewHaberdasherTwirpClient(baseURL string, opts ...twirp.ClientOption) hatsv1.Haberdasher {",
+		"hatsv1connect.NewClosetClient(http.DefaultClient, baseURL, append([]connect.ClientOption{interceptors}, opts...)...)",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("client package lacks %q:\n%s", want, src)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A ServicesConfig configures the generation, if enabled, of constants
+// of the names of the services of the compiled .proto files and of
+// their methods, and of the full gRPC method names and Twirp paths of
+// the methods, beside each file of protoc-gen-go that describes
+// services, for middleware, metrics and authorization policies.
+type ServicesConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	TwirpPrefix string `yaml:"twirp_prefix"` // path prefix of the Twirp server (default: "/twirp"; "/" for none)
+}
+
+// Defaults of ServicesConfig.
+const (
+	defaultTwirpPrefix = "/twirp"
+)
+
+// resolve sets the unset fields of the config to their defaults.
+func (sc *ServicesConfig) resolve() error {
+	if !sc.Enabled {
+		return nil
+	}
+	if sc.TwirpPrefix == "" {
+		sc.TwirpPrefix = defaultTwirpPrefix
+	}
+	if !strings.HasPrefix(sc.TwirpPrefix, "/") {
+		return fmt.Errorf("services: twirp_prefix %q must begin with a slash", sc.TwirpPrefix)
+	}
+	sc.TwirpPrefix = strings.TrimSuffix(sc.TwirpPrefix, "/")
+	return nil
+}
+
+// writeServices writes, if Config.Services is enabled, the constants of
+// the services of the compiled .proto files, described by descs, beside
+// the generated files of protoc-gen-go of those with services, named
+// relative to the host directory dir, which stands in for opts.Dir, and
+// returns the names of those it created or modified.
+func writeServices(opts *Options, dir string, files []string, descs []*ProtoFile) ([]string, error) {
+	if !opts.Services.Enabled {
+		return nil, nil
+	}
+	byName := make(map[string]*ProtoFile)
+	for _, f := range descs {
+		if f.Generate && len(f.Services) > 0 {
+			byName[f.Name] = f
+		}
+	}
+	var written []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pb.go") || strings.HasSuffix(file, "_grpc.pb.go") {
+			continue
+		}
+		src, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		pkg, source, err := generatedSource(file, src)
+		if err != nil {
+			return nil, err
+		}
+		desc := byName[source]
+		if desc == nil {
+			continue // no services
+		}
+		consts, err := serviceFile(desc, pkg, &opts.Services)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(file, ".pb.go") + "_services.go"
+		filename := filepath.Join(dir, name)
+		if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, consts) {
+			continue
+		}
+		if err := os.WriteFile(filename, consts, 0666); err != nil {
+			return nil, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// generatedSource returns the package name of the Go file generated by
+// protoc-gen-go, and the import name of the .proto file from which it
+// was generated, given by its "// source:" comment.
+func generatedSource(name string, src []byte) (pkg, source string, err error) {
+	f, err := parser.ParseFile(token.NewFileSet(), name, src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return "", "", fmt.Errorf("services: %v", err)
+	}
+	for _, group := range f.Comments {
+		for _, c := range group.List {
+			if s := strings.TrimPrefix(c.Text, "// source: "); s != c.Text {
+				return f.Name.Name, strings.TrimSpace(s), nil
+			}
+		}
+	}
+	return f.Name.Name, "", nil
+}
+
+// serviceFile returns the source of the constants of the services of
+// the .proto file, in the Go package pkg.
+func serviceFile(desc *ProtoFile, pkg string, sc *ServicesConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by proto-gen-go from %s. DO NOT EDIT.\n\npackage %s\n", desc.Name, pkg)
+	for _, svc := range desc.Services {
+		service := camelCase(svc.Name)
+		fmt.Fprintf(&buf, "\n// Names of the service %s and its methods, and the full gRPC\n// method names and Twirp paths of the methods.\nconst (\n", svc.FullName)
+		fmt.Fprintf(&buf, "\t%sServiceName = %q\n", service, svc.FullName)
+		for _, m := range svc.Methods {
+			method := service + "_" + camelCase(m.Name)
+			fmt.Fprintf(&buf, "\n\t%s_Method = %q\n", method, m.Name)
+			fmt.Fprintf(&buf, "\t%s_GRPCMethod = %q\n", method, "/"+svc.FullName+"/"+m.Name)
+			fmt.Fprintf(&buf, "\t%s_TwirpPath = %q\n", method, sc.TwirpPrefix+"/"+svc.FullName+"/"+m.Name)
+		}
+		buf.WriteString(")\n")
+	}
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("services of %s: %v", desc.Name, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,240 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A TagsConfig configures the struct tags added to the fields of the
+// message types generated by protoc-gen-go, as protoc-go-inject-tag
+// and protoc-gen-gotag do. A tag replaces that of the same key, such as
+// json, generated by protoc-gen-go, if any.
+type TagsConfig struct {
+	// Auto lists tag keys, such as db or bson, to add to every field
+	// (except oneofs) with the field's proto name as value, as in
+	// db:"user_id".
+	Auto []string `yaml:"auto"`
+
+	// Fields maps fields, named by their Go type and proto field name
+	// (e.g. "User.email", or "User_Address.zip" for a nested message),
+	// to the tags to add, e.g. `validate:"required,email"`.
+	Fields map[string]string `yaml:"fields"`
+
+	// Comments, if set, adds the tags of "@gotags:" comments on the
+	// fields of the .proto files, as in:
+	//
+	//	// @gotags: db:"email_address" validate:"email"
+	//	string email = 2;
+	Comments bool `yaml:"comments"`
+}
+
+// enabled reports whether any tags are configured.
+func (tc *TagsConfig) enabled() bool {
+	return len(tc.Auto) > 0 || len(tc.Fields) > 0 || tc.Comments
+}
+
+// check reports an error if a tag of the config is malformed.
+func (tc *TagsConfig) check() error {
+	for _, key := range tc.Auto {
+		if !tagKeyPattern.MatchString(key) {
+			return fmt.Errorf("tags: invalid key %q", key)
+		}
+	}
+	for field, tags := range tc.Fields {
+		if typ, name, ok := strings.Cut(field, "."); !ok || typ == "" || name == "" {
+			return fmt.Errorf("tags: field %q is not of the form Type.field", field)
+		}
+		if _, err := parseTags(tags); err != nil {
+			return fmt.Errorf("tags: %s: %v", field, err)
+		}
+	}
+	return nil
+}
+
+// A structTag is a key:"value" pair of a struct tag.
+type structTag struct{ key, value string }
+
+// tagKeyPattern matches the keys of struct tags.
+var tagKeyPattern = regexp.MustCompile(`^[^\s:"` + "`" + `]+$`)
+
+// gotagsPattern matches the "@gotags:" comments of fields.
+var gotagsPattern = regexp.MustCompile(`@gotags:\s*(.*)$`)
+
+// parseTags parses a struct tag, by the conventions of reflect.StructTag.
+func parseTags(s string) ([]structTag, error) {
+	var tags []structTag
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return tags, nil
+		}
+		colon := strings.Index(s, `:"`)
+		if colon <= 0 || !tagKeyPattern.MatchString(s[:colon]) {
+			return nil, fmt.Errorf("malformed struct tag %q (want key:\"value\" ...)", s)
+		}
+		key := s[:colon]
+		s = s[colon+1:]
+		i := 1
+		for i < len(s) && s[i] != '"' {
+			if s[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(s) {
+			return nil, fmt.Errorf("malformed struct tag value %q", s)
+		}
+		value, err := strconv.Unquote(s[:i+1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed struct tag value %q", s[:i+1])
+		}
+		tags = append(tags, structTag{key, value})
+		s = s[i+1:]
+	}
+}
+
+// formatTags formats struct tags.
+func formatTags(tags []structTag) string {
+	var parts []string
+	for _, t := range tags {
+		parts = append(parts, t.key+":"+strconv.Quote(t.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// mergeTags returns tags with each of extra replacing the tag of the
+// same key, or else appended.
+func mergeTags(tags, extra []structTag) []structTag {
+	tags = append([]structTag(nil), tags...)
+outer:
+	for _, x := range extra {
+		for i := range tags {
+			if tags[i].key == x.key {
+				tags[i].value = x.value
+				continue outer
+			}
+		}
+		tags = append(tags, x)
+	}
+	return tags
+}
+
+// protoFieldName returns the proto name of a field generated by
+// protoc-gen-go, from its protobuf (or protobuf_oneof) tag, or "".
+func protoFieldName(tags []structTag) string {
+	for _, t := range tags {
+		switch t.key {
+		case "protobuf":
+			for _, part := range strings.Split(t.value, ",") {
+				if strings.HasPrefix(part, "name=") {
+					return strings.TrimPrefix(part, "name=")
+				}
+			}
+		case "protobuf_oneof":
+			return t.value
+		}
+	}
+	return ""
+}
+
+// injectTags adds the configured struct tags to the fields of the
+// message types of the Go file generated by protoc-gen-go, rewriting it
+// only if they change.
+func injectTags(filename string, tc *TagsConfig) error {
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("adding tags to %s: %v", filename, err)
+	}
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			for _, field := range st.Fields.List {
+				if field.Tag == nil {
+					continue
+				}
+				lit, err := strconv.Unquote(field.Tag.Value)
+				if err != nil {
+					continue
+				}
+				tags, err := parseTags(lit)
+				if err != nil {
+					continue
+				}
+				name := protoFieldName(tags)
+				if name == "" {
+					continue
+				}
+				var extra []structTag
+				if tags[0].key == "protobuf" { // not a oneof's interface
+					for _, key := range tc.Auto {
+						extra = append(extra, structTag{key, name})
+					}
+				}
+				if s, ok := tc.Fields[ts.Name.Name+"."+name]; ok {
+					x, _ := parseTags(s) // validated by check
+					extra = append(extra, x...)
+				}
+				if tc.Comments && field.Doc != nil {
+					for _, c := range field.Doc.List {
+						if m := gotagsPattern.FindStringSubmatch(c.Text); m != nil {
+							x, err := parseTags(strings.TrimSpace(m[1]))
+							if err != nil {
+								return fmt.Errorf("%s: @gotags: %v", fset.Position(c.Pos()), err)
+							}
+							extra = append(extra, x...)
+						}
+					}
+				}
+				if extra == nil {
+					continue
+				}
+				text := formatTags(mergeTags(tags, extra))
+				if strings.Contains(text, "`") {
+					text = strconv.Quote(text)
+				} else {
+					text = "`" + text + "`"
+				}
+				if text != field.Tag.Value {
+					edits = append(edits, edit{fset.Position(field.Tag.Pos()).Offset, fset.Position(field.Tag.End()).Offset, text})
+				}
+			}
+		}
+	}
+	if edits == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	last := 0
+	for _, e := range edits {
+		buf.Write(src[last:e.start])
+		buf.WriteString(e.text)
+		last = e.end
+	}
+	buf.Write(src[last:])
+	return os.WriteFile(filename, buf.Bytes(), 0666)
+}
@@ -0,0 +1,177 @@
+package protogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// A TemplateConfig configures a file generated, in place of an in-house
+// plugin, by rendering a Go text/template with the descriptors of the
+// .proto files (see TemplateData), such as a route table or constants
+// of metric labels.
+type TemplateConfig struct {
+	Template string `yaml:"template"` // text/template file, relative to the directory of the config file
+	Out      string `yaml:"out"`      // generated file, relative to the working directory; with each: file, a template such as "gen/{{.File.Dir}}/{{.File.Base}}_routes.go"
+	Each     string `yaml:"each"`     // "file" to render the template once for each compiled .proto file (default: once for all)
+}
+
+// TemplateData is the data with which a template of Config.Templates is
+// rendered, as is its Out name.
+type TemplateData struct {
+	Files   []*ProtoFile // the compiled .proto files and those they import (see ProtoFile.Generate)
+	File    *ProtoFile   // with each: file, the .proto file for which the template is rendered
+	Version string       // version of proto-gen-go
+}
+
+// check reports an error if the template config is invalid.
+func (tc *TemplateConfig) check() error {
+	if tc.Template == "" || tc.Out == "" {
+		return fmt.Errorf("templates: a template requires template and out")
+	}
+	if tc.Each != "" && tc.Each != "file" {
+		return fmt.Errorf("templates: %s: invalid each %q (want file, or none)", tc.Template, tc.Each)
+	}
+	if tc.Each == "file" && !strings.Contains(tc.Out, "{{") {
+		return fmt.Errorf("templates: %s: with each: file, out %q must be a template naming a file for each .proto file", tc.Template, tc.Out)
+	}
+	return nil
+}
+
+// templateFuncs are the functions available to the templates, in
+// addition to those of text/template.
+var templateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"camel":      camelCase,
+	"lowerCamel": func(s string) string { return lowerFirst(camelCase(s)) },
+	"snake":      snakeCase,
+	"join":       strings.Join,
+	"split":      strings.Split,
+	"replace":    strings.ReplaceAll,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"hasPrefix":  strings.HasPrefix,
+	"hasSuffix":  strings.HasSuffix,
+	"contains":   strings.Contains,
+	"base":       func(name string) string { return name[strings.LastIndex(name, ".")+1:] }, // of a full name
+	"quote":      func(s string) string { return fmt.Sprintf("%q", s) },
+}
+
+// camelCase converts a snake_case name, such as that of a field, to
+// CamelCase, as protoc-gen-go does.
+func camelCase(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		switch {
+		case r == '_' || r == '-' || r == '.':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+			upper = unicode.IsDigit(r)
+		}
+	}
+	return b.String()
+}
+
+// lowerFirst returns s with its first letter in lower case.
+func lowerFirst(s string) string {
+	for i, r := range s {
+		return string(unicode.ToLower(r)) + s[i+len(string(r)):]
+	}
+	return s
+}
+
+// snakeCase converts a CamelCase name to snake_case.
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) && runes[i-1] != '_' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// renderTemplates renders Config.Templates with the .proto files of
+// the descriptor set of the run (see env.readDescriptorSet), with the
+// host directory dir standing in for the working directory opts.Dir.
+// Unchanged files are left untouched, and Go files are formatted.
+func renderTemplates(opts *Options, dir string, files []*ProtoFile) error {
+	for _, tc := range opts.Templates {
+		text, err := os.ReadFile(tc.Template)
+		if err != nil {
+			return fmt.Errorf("templates: %v", err)
+		}
+		name := filepath.Base(tc.Template)
+		tmpl, err := template.New(name).Funcs(templateFuncs).Parse(string(text))
+		if err != nil {
+			return fmt.Errorf("templates: %v", err)
+		}
+		out, err := template.New(name + " out").Funcs(templateFuncs).Parse(tc.Out)
+		if err != nil {
+			return fmt.Errorf("templates: %s: out: %v", tc.Template, err)
+		}
+		data := []TemplateData{{Files: files, Version: Version()}}
+		if tc.Each == "file" {
+			data = nil
+			for _, f := range files {
+				if f.Generate {
+					data = append(data, TemplateData{Files: files, File: f, Version: Version()})
+				}
+			}
+		}
+		for _, d := range data {
+			if err := renderTemplate(tmpl, out, &d, dir); err != nil {
+				return fmt.Errorf("templates: %s: %v", tc.Template, err)
+			}
+		}
+	}
+	return nil
+}
+
+// renderTemplate renders the template, and its output file name, with
+// the data, and writes the file beneath dir unless unchanged. An empty
+// output writes no file.
+func renderTemplate(tmpl, out *template.Template, data *TemplateData, dir string) error {
+	var name, buf bytes.Buffer
+	if err := out.Execute(&name, data); err != nil {
+		return err
+	}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(buf.Bytes())) == 0 {
+		return nil
+	}
+	content := buf.Bytes()
+	if strings.HasSuffix(name.String(), ".go") {
+		formatted, err := format.Source(content)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name.String(), err)
+		}
+		content = formatted
+	}
+	filename := filepath.Join(dir, filepath.FromSlash(name.String()))
+	if !within(filename, dir) {
+		return fmt.Errorf("%s is outside the working directory", name.String())
+	}
+	if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, content) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, content, 0666)
+}
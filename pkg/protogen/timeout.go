@@ -0,0 +1,38 @@
+package protogen
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The default limits on the duration of image builds (or pulls or
+// loads) and of protoc runs, after which their commands are killed, so
+// that a hung apt mirror or plugin fails the run instead of blocking it.
+const (
+	defaultBuildTimeout = 30 * time.Minute
+	defaultRunTimeout   = 10 * time.Minute
+)
+
+// withTimeout returns a context that is done after the limit d, or def
+// if d is zero. A negative d means no limit.
+func withTimeout(ctx context.Context, d, def time.Duration) (context.Context, context.CancelFunc, time.Duration) {
+	if d == 0 {
+		d = def
+	}
+	if d < 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, d
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	return ctx, cancel, d
+}
+
+// timedOut returns a timeout error describing what, if the context's
+// limit d (set by the named flag) has expired, or else err.
+func timedOut(ctx context.Context, err error, what string, d time.Duration, flag string) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %v and was killed (see %s)", what, d, flag)
+	}
+	return err
+}
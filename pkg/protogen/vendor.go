@@ -0,0 +1,179 @@
+package protogen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LockFile is the name of the lock file, in the vendor directory, that
+// records the commit of each vendored dependency.
+const LockFile = "deps.lock"
+
+// A Lock records the resolved commits of the dependencies of a config.
+type Lock struct {
+	Deps []LockedDep `yaml:"deps"`
+}
+
+// A LockedDep is a dependency and the commit to which its Rev resolved.
+type LockedDep struct {
+	ProtoDep `yaml:",inline"`
+	Commit   string `yaml:"commit"`
+}
+
+// VendorProtos copies the .proto files of the config's dependencies
+// (Config.Deps) into the vendor directory (Config.VendorDir), replacing
+// its previous contents, and records their commits in its lock file.
+// A dependency that is unchanged since it was locked is fetched at its
+// locked commit, unless update is set, in which case its Rev is resolved
+// anew. The vendor directory may then be added to the import path
+// (--proto_path) so that generation needs no network access.
+func VendorProtos(ctx context.Context, opts Options, update bool) (*Lock, error) {
+	if err := opts.Config.resolve(); err != nil {
+		return nil, err
+	}
+	if opts.Dir == "" {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		opts.Dir = pwd
+	}
+	vendorDir := filepath.Join(opts.Dir, filepath.FromSlash(opts.VendorDir))
+
+	var old Lock
+	if !update {
+		data, err := os.ReadFile(filepath.Join(vendorDir, LockFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &old); err != nil {
+			return nil, fmt.Errorf("%s: %v", LockFile, err)
+		}
+	}
+
+	// Populate a temporary directory, then replace the vendor directory,
+	// so that a failure leaves it unchanged.
+	if err := os.MkdirAll(filepath.Dir(vendorDir), 0777); err != nil {
+		return nil, err
+	}
+	tmpdir, err := os.MkdirTemp(filepath.Dir(vendorDir), "tmp-vendor")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lock := new(Lock)
+	origin := make(map[string]string) // maps each vendored file to its dependency
+	for _, dep := range opts.Deps {
+		rev := dep.Rev
+		for _, l := range old.Deps {
+			if l.Name == dep.Name && l.Git == dep.Git && l.Rev == dep.Rev && l.Root == dep.Root && equalStrings(l.Dirs, dep.Dirs) {
+				rev = l.Commit
+			}
+		}
+		opts.logf("fetching %s %s...", dep.Name, rev)
+		commit, err := fetchProtos(ctx, dep, rev, tmpdir, origin)
+		if err != nil {
+			return nil, fmt.Errorf("dependency %s: %v", dep.Name, err)
+		}
+		lock.Deps = append(lock.Deps, LockedDep{dep, commit})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Code generated by proto-gen-go vendor-protos. DO NOT EDIT.\n")
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(lock); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(tmpdir, LockFile), buf.Bytes(), 0666); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(vendorDir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpdir, vendorDir); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// fetchProtos fetches the revision rev of the dependency's repository,
+// copies its .proto files beneath the dependency's directories into dst,
+// and returns the commit. The origin map, which records the dependency
+// of each file in dst, detects files provided by two dependencies.
+func fetchProtos(ctx context.Context, dep ProtoDep, rev, dst string, origin map[string]string) (string, error) {
+	repo, err := os.MkdirTemp("", "proto-gen-go-vendor")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(repo)
+	if _, err := git(ctx, repo, "init", "-q"); err != nil {
+		return "", err
+	}
+	if _, err := git(ctx, repo, "fetch", "-q", "--depth=1", dep.Git, rev); err != nil {
+		return "", err
+	}
+	commit, err := git(ctx, repo, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"archive", "--format=tar", commit, "--"}, dep.Dirs...)...)
+	cmd.Dir = repo
+	var archive, stderr bytes.Buffer
+	cmd.Stdout = &archive
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git archive %s: %v: %s", commit, err, strings.TrimSpace(stderr.String()))
+	}
+	tree := filepath.Join(repo, ".tree")
+	if err := untar(tree, &archive); err != nil {
+		return "", fmt.Errorf("extracting %s: %v", commit, err)
+	}
+	tree = filepath.Join(tree, filepath.FromSlash(dep.Root))
+
+	err = filepath.WalkDir(tree, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || !strings.HasSuffix(path, ".proto") {
+			return err
+		}
+		rel, err := filepath.Rel(tree, path)
+		if err != nil {
+			return err
+		}
+		if other, ok := origin[rel]; ok {
+			return fmt.Errorf("%s is also provided by %s", filepath.ToSlash(rel), other)
+		}
+		origin[rel] = dep.Name
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+		return copyFile(target, path)
+	})
+	if err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// equalStrings reports whether the slices have the same elements in the same order.
+func equalStrings(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
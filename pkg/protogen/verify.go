@@ -0,0 +1,139 @@
+package protogen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A VerifyConfig requires the prebuilt toolchain image of Options.Image
+// to bear a cosign signature, and, if Attestation is set, an attestation,
+// that verify with the public Key or, keylessly, with the certificate of
+// Identity issued by Issuer, before it is run, even if it is loaded
+// from Options.ImageTar, which then requires Options.Image, its
+// reference in the registry. Verification fails closed: if cosign is
+// missing or the image does not verify, the run fails. Images built from
+// the config are not verified.
+type VerifyConfig struct {
+	Key            string `yaml:"key"`             // public key file, relative to the directory of the config file, or KMS URI, e.g. "cosign.pub"
+	Identity       string `yaml:"identity"`        // keyless: identity of the signing certificate, e.g. the URL of a release workflow
+	IdentityRegexp string `yaml:"identity_regexp"` // keyless: regular expression matching the identity, instead of Identity
+	Issuer         string `yaml:"issuer"`          // keyless: OIDC issuer of the identity, e.g. "https://token.actions.githubusercontent.com"
+	Attestation    string `yaml:"attestation"`     // predicate type of an attestation to verify too, e.g. "slsaprovenance" (default: none)
+}
+
+// enabled reports whether the config requires verification.
+func (v *VerifyConfig) enabled() bool {
+	return v.Key != "" || v.Identity != "" || v.IdentityRegexp != ""
+}
+
+// check reports an error if the verify config is incomplete.
+func (v *VerifyConfig) check() error {
+	keyless := v.Identity != "" || v.IdentityRegexp != ""
+	switch {
+	case v.Key != "" && keyless:
+		return fmt.Errorf("verify: key and identity are mutually exclusive")
+	case v.Identity != "" && v.IdentityRegexp != "":
+		return fmt.Errorf("verify: identity and identity_regexp are mutually exclusive")
+	case keyless && v.Issuer == "":
+		return fmt.Errorf("verify: identity requires issuer, the OIDC issuer of the signing certificate")
+	case !v.enabled() && (v.Issuer != "" || v.Attestation != ""):
+		return fmt.Errorf("verify: requires key, or identity and issuer")
+	}
+	return nil
+}
+
+// flags returns the cosign flags that select the key or identity.
+func (v *VerifyConfig) flags() []string {
+	if v.Key != "" {
+		return []string{"--key", v.Key}
+	}
+	flags := []string{"--certificate-oidc-issuer", v.Issuer}
+	if v.IdentityRegexp != "" {
+		return append(flags, "--certificate-identity-regexp", v.IdentityRegexp)
+	}
+	return append(flags, "--certificate-identity", v.Identity)
+}
+
+// verifyImage verifies the cosign signature (and attestation) of the
+// image ref in its registry, as opts.Verify requires, and checks that
+// the local image, which is then run, is one of the verified digests.
+func verifyImage(ctx context.Context, opts *Options, rt *runtime, ref string) error {
+	v := &opts.Verify
+	if _, err := exec.LookPath("cosign"); err != nil && !opts.DryRun {
+		return fmt.Errorf("verifying %s: cosign is not installed (see https://docs.sigstore.dev/cosign/system_config/installation/)", ref)
+	}
+	opts.logf("verifying the signature of %s...", ref)
+	out, err := cosign(ctx, opts, append(append([]string{"verify"}, v.flags()...), ref)...)
+	if err != nil {
+		return fmt.Errorf("verifying the signature of %s: %v", ref, err)
+	}
+	if v.Attestation != "" {
+		args := append([]string{"verify-attestation", "--type", v.Attestation}, v.flags()...)
+		if _, err := cosign(ctx, opts, append(args, ref)...); err != nil {
+			return fmt.Errorf("verifying the %s attestation of %s: %v", v.Attestation, ref, err)
+		}
+	}
+	if opts.DryRun {
+		return nil
+	}
+
+	// cosign verifies the image in the registry, by digest; make sure
+	// that the local image is the same.
+	var sigs []struct {
+		Critical struct {
+			Image struct {
+				Digest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(out, &sigs); err != nil {
+		return fmt.Errorf("verifying the signature of %s: reading cosign's output: %v", ref, err)
+	}
+	cmd := rt.command(ctx, "image", "inspect", "--format={{json .RepoDigests}}", ref)
+	cmd.Stderr = opts.Stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%s image inspect: %v", rt.name, err)
+	}
+	var repoDigests []string
+	if err := json.Unmarshal(data, &repoDigests); err != nil {
+		return fmt.Errorf("%s image inspect: %v", rt.name, err)
+	}
+	for _, sig := range sigs {
+		for _, rd := range repoDigests {
+			if d := sig.Critical.Image.Digest; d != "" && strings.HasSuffix(rd, "@"+d) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the local image %s is not the one whose signature verified; remove it ('%s rmi %s') to pull it anew", ref, rt.name, ref)
+}
+
+// cosign runs cosign with the specified arguments, with the registry
+// credentials of the options, and returns its output. Its diagnostics
+// are shown if it fails, or with Verbose.
+func cosign(ctx context.Context, opts *Options, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "cosign", args...)
+	if dir := opts.Registry.DockerConfig; dir != "" {
+		cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+dir)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if opts.Verbose {
+		cmd.Stderr = io.MultiWriter(&stderr, opts.Stderr)
+	}
+	if err := opts.run(cmd); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
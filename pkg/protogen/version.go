@@ -0,0 +1,75 @@
+package protogen
+
+import (
+	"runtime/debug"
+	"strings"
+)
+
+// ModulePath is the path of the module that provides this package.
+const ModulePath = "github.com/github/proto-gen-go"
+
+// Version returns the version of the proto-gen-go module, as recorded
+// in the build information of the running program, or "(devel)" if it
+// is unknown, as when built from a working tree.
+func Version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if bi.Main.Path == ModulePath && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == ModulePath {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			if dep.Version != "" {
+				return dep.Version
+			}
+		}
+	}
+	return "(devel)"
+}
+
+// A ComponentVersion is the version of a component of the toolchain.
+type ComponentVersion struct {
+	Name    string // e.g. "protoc", or the name of a plugin
+	Package string // image, module or package from which it is installed, if any
+	Version string
+	Digest  string // content digest pinned by the ToolchainLockFile, if any
+}
+
+// Versions returns the versions of the components of the toolchain
+// specified by the config: the base image, protoc, the plugins and
+// tools (such as buf, for lint), and the runtimes of npm and Swift
+// plugins. If the config has a Lock, they include the digests it pins.
+func (cfg *Config) Versions() []ComponentVersion {
+	base, digest, _ := strings.Cut(cfg.BaseImage, "@")
+	if cfg.Lock != nil && cfg.Lock.BaseImage != "" {
+		base, digest, _ = strings.Cut(cfg.Lock.BaseImage, "@")
+	}
+	versions := []ComponentVersion{
+		{Name: "base-image", Version: base, Digest: digest}, // e.g. golang:1.19.1
+		{Name: "protoc", Version: cfg.Protoc},
+	}
+	var npm, swift bool
+	for _, p := range cfg.installs() {
+		v := ComponentVersion{Name: p.Name, Package: p.Package(), Version: p.Version}
+		if p.Module != "" && cfg.Lock != nil {
+			if m, ok := cfg.Lock.module(p); ok {
+				v.Digest = m.Sum
+			}
+		}
+		versions = append(versions, v)
+		npm = npm || p.Npm != ""
+		swift = swift || p.Swift != ""
+	}
+	if npm {
+		versions = append(versions, ComponentVersion{Name: "node", Version: cfg.Node})
+	}
+	if swift {
+		versions = append(versions, ComponentVersion{Name: "swift", Version: cfg.Swift})
+	}
+	return versions
+}
@@ -0,0 +1,114 @@
+package protogen
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// debounce is the quiet period after a change to a .proto file before
+// protoc is rerun, so that a burst of changes causes a single run.
+const debounce = 250 * time.Millisecond
+
+// Watch runs protoc as Run does, then again each time a .proto file
+// beneath one of the import directories (--proto_path) changes, until
+// the context is done. Unless Options.Local, protoc runs in a single
+// long-lived container that is removed when Watch returns (unless the
+// runtime is remote). The outcome
+// of each run is passed to report. Options.Check is ignored.
+func Watch(ctx context.Context, opts Options, report func(*Result, error)) error {
+	if opts.DryRun {
+		return fmt.Errorf("cannot watch with DryRun")
+	}
+	e, err := prepare(ctx, &opts)
+	if err != nil {
+		return err
+	}
+	pwd := opts.Dir
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	for _, dir := range protoPaths(e.protocArgs, pwd) {
+		if err := watchTree(watcher, dir); err != nil {
+			return err
+		}
+	}
+
+	if e.rt != nil && !e.rt.remote {
+		c, err := startContainer(ctx, &opts, e, pwd)
+		if err != nil {
+			return err
+		}
+		defer c.stop()
+		e.container = c
+	}
+
+	generate := func() {
+		res := &Result{Image: e.image}
+		err := e.preflight(ctx, &opts, pwd)
+		if err == nil {
+			err = runHooks(ctx, &opts, "pre", opts.Hooks.Pre, pwd, nil)
+		}
+		if err == nil {
+			res.Files, err = e.generate(ctx, &opts, pwd)
+		}
+		if err == nil && len(opts.Hooks.Post) > 0 {
+			if res.Hashes, err = hashFiles(pwd, res.Files); err == nil {
+				err = runHooks(ctx, &opts, "post", opts.Hooks.Post, pwd, res)
+			}
+		}
+		report(res, err)
+	}
+	generate()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-watcher.Errors:
+			return err
+
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Create != 0 {
+				// Watch new subdirectories too.
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchTree(watcher, event.Name); err != nil {
+						return err
+					}
+				}
+			}
+			if strings.HasSuffix(event.Name, ".proto") {
+				timer = time.After(debounce)
+			}
+
+		case <-timer:
+			timer = nil
+			opts.logf("change detected; regenerating")
+			generate()
+		}
+	}
+}
+
+// watchTree adds dir and its subdirectories (except .git) to the watcher.
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
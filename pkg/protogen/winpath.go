@@ -0,0 +1,69 @@
+package protogen
+
+import (
+	"regexp"
+	goruntime "runtime"
+	"strings"
+)
+
+// windowsPaths is set if host paths are Windows paths, which the Linux
+// containers of Docker Desktop (or podman machine) cannot use as they
+// are. A host directory such as C:\src\api is instead mounted at the
+// container path /c/src/api, and the host paths in the arguments of
+// container commands are translated to match (see containerArg).
+var windowsPaths = goruntime.GOOS == "windows"
+
+// drivePath matches the drive of an absolute Windows path at the start
+// of a command argument or of the value of a flag (-IC:\src, or
+// --proto_path=C:\src), or after the : or , of a protoc plugin's
+// parameters, as in --go_out=plugins=grpc:C:\gen.
+var drivePath = regexp.MustCompile(`(^-[Io]|^|[=:,])([A-Za-z]):[\\/]`)
+
+// containerPath returns the container path at which the absolute host
+// path is mounted: the path itself, or, on Windows, its translation.
+func containerPath(path string) string {
+	if !windowsPaths {
+		return path
+	}
+	return containerArg(path)
+}
+
+// containerArgs returns the arguments of a container command with
+// their host paths translated to container paths (see containerArg).
+func containerArgs(args []string) []string {
+	if !windowsPaths {
+		return args
+	}
+	ctr := make([]string, len(args))
+	for i, arg := range args {
+		ctr[i] = containerArg(arg)
+	}
+	return ctr
+}
+
+// containerArg translates the Windows paths in a command argument to
+// container paths: C:\src\api becomes /c/src/api, and, since the
+// argument is for a Linux command, every backslash a slash, as in the
+// relative path api\v1\a.proto.
+func containerArg(arg string) string {
+	arg = strings.ReplaceAll(arg, `\`, "/")
+	return drivePath.ReplaceAllStringFunc(arg, func(m string) string {
+		sep := m[:len(m)-3] // "", "-I", "-o", or one of "=:,"
+		drive := strings.ToLower(m[len(m)-3 : len(m)-2])
+		return sep + "/" + drive + "/"
+	})
+}
+
+// containerHostPath returns the host path of the container path of a
+// mounted Windows directory, such as C:\src\api for /c/src/api, or the
+// path itself if it is not one (or the host is not Windows).
+func containerHostPath(path string) string {
+	if !windowsPaths || len(path) < 3 || path[0] != '/' || path[2] != '/' {
+		return path
+	}
+	drive := path[1]
+	if !('a' <= drive && drive <= 'z') {
+		return path
+	}
+	return strings.ToUpper(path[1:2]) + `:\` + strings.ReplaceAll(path[3:], "/", `\`)
+}
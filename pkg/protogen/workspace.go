@@ -0,0 +1,173 @@
+package protogen
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A WorkspaceRoot is a proto root of a workspace config (Config.Roots):
+// a working directory with its own protoc arguments, and, optionally,
+// its own plugins and flags, in place of a go:generate directive of its
+// own.
+type WorkspaceRoot struct {
+	Dir     string   `yaml:"dir"`     // working directory, relative to the directory of the config file
+	Args    []string `yaml:"args"`    // protoc flags and .proto files or patterns, e.g. ["--go_out=.", "api/**/*.proto"] (default: the .proto files beneath Dir)
+	Plugins []Plugin `yaml:"plugins"` // plugins replacing those of the config, with their out and opt settings
+	Flags   []string `yaml:"flags"`   // protoc flags following those of the config
+}
+
+// name returns the name of the root for messages: its directory,
+// relative to pwd if within it.
+func (r *WorkspaceRoot) name(pwd string) string {
+	if rel, err := filepath.Rel(pwd, r.Dir); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return r.Dir
+}
+
+// checkRoots reports an error if the roots of a workspace are invalid.
+func checkRoots(roots []WorkspaceRoot) error {
+	seen := make(map[string]bool)
+	for _, r := range roots {
+		if r.Dir == "" {
+			return fmt.Errorf("roots: a root has no dir")
+		}
+		dir := filepath.Clean(r.Dir)
+		if seen[dir] {
+			return fmt.Errorf("roots: %s appears twice", r.Dir)
+		}
+		seen[dir] = true
+	}
+	return nil
+}
+
+// RootOptions returns the options of each root of the workspace config
+// of opts (Config.Roots), in order: those of opts, with the root's
+// directory, arguments, plugins and flags. A root without .proto files
+// among its arguments compiles those beneath its directory.
+func RootOptions(opts Options) []Options {
+	var all []Options
+	for _, r := range opts.Roots {
+		o := opts
+		o.Roots = nil
+		o.Dir = r.Dir
+		o.ProtocArgs = append(append([]string(nil), opts.ProtocArgs...), r.Args...)
+		if r.Plugins != nil {
+			o.Plugins = r.Plugins
+		}
+		o.Flags = append(append([]string(nil), opts.Flags...), r.Flags...)
+		if len(protoFiles(o.ProtocArgs)) == 0 && o.Recursive == "" {
+			o.Recursive = "."
+		}
+		all = append(all, o)
+	}
+	return all
+}
+
+// A runsError reports the failures of several runs.
+type runsError struct {
+	failed []string // names of the failed runs
+	errs   []error
+	runs   int
+}
+
+func (e *runsError) Error() string {
+	if e.runs == 1 {
+		return fmt.Sprintf("%s: %v", e.failed[0], e.errs[0])
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d runs failed:", len(e.failed), e.runs)
+	for i, name := range e.failed {
+		fmt.Fprintf(&b, "\n\t%s: %v", name, e.errs[i])
+	}
+	return b.String()
+}
+
+func (e *runsError) Unwrap() error { return e.errs[0] }
+
+// RunWorkspace runs each root of the workspace config of opts (see
+// RootOptions), at most parallel at a time, as RunEach does, naming
+// them by their directories, relative to opts.Dir (default: the
+// current directory) if within it.
+func RunWorkspace(ctx context.Context, opts Options, parallel int) ([]*Result, error) {
+	if len(opts.Roots) == 0 {
+		return nil, fmt.Errorf("no roots in %s", ConfigFile)
+	}
+	pwd := opts.Dir
+	if pwd == "" {
+		var err error
+		if pwd, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for _, r := range opts.Roots {
+		names = append(names, r.name(pwd))
+	}
+	return RunEach(ctx, RootOptions(opts), names, parallel)
+}
+
+// RunEach runs Run with each of the options, at most parallel at a
+// time, and returns their results, in order, nil for those that
+// failed. It prefixes the messages of each run with its name, which
+// also identifies it in errors. It runs them all even if some fail,
+// and reports all the failures.
+func RunEach(ctx context.Context, all []Options, names []string, parallel int) ([]*Result, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]*Result, len(all))
+	errs := make([]error, len(all))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := range all {
+		o := &all[i]
+		if o.Stdout == nil {
+			o.Stdout = os.Stdout
+		}
+		if o.Stderr == nil {
+			o.Stderr = os.Stderr
+		}
+		name := names[i]
+		var prefixed []*prefixWriter
+		if parallel > 1 && len(all) > 1 {
+			stdout := &prefixWriter{mu: &mu, w: o.Stdout}
+			stderr := &prefixWriter{mu: &mu, w: o.Stderr, prefix: "[" + name + "] "}
+			o.Stdout, o.Stderr = stdout, stderr
+			prefixed = append(prefixed, stdout, stderr)
+		}
+		if logf := o.Logf; logf != nil && len(all) > 1 {
+			o.Logf = func(format string, args ...interface{}) {
+				logf("[%s] %s", name, fmt.Sprintf(format, args...))
+			}
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			results[i], errs[i] = Run(ctx, *o)
+			for _, w := range prefixed {
+				w.flush()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rerr := &runsError{runs: len(all)}
+	for i, err := range errs {
+		if err != nil {
+			rerr.failed = append(rerr.failed, names[i])
+			rerr.errs = append(rerr.errs, err)
+		}
+	}
+	if len(rerr.errs) > 0 {
+		return results, rerr
+	}
+	return results, nil
+}
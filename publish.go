@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// runPublish implements the publish command.
+func runPublish(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	fs.StringVar(&tf.config, "config", "", "project config file (default: nearest "+protogen.ConfigFile+")")
+	dryRun := fs.Bool("dry-run", false, "commit in a temporary clone and list the changed files, without pushing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	cfg, err := tf.loadConfig(pwd)
+	if err != nil {
+		return err
+	}
+	res, err := protogen.Publish(ctx, protogen.Options{Config: *cfg, Dir: pwd, DryRun: *dryRun, Logf: log.Printf})
+	if err != nil {
+		return err
+	}
+	switch {
+	case res.Commit == "":
+	case *dryRun:
+		for _, file := range res.Files {
+			fmt.Println(file)
+		}
+	default:
+		log.Printf("published %d changed files to %s as %.12s", len(res.Files), cfg.Publish.Repo, res.Commit)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// runSBOM implements the sbom command.
+func runSBOM(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	fs.StringVar(&tf.config, "config", "", "project config file (default: nearest "+protogen.ConfigFile+")")
+	fs.StringVar(&tf.runtime, "runtime", "", "container runtime: docker, podman or nerdctl (default: first found in PATH)")
+	fs.IntVar(&tf.retries, "retries", 2, "times to retry image builds, pulls and downloads that fail with network errors, with exponential backoff")
+	fs.StringVar(&tf.plugins, "plugins", "", "comma-separated list of additional plugins (e.g. gateway,openapiv2,validate)")
+	fs.StringVar(&tf.platform, "platform", "", "container platform of the image: linux/amd64 or linux/arm64 (default: host's)")
+	fs.StringVar(&tf.image, "image", "", "prebuilt toolchain image to pull and describe instead of building one")
+	fs.StringVar(&tf.proxy, "proxy", "", "HTTP(S) proxy URL for the image build (default: $HTTPS_PROXY etc.)")
+	fs.StringVar(&tf.noProxy, "no-proxy", "", "comma-separated hosts to reach without the proxy (default: $NO_PROXY)")
+	fs.StringVar(&tf.caCerts, "ca-cert", "", "comma-separated PEM files of additional CA certificates for the image to trust")
+	fs.StringVar(&tf.dockerfile, "dockerfile", "", "Dockerfile that replaces the generated one (if it has a FROM instruction) or extends it")
+	fs.BoolVar(&tf.verbose, "v", false, "verbose: log each command, and show the full output of image builds")
+	format := fs.String("format", "spdx", "SBOM format: spdx (SPDX 2.3 JSON) or cyclonedx (CycloneDX 1.5 JSON)")
+	output := fs.String("o", "", "file to write (default: standard output)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "spdx" && *format != "cyclonedx" {
+		return fmt.Errorf("invalid -format %q (want spdx or cyclonedx)", *format)
+	}
+	opts, err := tf.options(nil)
+	if err != nil {
+		return err
+	}
+	sbom, err := protogen.ToolchainSBOM(ctx, opts)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if *format == "cyclonedx" {
+		data, err = sbom.CycloneDX()
+	} else {
+		data, err = sbom.SPDX()
+	}
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0666); err != nil {
+		return err
+	}
+	report(opts, "wrote the SBOM of %s (%d components) to %s", sbom.Image, len(sbom.Components), *output)
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// updateCheckInterval is the interval between checks for a new release,
+// whose result is cached meanwhile.
+const updateCheckInterval = 24 * time.Hour
+
+// toolPin and imagePin match the version pins of the tool's module and
+// of its published image, whose versions self-update replaces.
+var (
+	toolPin  = regexp.MustCompile(regexp.QuoteMeta(protogen.ModulePath) + `@(v[0-9][^\s"'` + "`" + `]*)`)
+	imagePin = regexp.MustCompile(`ghcr\.io/github/proto-gen-go:(v[0-9][^\s"'` + "`" + `@]*)`)
+)
+
+// latestVersion returns the latest release of the tool, as reported
+// by the go command, which honors GOPROXY and the like.
+func latestVersion(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, "go", "list", "-m", "-f", "{{.Version}}", protogen.ModulePath+"@latest")
+	cmd.Dir = os.TempDir() // outside any module, whose go.mod might require another version
+	cmd.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go list -m %s@latest: %v: %s", protogen.ModulePath, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// cachedLatestVersion returns the latest release of the tool, from
+// the user's cache if it was checked within updateCheckInterval.
+func cachedLatestVersion(ctx context.Context) (string, error) {
+	var file string
+	if cache, err := os.UserCacheDir(); err == nil {
+		file = filepath.Join(cache, "proto-gen-go", "latest-version")
+		if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) < updateCheckInterval {
+			if data, err := os.ReadFile(file); err == nil {
+				return strings.TrimSpace(string(data)), nil
+			}
+		}
+	}
+	latest, err := latestVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	if file != "" && os.MkdirAll(filepath.Dir(file), 0777) == nil {
+		os.WriteFile(file, []byte(latest+"\n"), 0666)
+	}
+	return latest, nil
+}
+
+// startUpdateCheck starts checking, if the config's update_check
+// setting or $PROTO_GEN_GO_UPDATE_CHECK enables it, whether a newer
+// release of the tool than the running one exists. The returned
+// function reports it, waiting briefly for the check to finish.
+func startUpdateCheck(ctx context.Context, opts protogen.Options) func() {
+	current := protogen.Version()
+	enabled := opts.UpdateCheck || os.Getenv("PROTO_GEN_GO_UPDATE_CHECK") == "1"
+	if !enabled || !isRelease(current) {
+		return func() {}
+	}
+	done := make(chan string, 1)
+	go func() {
+		latest, err := cachedLatestVersion(ctx)
+		if err != nil && opts.Verbose {
+			report(opts, "checking for a new release: %v", err)
+		}
+		done <- latest
+	}()
+	return func() {
+		select {
+		case latest := <-done:
+			if isRelease(latest) && compareVersions(current, latest) < 0 {
+				report(opts, "proto-gen-go %s is out of date; the latest release is %s. Run 'proto-gen-go self-update' to update the pinned versions", current, latest)
+			}
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// runSelfUpdate implements the self-update command.
+func runSelfUpdate(ctx context.Context, cmd *command, args []string) error {
+	fset := cmd.flagSet()
+	version := fset.String("version", "", "version to update to (default: the latest release)")
+	dryRun := fset.Bool("dry-run", false, "list the files that would change, without changing them")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fset.Args(), " "))
+	}
+	target := *version
+	if target == "" {
+		latest, err := latestVersion(ctx)
+		if err != nil {
+			return err
+		}
+		target = latest
+	}
+	if !isRelease(target) {
+		return fmt.Errorf("invalid version %q (want a release, such as v1.5.0)", target)
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root, _, err := findModule(pwd)
+	if err != nil {
+		return err
+	}
+	if root == "" {
+		root = pwd
+	}
+
+	// Update the pins of the tool and its image in the go:generate
+	// directives of the module's Go files, and in its Makefile.
+	var changed []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "node_modules" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, ".go") && name != "Makefile" && !strings.HasSuffix(name, ".mk") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		updated := updatePins(data, target, strings.HasSuffix(name, ".go"))
+		if bytes.Equal(updated, data) {
+			return nil
+		}
+		rel, _ := filepath.Rel(pwd, path)
+		changed = append(changed, rel)
+		if *dryRun {
+			return nil
+		}
+		return os.WriteFile(path, updated, 0666)
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range changed {
+		fmt.Println(file)
+	}
+
+	// A module that requires the tool (as with a tools.go file) needs
+	// its go.mod updated too.
+	if data, err := os.ReadFile(filepath.Join(root, "go.mod")); err == nil && bytes.Contains(data, []byte(protogen.ModulePath+" v")) {
+		get := exec.CommandContext(ctx, "go", "get", protogen.ModulePath+"@"+target)
+		get.Dir = root
+		get.Stdout, get.Stderr = os.Stderr, os.Stderr
+		if *dryRun {
+			fmt.Printf("# in %s: %s\n", root, strings.Join(get.Args, " "))
+		} else if err := get.Run(); err != nil {
+			return fmt.Errorf("go get: %v", err)
+		}
+	}
+
+	switch {
+	case *dryRun:
+	case len(changed) == 0:
+		log.Printf("no pinned versions to update; for an installed binary, run 'go install %s@%s'", protogen.ModulePath, target)
+	default:
+		log.Printf("updated %d files to proto-gen-go %s; run 'go generate ./...' to regenerate", len(changed), target)
+	}
+	return nil
+}
+
+// updatePins returns the content of a file with the pinned versions of
+// the tool and its image replaced by version; in a Go file, only those
+// of go:generate directives.
+func updatePins(data []byte, version string, goFile bool) []byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for i, line := range lines {
+		if goFile && !bytes.HasPrefix(bytes.TrimSpace(line), []byte("//go:generate ")) {
+			continue
+		}
+		line = toolPin.ReplaceAll(line, []byte(protogen.ModulePath+"@"+version))
+		lines[i] = imagePin.ReplaceAll(line, []byte("ghcr.io/github/proto-gen-go:"+version))
+	}
+	return bytes.Join(lines, nil)
+}
+
+// isRelease reports whether v is a release version, such as v1.5.0,
+// rather than a pre-release, pseudo-version or "(devel)".
+func isRelease(v string) bool {
+	_, ok := versionNumbers(v)
+	return ok
+}
+
+// compareVersions compares the release versions a and b, returning
+// -1, 0 or +1.
+func compareVersions(a, b string) int {
+	x, _ := versionNumbers(a)
+	y, _ := versionNumbers(b)
+	for i := range x {
+		switch {
+		case x[i] < y[i]:
+			return -1
+		case x[i] > y[i]:
+			return +1
+		}
+	}
+	return 0
+}
+
+// versionNumbers returns the major, minor and patch numbers of the
+// release version v (vMAJOR.MINOR.PATCH).
+func versionNumbers(v string) ([3]int, bool) {
+	var n [3]int
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if !strings.HasPrefix(v, "v") || len(parts) != 3 {
+		return n, false
+	}
+	for i, p := range parts {
+		x, err := strconv.Atoi(p)
+		if err != nil || x < 0 {
+			return n, false
+		}
+		n[i] = x
+	}
+	return n, true
+}
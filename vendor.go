@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// runVendor implements the vendor-protos command.
+func runVendor(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	fs.StringVar(&tf.config, "config", "", "project config file (default: nearest "+protogen.ConfigFile+")")
+	update := fs.Bool("update", false, "resolve each dependency's rev anew, ignoring the lock file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	cfg, err := tf.loadConfig(pwd)
+	if err != nil {
+		return err
+	}
+	lock, err := protogen.VendorProtos(ctx, protogen.Options{Config: *cfg, Dir: pwd, Logf: log.Printf}, *update)
+	if err != nil {
+		return err
+	}
+	log.Printf("vendored %d dependencies in %s", len(lock.Deps), cfg.VendorDir)
+	return nil
+}
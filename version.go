@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/github/proto-gen-go/pkg/protogen"
+)
+
+// runVersion implements the version command.
+func runVersion(ctx context.Context, cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	var tf toolFlags
+	tf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	cfg, err := tf.loadConfig(pwd)
+	if err != nil {
+		return err
+	}
+	printVersions(cfg)
+	return nil
+}
+
+// printVersions prints the versions of the tool and of the components
+// of the config's toolchain, with the digests of the lock file, if any.
+func printVersions(cfg *protogen.Config) {
+	fmt.Printf("proto-gen-go %s\n", protogen.Version())
+	for _, v := range cfg.Versions() {
+		line := v.Name
+		switch {
+		case v.Package != "" && v.Version != "":
+			line += " " + v.Package + "@" + v.Version
+		case v.Package != "":
+			line += " " + v.Package
+		default:
+			line += " " + v.Version
+		}
+		if v.Digest != "" {
+			line += " " + v.Digest
+		}
+		fmt.Println(line)
+	}
+}